@@ -0,0 +1,218 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command lldbwal inspects the write ahead log of an lldb ACIDFiler0, for
+// example the WAL of a dbm DB using ACIDFull.
+//
+// Usage:
+//
+//	lldbwal [flags] wal
+//
+// lldbwal lists the WAL packets, their offsets and sizes, the transaction
+// numbers and the database offsets and sizes of the written data. It checks
+// the WAL for violations of the WAL file format, see the lldb package
+// documentation, and reports what the recovery of the database does with the
+// WAL:
+//
+//	empty		there's nothing to recover
+//	committed	the transaction in the WAL is applied to the database
+//	incomplete	the incomplete transaction in the WAL is discarded
+//	invalid		the recovery fails
+//
+// A packet with non zero padding bytes violates the WAL file format as well,
+// but the recovery ignores the padding, so lldbwal only prints a warning.
+//
+// The flags are:
+//
+//	-data
+//		Dump the data of the write packets.
+//	-key hex
+//		The key of an encrypted WAL, eg. the dbm Options.EncryptionKey.
+//	-replay db -o file
+//		Replay the committed transaction in the WAL to a copy of the
+//		database file db, file must not exist. The WAL is not modified.
+//	-checksums
+//		The database file uses checksums, eg. the dbm Options.Checksums.
+//	-encrypted
+//		The database file is encrypted using the -key key.
+//
+// The exit status is 1 if the WAL is invalid or on any other error.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/cznic/exp/lldb"
+)
+
+var (
+	oChecksums = flag.Bool("checksums", false, "the database file uses checksums")
+	oData      = flag.Bool("data", false, "dump the data of the write packets")
+	oEncrypted = flag.Bool("encrypted", false, "the database file is encrypted using the -key key")
+	oKey       = flag.String("key", "", "hex encoded WAL encryption key")
+	oOut       = flag.String("o", "", "the database copy written by -replay")
+	oReplay    = flag.String("replay", "", "replay the WAL to a copy of this database file")
+)
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] wal\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || (*oReplay == "") != (*oOut == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	key, err := hex.DecodeString(*oKey)
+	if err != nil {
+		log.Fatalf("invalid -key: %v", err)
+	}
+
+	if *oEncrypted && len(key) == 0 {
+		log.Fatal("-encrypted requires -key")
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer f.Close()
+
+	wal := lldb.NewSimpleFileFiler(f)
+	committed, err := list(wal, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *oReplay == "" {
+		return
+	}
+
+	if !committed {
+		log.Fatal("no committed transaction to replay")
+	}
+
+	if err = replay(*oOut, *oReplay, wal, key); err != nil {
+		os.Remove(*oOut)
+		log.Fatal(err)
+	}
+}
+
+// list lists the packets of wal and reports whether it holds a committed
+// transaction.
+func list(wal lldb.Filer, key []byte) (committed bool, err error) {
+	r, err := lldb.NewWALReader(wal, key)
+	if err != nil {
+		return
+	}
+
+	var packets, writes, bytes int64
+	for {
+		p, err := r.Next()
+		switch err {
+		case nil:
+			// ok
+		case io.EOF:
+			switch {
+			case packets == 0:
+				fmt.Println("empty")
+			default:
+				fmt.Printf("committed: %d packets, %d writes, %d bytes\n", packets, writes, bytes)
+			}
+			return packets != 0, nil
+		case io.ErrUnexpectedEOF:
+			fmt.Printf("incomplete: %d valid packets, %d writes, %d bytes\n", packets, writes, bytes)
+			return false, nil
+		default:
+			return false, fmt.Errorf("invalid: %v", err)
+		}
+
+		packets++
+		fmt.Printf("%#010x %6d tx %#016x ", p.Off, p.Size, p.Tx)
+		switch p.Tag {
+		case lldb.WALHeader:
+			fmt.Printf("header type %d %q\n", p.Type, p.Comment)
+		case lldb.WALWriteData:
+			writes++
+			bytes += int64(len(p.Data))
+			fmt.Printf("write %d bytes at %#x\n", len(p.Data), p.DataOff)
+			if *oData {
+				fmt.Print(hex.Dump(p.Data))
+			}
+		case lldb.WALCheckpoint:
+			fmt.Printf("checkpoint database size %d\n", p.DBSize)
+		}
+		if p.BadPadding {
+			fmt.Println("warning: non zero padding ignored by the recovery")
+		}
+	}
+}
+
+// replay replays wal to dst, a copy of the database file src.
+func replay(dst, src string, wal lldb.Filer, key []byte) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return
+	}
+
+	var db lldb.Filer = lldb.NewSimpleFileFiler(out)
+	defer func() {
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	if _, err = io.Copy(out, in); err != nil {
+		return
+	}
+
+	if *oChecksums {
+		db = lldb.NewChecksumFiler(db)
+	}
+	if *oEncrypted {
+		var e *lldb.EncryptingFiler
+		if e, err = lldb.NewEncryptingFiler(db, key); err != nil {
+			return
+		}
+
+		db = e
+	}
+
+	// ReplayWAL empties the WAL, replay a copy.
+	sz, err := wal.Size()
+	if err != nil {
+		return
+	}
+
+	b := make([]byte, sz)
+	if n, err := wal.ReadAt(b, 0); n != len(b) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	w := lldb.NewMemFiler()
+	if _, err = w.WriteAt(b, 0); err != nil {
+		return
+	}
+
+	return lldb.ReplayWAL(db, w, key)
+}
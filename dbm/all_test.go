@@ -10,19 +10,25 @@ package dbm
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"testing/fstest"
 	"time"
 
 	"github.com/cznic/exp/lldb"
@@ -34,7 +40,9 @@ var (
 	oACIDEnableWAL  = flag.Bool("wal", false, "enable WAL")
 	oACIDEnableXACT = flag.Bool("xact", false, "enable structural transactions")
 	oACIDGrace      = flag.Duration("grace", time.Second, "Grace period for -wal")
+	oACIDGroup      = flag.Bool("group", false, "enable WAL with group commit")
 	oBench          = flag.Bool("tbench", false, "enable (long) TestBench* tests")
+	oMmap           = flag.Bool("mmap", false, "read DB files through a memory mapping")
 )
 
 // Bench knobs.
@@ -46,6 +54,7 @@ const (
 func init() {
 	flag.Parse()
 	compress = !*oNoZip
+	o.Mmap = *oMmap
 	if *oACIDEnableXACT {
 		o.ACID = ACIDTransactions
 	}
@@ -53,6 +62,10 @@ func init() {
 		o.ACID = ACIDFull
 		o.GracePeriod = *oACIDGrace
 	}
+	if *oACIDGroup {
+		o.ACID = ACIDFull
+		o.GroupCommit = true
+	}
 }
 
 func dbg(s string, va ...interface{}) {
@@ -73,6 +86,7 @@ func temp() (dir, name string) {
 	}
 
 	name = filepath.Join(dir, "test.db")
+	o.WAL = "" // Options.check sets it to the WAL of the previous DB.
 	return
 }
 
@@ -116,7 +130,7 @@ func Test0(t *testing.T) {
 	}
 
 	var tr *lldb.BTree
-	if tr, err = db.acache.getTree(db, arraysPrefix, "Test0", false, aCacheSize); err != nil {
+	if tr, _, err = db.acache.getTree(db, arraysPrefix, "Test0", false, aCacheSize); err != nil {
 		t.Error(err)
 		return
 	}
@@ -131,7 +145,7 @@ func Test0(t *testing.T) {
 		return
 	}
 
-	if tr, err = db.acache.getTree(db, arraysPrefix, "Test0", true, aCacheSize); err != nil {
+	if tr, _, err = db.acache.getTree(db, arraysPrefix, "Test0", true, aCacheSize); err != nil {
 		t.Error(err)
 		return
 	}
@@ -161,7 +175,7 @@ func Test0(t *testing.T) {
 		return
 	}
 
-	if tr, err = db.acache.getTree(db, arraysPrefix, "Test0", true, aCacheSize); err != nil {
+	if tr, _, err = db.acache.getTree(db, arraysPrefix, "Test0", true, aCacheSize); err != nil {
 		t.Error(err)
 		return
 	}
@@ -1283,7 +1297,7 @@ func TestRemoveArray0(t *testing.T) {
 		return
 	}
 
-	tr, err := db.acache.getTree(db, arraysPrefix, aname, false, aCacheSize)
+	tr, _, err := db.acache.getTree(db, arraysPrefix, aname, false, aCacheSize)
 	if err != nil {
 		db.leave(&err)
 		t.Error(err)
@@ -2899,3 +2913,3413 @@ func TestIsMem(t *testing.T) {
 		return
 	}
 }
+
+func TestTx(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for i := 0; i < 6; i++ {
+		if err = db.Set(i, "TestTx", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx2, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Set(10, "TestTx", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Delete("TestTx", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := tx.Inc(5, "TestTx", 3); err != nil || n != 8 {
+		t.Fatal(n, err)
+	}
+
+	if n, err := tx.Inc(1, "TestTx", 3); err != nil || n != 9 {
+		t.Fatal(n, err)
+	}
+
+	if err = tx.Set("x", "TestTx", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Set("y", "TestTx", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx2.Set(42, "TestTx", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pending updates are visible only through their Tx.
+	if v, err := db.Get("TestTx", 1); err != nil || v != int64(1) {
+		t.Fatal(v, err)
+	}
+
+	if v, err := tx.Get("TestTx", 1); err != nil || v != int64(10) {
+		t.Fatal(v, err)
+	}
+
+	if v, err := tx.Get("TestTx", 2); err != nil || v != nil {
+		t.Fatal(v, err)
+	}
+
+	if v, err := tx.Get("TestTx", 3); err != nil || v != int64(9) {
+		t.Fatal(v, err)
+	}
+
+	if v, err := tx.Get("TestTx", 0); err != nil || v != int64(0) {
+		t.Fatal(v, err)
+	}
+
+	s, err := tx.Slice("TestTx", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var a []string
+	if err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+		a = append(a, fmt.Sprintf("%v:%v", subscripts, value))
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := strings.Join(a, " "), "[-1]:[x] [0]:[0] [1]:[10] [3]:[9] [4]:[4] [5]:[5] [100]:[y]"; g != e {
+		t.Fatalf("\n%s\n%s", g, e)
+	}
+
+	a = nil
+	if s, err = tx.Slice("TestTx", nil, []interface{}{1}, []interface{}{4}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+		a = append(a, fmt.Sprintf("%v:%v", subscripts, value))
+		return len(a) < 2, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := strings.Join(a, " "), "[1]:[10] [3]:[9]"; g != e {
+		t.Fatalf("\n%s\n%s", g, e)
+	}
+
+	if err = tx2.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx2.Commit(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	// Concurrent non transactional update composes with tx.Inc.
+	if _, err = db.Inc(100, "TestTx", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = tx.Get("TestTx", 1); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	for _, v := range []struct {
+		k int
+		v interface{}
+	}{
+		{-1, "x"},
+		{0, int64(0)},
+		{1, int64(10)},
+		{2, nil},
+		{3, int64(109)},
+		{4, int64(4)},
+		{100, "y"},
+	} {
+		if g, err := db.Get("TestTx", v.k); err != nil || g != v.v {
+			t.Fatal(v.k, g, v.v, err)
+		}
+	}
+
+	// A failing collation is reported as an error.
+	if err = RegisterCollation("TestTx", func(x, y []interface{}) (int, error) {
+		for _, v := range append(append([]interface{}(nil), x...), y...) {
+			if v == "fail" {
+				return 0, fmt.Errorf("TestTx: collation failed")
+			}
+		}
+
+		return lldb.Collate(x, y, nil)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.CreateArray("TestTxCollation", "TestTx"); err != nil {
+		t.Fatal(err)
+	}
+
+	if tx, err = db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Set(1, "TestTxCollation", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Set(2, "TestTxCollation", "fail"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = tx.Delete("TestTxCollation", "fail"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if _, err = tx.Inc(1, "TestTxCollation", "fail"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if _, err = tx.Get("TestTxCollation", "fail"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if s, err = tx.Slice("TestTxCollation", nil, []interface{}{"fail"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Do(func(subscripts, value []interface{}) (bool, error) { return true, nil }); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failFiler fails the next BeginUpdate or EndUpdate when armed.
+type failFiler struct {
+	lldb.Filer
+	failBegin bool
+	failEnd   bool
+}
+
+func (f *failFiler) BeginUpdate() error {
+	if f.failBegin {
+		f.failBegin = false
+		return fmt.Errorf("%s: BeginUpdate failed", f.Name())
+	}
+
+	return f.Filer.BeginUpdate()
+}
+
+func (f *failFiler) EndUpdate() error {
+	if f.failEnd {
+		f.failEnd = false
+		f.Filer.Rollback()
+		return fmt.Errorf("%s: EndUpdate failed", f.Name())
+	}
+
+	return f.Filer.EndUpdate()
+}
+
+func TestTxCommitRetry(t *testing.T) {
+	f := &failFiler{Filer: lldb.NewMemFiler()}
+	db, err := create(nil, f, nil, &Options{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Set(42, "TestTxCommitRetry", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Commit failing before applying anything can be retried.
+	f.failBegin = true
+	if err = tx.Commit(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if v, err := db.Get("TestTxCommitRetry", 1); err != nil || v != nil {
+		t.Fatal(v, err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get("TestTxCommitRetry", 1); err != nil || v != int64(42) {
+		t.Fatal(v, err)
+	}
+
+	// Or rolled back.
+	if tx, err = db.Begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Set(43, "TestTxCommitRetry", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failBegin = true
+	if err = tx.Commit(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get("TestTxCommitRetry", 1); err != nil || v != int64(42) {
+		t.Fatal(v, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, acid := range []int{ACIDTransactions, ACIDFull} {
+		testSnapshot(t, &Options{ACID: acid, GracePeriod: time.Hour})
+	}
+}
+
+func testSnapshot(t *testing.T, o *Options) {
+	const N = 1000
+
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for i := 0; i < N; i++ {
+		if err = db.Set(i, "TestSnapshot", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := db.File("TestSnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteAt([]byte("foo"), 1e5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if o.ACID == ACIDFull {
+		// The updates of the open grace period batch are not visible.
+		if err = db.Set(42, "TestSnapshot3"); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := db.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, err := s.Get("TestSnapshot3"); err != nil || v != nil {
+			t.Fatal(v, err)
+		}
+
+		if v, err := s.Get("TestSnapshot", 1); err != nil || v != int64(1) {
+			t.Fatal(v, err)
+		}
+
+		if err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < N; i++ {
+		switch {
+		case i&1 == 0:
+			err = db.Delete("TestSnapshot", i)
+		default:
+			err = db.Set(-i, "TestSnapshot", i)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Set(42, "TestSnapshot2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RemoveFile("TestSnapshot"); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.Array("TestSnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := 0
+	sl, err := a.Slice(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sl.Do(func(subscripts, value []interface{}) (bool, error) {
+		if g, e := subscripts[0], int64(i); g != e {
+			return false, fmt.Errorf("key %v %v", g, e)
+		}
+
+		if g, e := value[0], int64(i); g != e {
+			return false, fmt.Errorf("value %v %v", g, e)
+		}
+
+		i++
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := i, N; g != e {
+		t.Fatal(g, e)
+	}
+
+	if v, err := s.Get("TestSnapshot2"); err != nil || v != nil {
+		t.Fatal(v, err)
+	}
+
+	sf, err := s.File("TestSnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 3)
+	if n, err := sf.ReadAt(b, 1e5); n != 3 || string(b) != "foo" {
+		t.Fatal(n, err, b)
+	}
+
+	if err = s.Set(1, "TestSnapshot", 0); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get("TestSnapshot", 1); err != nil || v != int64(-1) {
+		t.Fatal(v, err)
+	}
+
+	db2, err := CreateMem(&Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db2.Snapshot(); err == nil {
+		t.Fatal("unexpected success")
+	}
+}
+
+func TestSnapshotGracePeriod(t *testing.T) {
+	walf := &syncFiler{Filer: lldb.NewMemFiler()}
+	db, err := create(nil, lldb.NewMemFiler(), walf, &Options{ACID: ACIDFull, GracePeriod: time.Hour}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(1, "TestSnapshotGracePeriod", "committed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(2, "TestSnapshotGracePeriod", "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		if v, err := s.Get("TestSnapshotGracePeriod", "committed"); err != nil || v != int64(1) {
+			t.Fatal(v, err)
+		}
+
+		if v, err := s.Get("TestSnapshotGracePeriod", "batch"); err != nil || v != nil {
+			t.Fatal(v, err)
+		}
+	}
+
+	check()
+
+	// The batch is lost.
+	atomic.StoreInt32(&walf.fail, 1)
+	if err = db.Commit(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	check()
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollation(t *testing.T) {
+	if err := RegisterCollation("TestCollation", func(x, y []interface{}) (int, error) {
+		return lldb.Collate(x, y, func(a, b string) int { return -strings.Compare(a, b) })
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RegisterCollation("TestCollation", nil); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []interface{}{"b", "B", "a", "A", "a-c", "ab", 2, 10, -1, 1.5}
+	tab := []struct {
+		coll string
+		exp  string
+	}{
+		{CollateDefault, "[-1 1.5 2 10 A B a a-c ab b]"},
+		{CollateNoCase, "[-1 1.5 2 10 A a a-c ab B b]"},
+		{CollateLocale, "[-1 1.5 2 10 A a ab a-c B b]"},
+		{CollateDescNum, "[10 2 1.5 -1 A B a a-c ab b]"},
+		{"TestCollation", "[-1 1.5 2 10 b ab a-c a B A]"},
+	}
+
+	for _, v := range tab {
+		a, err := db.CreateArray("TestCollation/"+v.coll, v.coll)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, k := range keys {
+			if err = a.Set(fmt.Sprint(k), k); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err = db.CreateArray("TestCollation/TestCollation", "TestCollation"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.CreateArray("TestCollation/TestCollation", CollateNoCase); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if _, err = db.CreateArray("TestCollation2", "nonexistent"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	for _, v := range tab {
+		a, err := db.Array("TestCollation/" + v.coll)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := a.Collation(), v.coll; g != e {
+			t.Fatalf("%q %q", g, e)
+		}
+
+		var got []interface{}
+		s, err := a.Slice(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+			got = append(got, subscripts[0])
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := fmt.Sprint(got), v.exp; g != e {
+			t.Fatalf("%q\n%s\n%s", v.coll, g, e)
+		}
+
+		got = got[:0]
+		en, err := a.Enumerator(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			k, _, err := en.Next()
+			if err != nil {
+				if err != io.EOF {
+					t.Fatal(err)
+				}
+
+				break
+			}
+
+			got = append(got, k[0])
+		}
+
+		if g, e := fmt.Sprint(got), v.exp; g != e {
+			t.Fatalf("%q\n%s\n%s", v.coll, g, e)
+		}
+
+		for _, k := range keys {
+			if g, err := a.Get(k); err != nil || g != fmt.Sprint(k) {
+				t.Fatal(v.coll, k, g, err)
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tx.Set("x", "TestCollation/"+v.coll, "aa"); err != nil {
+			t.Fatal(err)
+		}
+
+		if s, err = tx.Slice("TestCollation/"+v.coll, nil, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		got = got[:0]
+		if err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+			got = append(got, subscripts[0])
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := len(got), len(keys)+1; g != e {
+			t.Fatal(v.coll, g, e, got)
+		}
+
+		if err = tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCorruptedRootValue(t *testing.T) {
+	db, err := CreateMem(&Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	root, err := db.root()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range []interface{}{
+		[]interface{}{},
+		[]interface{}{"foo", int64(1)},
+		[]interface{}{int64(1), "foo", "bar"},
+	} {
+		name := fmt.Sprintf("TestCorruptedRootValue%d", i)
+		if err = root.set(v, arraysPrefix, name); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = db.Get(name, 1); err == nil {
+			t.Fatal(i, "unexpected success")
+		}
+
+		if _, ok := err.(*lldb.ErrINVAL); !ok {
+			t.Fatalf("%d: %T %v", i, err, err)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := db.Array("items")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, v := range [][]interface{}{
+		{"a", 10, 1.5},
+		{"b", 20, 2.5},
+		{"a", 30, 3.5},
+	} {
+		if err = items.Set(v, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.CreateIndex("items", "num", IndexValue, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.CreateIndex("items", "num", IndexValue, 1); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.CreateIndex("orders", "date", IndexSubscript, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(array, index string, value interface{}, exp string) {
+		ss, err := db.Lookup(array, index, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g := fmt.Sprint(ss); g != exp {
+			t.Fatalf("Lookup(%q, %q, %v): %s, expected %s", array, index, value, g, exp)
+		}
+	}
+
+	lookup("items", "num", "a", "[[0] [2]]")
+	lookup("items", "num", "b", "[[1]]")
+	lookup("items", "num", "c", "[]")
+
+	if err = items.Set([]interface{}{"c", 40, 4.5}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = items.Set("a", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup("items", "num", "a", "[[2] [3]]")
+	lookup("items", "num", "c", "[[0]]")
+
+	if err = items.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = items.Inc(1, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup("items", "num", "a", "[[3]]")
+	lookup("items", "num", int64(1), "[[4]]")
+
+	orders, err := db.Array("orders", 2014)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = orders.Set(100, "jan", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = orders.Set(200, "jan", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = orders.Set(300, "feb", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup("orders", "date", "jan", "[[2014 jan 1] [2014 jan 2]]")
+
+	if err = orders.Clear("jan"); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup("orders", "date", "jan", "[]")
+	lookup("orders", "date", "feb", "[[2014 feb 1]]")
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup("items", "num", "c", "[[0]]")
+
+	if err = db.DropIndex("items", "num"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.Lookup("items", "num", "c"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.RemoveArray("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.Lookup("orders", "date", "feb"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexCollation(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := db.CreateArray("items", CollateDescNum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Maintained by Set.
+	if err = db.CreateIndex("items", "set", IndexValue, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		if err = items.Set(i%2, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Built from the existing records.
+	if err = db.CreateIndex("items", "created", IndexValue, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	lookup := func(index string, value interface{}, exp string) {
+		ss, err := db.Lookup("items", index, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g := fmt.Sprint(ss); g != exp {
+			t.Fatalf("Lookup(%q, %q, %v): %s, expected %s", "items", index, value, g, exp)
+		}
+	}
+
+	check := func() {
+		for _, index := range []string{"set", "created"} {
+			lookup(index, int64(0), "[[4] [2]]")
+			lookup(index, int64(1), "[[3] [1]]")
+			lookup(index, int64(2), "[]")
+		}
+	}
+
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	t0 := time.Now()
+	for _, v := range []string{"/a/b/c", "/a/d", "/e", "/a-f", "nonrooted"} {
+		f, err := db.File(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.WriteAt([]byte("content of "+v), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fsys, err := db.FS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fstest.TestFS(fsys, "a/b/c", "a/d", "e", "a-f"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fsys.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, v := range entries {
+		names = append(names, fmt.Sprintf("%s:%v", v.Name(), v.IsDir()))
+	}
+	if g, e := strings.Join(names, " "), "a:true a-f:false e:false"; g != e {
+		t.Fatalf("%q %q", g, e)
+	}
+
+	fi, err := fsys.Stat("a/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fi.Size(), int64(len("content of /a/d")); g != e {
+		t.Fatal(g, e)
+	}
+
+	if g := fi.ModTime(); g.Before(t0) || g.After(time.Now()) {
+		t.Fatal(g, t0)
+	}
+
+	if _, err = fsys.Stat("nonrooted"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if _, err = db.FS("relative"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	srv := httptest.NewServer(http.FileServer(db.HttpDir("/a")))
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/d", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Range", "bytes=3-6")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := resp.StatusCode, http.StatusPartialContent; g != e {
+		t.Fatal(g, e)
+	}
+
+	if g, e := string(b), "tent"; g != e {
+		t.Fatalf("%q %q", g, e)
+	}
+
+	if resp, err = http.Get(srv.URL + "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g := string(b); !strings.Contains(g, `href="b/"`) || !strings.Contains(g, `href="d"`) {
+		t.Fatal(g)
+	}
+}
+
+func TestFileStat(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := db.File("/dir/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprintf("%v %v %v %v %v", fi.Name(), fi.Size(), fi.Mode(), fi.ModTime().IsZero(), fi.CreateTime().IsZero()), "f 0 -rw-r--r-- true true"; g != e {
+		t.Fatalf("%q %q", g, e)
+	}
+
+	t0 := time.Now()
+	if _, err = f.ReadFrom(strings.NewReader("foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err = f.Stat(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctime := fi.CreateTime()
+	if ctime.Before(t0) || fi.ModTime().Before(ctime) {
+		t.Fatal(ctime, fi.ModTime(), t0)
+	}
+
+	if err = f.SetMode(0600 | os.ModeDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.SetAttr("content-type", []byte("text/plain")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.SetAttr("owner", []byte("joe")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.SetAttr("owner", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err = f.ReadFrom(strings.NewReader("quux")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if f, err = db.File("/dir/f"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err = f.Stat(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := fmt.Sprintf("%v %v %v %v %v", fi.Name(), fi.Size(), fi.Mode(), fi.IsDir(), fi.Attrs()), "f 4 -rw------- false map[content-type:[116 101 120 116 47 112 108 97 105 110]]"; g != e {
+		t.Fatalf("%q %q", g, e)
+	}
+
+	if g := fi.CreateTime(); !g.Equal(ctime) {
+		t.Fatal(g, ctime)
+	}
+
+	if g := fi.ModTime(); !g.After(ctime) {
+		t.Fatal(g, ctime)
+	}
+
+	b, err := f.Attr("content-type")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := string(b), "text/plain"; g != e {
+		t.Fatalf("%q %q", g, e)
+	}
+
+	fsys, err := db.FS("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sfi, err := fsys.Stat("dir/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := sfi.Mode(), os.FileMode(0600); g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestFileHandle(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	f, err := db.File("TestFileHandle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	var e []byte
+	h := f.Open()
+	for i := 0; i < 200; i++ {
+		if rng.Intn(10) == 0 {
+			off := rng.Int63n(int64(len(e)) + 1)
+			if _, err = h.Seek(off, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		fp, err := h.Seek(0, io.SeekCurrent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, rng.Intn(3*pgSize/2))
+		rng.Read(b)
+		if n, err := h.Write(b); n != len(b) || err != nil {
+			t.Fatal(n, len(b), err)
+		}
+
+		if end := int(fp) + len(b); end > len(e) {
+			e = append(e, make([]byte, end-len(e))...)
+		}
+		copy(e[fp:], b)
+	}
+
+	if err = h.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.Seek(int64(len(e)), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.Write([]byte("buffered")); err != nil {
+		t.Fatal(err)
+	}
+
+	if sz, err := f.Size(); err != nil || sz != int64(len(e)) {
+		t.Fatal(sz, len(e), err)
+	}
+
+	e = append(e, "buffered"...)
+
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = h.Write(nil); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	h = f.Open()
+	if _, err = h.Seek(-int64(len("buffered")), io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := string(b), "buffered"; g != e {
+		t.Fatalf("%q %q", g, e)
+	}
+
+	if _, err = h.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	b = make([]byte, len(e))
+	if _, err = io.ReadFull(h, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, e) {
+		t.Fatal("content mismatch")
+	}
+
+	z, err := db.File("TestFileHandle.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zh := z.Open()
+	w := gzip.NewWriter(zh)
+	if _, err = io.Copy(w, io.NewSectionReader(h, 0, int64(len(e)))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = zh.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := gzip.NewReader(zh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err = ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, e) {
+		t.Fatal("content mismatch")
+	}
+
+	if err = zh.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileHandleTouch(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	f, err := db.File("TestFileHandleTouch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The chunks of a run are written, but the File is touched only when
+	// the run is flushed.
+	h := f.Open()
+	if _, err = h.Write(make([]byte, 3*pgSize+10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if sz, err := f.Size(); sz != 3*pgSize || err != nil {
+		t.Fatal(sz, err)
+	}
+
+	mtime, err := f.ModTime()
+	if err != nil || !mtime.IsZero() {
+		t.Fatal(mtime, err)
+	}
+
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if mtime, err = f.ModTime(); err != nil || mtime.IsZero() {
+		t.Fatal(mtime, err)
+	}
+
+	// Internal Files are not touched.
+	if err = db.enter(); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.sysArray(true, "TestFileHandleTouch")
+	if db.leave(&err); err != nil {
+		t.Fatal(err)
+	}
+
+	g := File(a)
+	if _, err = g.WriteAt([]byte("foo"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := a.Get(fMtime); v != nil || err != nil {
+		t.Fatal(v, err)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := strings.Repeat("0123456789abcdef", 20000)
+	bigb := bytes.Repeat([]byte{42}, 3*pgSize+1)
+	a, err := db.Array("TestSpill")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Set(big, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Set([]interface{}{"x", bigb, 3}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Set("small", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	spills := func() (n int) {
+		db.bkl.Lock()
+		defer db.bkl.Unlock()
+
+		root, err := db.root()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		en, err := root.tree.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			k, _, err := en.Next()
+			if err != nil {
+				break
+			}
+
+			if bytes.Contains(k, []byte("spill\x00")) {
+				n++
+			}
+		}
+		return
+	}
+
+	check := func() {
+		v, err := a.Get(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v != big {
+			t.Fatal("value mismatch")
+		}
+
+		if v, err = a.Get(2); err != nil {
+			t.Fatal(err)
+		}
+
+		va, ok := v.([]interface{})
+		if !ok || len(va) != 3 || va[0] != "x" || !bytes.Equal(va[1].([]byte), bigb) || va[2] != int64(3) {
+			t.Fatal("value mismatch")
+		}
+
+		s, err := a.Slice(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []int
+		if err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+			got = append(got, len(fmt.Sprint(value...)))
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := fmt.Sprint(got), fmt.Sprint([]int{len(big), len(fmt.Sprint("x", bigb, 3)), 5}); g != e {
+			t.Fatal(g, e)
+		}
+
+		en, err := a.Enumerator(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, v, err := en.Next(); err != nil || len(v) != 1 || v[0] != big {
+			t.Fatal(err)
+		}
+	}
+
+	check()
+	if g, e := spills(), 2; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err = db.Array("TestSpill"); err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+	if err = a.Set("small", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := spills(), 1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err = a.Set(big, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Delete(4); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := spills(), 1; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err = a.Set(big, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := spills(), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	if err = a.Set(big, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RemoveArray("TestSpill"); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := spills(), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Set(big, "TestSpill2", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := tx.Get("TestSpill2", 1); err != nil || v != big {
+		t.Fatal(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get("TestSpill2", 1); err != nil || v != big {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArrayCount(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("TestArrayCount")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 3000
+	for i := 0; i < n; i++ {
+		if err = a.Set(i, i); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%3 == 0 {
+			if err = a.Set(-i, "x", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err = a.Set(42, "y"); err != nil {
+		t.Fatal(err)
+	}
+
+	x, err := a.Array("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := MemArray("m")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if err = m.Set(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	none, err := db.Array("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(a Array, e int64) {
+		g, err := a.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	count(a, n+n/3+1)
+	count(x, n/3)
+	count(m, 100)
+	count(none, 0)
+
+	if err = a.Delete("x", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, n+n/3)
+	count(x, n/3-1)
+
+	list := func(s *Slice) (r []string) {
+		if err := s.Do(func(subscripts, value []interface{}) (bool, error) {
+			r = append(r, fmt.Sprint(subscripts, value))
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	for _, a := range []Array{a, x, m, none} {
+		s, err := a.Slice(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		all := list(s)
+		for _, page := range []int64{1, 7, 100, 1000} {
+			var got []string
+			for off := int64(0); ; off += page {
+				s, err := a.SliceOffset(off, page)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				l := list(s)
+				if int64(len(l)) > page {
+					t.Fatal(len(l), page)
+				}
+
+				if len(l) == 0 {
+					break
+				}
+
+				got = append(got, l...)
+			}
+			if g, e := strings.Join(got, "\n"), strings.Join(all, "\n"); g != e {
+				t.Fatalf("page %d: got %d items, expected %d", page, len(got), len(all))
+			}
+		}
+
+		s, err = a.SliceOffset(1, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := len(list(s)), len(all)-1; len(all) != 0 && g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	if _, err = a.SliceOffset(-1, 1); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArrayImport(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.CreateIndex("TestArrayImport", "v", IndexValue, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("TestArrayImport", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 5000
+	big := strings.Repeat("0123456789abcdef", 20000)
+	value := func(i int) interface{} {
+		if i == 42 {
+			return []interface{}{int64(2), big}
+		}
+
+		return int64(i % 10)
+	}
+	src := func(from, step int) func() ([]interface{}, interface{}, error) {
+		i := from
+		return func() ([]interface{}, interface{}, error) {
+			if i >= n {
+				return nil, nil, io.EOF
+			}
+
+			j := i
+			i += step
+			return []interface{}{int64(j)}, value(j), nil
+		}
+	}
+
+	// Not in ascending order.
+	i := 0
+	if err = a.Import(func() ([]interface{}, interface{}, error) {
+		i++
+		return []interface{}{int64(100 - i)}, i, nil
+	}); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	c, err := a.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c != 0 {
+		t.Fatal(c)
+	}
+
+	// Bulk load of the empty Array.
+	if err = a.Import(src(0, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Non empty Array.
+	if err = a.Import(src(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if c, err = a.Count(); err != nil {
+		t.Fatal(err)
+	}
+
+	if c != n {
+		t.Fatal(c, n)
+	}
+
+	for i := 0; i < n; i++ {
+		v, err := a.Get(int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := fmt.Sprint(v), fmt.Sprint(value(i)); g != e {
+			t.Fatal(i, len(g), len(e))
+		}
+	}
+
+	for _, j := range []int{2, 7} { // Bulk loaded, Set.
+		x, err := db.Lookup("TestArrayImport", "v", int64(j))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := len(x), n/10; g != e {
+			t.Fatal(g, e)
+		}
+
+		for i, v := range x {
+			if g, e := fmt.Sprint(v), fmt.Sprint([]interface{}{"x", 10*i + j}); g != e {
+				t.Fatal(g, e)
+			}
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSliceDelete(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.CreateIndex("TestSliceDelete", "v", IndexValue, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("TestSliceDelete")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 3000
+	big := strings.Repeat("0123456789abcdef", 20000)
+	for i := 0; i < n; i++ {
+		v := interface{}(int64(i % 10))
+		if i == 1500 {
+			v = []interface{}{int64(0), big}
+		}
+		if err = a.Set(v, i); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%2 == 0 {
+			if err = a.Set(int64(i%10), "x", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	x, err := a.Array("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(a Array, e int64) {
+		g, err := a.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	lookup := func(v, e int) {
+		x, err := db.Lookup("TestSliceDelete", "v", int64(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g := len(x); g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	spills := func() (n int) {
+		db.bkl.Lock()
+		defer db.bkl.Unlock()
+
+		spills, err := db.sysArray(false, spname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if spills.tree == nil {
+			return
+		}
+
+		root, err := db.root()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		en, err := root.tree.SeekFirst()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for {
+			k, _, err := en.Next()
+			if err != nil {
+				break
+			}
+
+			if bytes.Contains(k, []byte("spill\x00")) {
+				n++
+			}
+		}
+		return
+	}
+
+	count(a, n+n/2)
+	count(x, n/2)
+	lookup(0, n/10+n/10)
+	if g, e := spills(), 1; g != e {
+		t.Fatal(g, e)
+	}
+
+	s, err := a.Slice([]interface{}{1000}, []interface{}{1999})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, n-1000+n/2)
+	lookup(0, (n-1000)/10+n/10)
+	if g, e := spills(), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	for _, i := range []int{999, 1000, 1500, 1999, 2000} {
+		v, err := a.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := v != nil, i < 1000 || i > 1999; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+
+	// Prefix.
+	if s, err = x.Slice(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, n-1000)
+	count(x, 0)
+
+	// Offset and limit.
+	if s, err = a.SliceOffset(10, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, n-1020)
+	for _, i := range []int{9, 10, 29, 30} {
+		v, err := a.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := v != nil, i < 10 || i > 29; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+
+	// Within a Tx.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = tx.Slice("TestSliceDelete", nil, []interface{}{2000}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, n-1020)
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, 1000-20)
+	lookup(0, 100-2)
+
+	// Clear.
+	if err = a.Clear(5); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, 1000-21)
+	if err = a.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	count(a, 0)
+	lookup(0, 0)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSliceDeleteBounds(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("TestSliceDeleteBounds")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 300
+	keys := func(s *Slice, pfx ...interface{}) (r []string) {
+		if err := s.Do(func(k, _ []interface{}) (bool, error) {
+			r = append(r, fmt.Sprint(append(append([]interface{}(nil), pfx...), k...)))
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	for i, v := range []struct {
+		sub      []interface{}
+		from, to []interface{}
+		offset   int64
+		limit    int64
+	}{
+		{nil, []interface{}{100}, []interface{}{199}, 0, 0},
+		{nil, nil, nil, 0, 0},
+		{[]interface{}{"x"}, nil, nil, 0, 0},
+		{[]interface{}{"x"}, []interface{}{51}, nil, 0, 0},
+		{[]interface{}{"x"}, nil, []interface{}{51}, 0, 0},
+		{[]interface{}{"x"}, []interface{}{1000}, nil, 0, 0},
+		{[]interface{}{"x"}, []interface{}{60}, []interface{}{40}, 0, 0},
+		{[]interface{}{"x"}, nil, nil, 5, 10},
+		{[]interface{}{"x"}, nil, nil, 5, -1},
+		{[]interface{}{"x"}, nil, nil, 1000, 5},
+		{nil, nil, nil, 290, 100},
+	} {
+		if err = a.Clear(); err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < n; j++ {
+			a.Set(j, j)
+			if j%2 == 0 {
+				a.Set(j, "x", j)
+			}
+			a.Set(j, "y", j)
+		}
+
+		x, err := a.Array(v.sub...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var s *Slice
+		switch {
+		case v.offset != 0 || v.limit != 0:
+			s, err = x.SliceOffset(v.offset, v.limit)
+		default:
+			s, err = x.Slice(v.from, v.to)
+		}
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		all, err := a.Slice(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := map[string]bool{}
+		for _, k := range keys(s, v.sub...) {
+			m[k] = true
+		}
+		var e []string
+		for _, k := range keys(all) {
+			if !m[k] {
+				e = append(e, k)
+			}
+		}
+
+		if err = s.Delete(); err != nil {
+			t.Fatal(i, err)
+		}
+
+		if g := keys(all); !reflect.DeepEqual(g, e) {
+			t.Fatal(i, len(g), len(e))
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("TestCompact", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := db.Array("TestCompact", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 2000
+	v := strings.Repeat("0123456789abcdef", 30)
+	for i := 0; i < n; i++ {
+		if err = a.Set(fmt.Sprintf("%s%d", v, i), i); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = b.Set(fmt.Sprintf("%d%s", i, v), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = a.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *DB) {
+		b, err := db.Array("TestCompact", "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			g, err := b.Get(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e := fmt.Sprintf("%d%s", i, v); g != e {
+				t.Fatalf("%d: got %v, exp %v", i, g, e)
+			}
+		}
+
+		if err = db.Verify(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; ; i++ {
+		done, err := db.Compact(time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if done {
+			break
+		}
+
+		if i%10 == 0 {
+			if err = b.Set(fmt.Sprintf("%d%s", i%n, v), i%n); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sz, err := db.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sz >= sz0 {
+		t.Fatalf("file size %d, before compaction %d", sz, sz0)
+	}
+
+	t.Logf("file size %d, before compaction %d", sz, sz0)
+	check(db)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = Open(dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	check(db)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(42, "TestFormatVersion"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	setVer := func(ver byte) {
+		f, err := os.OpenFile(dbname, os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.WriteAt([]byte{ver}, 4); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ver := func() byte {
+		b, err := ioutil.ReadFile(dbname)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return b[4]
+	}
+
+	if g, e := ver(), byte(0x01); g != e {
+		t.Fatal(g, e)
+	}
+
+	// A version 0x00 DB is upgraded.
+	setVer(0x00)
+	if db, err = Open(dbname, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := db.Get("TestFormatVersion"); err != nil || v != int64(42) {
+		t.Fatal(v, err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := ver(), byte(0x01); g != e {
+		t.Fatal(g, e)
+	}
+
+	setVer(0x02)
+	if _, err = Open(dbname, &Options{}); err == nil {
+		t.Fatal("unexpected success")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	defer func(c bool) { compress = c }(compress)
+	compress = true // The copy must have no relocations even w/ compression.
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.CreateIndex("a", "v", IndexValue, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := db.CreateArray("b", CollateNoCase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 2000
+	v := strings.Repeat("0123456789abcdef", 20)
+	for i := 0; i < n; i++ {
+		if err = a.Set(int64(i%10), i); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = b.Set(v, fmt.Sprintf("K%d", i)); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = db.Set(v, "c", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	big := strings.Repeat("0123456789abcdef", 20000)
+	if err = a.Set([]interface{}{int64(1), big}, "big"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := db.File("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteAt([]byte(v), 1e6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Clear("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RemoveArray("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, dense bool) {
+		db, err := Open(name, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer func() {
+			if err = db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+
+		var stats lldb.AllocStats
+		if err = db.Verify(nil, &stats); err != nil {
+			t.Fatal(err)
+		}
+
+		if g := stats.Relocations; dense && g != 0 {
+			t.Fatalf("%s: relocations %d", name, g)
+		}
+
+		a, err := db.Array("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, err := a.Count(); err != nil || g != n+1 {
+			t.Fatal(g, err)
+		}
+
+		if g, err := a.Get("big"); err != nil || !reflect.DeepEqual(g, []interface{}{int64(1), big}) {
+			t.Fatal(err)
+		}
+
+		s, err := db.Lookup("a", "v", int64(7))
+		if err != nil || len(s) != n/10 {
+			t.Fatal(len(s), err)
+		}
+
+		b, err := db.CreateArray("b", CollateNoCase)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, err := b.Get("K42"); err != nil || g != v {
+			t.Fatal(g, err)
+		}
+
+		c, err := db.Array("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, err := c.Count(); err != nil || g != 0 {
+			t.Fatal(g, err)
+		}
+
+		f, err := db.File("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, len(v))
+		if n, err := f.ReadAt(buf, 1e6); n != len(buf) || string(buf) != v {
+			t.Fatal(n, err)
+		}
+	}
+
+	fi, err := os.Stat(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz0 := fi.Size()
+	cname := dbname + ".copy"
+	if err = Copy(cname, dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	check(cname, true)
+	check(dbname, false)
+	if err = Copy(dbname, dbname, o); err != nil {
+		t.Fatal(err)
+	}
+
+	check(dbname, true)
+	if fi, err = os.Stat(dbname); err != nil {
+		t.Fatal(err)
+	}
+
+	if sz := fi.Size(); sz >= sz0 {
+		t.Fatalf("file size %d, before copy %d", sz, sz0)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	opts := *o
+	opts.WAL = "" // Set by Options.check of an earlier test.
+	opts.Mmap = true
+	db, err := Create(dbname, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 5000
+	v := strings.Repeat("0123456789abcdef", 10)
+	set := func(db *DB, from, to int) {
+		a, err := db.Array("TestMmap")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := from; i < to; i++ {
+			if err = a.Set(fmt.Sprintf("%d%s", i, v), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(db *DB, m int) {
+		a, err := db.Array("TestMmap")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := a.Slice(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		i := 0
+		if err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+			if g, e := subscripts[0], int64(i); g != e {
+				t.Fatalf("got %v, exp %v", g, e)
+			}
+
+			if g, e := value[0], fmt.Sprintf("%d%s", i, v); g != e {
+				t.Fatalf("%d: got %v, exp %v", i, g, e)
+			}
+
+			i++
+			return true, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if i != m {
+			t.Fatal(i, m)
+		}
+	}
+
+	set(db, 0, n)
+	check(db, n)
+	set(db, n, 2*n)
+	check(db, 2*n)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts = *o
+	opts.Mmap = true
+	if db, err = Open(dbname, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	check(db, 2*n)
+	if err = db.Clear("TestMmap"); err != nil {
+		t.Fatal(err)
+	}
+
+	check(db, 0)
+	set(db, 0, n)
+	check(db, n)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	testEncryption(t, ACIDNone)
+	testEncryption(t, ACIDFull)
+}
+
+func testEncryption(t *testing.T, acid int) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	newOpts := func(key []byte) *Options {
+		opts := *o
+		opts.WAL = "" // Set by Options.check of an earlier test.
+		opts.ACID = acid
+		opts.EncryptionKey = key
+		return &opts
+	}
+
+	db, err := Create(dbname, newOpts(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 1000
+	a, err := db.Array("TestEncryption")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if err = a.Set(fmt.Sprintf("secret %d", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte("secret")) {
+		t.Fatal("plaintext found in the DB file")
+	}
+
+	for _, v := range [][]byte{nil, []byte("fedcba9876543210fedcba9876543210"), key[:15]} {
+		if db, err = Open(dbname, newOpts(v)); err == nil {
+			db.Close()
+			t.Fatalf("%q: unexpected success", v)
+		}
+
+		t.Log(err)
+	}
+
+	cname := filepath.Join(dir, "copy.db")
+	if err = Copy(cname, dbname, newOpts(key)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{dbname, cname} {
+		if db, err = Open(name, newOpts(key)); err != nil {
+			t.Fatal(err)
+		}
+
+		if a, err = db.Array("TestEncryption"); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < n; i++ {
+			v, err := a.Get(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := v, fmt.Sprintf("secret %d", i); g != e {
+				t.Fatalf("got %v, exp %v", g, e)
+			}
+		}
+
+		if err = db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if acid == ACIDFull {
+			// Copy writes no WAL.
+			break
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	testScrub(t, nil, lldb.ErrChecksum)
+	testScrub(t, []byte("0123456789abcdef"), lldb.ErrDecrypt)
+}
+
+func testScrub(t *testing.T, key []byte, typ lldb.ErrType) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	opts := *o
+	opts.WAL = "" // Set by Options.check of an earlier test.
+	opts.Checksums = true
+	opts.EncryptionKey = key
+	db, err := Create(dbname, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := db.Array("TestScrub")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := strings.Repeat("0123456789abcdef", 100)
+	for i := 0; i < 1000; i++ {
+		if err = a.Set(v, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scrub := func(db *DB) (errs []error) {
+		for {
+			done, err := db.Scrub(time.Millisecond)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if done {
+				return
+			}
+		}
+	}
+
+	if errs := scrub(db); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the middle of the file.
+	f, err := os.OpenFile(dbname, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b [1]byte
+	off := fi.Size() / 2
+	if _, err = f.ReadAt(b[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	b[0] ^= 0x10
+	if _, err = f.WriteAt(b[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts = *o
+	opts.Checksums = true
+	opts.EncryptionKey = key
+	if db, err = Open(dbname, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := scrub(db)
+	if len(errs) != 1 {
+		t.Fatal(errs)
+	}
+
+	t.Log(errs[0])
+	if e, ok := errs[0].(*lldb.ErrILSEQ); !ok || e.Type != typ {
+		t.Fatalf("%T %v", errs[0], errs[0])
+	}
+
+	if errs := scrub(db); len(errs) != 1 {
+		t.Fatal(errs)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	testCrashRecovery(t, Options{})
+	testCrashRecovery(t, Options{EncryptionKey: key})
+	testCrashRecovery(t, Options{Checksums: true})
+	testCrashRecovery(t, Options{EncryptionKey: key, Checksums: true})
+}
+
+func testCrashRecovery(t *testing.T, opts Options) {
+	const n = 20
+
+	opts.ACID = ACIDFull
+	newOpts := func() *Options {
+		o := opts
+		return &o
+	}
+
+	dbf := lldb.NewCrashFiler()
+	walf := dbf.Sibling()
+	o := newOpts()
+	filer, err := o.pageFiler(dbf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := create(nil, filer, walf, o, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every update is a transaction, states[i] is the content after ends[i]
+	// operations of the CrashFiler log.
+	ends := []int{dbf.Ops()}
+	states := []map[int64]int64{{}}
+	m := map[int64]int64{}
+	v := strings.Repeat("x", 300)
+	for i := int64(0); i < n; i++ {
+		a, err := db.Array("TestCrashRecovery")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch {
+		case i%4 == 3:
+			if err = a.Delete(i - 2); err != nil {
+				t.Fatal(err)
+			}
+
+			delete(m, i-2)
+		default:
+			if err = a.Set(fmt.Sprintf("%d%s", i, v), i); err != nil {
+				t.Fatal(err)
+			}
+
+			m[i] = i
+		}
+
+		c := map[int64]int64{}
+		for k, v := range m {
+			c[k] = v
+		}
+		ends = append(ends, dbf.Ops())
+		states = append(states, c)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(k int, persist func(op, sector int) bool) {
+		dimg, err := dbf.Crash(k, persist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wimg, err := walf.Crash(k, persist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o := newOpts()
+		filer, err := o.pageFiler(dimg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := open(nil, filer, wimg, o)
+		if err != nil {
+			t.Fatalf("crash point %d: %v", k, err)
+		}
+
+		defer func() {
+			if err := db.Close(); err != nil {
+				t.Fatalf("crash point %d: %v", k, err)
+			}
+		}()
+
+		if err = db.Verify(nil, nil); err != nil {
+			t.Fatalf("crash point %d: %v", k, err)
+		}
+
+		a, err := db.Array("TestCrashRecovery")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g := map[int64]int64{}
+		for i := int64(0); i < n; i++ {
+			v, err := a.Get(i)
+			if err != nil {
+				t.Fatalf("crash point %d: %v", k, err)
+			}
+
+			if v != nil {
+				if e := fmt.Sprintf("%d%s", i, strings.Repeat("x", 300)); v != e {
+					t.Fatalf("crash point %d: got %v, exp %v", k, v, e)
+				}
+
+				g[i] = i
+			}
+		}
+
+		// The last transaction committed before the crash point must
+		// be intact, the one in progress may or may not survive.
+		j := 0
+		for j+1 < len(ends) && ends[j+1] <= k {
+			j++
+		}
+		if !reflect.DeepEqual(g, states[j]) && (j+1 == len(states) || !reflect.DeepEqual(g, states[j+1])) {
+			t.Fatalf("crash point %d: got %v, exp %v", k, g, states[j])
+		}
+	}
+
+	all := func(op, sector int) bool { return true }
+	for k := ends[0]; k <= dbf.Ops(); k++ {
+		torn := func(op, sector int) bool { return op < k-1 || sector == 0 }
+		check(k, nil)
+		check(k, all)
+		check(k, torn)
+	}
+	t.Log(dbf.Ops()-ends[0], "crash points")
+}
+
+type syncFiler struct {
+	lldb.Filer
+	syncs int32
+	fail  int32 // Sync fails if set
+}
+
+func (f *syncFiler) Sync() error {
+	atomic.AddInt32(&f.syncs, 1)
+	if atomic.LoadInt32(&f.fail) != 0 {
+		return fmt.Errorf("%s: Sync failed", f.Name())
+	}
+
+	time.Sleep(time.Millisecond) // Simulate a disk.
+	return f.Filer.Sync()
+}
+
+func TestGroupCommit(t *testing.T) {
+	const (
+		writers = 8
+		n       = 50
+	)
+
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	if _, err := Create(dbname, &Options{ACID: ACIDFull, GracePeriod: time.Second, GroupCommit: true}); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	walf := &syncFiler{Filer: lldb.NewMemFiler()}
+	db, err := create(nil, lldb.NewMemFiler(), walf, &Options{ACID: ACIDFull, GroupCommit: true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncs0 := atomic.LoadInt32(&walf.syncs)
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			for j := 0; j < n; j++ {
+				if err := db.Set(j, "TestGroupCommit", i, j); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every commit syncs the WAL three times.
+	commits := int(atomic.LoadInt32(&walf.syncs)-syncs0) / 3
+	t.Logf("%d updates, %d commits", writers*n, commits)
+	if commits >= writers*n/2 {
+		t.Fatalf("%d updates, %d commits", writers*n, commits)
+	}
+
+	for i := 0; i < writers; i++ {
+		for j := 0; j < n; j++ {
+			if v, err := db.Get("TestGroupCommit", i, j); err != nil || v != int64(j) {
+				t.Fatal(i, j, v, err)
+			}
+		}
+	}
+
+	// A failed commit is reported by the update and by the following ones.
+	atomic.StoreInt32(&walf.fail, 1)
+	if err = db.Set(42, "TestGroupCommit"); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.Set(43, "TestGroupCommit"); err == nil {
+		t.Fatal("unexpected success")
+	}
+}
+
+// Read only operations don't wait for the group commit and a steady stream of
+// operations doesn't postpone it forever.
+func TestGroupCommitStream(t *testing.T) {
+	db, err := create(nil, lldb.NewMemFiler(), lldb.NewMemFiler(), &Options{ACID: ACIDFull, GroupCommit: true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(42, "TestGroupCommitStream"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend another goroutine is always waiting to enter.
+	atomic.AddInt32(&db.entering, 1)
+	defer atomic.AddInt32(&db.entering, -1)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	errs := make(chan error, 2)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if _, err := db.Get("TestGroupCommitStream"); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() { errs <- db.Set(43, "TestGroupCommitStream") }()
+
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("commit starved")
+	}
+}
+
+func TestGroupCommitReadAfterWrite(t *testing.T) {
+	db, err := create(nil, lldb.NewMemFiler(), lldb.NewMemFiler(), &Options{ACID: ACIDFull, GroupCommit: true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(42, "TestGroupCommitReadAfterWrite"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend another goroutine is waiting to enter, so the Set doesn't
+	// commit its batch.
+	atomic.AddInt32(&db.entering, 1)
+	set := make(chan error, 1)
+	go func() { set <- db.Set(43, "TestGroupCommitReadAfterWrite") }()
+	for {
+		db.bkl.Lock()
+		ops := 0
+		if g := db.group; g != nil {
+			ops = g.ops
+		}
+		db.bkl.Unlock()
+		if ops != 0 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// A Get in the same batch doesn't wait for the commit.
+	get := make(chan error, 1)
+	go func() {
+		v, err := db.Get("TestGroupCommitReadAfterWrite")
+		if err == nil && v != int64(43) {
+			err = fmt.Errorf("%v", v)
+		}
+		get <- err
+	}()
+	select {
+	case err = <-get:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("read only operation waits for the commit")
+	}
+
+	select {
+	case err = <-set:
+		t.Fatal("unexpected commit", err)
+	default:
+	}
+
+	// The next operation commits the batch.
+	atomic.AddInt32(&db.entering, -1)
+	if _, err = db.Get("TestGroupCommitReadAfterWrite"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-set; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommit(t *testing.T) {
+	walf := &syncFiler{Filer: lldb.NewMemFiler()}
+	db, err := create(nil, lldb.NewMemFiler(), walf, &Options{ACID: ACIDFull, GracePeriod: time.Hour}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(42, "TestCommit"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if g, e := db.WaitDurable(ctx), context.DeadlineExceeded; g != e {
+		t.Fatal(g, e)
+	}
+
+	c := make(chan error, 1)
+	db.OnCommit(func(err error) { c <- err })
+	select {
+	case err := <-c:
+		t.Fatal("unexpected commit", err)
+	default:
+	}
+
+	syncs0 := atomic.LoadInt32(&walf.syncs)
+	if err = db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&walf.syncs) == syncs0 {
+		t.Fatal("WAL not synced")
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.WaitDurable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed commit is reported by Commit and by OnCommit.
+	atomic.StoreInt32(&walf.fail, 1)
+	if err = db.Set(43, "TestCommit"); err != nil {
+		t.Fatal(err)
+	}
+
+	db.OnCommit(func(err error) { c <- err })
+	if err = db.Commit(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = <-c; err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.WaitDurable(context.Background()); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	// Without a grace period every update is durable when it returns.
+	if db, err = CreateMem(&Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(42, "TestCommit"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.WaitDurable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// An operation ending the grace period batch commits the batch after its own
+// transaction, a failing operation rolls back only its own updates.
+func TestCommitTriggered(t *testing.T) {
+	walf := &syncFiler{Filer: lldb.NewMemFiler()}
+	db, err := create(nil, lldb.NewMemFiler(), walf, &Options{ACID: ACIDFull, GracePeriod: time.Hour}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// trigger runs an operation setting a value and failing with e while
+	// the grace period expires.
+	trigger := func(e error) error {
+		if err := db.enter(); err != nil {
+			return err
+		}
+
+		db.acidTimer.Stop()
+		db.acidState = stCollectingTriggered
+		a, err := db.array_(true, "TestCommitTriggered", "op")
+		if err == nil {
+			if err = a.set(1); err == nil {
+				err = e
+			}
+		}
+		return db.leave(&err)
+	}
+
+	if err = db.Set(42, "TestCommitTriggered", "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan error, 1)
+	db.OnCommit(func(err error) { c <- err })
+	e := fmt.Errorf("TestCommitTriggered")
+	if g := trigger(e); g != e {
+		t.Fatal(g, e)
+	}
+
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+
+	if g, err := db.Get("TestCommitTriggered", "batch"); err != nil || g != int64(42) {
+		t.Fatal(g, err)
+	}
+
+	if g, err := db.Get("TestCommitTriggered", "op"); err != nil || g != nil {
+		t.Fatal(g, err)
+	}
+
+	if err = db.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lost batch is reported to the callbacks.
+	if err = db.Set(43, "TestCommitTriggered", "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&walf.fail, 1)
+	db.OnCommit(func(err error) { c <- err })
+	if err = trigger(nil); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = <-c; err == nil {
+		t.Fatal("unexpected success")
+	}
+}
+
+func TestGroupCommitEndUpdateFailed(t *testing.T) {
+	db, err := create(nil, lldb.NewMemFiler(), lldb.NewMemFiler(), &Options{ACID: ACIDFull, GroupCommit: true}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := db.filer.(*lldb.ACIDFiler0)
+	f := &failFiler{Filer: a}
+	db.filer = f
+	if err = db.Set(1, "TestGroupCommitEndUpdateFailed", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	f.failEnd = true
+	if err = db.Set(2, "TestGroupCommitEndUpdateFailed", 2); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	// The batch is rolled back, no transaction level is left open.
+	if err = a.Rollback(); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = db.Set(3, "TestGroupCommitEndUpdateFailed", 3); err == nil {
+		t.Fatal("unexpected success")
+	}
+}
+
+func TestCommitInFlight(t *testing.T) {
+	db, err := create(nil, lldb.NewMemFiler(), lldb.NewMemFiler(), &Options{ACID: ACIDFull, GracePeriod: time.Hour}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(42, "TestCommitInFlight", "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An operation in flight while Commit is called.
+	if err = db.enter(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := make(chan error, 1)
+	go func() { c <- db.Commit() }()
+	a, err := db.array_(true, "TestCommitInFlight", "op")
+	if err == nil {
+		err = a.set(43)
+	}
+	if err = db.leave(&err); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err = <-c:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("Commit waits for the grace period timer")
+	}
+
+	db.bkl.Lock()
+	ok, err := db.durable()
+	db.bkl.Unlock()
+	if !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStandby(t *testing.T) {
+	dir, dbname := temp()
+	defer os.RemoveAll(dir)
+
+	db, err := Create(dbname, &Options{ACID: ACIDFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(-1, "TestStandby", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(dbname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sname := filepath.Join(dir, "standby.db")
+	if err = ioutil.WriteFile(sname, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = OpenStandby(sname, &Options{}); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	pr, pw := io.Pipe()
+	if db, err = Open(dbname, &Options{ACID: ACIDFull, Ship: pw}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenStandby(sname, &Options{ACID: ACIDFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Apply(pr); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = s.Set(42, "TestStandby", 42); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	stale, err := s.Array("TestStandby")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.Apply(pr) }()
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err = db.Set(i, "TestStandby", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, err := db.Array("TestStandby")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Delete(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := db.File("TestStandby")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.WriteAt([]byte("foo"), 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.ShipError(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pw.Close()
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	// Arrays obtained before a transaction was applied are stale.
+	if _, err = stale.Get(0); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	check := func(db *DB) {
+		for i := -1; i < n; i++ {
+			v, err := db.Get("TestStandby", i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i < 0 && v != nil || i >= 0 && v != int64(i) {
+				t.Fatal(i, v)
+			}
+		}
+
+		f, err := db.File("TestStandby")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, 3)
+		if n, err := f.ReadAt(b, 1000); n != 3 || string(b) != "foo" {
+			t.Fatalf("%q %v", b, err)
+		}
+	}
+
+	check(s)
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failover.
+	if s, err = Open(sname, &Options{ACID: ACIDFull}); err != nil {
+		t.Fatal(err)
+	}
+
+	check(s)
+	if err = s.Set(42, "TestStandby", 42); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed shipping is reported by ShipError.
+	pr, pw = io.Pipe()
+	pr.Close()
+	if db, err = Open(dbname, &Options{ACID: ACIDFull, Ship: pw}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.ShipError(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Set(43, "TestStandby", 43); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close waits for the shipping.
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.ShipError(); err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+
+	// A stalled shipping doesn't block the DB.
+	stall := make(stallWriter)
+	if db, err = Open(dbname, &Options{ACID: ACIDFull, Ship: stall}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 3; i++ {
+			if err := db.Set(i, "TestStandby", 44+i); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("Set waits for the shipping")
+	}
+
+	close(stall)
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.ShipError(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stallWriter blocks every write until it's closed.
+type stallWriter chan struct{}
+
+func (w stallWriter) Write(b []byte) (int, error) {
+	<-w
+	return len(b), nil
+}
@@ -5,19 +5,23 @@
 package dbm
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 
 	"github.com/cznic/exp/lldb"
+	"github.com/cznic/fileutil"
 )
 
 // Array is a reference to a subtree of an array.
 type Array struct {
 	db        *DB
 	tree      *lldb.BTree
+	coll      *collation // nil for the default collation
 	prefix    []byte
 	name      string
 	namespace byte
+	gen       int64 // DB.gen when a was obtained
 }
 
 // MemArray returns an Array associated with a subtree of an anonymous array,
@@ -29,7 +33,7 @@ func MemArray(subscripts ...interface{}) (a Array, err error) {
 		return a, err
 	}
 
-	a.tree = lldb.NewBTree(collate)
+	a.tree = lldb.NewCountedBTree(collate)
 	return
 }
 
@@ -44,17 +48,21 @@ func bpack(a []byte) []byte {
 // Named trees (arrays) can get removed, but references to them (Arrays) may
 // outlive that. db.bkl locked is assumed. ok => a.tree != nil && err == nil.
 func (a *Array) validate(canCreate bool) (ok bool, err error) {
+	if a.gen != a.db.gen {
+		return false, &lldb.ErrPERM{Src: "dbm: Array or File obtained before a standby DB applied a transaction"}
+	}
+
 	if a.tree != nil && (a.tree.Handle() == 1 || a.tree.IsMem()) {
 		return true, nil
 	}
 
 	switch a.namespace {
 	case arraysPrefix:
-		a.tree, err = a.db.acache.getTree(a.db, arraysPrefix, a.name, canCreate, aCacheSize)
+		a.tree, a.coll, err = a.db.acache.getTree(a.db, arraysPrefix, a.name, canCreate, aCacheSize)
 	case filesPrefix:
-		a.tree, err = a.db.fcache.getTree(a.db, filesPrefix, a.name, canCreate, fCacheSize)
+		a.tree, a.coll, err = a.db.fcache.getTree(a.db, filesPrefix, a.name, canCreate, fCacheSize)
 	case systemPrefix:
-		a.tree, err = a.db.scache.getTree(a.db, systemPrefix, a.name, canCreate, sCacheSize)
+		a.tree, a.coll, err = a.db.scache.getTree(a.db, systemPrefix, a.name, canCreate, sCacheSize)
 	default:
 		panic("internal error")
 	}
@@ -104,8 +112,19 @@ func (a *Array) bset(val, key []byte) (err error) {
 	return
 }
 
-func (a *Array) binc(delta int64, key []byte) (r int64, err error) {
-	_, _, err = a.tree.Put(
+func (a *Array) bput(val, key []byte) (old []byte, err error) {
+	old, _, err = a.tree.Put(
+		nil, //TODO buffers
+		append(a.prefix, key...),
+		func(key []byte, old []byte) (new []byte, write bool, err error) {
+			return val, true, nil
+		},
+	)
+	return
+}
+
+func (a *Array) binc(delta int64, key []byte) (r int64, old []byte, err error) {
+	old, _, err = a.tree.Put(
 		nil, //TODO buffers
 		append(a.prefix, key...),
 		func(key []byte, old []byte) (new []byte, write bool, err error) {
@@ -137,6 +156,31 @@ func (a *Array) bdelete(key []byte) (err error) {
 	return a.tree.Delete(append(a.prefix, key...))
 }
 
+func (a *Array) bextract(key []byte) (old []byte, err error) {
+	return a.tree.Extract(nil, append(a.prefix, key...))
+}
+
+// updated maintains the indexes and the spilled values of a after the value
+// at key changed from old to new. A nil value means a non existing record.
+func (a *Array) updated(key, old, new []byte) (err error) {
+	x, err := a.hasIndexes()
+	if err != nil {
+		return
+	}
+
+	if x {
+		if err = a.updateIndexes(key, old, new); err != nil {
+			return
+		}
+	}
+
+	if bytes.Equal(old, new) {
+		return
+	}
+
+	return a.db.freeSpill(old)
+}
+
 // Set sets the value at subscripts in subtree 'a'. Any previous value, if
 // existed, is overwritten by the new one.
 func (a *Array) Set(value interface{}, subscripts ...interface{}) (err error) {
@@ -163,7 +207,21 @@ func (a *Array) Set(value interface{}, subscripts ...interface{}) (err error) {
 }
 
 func (a *Array) set(value interface{}, subscripts ...interface{}) (err error) {
-	val, err := encVal(value)
+	if a.namespace != arraysPrefix {
+		val, err := encVal(value)
+		if err != nil {
+			return err
+		}
+
+		key, err := lldb.EncodeScalars(subscripts...)
+		if err != nil {
+			return err
+		}
+
+		return a.bset(val, key)
+	}
+
+	val, err := a.db.encValue(value)
 	if err != nil {
 		return
 	}
@@ -173,7 +231,113 @@ func (a *Array) set(value interface{}, subscripts ...interface{}) (err error) {
 		return
 	}
 
-	return a.bset(val, key)
+	old, err := a.bput(val, key)
+	if err != nil {
+		return
+	}
+
+	return a.updated(key, old, val)
+}
+
+// Import sets the values at subscripts produced by src, which returns io.EOF
+// after the last pair. The subscripts must be produced in strictly ascending
+// collation order. src must not invoke methods of a's DB.
+//
+// If the whole tree of a is empty, Import builds it bottom-up from the
+// imported pairs, which is much faster than setting them one by one. Otherwise
+// Import works like a sequence of Sets.
+func (a *Array) Import(src func() (subscripts []interface{}, value interface{}, err error)) (err error) {
+	if err = a.db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		a.db.leave(&err)
+	}()
+
+	if t := a.tree; t != nil && !t.IsMem() && a.tree.Handle() == 1 {
+		return &lldb.ErrPERM{Src: "dbm.Array.Import"}
+	}
+
+	if ok, err := a.validate(true); !ok {
+		return err
+	}
+
+	return a.load(src)
+}
+
+func (a *Array) load(src func() (subscripts []interface{}, value interface{}, err error)) (err error) {
+	if _, err = a.tree.SeekFirst(); !fileutil.IsEOF(err) {
+		if err != nil {
+			return
+		}
+
+		for {
+			subscripts, value, err := src()
+			if err != nil {
+				return noEof(err)
+			}
+
+			if err = a.set(value, subscripts...); err != nil {
+				return err
+			}
+		}
+	}
+
+	var spills [][]byte
+	if err = a.tree.BulkLoad(func() (key, val []byte, err error) {
+		subscripts, value, err := src()
+		if err != nil {
+			return
+		}
+
+		if a.namespace != arraysPrefix {
+			val, err = encVal(value)
+		} else {
+			val, err = a.db.encValue(value)
+		}
+		if err != nil {
+			return
+		}
+
+		if isSpill(val) {
+			spills = append(spills, val)
+		}
+		if key, err = lldb.EncodeScalars(subscripts...); err != nil {
+			return
+		}
+
+		return append(append([]byte(nil), a.prefix...), key...), val, nil
+	}); err != nil {
+		for _, v := range spills {
+			a.db.freeSpill(v)
+		}
+		return
+	}
+
+	x, err := a.hasIndexes()
+	if !x || err != nil {
+		return
+	}
+
+	en, err := a.tree.SeekFirst()
+	if err != nil {
+		return noEof(err)
+	}
+
+	for {
+		bk, bv, err := en.Next()
+		if err != nil {
+			return noEof(err)
+		}
+
+		if err = a.updateIndexes(bk[len(a.prefix):], nil, bv); err != nil {
+			return err
+		}
+	}
 }
 
 // Inc atomically increments the value at subscripts by delta and returns the
@@ -208,7 +372,17 @@ func (a *Array) inc(delta int64, subscripts ...interface{}) (val int64, err erro
 		return
 	}
 
-	return a.binc(delta, key)
+	val, old, err := a.binc(delta, key)
+	if a.namespace != arraysPrefix || err != nil {
+		return
+	}
+
+	new, err := lldb.EncodeScalars(val)
+	if err != nil {
+		return
+	}
+
+	return val, a.updated(key, old, new)
 }
 
 // Get returns the value at subscripts in subtree 'a', or nil if no such value
@@ -256,7 +430,7 @@ func (a *Array) get(subscripts ...interface{}) (value interface{}, err error) {
 		return
 	}
 
-	va, err := lldb.DecodeScalars(val)
+	va, err := a.db.decodeValue(val)
 	if err != nil {
 		return nil, err
 	}
@@ -298,25 +472,29 @@ func (a *Array) delete(subscripts ...interface{}) (err error) {
 		return
 	}
 
-	return a.bdelete(key)
+	if a.namespace != arraysPrefix {
+		return a.bdelete(key)
+	}
+
+	old, err := a.bextract(key)
+	if err != nil {
+		return
+	}
+
+	return a.updated(key, old, nil)
 }
 
 // Clear empties the subtree at subscripts in 'a'.
 func (a *Array) Clear(subscripts ...interface{}) (err error) {
-	//TODO optimize for clear "everything"
-
 	if err = a.db.enter(); err != nil {
 		return
 	}
 
-	doLeave := true
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%v", e)
 		}
-		if doLeave {
-			a.db.leave(&err)
-		}
+		a.db.leave(&err)
 	}()
 
 	if t := a.tree; t != nil && !t.IsMem() && a.tree.Handle() == 1 {
@@ -327,52 +505,18 @@ func (a *Array) Clear(subscripts ...interface{}) (err error) {
 		return err
 	}
 
-	doLeave = false
-	if a.db.leave(&err) != nil {
-		return
-	}
-
-	a0 := *a
-	a0.prefix = nil
-
-	prefix, err := lldb.DecodeScalars(a.prefix)
-	if err != nil {
-		panic("internal error")
-	}
-
-	subscripts = append(prefix, subscripts...)
-	n := len(subscripts)
-
-	bSubscripts, err := lldb.EncodeScalars(subscripts...)
+	sub, err := a.array(subscripts...)
 	if err != nil {
-		panic("internal error")
+		return
 	}
 
-	s, err := a0.Slice(nil, nil)
+	prefix, err := lldb.DecodeScalars(sub.prefix)
 	if err != nil {
 		return
 	}
 
-	return s.Do(func(actualSubscripts, value []interface{}) (more bool, err error) {
-		if len(actualSubscripts) < n {
-			return
-		}
-
-		common := actualSubscripts[:n]
-		bcommon, err := lldb.EncodeScalars(common...)
-		if err != nil {
-			panic("internal error")
-		}
-
-		switch collate(bcommon, bSubscripts) {
-		case -1:
-			return true, nil
-		case 0:
-			return true, a0.Delete(actualSubscripts...)
-		}
-		// case 1:
-		return false, nil
-	})
+	s := &Slice{a: &sub, prefix: prefix}
+	return s.delete()
 }
 
 // Slice returns a new Slice from Array, with a subscripts range of [from, to].
@@ -403,6 +547,88 @@ func (a *Array) Slice(from, to []interface{}) (s *Slice, err error) {
 	}, nil
 }
 
+// SliceOffset returns a new Slice of a with at most limit subscripts/value
+// pairs, starting with the pair at position offset in the collation order of
+// the subscripts, ie. the offset-th pair of a Slice(nil, nil). A negative
+// limit means no limit.
+//
+// Positioning to offset is O(log n) for Arrays created by this version of dbm
+// and O(n) for older ones.
+func (a *Array) SliceOffset(offset, limit int64) (s *Slice, err error) {
+	if offset < 0 {
+		return nil, &lldb.ErrINVAL{Src: "dbm.Array.SliceOffset: invalid offset", Val: offset}
+	}
+
+	if s, err = a.Slice(nil, nil); err != nil {
+		return
+	}
+
+	s.indexed, s.offset, s.limit = true, offset, limit
+	return
+}
+
+// Count returns the number of subscripts/value pairs in a.
+//
+// Count is O(log n) for Arrays created by this version of dbm and O(n) for
+// older ones.
+func (a *Array) Count() (n int64, err error) {
+	if err = a.db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		a.db.leave(&err)
+	}()
+
+	return a.count()
+}
+
+func (a *Array) count() (n int64, err error) {
+	if ok, err := a.validate(false); !ok {
+		return 0, err
+	}
+
+	if len(a.prefix) == 0 {
+		return a.tree.Len()
+	}
+
+	lo, hi, err := a.bounds()
+	return hi - lo, err
+}
+
+// bounds returns the range of indexes of the keys of a.tree having a.prefix.
+func (a *Array) bounds() (lo, hi int64, err error) {
+	if lo, _, err = a.tree.Rank(a.prefix); err != nil {
+		return
+	}
+
+	hi, _, err = a.tree.IndexRank(a.prefix, func(prefix, key []byte) int {
+		if bytes.HasPrefix(key, prefix) {
+			return 1
+		}
+
+		return a.coll.bytes(prefix, key)
+	})
+	return
+}
+
+// keyAt returns the key at index i of a.tree or nil if there's none.
+func (a *Array) keyAt(i int64) (k []byte, err error) {
+	en, err := a.tree.SeekIndex(i)
+	if err != nil {
+		return nil, noEof(err)
+	}
+
+	if k, _, err = en.Next(); err != nil {
+		return nil, noEof(err)
+	}
+
+	return
+}
+
 // Dump outputs a human readable dump of a to w.  Intended use is only for
 // examples or debugging. Some type information is lost in the rendering, for
 // example a float value '17.' and an integer value '17' may both output as
@@ -507,7 +733,7 @@ func (e *Enumerator) Next() (key, value []interface{}, err error) {
 		return
 	}
 
-	value, err = lldb.DecodeScalars(v)
+	value, err = e.db.decodeValue(v)
 	return
 }
 
@@ -542,6 +768,6 @@ func (e *Enumerator) Prev() (key, value []interface{}, err error) {
 		return
 	}
 
-	value, err = lldb.DecodeScalars(v)
+	value, err = e.db.decodeValue(v)
 	return
 }
@@ -0,0 +1,312 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Named, per Array collations.
+
+package dbm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/cznic/exp/lldb"
+)
+
+// Names of the predefined collations.
+const (
+	// The default collation, see lldb.Collate.
+	CollateDefault = ""
+
+	// Strings collate case insensitively. Strings equal except for case
+	// collate in the default order, ie. they remain distinct keys.
+	CollateNoCase = "nocase"
+
+	// Strings collate in a dictionary like order: First by comparing only
+	// their letters and digits, ignoring case, next by comparing them
+	// ignoring case and finally using the default order. No locale
+	// specific tailoring is performed.
+	CollateLocale = "locale"
+
+	// Numbers collate in descending order. Any other types collate in the
+	// default order.
+	CollateDescNum = "descnum"
+)
+
+var (
+	collations = map[string]*collation{
+		CollateDefault: defaultCollation,
+		CollateNoCase:  {CollateNoCase, collateNoCase},
+		CollateLocale:  {CollateLocale, collateLocale},
+		CollateDescNum: {CollateDescNum, collateDescNum},
+	}
+	collationsMu sync.RWMutex
+
+	defaultCollation = &collation{CollateDefault, func(x, y []interface{}) (int, error) {
+		return lldb.Collate(x, y, nil)
+	}}
+)
+
+type collation struct {
+	name string
+	f    func(x, y []interface{}) (int, error)
+}
+
+// RegisterCollation registers f as the collation named name. Arrays created
+// by DB.CreateArray using name will have their subscripts ordered by f. The
+// name, not f, is persisted with the Array, so the same collation must be
+// registered, before accessing such Arrays, every time the DB is opened.
+//
+// f must return -1, 0 or 1 when x collates before, equal to or after y. f
+// must define a total order and it must never change for an existing Array.
+// Subscripts which f reports as collating equal are the same key. Slices
+// require that subscripts collate after any of their proper prefixes and
+// before any subscripts not having the same prefix which collate after that
+// prefix, ie. f should compare x and y item by item, like lldb.Collate does.
+//
+// Attempting to register an already registered name is an error.
+func RegisterCollation(name string, f func(x, y []interface{}) (int, error)) (err error) {
+	if f == nil {
+		return &lldb.ErrINVAL{Src: "dbm.RegisterCollation: nil collation", Val: name}
+	}
+
+	collationsMu.Lock()
+	defer collationsMu.Unlock()
+
+	if _, ok := collations[name]; ok {
+		return &lldb.ErrINVAL{Src: "dbm.RegisterCollation: collation already registered", Val: name}
+	}
+
+	collations[name] = &collation{name, f}
+	return
+}
+
+func getCollation(name string) (c *collation, err error) {
+	if strings.HasPrefix(name, indexCollationPrefix) {
+		if c, err = getCollation(name[len(indexCollationPrefix):]); err != nil {
+			return
+		}
+
+		return indexCollation(c), nil
+	}
+
+	collationsMu.RLock()
+	defer collationsMu.RUnlock()
+
+	if c = collations[name]; c == nil {
+		err = &lldb.ErrINVAL{Src: "dbm: unregistered collation", Val: name}
+	}
+	return
+}
+
+// indexCollationPrefix prefixes the persisted collation names of index arrays.
+const indexCollationPrefix = "\x00index\x00"
+
+// indexCollation returns the collation of the index entries of an Array using
+// c. The entries collate by the indexed item in the default order, so Lookup
+// finds all the entries of a value together, and then by the subscripts of the
+// records using c.
+func indexCollation(c *collation) *collation {
+	return &collation{indexCollationPrefix + c.name, func(x, y []interface{}) (int, error) {
+		if len(x) < 2 || len(y) < 2 {
+			return lldb.Collate(x, y, nil)
+		}
+
+		if r, err := lldb.Collate(x[:1], y[:1], nil); r != 0 || err != nil {
+			return r, err
+		}
+
+		return c.f(x[1:], y[1:])
+	}}
+}
+
+// bytes is the BTree collating function of c. A nil c is the default
+// collation.
+func (c *collation) bytes(a, b []byte) (r int) {
+	if c == nil || c == defaultCollation {
+		return collate(a, b)
+	}
+
+	da, err := lldb.DecodeScalars(a)
+	if err != nil {
+		panic(err)
+	}
+
+	db, err := lldb.DecodeScalars(b)
+	if err != nil {
+		panic(err)
+	}
+
+	if r, err = c.f(da, db); err != nil {
+		panic(err)
+	}
+
+	return
+}
+
+// cmp collates x and y using c. A nil c is the default collation.
+func (c *collation) cmp(x, y []interface{}) (int, error) {
+	if c == nil {
+		return lldb.Collate(x, y, nil)
+	}
+
+	return c.f(x, y)
+}
+
+func collateNoCase(x, y []interface{}) (int, error) {
+	return lldb.Collate(x, y, func(a, b string) int {
+		if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a, b)
+	})
+}
+
+func collateLocale(x, y []interface{}) (int, error) {
+	return lldb.Collate(x, y, func(a, b string) int {
+		ra, rb := []rune(a), []rune(b)
+		i, j := 0, 0
+		for {
+			for i < len(ra) && !unicode.IsLetter(ra[i]) && !unicode.IsDigit(ra[i]) {
+				i++
+			}
+			for j < len(rb) && !unicode.IsLetter(rb[j]) && !unicode.IsDigit(rb[j]) {
+				j++
+			}
+			if i == len(ra) || j == len(rb) {
+				break
+			}
+
+			ca, cb := unicode.ToLower(ra[i]), unicode.ToLower(rb[j])
+			switch {
+			case ca < cb:
+				return -1
+			case ca > cb:
+				return 1
+			}
+
+			i++
+			j++
+		}
+		switch {
+		case i < len(ra):
+			return 1
+		case j < len(rb):
+			return -1
+		}
+
+		if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+			return c
+		}
+
+		return strings.Compare(a, b)
+	})
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return true
+	}
+	return false
+}
+
+func collateDescNum(x, y []interface{}) (r int, err error) {
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if r, err = lldb.Collate(x[i:i+1], y[i:i+1], nil); err != nil {
+			return
+		}
+
+		if r == 0 {
+			continue
+		}
+
+		if isNumber(x[i]) && isNumber(y[i]) {
+			r = -r
+		}
+		return
+	}
+
+	switch {
+	case len(x) < len(y):
+		return -1, nil
+	case len(x) > len(y):
+		return 1, nil
+	}
+	return
+}
+
+// CreateArray returns an Array named array using the named collation. If
+// array doesn't exist, it's created and the collation name is persisted with
+// it. It's an error if array already exists and uses a different collation.
+//
+// Arrays created implicitly, for example by DB.Set, use CollateDefault.
+func (db *DB) CreateArray(array, collation string) (a Array, err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	c, err := getCollation(collation)
+	if err != nil {
+		return
+	}
+
+	if a, err = db.array_(false, array); err != nil {
+		return
+	}
+
+	if a.tree != nil {
+		if g := a.Collation(); g != collation {
+			return a, &lldb.ErrINVAL{Src: "dbm.DB.CreateArray: array " + array + " already exists with collation", Val: g}
+		}
+
+		return
+	}
+
+	root, err := db.root()
+	if err != nil {
+		return
+	}
+
+	_, h, err := lldb.CreateCountedBTree(db.alloc, c.bytes)
+	if err != nil {
+		return
+	}
+
+	var val interface{} = h
+	if c != defaultCollation {
+		val = []interface{}{h, collation}
+	}
+	if err = root.set(val, arraysPrefix, array); err != nil {
+		return
+	}
+
+	delete(db.acache, array)
+	return db.array_(false, array)
+}
+
+// Collation returns the name of the collation used by a.
+func (a *Array) Collation() string {
+	if a.coll == nil {
+		return CollateDefault
+	}
+
+	return a.coll.name
+}
+
+// cmp collates x and y using the collation of a.
+func (a *Array) cmp(x, y []interface{}) (int, error) {
+	return a.coll.cmp(x, y)
+}
@@ -0,0 +1,230 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Offline copying of DBs.
+
+package dbm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cznic/exp/lldb"
+)
+
+// Copy writes a densely packed copy of the DB src to dst. All Arrays and Files
+// of src are rebuilt in a new DB file using bulk loaded trees, so the copy has
+// no relocated blocks and almost no free space. Arrays and Files waiting to be
+// removed by a previous RemoveArray or RemoveFile are not copied.
+//
+// The copy is built in a temporary file in the directory of dst, which then
+// atomically replaces dst, if it exists. dst may be the same as src, which
+// compacts src offline. src is opened using opts, while the copy is written
+// without a WAL, using opts.EncryptionKey and opts.Checksums. No DB at src
+// or dst may be open while Copy is running. If dst was used with ACIDFull, its
+// WAL must be empty.
+func Copy(dst, src string, opts *Options) (err error) {
+	sfi, err := os.Stat(src)
+	if err != nil {
+		return
+	}
+
+	same := false
+	switch dfi, err := os.Stat(dst); {
+	case err == nil:
+		same = os.SameFile(sfi, dfi)
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	if !same {
+		lo := &Options{}
+		if err = lo.check(dst, false, true, nil); err != nil {
+			return
+		}
+
+		defer func() {
+			n := lo.lock.Name()
+			lo.lock.Close()
+			os.Remove(n)
+		}()
+	}
+
+	s, err := Open(src, opts)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if s != nil {
+			s.Close()
+		}
+	}()
+
+	d, err := CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".", ".tmp", &Options{EncryptionKey: opts.EncryptionKey, Checksums: opts.Checksums})
+	if err != nil {
+		return
+	}
+
+	tmp := d.Name()
+	defer func() {
+		if d != nil {
+			d.Close()
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+
+	if err = s.copyTo(d); err != nil {
+		return
+	}
+
+	err, d = d.Close(), nil
+	if err != nil {
+		return
+	}
+
+	err, s = s.Close(), nil
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp, dst)
+}
+
+// copyTo copies the root directory of db and all the trees it refers to into
+// the empty DB dst.
+func (db *DB) copyTo(dst *DB) (err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	if err = dst.enter(); err != nil {
+		return
+	}
+
+	defer dst.leave(&err)
+
+	sroot, err := db.root()
+	if err != nil {
+		return
+	}
+
+	droot, err := dst.root()
+	if err != nil {
+		return
+	}
+
+	dst.alloc.Compress = db.alloc.Compress
+	enum, err := sroot.tree.SeekFirst()
+	if err != nil {
+		return noEof(err)
+	}
+
+	var keys, vals [][]byte
+	for {
+		k, v, err := enum.Next()
+		if err != nil {
+			if err = noEof(err); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		key, err := lldb.DecodeScalars(k)
+		if err != nil {
+			return err
+		}
+
+		if len(key) == 2 && key[0] == int64(systemPrefix) && key[1] == rname {
+			continue
+		}
+
+		val, err := lldb.DecodeScalars(v)
+		if err != nil {
+			return err
+		}
+
+		var h int64
+		ok := len(val) == 1 || len(val) == 2
+		if ok {
+			h, ok = val[0].(int64)
+		}
+		c := collate
+		if ok && len(val) == 2 {
+			var cname string
+			if cname, ok = val[1].(string); ok {
+				coll, err := getCollation(cname)
+				if err != nil {
+					return err
+				}
+
+				c = coll.bytes
+			}
+		}
+		if !ok {
+			return &lldb.ErrINVAL{Src: "dbm.Copy: corrupted root directory value for", Val: key}
+		}
+
+		if val[0], err = copyTree(dst.alloc, db.alloc, c, h); err != nil {
+			return err
+		}
+
+		if v, err = lldb.EncodeScalars(val...); err != nil {
+			return err
+		}
+
+		keys = append(keys, append([]byte(nil), k...))
+		vals = append(vals, v)
+	}
+
+	i := 0
+	return droot.tree.BulkLoad(func() (k, v []byte, err error) {
+		if i == len(keys) {
+			return nil, nil, io.EOF
+		}
+
+		k, v = keys[i], vals[i]
+		i++
+		return
+	})
+}
+
+// copyTree bulk loads a new tree in dst with the content of the tree h in src
+// and returns the handle of the new tree.
+func copyTree(dst, src *lldb.Allocator, c func(a, b []byte) int, h int64) (r int64, err error) {
+	s, err := lldb.OpenBTree(src, c, h)
+	if err != nil {
+		return
+	}
+
+	var d *lldb.BTree
+	switch {
+	case s.IsCounted():
+		d, r, err = lldb.CreateCountedBTree(dst, c)
+	default:
+		d, r, err = lldb.CreateBTree(dst, c)
+	}
+	if err != nil {
+		return
+	}
+
+	enum, err := s.SeekFirst()
+	if err != nil {
+		return r, noEof(err)
+	}
+
+	return r, d.BulkLoad(enum.Next)
+}
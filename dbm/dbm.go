@@ -15,6 +15,7 @@ package dbm
 //	to bee a too different API then. (package udbm?)
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"runtime"
@@ -32,6 +33,10 @@ const (
 	fCacheSize = 500
 	sCacheSize = 50
 
+	compactStep = 64 // Allocator blocks examined per lldb.Allocator.Compact call
+	scrubStep   = 64 // Pages verified per scrubber.Scrub call
+	groupOps    = 64 // Operations per group commit batch at most
+
 	rname        = "2remove" // Array shredder queue
 	arraysPrefix = 'A'
 	filesPrefix  = 'F'
@@ -54,6 +59,8 @@ const (
 	stCollectingArmed
 	stCollectingTriggered
 	stEndUpdateFailed
+	stGroupIdle
+	stGroupCollecting
 )
 
 func init() {
@@ -72,20 +79,37 @@ type DB struct {
 	bkl           sync.Mutex      // Big Kernel Lock
 	closeMu       sync.Mutex      // Close() coordination
 	closed        chan bool
-	emptySize     int64         // Any header size including FLT.
-	f             *os.File      // Underlying file. Potentially nil (if filer is lldb.MemFiler)
-	fcache        treeCache     // Files cache
-	filer         lldb.Filer    // Wraps f
-	gracePeriod   time.Duration // WAL grace period
-	isMem         bool          // No signal capture
+	closing       bool                  // Close in progress
+	commitFns     []func(error)         // OnCommit callbacks waiting for the grace period batch
+	emptySize     int64                 // Any header size including FLT.
+	entering      int32                 // Goroutines waiting for bkl in enter
+	f             *os.File              // Underlying file. Potentially nil (if filer is lldb.MemFiler)
+	fcache        treeCache             // Files cache
+	filer         lldb.Filer            // Wraps f
+	gen           int64                 // Transactions applied to a standby DB, see Array.gen
+	gracePeriod   time.Duration         // WAL grace period
+	group         *commitGroup          // The batch being collected, group commit
+	indexes       map[string][]indexDef // Index definitions cache
+	isMem         bool                  // No signal capture
 	lastCommitErr error
-	lock          *os.File       // The DB file lock
-	removing      map[int64]bool // BTrees being removed
-	removingMu    sync.Mutex     // Remove() coordination
-	scache        treeCache      // System arrays cache
-	stop          chan int       // Remove() coordination
-	wg            sync.WaitGroup // Remove() coordination
-	xact          bool           // Updates are made within automatic structural transactions
+	lock          *os.File         // The DB file lock
+	removing      map[int64]bool   // BTrees being removed
+	removingMu    sync.Mutex       // Remove() coordination
+	scache        treeCache        // System arrays cache
+	scrub         scrubber         // Verifies the pages of f if Options.Checksums is set
+	standby       *lldb.WALApplier // Applies the shipped transactions, standby DB
+	stop          chan int         // Remove() coordination
+	updates       int64            // Filer updates when the operation in progress entered
+	wg            sync.WaitGroup   // Remove() coordination
+	xact          bool             // Updates are made within automatic structural transactions
+}
+
+// commitGroup is a batch of DB operations committed together in the group
+// commit mode, see Options.GroupCommit.
+type commitGroup struct {
+	done chan struct{} // Closed when the batch is committed
+	err  error         // The commit error
+	ops  int           // Operations in the batch
 }
 
 // Create creates the named DB file mode 0666 (before umask). The file must not
@@ -100,10 +124,19 @@ func Create(name string, opts *Options) (db *DB, err error) {
 		return
 	}
 
-	return create(f, lldb.NewSimpleFileFiler(f), opts, false)
+	filer, err := opts.fileFiler(f)
+	if err != nil {
+		f.Close()
+		os.Remove(name)
+		return
+	}
+
+	return create(f, filer, nil, opts, false)
 }
 
-func create(f *os.File, filer lldb.Filer, opts *Options, isMem bool) (db *DB, err error) {
+// create creates a DB in filer. The WAL of an ACIDFull DB is wal or, if wal is
+// nil, the WAL file.
+func create(f *os.File, filer, wal lldb.Filer, opts *Options, isMem bool) (db *DB, err error) {
 	defer func() {
 		lock := opts.lock
 		if err != nil && lock != nil {
@@ -114,18 +147,21 @@ func create(f *os.File, filer lldb.Filer, opts *Options, isMem bool) (db *DB, er
 		}
 	}()
 
-	if err = opts.check(filer.Name(), true, !isMem); err != nil {
+	if err = opts.check(filer.Name(), true, !isMem, wal); err != nil {
 		return
 	}
 
-	b := [16]byte{byte(magic[0]), byte(magic[1]), byte(magic[2]), byte(magic[3]), 0x00} // ver 0x00
+	b := [16]byte{byte(magic[0]), byte(magic[1]), byte(magic[2]), byte(magic[3]), 0x01} // ver 0x01
 	if n, err := filer.WriteAt(b[:], 0); n != 16 {
 		return nil, &os.PathError{Op: "dbm.Create.WriteAt", Path: filer.Name(), Err: err}
 	}
 
 	db = &DB{emptySize: 128, f: f, lock: opts.lock, closed: make(chan bool)}
+	if !isMem {
+		db.scrub = opts.scrub
+	}
 
-	if filer, err = opts.acidFiler(db, filer); err != nil {
+	if filer, err = opts.acidFiler(db, filer, wal); err != nil {
 		return nil, err
 	}
 
@@ -161,7 +197,7 @@ func CreateMem(opts *Options) (db *DB, err error) {
 	if opts.ACID == ACIDFull {
 		opts.ACID = ACIDTransactions
 	}
-	return create(nil, f, opts, true)
+	return create(nil, f, nil, opts, true)
 }
 
 // CreateTemp creates a new temporary DB in the directory dir with a basename
@@ -179,7 +215,14 @@ func CreateTemp(dir, prefix, suffix string, opts *Options) (db *DB, err error) {
 		return
 	}
 
-	return create(f, lldb.NewSimpleFileFiler(f), opts, false)
+	filer, err := opts.fileFiler(f)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return
+	}
+
+	return create(f, filer, nil, opts, false)
 }
 
 // Open opens the named DB file for reading/writing. If successful, methods on
@@ -204,7 +247,7 @@ func Open(name string, opts *Options) (db *DB, err error) {
 		}
 	}()
 
-	if err = opts.check(name, false, true); err != nil {
+	if err = opts.check(name, false, true, nil); err != nil {
 		return
 	}
 
@@ -213,12 +256,29 @@ func Open(name string, opts *Options) (db *DB, err error) {
 		return
 	}
 
-	filer := lldb.Filer(lldb.NewSimpleFileFiler(f))
-	sz, err := filer.Size()
+	filer, err := opts.fileFiler(f)
 	if err != nil {
+		f.Close()
 		return
 	}
 
+	return open(f, filer, nil, opts)
+}
+
+// open opens the DB in filer, wal is as in create.
+func open(f *os.File, filer, wal lldb.Filer, opts *Options) (db *DB, err error) {
+	// The WAL recovery comes first, it may rewrite the header page.
+	name := filer.Name()
+	db = &DB{f: f, scrub: opts.scrub, lock: opts.lock, closed: make(chan bool)}
+	if filer, err = opts.acidFiler(db, filer, wal); err != nil {
+		return nil, err
+	}
+
+	sz, err := filer.Size()
+	if err != nil {
+		return nil, err
+	}
+
 	if sz%16 != 0 {
 		return nil, &os.PathError{Op: "dbm.Open:", Path: name, Err: fmt.Errorf("file size %d(%#x) is not 0 (mod 16)", sz, sz)}
 	}
@@ -233,17 +293,12 @@ func Open(name string, opts *Options) (db *DB, err error) {
 		return nil, &os.PathError{Op: "dbm.Open:validate header", Path: name, Err: err}
 	}
 
-	db = &DB{f: f, lock: opts.lock, closed: make(chan bool)}
-	if filer, err = opts.acidFiler(db, filer); err != nil {
-		return nil, err
-	}
-
 	db.filer = filer
 	switch h.ver {
 	default:
 		return nil, &os.PathError{Op: "dbm.Open", Path: name, Err: fmt.Errorf("unknown dbm file format version %#x", h.ver)}
-	case 0x00:
-		return open00(name, db)
+	case 0x00, 0x01:
+		return open00(name, db, h.ver)
 	}
 
 }
@@ -285,16 +340,27 @@ func (db *DB) Close() (err error) {
 	}
 
 	var e error
-	for db.acidNest > 0 {
-		db.acidNest--
-		if err := db.filer.EndUpdate(); err != nil {
-			e = err
+	switch {
+	case db.group != nil:
+		db.closing = true // leave commits the batch.
+	default:
+		for db.acidNest > 0 {
+			db.acidNest--
+			if err := db.filer.EndUpdate(); err != nil {
+				e = err
+			}
 		}
 	}
 	err = e
 
 	doLeave = false
 	e = db.leave(&err)
+	db.bkl.Lock()
+	db.fireCommit(e)
+	if a, ok := db.filer.(*lldb.ACIDFiler0); ok {
+		a.Ship(nil) // Write the queued transactions.
+	}
+	db.bkl.Unlock()
 	if err = db.close(); err == nil {
 		err = e
 	}
@@ -321,7 +387,11 @@ func (db *DB) close() (err error) {
 		db.stop = nil
 	}
 
-	if db.f == nil { // lldb.MemFiler
+	if db.f == nil { // lldb.MemFiler or lldb.Snapshot
+		if s, ok := db.filer.(*lldb.Snapshot); ok {
+			return s.Close()
+		}
+
 		return
 	}
 
@@ -355,7 +425,7 @@ func (db *DB) root() (r *Array, err error) {
 			panic("internal error")
 		}
 
-		r = &Array{db, tree, nil, "", 0}
+		r = &Array{db, tree, nil, nil, "", 0, db.gen}
 		db._root = r
 		return r, nil
 	default:
@@ -364,7 +434,7 @@ func (db *DB) root() (r *Array, err error) {
 			return nil, err
 		}
 
-		r = &Array{db, tree, nil, "", 0}
+		r = &Array{db, tree, nil, nil, "", 0, db.gen}
 		db._root = r
 		return r, nil
 	}
@@ -389,10 +459,11 @@ func (db *DB) Array(array string, subscripts ...interface{}) (a Array, err error
 
 func (db *DB) array_(canCreate bool, array string, subscripts ...interface{}) (a Array, err error) {
 	a.db = db
+	a.gen = db.gen
 	if a, err = a.array(subscripts...); err != nil {
 		return
 	}
-	a.tree, err = db.acache.getTree(db, arraysPrefix, array, canCreate, aCacheSize)
+	a.tree, a.coll, err = db.acache.getTree(db, arraysPrefix, array, canCreate, aCacheSize)
 	a.name = array
 	a.namespace = arraysPrefix
 	return
@@ -400,7 +471,8 @@ func (db *DB) array_(canCreate bool, array string, subscripts ...interface{}) (a
 
 func (db *DB) sysArray(canCreate bool, array string) (a Array, err error) {
 	a.db = db
-	a.tree, err = db.scache.getTree(db, systemPrefix, array, canCreate, sCacheSize)
+	a.gen = db.gen
+	a.tree, a.coll, err = db.scache.getTree(db, systemPrefix, array, canCreate, sCacheSize)
 	a.name = array
 	a.namespace = systemPrefix
 	return a, err
@@ -409,7 +481,8 @@ func (db *DB) sysArray(canCreate bool, array string) (a Array, err error) {
 func (db *DB) fileArray(canCreate bool, name string) (f File, err error) {
 	var a Array
 	a.db = db
-	a.tree, err = db.fcache.getTree(db, filesPrefix, name, canCreate, fCacheSize)
+	a.gen = db.gen
+	a.tree, a.coll, err = db.fcache.getTree(db, filesPrefix, name, canCreate, fCacheSize)
 	a.name = name
 	a.namespace = filesPrefix
 	return File(a), err
@@ -553,6 +626,66 @@ func (db *DB) Size() (sz int64, err error) {
 	return db.filer.Size()
 }
 
+// Compact performs an online compaction of the DB file for at most
+// approximately d. Content of used blocks is moved toward the file start and
+// free space at the end of the file is truncated. A compaction can span many
+// Compact calls and it's safe to update db in between them. done is true when
+// the compaction completed.
+//
+// The DB file cannot shrink below its highest used block handle.
+func (db *DB) Compact(d time.Duration) (done bool, err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	for t0 := time.Now(); !done && time.Since(t0) < d; {
+		if done, err = db.alloc.Compact(compactStep); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Scrub verifies the checksums of the DB file pages for at most approximately
+// d, see Options.Checksums. Scrubbing the whole file can span many Scrub calls
+// and it's safe to use db in between them, so Scrub can be called
+// periodically from a background goroutine. done is true when the last page
+// was verified, the next Scrub starts over. A corrupted page is reported as an
+// *lldb.ErrILSEQ of type lldb.ErrChecksum, or lldb.ErrDecrypt if db is
+// encrypted, and the next Scrub continues after it.
+//
+// Scrub returns done == true and does nothing if db doesn't use checksums.
+func (db *DB) Scrub(d time.Duration) (done bool, err error) {
+	if db.scrub == nil {
+		return true, nil
+	}
+
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	for t0 := time.Now(); !done && time.Since(t0) < d; {
+		if done, err = db.scrub.Scrub(scrubStep); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (db *DB) setRemoving(h int64, flag bool) (r bool) {
 	db.removingMu.Lock()
 	defer db.removingMu.Unlock()
@@ -585,6 +718,28 @@ func (db *DB) RemoveArray(array string) (err error) {
 		db.leave(&err)
 	}()
 
+	xx, err := db.indexesOf(array)
+	if err != nil {
+		return
+	}
+
+	for _, x := range xx {
+		if err = db.dropIndex(array, x); err != nil {
+			return
+		}
+	}
+
+	a, err := db.array_(false, array)
+	if err != nil {
+		return
+	}
+
+	if a.tree != nil {
+		if err = db.freeSpills(a.tree); err != nil {
+			return
+		}
+	}
+
 	return db.removeArray(arraysPrefix, array)
 }
 
@@ -609,7 +764,7 @@ func (db *DB) removeArray(prefix int, array string) (err error) {
 		db.stop = make(chan int)
 	}
 
-	t, err := db.acache.getTree(db, prefix, array, false, aCacheSize)
+	t, _, err := db.acache.getTree(db, prefix, array, false, aCacheSize)
 	if t == nil || err != nil {
 		return
 	}
@@ -849,7 +1004,9 @@ func (db *DB) Files() (a Array, err error) {
 }
 
 func (db *DB) enter() (err error) {
+	atomic.AddInt32(&db.entering, 1)
 	db.bkl.Lock()
+	atomic.AddInt32(&db.entering, -1)
 	switch db.acidState {
 	default:
 		panic("internal error")
@@ -874,15 +1031,30 @@ func (db *DB) enter() (err error) {
 		db.acidNest++
 	case stEndUpdateFailed:
 		return db.leave(&err)
+	case stGroupIdle:
+		if err = db.filer.BeginUpdate(); err != nil {
+			db.bkl.Unlock()
+			return
+		}
+
+		db.acidNest = 1
+		db.group = &commitGroup{done: make(chan struct{})}
+		db.acidState = stGroupCollecting
+	case stGroupCollecting:
+		db.acidNest++
 	}
 
 	if db.xact {
 		err = db.filer.BeginUpdate()
 	}
+	if a, ok := db.filer.(*lldb.ACIDFiler0); ok {
+		db.updates = a.Updates()
+	}
 	return
 }
 
 func (db *DB) leave(err *error) error {
+	var commit bool
 	switch db.acidState {
 	default:
 		panic("internal error")
@@ -904,22 +1076,27 @@ func (db *DB) leave(err *error) error {
 		}
 	case stCollectingTriggered:
 		db.acidNest--
-		if db.acidNest == 0 {
-			if e := db.filer.EndUpdate(); e != nil && err == nil {
-				*err = e
-			}
-			db.acidState = stIdle
-		}
+		commit = db.acidNest == 0 // After the operation's own transaction ends.
 	case stEndUpdateFailed:
 		db.bkl.Unlock()
 		return fmt.Errorf("Last transaction commit failed: %v", db.lastCommitErr)
+	case stGroupIdle:
+		panic("internal error")
+	case stGroupCollecting:
+		// nop, see leaveGroup
 	}
 
+	var updated bool
 	if db.xact {
 		switch {
 		case *err != nil:
 			db.filer.Rollback() // return the original, input error
+			db.acache = nil     // Trees created by the update may be gone now.
+			db.fcache = nil
+			db.scache = nil
+			db.indexes = nil // Index definitions may be gone now.
 		default:
+			updated = db.updated()
 			*err = db.filer.EndUpdate()
 			if *err != nil {
 				db.acidState = stEndUpdateFailed
@@ -927,10 +1104,84 @@ func (db *DB) leave(err *error) error {
 			}
 		}
 	}
+	if commit {
+		var commitErr error
+		switch {
+		case db.acidState == stEndUpdateFailed:
+			// The batch is lost.
+			db.filer.Rollback()
+			commitErr = db.lastCommitErr
+		default:
+			db.acidState = stIdle
+			if commitErr = db.filer.EndUpdate(); commitErr != nil { // No WAL was written (automatic Rollback)
+				db.acidState = stEndUpdateFailed
+				db.lastCommitErr = commitErr
+				if *err == nil {
+					*err = commitErr
+				}
+			}
+		}
+		db.fireCommit(commitErr)
+	}
+	if db.group != nil {
+		return db.leaveGroup(err, updated)
+	}
+
 	db.bkl.Unlock()
 	return *err
 }
 
+// leaveGroup finishes leave in the group commit mode. The last operation of a
+// batch, ie. when no other goroutine is waiting to enter or when the batch has
+// groupOps operations, commits the batch. A steady stream of operations thus
+// doesn't postpone the commit forever. Operations entering while the commit
+// is in progress form the next batch. The operations which updated the DB,
+// and the one committing the batch, wait for the commit and report its error.
+// leaveGroup unlocks bkl.
+func (db *DB) leaveGroup(err *error, updated bool) error {
+	g := db.group
+	db.acidNest--
+	g.ops++
+	switch {
+	case db.acidState == stEndUpdateFailed:
+		g.err = db.lastCommitErr
+		if db.acidNest == 0 {
+			// The batch is lost.
+			db.filer.Rollback()
+			db.group = nil
+			close(g.done)
+		}
+	case db.acidNest == 0 && (db.closing || g.ops >= groupOps || atomic.LoadInt32(&db.entering) == 0):
+		db.acidState = stGroupIdle
+		if g.err = db.filer.EndUpdate(); g.err != nil {
+			db.acidState = stEndUpdateFailed
+			db.lastCommitErr = g.err
+		}
+		db.group = nil
+		close(g.done)
+		updated = true
+	}
+	db.bkl.Unlock()
+
+	if !updated {
+		return *err
+	}
+
+	<-g.done
+	if *err == nil {
+		*err = g.err
+	}
+	return *err
+}
+
+// updated reports whether the operation in progress itself updated the DB,
+// the updates made by the other operations of its batch don't count. bkl
+// locked is assumed.
+func (db *DB) updated() bool {
+	a, ok := db.filer.(*lldb.ACIDFiler0)
+	return !ok || a.Updates() != db.updates
+}
+
 func (db *DB) timeout() {
 	db.bkl.Lock()
 	defer db.bkl.Unlock()
@@ -949,13 +1200,7 @@ func (db *DB) timeout() {
 	case stCollecting:
 		db.acidState = stCollectingTriggered
 	case stIdleArmed:
-		if err := db.filer.EndUpdate(); err != nil { // If EndUpdate fails, no WAL was written (automatic Rollback)
-			db.acidState = stEndUpdateFailed
-			db.lastCommitErr = err
-			return
-		}
-
-		db.acidState = stIdle
+		db.commit()
 	case stCollectingArmed:
 		db.acidState = stCollectingTriggered
 	case stCollectingTriggered:
@@ -963,6 +1208,108 @@ func (db *DB) timeout() {
 	}
 }
 
+// commit ends the grace period batch in state stIdleArmed. bkl locked is
+// assumed.
+func (db *DB) commit() (err error) {
+	db.acidState = stIdle
+	if err = db.filer.EndUpdate(); err != nil { // If EndUpdate fails, no WAL was written (automatic Rollback)
+		db.acidState = stEndUpdateFailed
+		db.lastCommitErr = err
+	}
+	db.fireCommit(err)
+	return
+}
+
+// fireCommit passes err to the OnCommit callbacks waiting for the grace period
+// batch, in another goroutine. bkl locked is assumed.
+func (db *DB) fireCommit(err error) {
+	fns := db.commitFns
+	db.commitFns = nil
+	if len(fns) == 0 {
+		return
+	}
+
+	go func() {
+		for _, fn := range fns {
+			fn(err)
+		}
+	}()
+}
+
+// durable reports whether the updates of db made so far are durable and if so,
+// the error to report. bkl locked is assumed.
+func (db *DB) durable() (ok bool, err error) {
+	switch db.acidState {
+	case stCollecting, stIdleArmed, stCollectingArmed, stCollectingTriggered:
+		return false, nil
+	case stEndUpdateFailed:
+		return true, fmt.Errorf("Last transaction commit failed: %v", db.lastCommitErr)
+	}
+
+	if _, ok := db.filer.(*lldb.ACIDFiler0); !ok {
+		err = db.filer.Sync()
+	}
+	return true, err
+}
+
+// OnCommit arranges for fn to be called once the updates of db made before
+// calling OnCommit are durable, passing it the error of the commit, if any.
+//
+// With Options.ACID == ACIDFull and a non zero GracePeriod, the updates are
+// durable when the grace period batch they belong to is committed to the WAL,
+// fn is then called from another goroutine. Otherwise every update is
+// committed before it returns, or, without a WAL, OnCommit syncs the DB file.
+// fn is then called before OnCommit returns.
+func (db *DB) OnCommit(fn func(err error)) {
+	db.bkl.Lock()
+	ok, err := db.durable()
+	if !ok {
+		db.commitFns = append(db.commitFns, fn)
+	}
+	db.bkl.Unlock()
+	if ok {
+		fn(err)
+	}
+}
+
+// WaitDurable waits until the updates of db made before calling WaitDurable
+// are durable, see OnCommit, and returns the error of their commit, if any.
+// If ctx is done first, WaitDurable returns ctx.Err(). WaitDurable doesn't end
+// the grace period early, see Commit.
+func (db *DB) WaitDurable(ctx context.Context) error {
+	c := make(chan error, 1)
+	db.OnCommit(func(err error) { c <- err })
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Commit is like WaitDurable without a deadline, but it commits the current
+// grace period batch immediately instead of waiting for its timer. If other
+// operations are in progress, the batch is committed when the last of them
+// ends.
+func (db *DB) Commit() (err error) {
+	db.bkl.Lock()
+	switch db.acidState {
+	case stIdleArmed:
+		if db.acidTimer.Stop() {
+			err = db.commit()
+			db.bkl.Unlock()
+			return
+		}
+	case stCollecting, stCollectingArmed:
+		if db.acidTimer.Stop() { // Otherwise timeout triggers the batch.
+			db.acidState = stCollectingTriggered
+		}
+	}
+
+	db.bkl.Unlock()
+	return db.WaitDurable(context.Background())
+}
+
 // Sync commits the current contents of the DB file to stable storage.
 // Typically, this means flushing the file system's in-memory copy of recently
 // written data to disk.
@@ -1145,6 +1492,63 @@ func (db *DB) PeakWALSize() int64 {
 	return af.PeakWALSize()
 }
 
+// Snapshot returns a read-only DB presenting a consistent point-in-time image
+// of all the Arrays and Files in db. Updates of db made after Snapshot
+// returns are not visible in the returned DB, while any attempt to update the
+// returned DB fails. The returned DB must be closed when no longer needed,
+// because the snapshot holds in memory the original content of every page of
+// db updated since.
+//
+// The image is the committed content of db. With Options.ACID == ACIDFull
+// and a non zero GracePeriod, or with Options.GroupCommit, the updates of the
+// batch not yet committed when Snapshot is invoked are thus not visible in
+// the returned DB, even when the batch is committed later. Invoke Commit
+// before Snapshot to include them.
+//
+// Snapshot requires db to be opened or created with Options.ACID set to
+// ACIDTransactions or ACIDFull, otherwise an error is returned.
+func (db *DB) Snapshot() (s *DB, err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	var rf *lldb.RollbackFiler
+	switch x := db.filer.(type) {
+	case *lldb.RollbackFiler:
+		rf = x
+	case *lldb.ACIDFiler0:
+		rf = x.RollbackFiler
+	default:
+		return nil, &lldb.ErrPERM{Src: "dbm.DB.Snapshot: DB not using transactions"}
+	}
+
+	sf, err := rf.Snapshot()
+	if err != nil {
+		return
+	}
+
+	s = &DB{
+		closed:    make(chan bool),
+		emptySize: db.emptySize,
+		filer:     sf,
+		isMem:     db.isMem,
+	}
+	if s.alloc, err = lldb.NewAllocator(lldb.NewInnerFiler(sf, 16), &lldb.Options{}); err != nil {
+		sf.Close()
+		return nil, err
+	}
+
+	s.alloc.Compress = compress
+	return
+}
+
 // IsMem reports whether db is backed by memory only.
 func (db *DB) IsMem() bool {
 	return db.isMem
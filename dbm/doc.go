@@ -58,13 +58,22 @@ Keys and values of an Array are multi-valued and every value must be a
      []byte (64kB max)
      string (64kb max)
 
+The size limits apply to keys. Values of Arrays longer than about 64kB are
+transparently stored in internal Files, referenced from the Array. Such
+values are reassembled by Get, Slice and Enumerator and their Files are
+removed when the value is overwritten or deleted or when the Array is
+removed.
+
 Collating
 
 Values in an Array are always ordered in the collating order of the respective
-keys. For details about the collating order please see lldb.Collate. There's a
-plan for a mechanism respecting user-supplied locale applied to string
-collating, but the required API differences call for a whole different package
-perhaps emerging in the future.
+keys. For details about the default collating order please see lldb.Collate.
+
+An Array can be created by db.CreateArray with a named collation, for example
+CollateNoCase, CollateLocale or CollateDescNum. Custom collations can be
+registered by RegisterCollation. The collation name is persisted with the
+Array, so reopening the DB restores the same ordering, provided any custom
+collation used is registered again.
 
 Multidimensional sparse arrays
 
@@ -288,6 +297,63 @@ for transaction collecting is:
 NOTE: The collecting "interval" can be modified by invoking db.BeginUpdate and
 db.EndUpdate.
 
+A successful DB operation within the grace period means only that its update
+was collected. db.WaitDurable waits until the updates made so far are
+committed, db.Commit commits them immediately, without waiting for the timer,
+and db.OnCommit registers a callback invoked once they are committed. All of
+them report a failed commit of the batch.
+
+Group commit
+
+For Options.ACID == ACIDFull, GracePeriod == 0 and Options.GroupCommit set,
+DB operations are collected into batches instead. The first operation of a
+batch begins its transaction, the last one ends it, ie. commits the batch. An
+operation is the last one of its batch if no other goroutine is waiting to
+enter the DB when it leaves, or if the batch has 64 operations. Operations of a
+batch, which updated the DB and are not the last one, wait for the commit. So
+writers arriving while a commit is in progress wait for it to finish and then
+form the next batch, committed by a single 2PC/WAL transaction. Every updating
+operation returns only after its batch is durable, read only operations return
+without waiting for the commit.
+
+Standby DBs
+
+An ACIDFull DB with Options.Ship set writes every committed transaction to
+an io.Writer, for example a net.Conn. A standby DB, opened by OpenStandby from
+a copy of the primary DB file, is kept up to date by db.Apply reading the
+shipped transactions. The writes don't block the DB operations. If a write of
+a shipped transaction fails, or too many of them are waiting to be written,
+the shipping stops and db.ShipError reports the error. The standby DB is read
+only, but it can be closed and opened by Open to replace a failed primary DB.
+
+Explicit transactions
+
+db.BeginUpdate, db.EndUpdate and db.Rollback are global to the DB, ie. a
+Rollback in one goroutine discards the updates made by all the other ones
+within the same nesting. Independent units of work should instead use a Tx
+obtained from db.Begin. Updates made through a Tx are collected in memory,
+visible only through that Tx and applied by tx.Commit within a single
+structural transaction. tx.Rollback affects only the updates of that Tx.
+
+Secondary indexes
+
+db.CreateIndex declares an index of an Array on an item of its values or on
+one of its subscripts. The index is kept up to date by every Set, Inc, Delete
+and Clear of the Array, within the same structural transaction as the update
+itself, so the index cannot get out of sync with its Array. db.Lookup returns
+the subscripts of the records having a particular value of the indexed item.
+Removing an Array removes its indexes as well.
+
+File format versions
+
+DBs are created with the file format version 0x01. Its Arrays are counted
+BTrees, the root directory keeps the collation names of Arrays and of their
+indexes, Array values may refer to spilled Files and BTree items may continue
+in overflow chains, none of which the earlier version 0x00 readers know. Open
+accepts version 0x00 files and marks them as version 0x01 before updating
+them. The change is one-way, earlier dbm versions then reject the file as of
+an unknown format version instead of reporting its content as corrupted.
+
 References
 
 Links fom the above godocs.
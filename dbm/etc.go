@@ -69,22 +69,26 @@ func collate(a, b []byte) (r int) {
 	return
 }
 
-type treeCache map[string]*lldb.BTree
+type treeCacheItem struct {
+	tree *lldb.BTree
+	coll *collation
+}
+
+type treeCache map[string]treeCacheItem
 
-func (t *treeCache) get() (r map[string]*lldb.BTree) {
+func (t *treeCache) get() (r map[string]treeCacheItem) {
 	if r = *t; r != nil {
 		return
 	}
 
-	*t = map[string]*lldb.BTree{}
+	*t = map[string]treeCacheItem{}
 	return *t
 }
 
-func (t *treeCache) getTree(db *DB, prefix int, name string, canCreate bool, cacheSize int) (r *lldb.BTree, err error) {
+func (t *treeCache) getTree(db *DB, prefix int, name string, canCreate bool, cacheSize int) (r *lldb.BTree, c *collation, err error) {
 	m := t.get()
-	r, ok := m[name]
-	if ok {
-		return
+	if it, ok := m[name]; ok {
+		return it.tree, it.coll, nil
 	}
 
 	root, err := db.root()
@@ -97,27 +101,51 @@ func (t *treeCache) getTree(db *DB, prefix int, name string, canCreate bool, cac
 		return
 	}
 
+	c = defaultCollation
 	switch x := val.(type) {
 	case nil:
 		if !canCreate {
-			return
+			return nil, nil, nil
 		}
 
 		var h int64
-		r, h, err = lldb.CreateBTree(db.alloc, collate)
+		switch prefix {
+		case arraysPrefix:
+			r, h, err = lldb.CreateCountedBTree(db.alloc, collate)
+		default:
+			r, h, err = lldb.CreateBTree(db.alloc, collate)
+		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		if err = root.set(h, prefix, name); err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	case int64:
 		if r, err = lldb.OpenBTree(db.alloc, collate, x); err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+	case []interface{}:
+		if len(x) != 2 {
+			return nil, nil, &lldb.ErrINVAL{Src: "corrupted root directory value for", Val: fmt.Sprintf("%q, %q", prefix, name)}
+		}
+
+		h, ok := x[0].(int64)
+		cname, ok2 := x[1].(string)
+		if !ok || !ok2 {
+			return nil, nil, &lldb.ErrINVAL{Src: "corrupted root directory value for", Val: fmt.Sprintf("%q, %q", prefix, name)}
+		}
+
+		if c, err = getCollation(cname); err != nil {
+			return nil, nil, err
+		}
+
+		if r, err = lldb.OpenBTree(db.alloc, c.bytes, h); err != nil {
+			return nil, nil, err
 		}
 	default:
-		return nil, &lldb.ErrINVAL{Src: "corrupted root directory value for", Val: fmt.Sprintf("%q, %q", prefix, name)}
+		return nil, nil, &lldb.ErrINVAL{Src: "corrupted root directory value for", Val: fmt.Sprintf("%q, %q", prefix, name)}
 	}
 
 	if len(m) > cacheSize {
@@ -135,7 +163,7 @@ func (t *treeCache) getTree(db *DB, prefix int, name string, canCreate bool, cac
 		}
 	}
 
-	m[name] = r
+	m[name] = treeCacheItem{r, c}
 	return
 }
 
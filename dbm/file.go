@@ -8,6 +8,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
+	"path"
+	"time"
 
 	"github.com/cznic/exp/lldb"
 	"github.com/cznic/fileutil"
@@ -100,7 +103,13 @@ BenchmarkBitsOn65536	     500	   8043347 ns/op	1018.48 kB/s
 */
 
 const (
-	fSize = "size"
+	fCtime = "ctime"
+	fMode  = "mode"
+	fMtime = "mtime"
+	fSize  = "size"
+	fXattr = "xattr"
+
+	defaultFileMode = 0644
 
 	pgBits = 16
 	pgSize = 1 << pgBits
@@ -111,10 +120,9 @@ var (
 	bfSize = []byte(fSize)
 )
 
-// File is a database blob with a file-like API. Values in Arrays are limited
-// in size to about 64kB. To put a larger value into an Array, the value can be
-// written to a File and the path stored in the Array instead of the too big
-// value.
+// File is a database blob with a file-like API. Values in Arrays longer than
+// about 64kB are stored in internal Files automatically. Writing a big value to
+// a File directly avoids holding the whole value in memory.
 type File Array
 
 // As os.File.Name().
@@ -159,6 +167,255 @@ func (f *File) size() (sz int64, err error) {
 	return 0, &lldb.ErrINVAL{Src: "dbm.File.Size", Val: v}
 }
 
+// ModTime returns the time of the last modification of f by WriteAt,
+// Truncate or ReadFrom. The zero time is returned for Files never modified
+// that way.
+func (f *File) ModTime() (t time.Time, err error) {
+	if err = f.db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		f.db.leave(&err)
+	}()
+
+	if ok, err := (*Array)(f).validate(false); !ok {
+		return t, err
+	}
+
+	return f.time(fMtime)
+}
+
+func (f *File) time(key string) (t time.Time, err error) {
+	v, err := (*Array)(f).get(key)
+	if err != nil {
+		return
+	}
+
+	switch x := v.(type) {
+	case int64:
+		return time.Unix(0, x), nil
+	case nil:
+		return
+	}
+
+	return t, &lldb.ErrINVAL{Src: "dbm.File." + key, Val: v}
+}
+
+func (f *File) mode() (m os.FileMode, err error) {
+	v, err := (*Array)(f).get(fMode)
+	if err != nil {
+		return
+	}
+
+	switch x := v.(type) {
+	case int64:
+		return os.FileMode(x), nil
+	case nil:
+		return defaultFileMode, nil
+	}
+
+	return 0, &lldb.ErrINVAL{Src: "dbm.File.Mode", Val: v}
+}
+
+// touch records the current time as the modification time of f and, if not
+// yet recorded, as its creation time. Only Files of the DB namespace are
+// touched.
+func (f *File) touch() (err error) {
+	if f.namespace != filesPrefix {
+		return
+	}
+
+	if err = f.db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		f.db.leave(&err)
+	}()
+
+	a := (*Array)(f)
+	if ok, err := a.validate(true); !ok {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	v, err := a.get(fCtime)
+	if err != nil {
+		return
+	}
+
+	if v == nil {
+		if err = a.set(now, fCtime); err != nil {
+			return
+		}
+	}
+
+	return a.set(now, fMtime)
+}
+
+// SetMode sets the permission bits of f to mode.Perm(). Files have mode 0644
+// until set otherwise. The mode is only recorded, dbm does not enforce it.
+func (f *File) SetMode(mode os.FileMode) (err error) {
+	return (*Array)(f).Set(int64(mode.Perm()), fMode)
+}
+
+// Attr returns the value of the attribute name of f or nil if no such
+// attribute exists.
+func (f *File) Attr(name string) (value []byte, err error) {
+	v, err := (*Array)(f).Get(fXattr, name)
+	if err != nil {
+		return
+	}
+
+	switch x := v.(type) {
+	case []byte:
+		return x, nil
+	case nil:
+		return
+	}
+
+	return nil, &lldb.ErrINVAL{Src: "dbm.File.Attr", Val: v}
+}
+
+// SetAttr sets the attribute name of f to value. A nil value removes the
+// attribute. Attributes are arbitrary user data, for example a content type.
+// Setting attributes doesn't change the modification time of f.
+func (f *File) SetAttr(name string, value []byte) (err error) {
+	a := (*Array)(f)
+	if value == nil {
+		return a.Delete(fXattr, name)
+	}
+
+	return a.Set(value, fXattr, name)
+}
+
+// Stat returns a FileInfo describing f. The FileInfo of a File which doesn't
+// exist reports zero size and times.
+func (f *File) Stat() (fi *FileInfo, err error) {
+	if err = f.db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		f.db.leave(&err)
+	}()
+
+	fi = &FileInfo{name: path.Base(f.name), mode: defaultFileMode, file: f}
+	a := (*Array)(f)
+	if ok, err := a.validate(false); !ok {
+		return fi, err
+	}
+
+	if fi.size, err = f.size(); err != nil {
+		return
+	}
+
+	if fi.ctime, err = f.time(fCtime); err != nil {
+		return
+	}
+
+	if fi.mtime, err = f.time(fMtime); err != nil {
+		return
+	}
+
+	if fi.mode, err = f.mode(); err != nil {
+		return
+	}
+
+	prefix, err := lldb.EncodeScalars(fXattr)
+	if err != nil {
+		return
+	}
+
+	en, _, err := a.tree.Seek(prefix)
+	if err != nil {
+		return fi, noEof(err)
+	}
+
+	for {
+		bk, bv, err := en.Next()
+		if err != nil {
+			return fi, noEof(err)
+		}
+
+		k, err := lldb.DecodeScalars(bk)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(k) != 2 || k[0] != fXattr {
+			return fi, nil
+		}
+
+		v, err := lldb.DecodeScalars(bv)
+		if err != nil {
+			return nil, err
+		}
+
+		name, _ := k[1].(string)
+		b, _ := v[0].([]byte)
+		if fi.attrs == nil {
+			fi.attrs = map[string][]byte{}
+		}
+		fi.attrs[name] = b
+	}
+}
+
+// FileInfo describes a File or a directory of a FS. FileInfo implements
+// os.FileInfo.
+type FileInfo struct {
+	attrs map[string][]byte
+	ctime time.Time
+	file  *File
+	mode  os.FileMode
+	mtime time.Time
+	name  string
+	size  int64
+}
+
+// Name implements os.FileInfo. It returns the base name of the File.
+func (fi *FileInfo) Name() string { return fi.name }
+
+// Size implements os.FileInfo.
+func (fi *FileInfo) Size() int64 { return fi.size }
+
+// Mode implements os.FileInfo.
+func (fi *FileInfo) Mode() os.FileMode { return fi.mode }
+
+// ModTime implements os.FileInfo.
+func (fi *FileInfo) ModTime() time.Time { return fi.mtime }
+
+// CreateTime returns the time when the File was first modified by WriteAt,
+// Truncate or ReadFrom.
+func (fi *FileInfo) CreateTime() time.Time { return fi.ctime }
+
+// IsDir implements os.FileInfo.
+func (fi *FileInfo) IsDir() bool { return fi.mode.IsDir() }
+
+// Sys implements os.FileInfo. It returns the *File of a regular file and nil
+// for a directory.
+func (fi *FileInfo) Sys() interface{} {
+	if fi.file == nil {
+		return nil
+	}
+
+	return fi.file
+}
+
+// Attrs returns the attributes of the File. The map is shared with fi and
+// must not be modified.
+func (fi *FileInfo) Attrs() map[string][]byte { return fi.attrs }
+
 // PunchHole deallocates space inside a "file" in the byte range starting at
 // off and continuing for size bytes.  The Filer size (as reported by `Size()`
 // does not change when hole punching, even when puching the end of a file off.
@@ -243,7 +500,11 @@ func (f *File) readAt(b []byte, off int64, bits bool) (n int, err error) {
 
 // As os.File.WriteAt().
 func (f *File) WriteAt(b []byte, off int64) (n int, err error) {
-	return f.writeAt(b, off, false)
+	if n, err = f.writeAt(b, off, false); err != nil {
+		return
+	}
+
+	return n, f.touch()
 }
 
 func (f *File) writeAt(b []byte, off int64, bits bool) (n int, err error) {
@@ -293,7 +554,9 @@ func (f *File) writeAt(b []byte, off int64, bits bool) (n int, err error) {
 	}
 	if !bits {
 		if newSize := mathutil.MaxInt64(fsize, off+int64(n)); newSize != fsize {
-			return n, a.Set(newSize, fSize)
+			if err = a.Set(newSize, fSize); err != nil {
+				return
+			}
 		}
 	}
 
@@ -302,6 +565,17 @@ func (f *File) writeAt(b []byte, off int64, bits bool) (n int, err error) {
 
 // As os.File.Truncate().
 func (f *File) Truncate(size int64) (err error) {
+	ok, err := f.truncate(size)
+	if !ok || err != nil {
+		return
+	}
+
+	return f.touch()
+}
+
+// truncate implements Truncate without touching f. ok is false if f doesn't
+// exist and size is zero, then truncate is a nop.
+func (f *File) truncate(size int64) (ok bool, err error) {
 	if err = f.db.enter(); err != nil {
 		return
 	}
@@ -319,17 +593,17 @@ func (f *File) Truncate(size int64) (err error) {
 			return
 		}
 
-		return &lldb.ErrINVAL{Src: "dbm.File.Truncate size", Val: size}
+		return false, &lldb.ErrINVAL{Src: "dbm.File.Truncate size", Val: size}
 	case size == 0:
-		if f.db.leave(&err); err != nil {
+		// Keep the metadata, but do not create f if it doesn't exist.
+		ok, e := a.validate(false)
+		if f.db.leave(&e); e != nil || !ok {
+			return false, e
+		}
+	default:
+		if f.db.leave(&err) != nil {
 			return
 		}
-
-		return a.Clear()
-	}
-
-	if f.db.leave(&err) != nil {
-		return
 	}
 
 	first := size >> pgBits
@@ -352,13 +626,15 @@ func (f *File) Truncate(size int64) (err error) {
 		}
 	}
 
-	return a.Set(size, fSize)
+	return true, a.Set(size, fSize)
 }
 
 // ReadFrom is a helper to populate File's content from r.  'n' reports the
-// number of bytes read from 'r'.
+// number of bytes read from 'r'. The modification time of f is updated once,
+// when r is exhausted.
 func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
-	if err = f.Truncate(0); err != nil {
+	ok, err := f.truncate(0)
+	if err != nil {
 		return
 	}
 
@@ -371,7 +647,7 @@ func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
 	var rerr error
 	for rerr == nil {
 		if rn, rerr = r.Read(b[:]); rn != 0 {
-			f.WriteAt(b[:rn], off)
+			f.writeAt(b[:rn], off, false)
 			off += int64(rn)
 			n += int64(rn)
 		}
@@ -379,6 +655,11 @@ func (f *File) ReadFrom(r io.Reader) (n int64, err error) {
 	if !fileutil.IsEOF(rerr) {
 		err = rerr
 	}
+	if ok || n != 0 {
+		if e := f.touch(); err == nil {
+			err = e
+		}
+	}
 	return
 }
 
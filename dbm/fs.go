@@ -0,0 +1,371 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// io/fs VFS support
+
+package dbm
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cznic/exp/lldb"
+)
+
+var (
+	_ fs.FS          = &FS{}     // Ensure FS is a fs.FS.
+	_ fs.ReadDirFS   = &FS{}     // Ensure FS is a fs.ReadDirFS.
+	_ fs.StatFS      = &FS{}     // Ensure FS is a fs.StatFS.
+	_ fs.ReadDirFile = &fsFile{} // Ensure fsFile is a fs.ReadDirFile.
+	_ io.Seeker      = &fsFile{} // Ensure fsFile is an io.Seeker.
+	_ io.ReaderAt    = &fsFile{} // Ensure fsFile is an io.ReaderAt.
+)
+
+// FS is a read only view of the DB Files namespace, restricted to a specific
+// directory tree. FS implements fs.FS, fs.ReadDirFS and fs.StatFS.
+//
+// Rooted file names, ie. names beginning with '/', form a directory tree: A
+// directory exists iff there is at least one File with a name having the
+// directory path as its prefix. File "/a/b/c" thus implies directories "/",
+// "/a" and "/a/b". Directories have no modification time. A File shadows any
+// directory having the same name. Files with names not beginning with '/' are
+// not visible through a FS.
+//
+// Files opened by FS implement io.Seeker and io.ReaderAt, directories
+// implement fs.ReadDirFile.
+type FS struct {
+	db   *DB
+	root string
+}
+
+// FS returns a FS using the DB file system restricted to the directory tree
+// at root.
+//
+// 'root' must be an absolute path beginning with '/'.
+func (db *DB) FS(root string) (fsys *FS, err error) {
+	dir := path.Clean(root)
+	if dir == "." || dir[0] != '/' {
+		return nil, &lldb.ErrINVAL{Src: "dbm.DB.FS: invalid root", Val: root}
+	}
+
+	return &FS{db, dir}, nil
+}
+
+// dbName returns the DB name of the fs.FS name.
+func (fsys *FS) dbName(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	return path.Join(fsys.root, name), nil
+}
+
+// isDir reports whether the DB name is a directory.
+func (fsys *FS) isDir(name string) (r bool, err error) {
+	if name == "/" {
+		return true, nil
+	}
+
+	ff, err := fsys.db.Files()
+	if err != nil {
+		return
+	}
+
+	pfx := name + "/"
+	s, err := ff.Slice([]interface{}{pfx}, nil)
+	if err != nil {
+		return
+	}
+
+	err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+		k, _ := subscripts[0].(string)
+		r = strings.HasPrefix(k, pfx)
+		return false, nil
+	})
+	return
+}
+
+// stat returns the fs.FileInfo of the DB name or nil if no such File or
+// directory exists.
+func (fsys *FS) stat(name string) (fi *FileInfo, err error) {
+	ff, err := fsys.db.Files()
+	if err != nil {
+		return
+	}
+
+	v, err := ff.Get(name)
+	if err != nil {
+		return
+	}
+
+	if v != nil {
+		f, err := fsys.db.File(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return f.Stat()
+	}
+
+	ok, err := fsys.isDir(name)
+	if !ok || err != nil {
+		return
+	}
+
+	return &FileInfo{name: path.Base(name), mode: fs.ModeDir | 0555}, nil
+}
+
+// Open implements fs.FS.
+func (fsys *FS) Open(name string) (f fs.File, err error) {
+	dbName, err := fsys.dbName("open", name)
+	if err != nil {
+		return
+	}
+
+	fi, err := fsys.stat(dbName)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	if fi == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	r := &fsFile{fsys: fsys, dbName: dbName, fi: fi}
+	if !fi.IsDir() {
+		file, err := fsys.db.File(dbName)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		r.h = file.Open()
+	}
+	return r, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (fsys *FS) ReadDir(name string) (r []fs.DirEntry, err error) {
+	dbName, err := fsys.dbName("readdir", name)
+	if err != nil {
+		return
+	}
+
+	fi, err := fsys.stat(dbName)
+	switch {
+	case err != nil:
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	case fi == nil:
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	case !fi.IsDir():
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if r, err = fsys.readDir(dbName); err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	return
+}
+
+// readDir returns the entries of the directory at the DB name sorted by file
+// name.
+func (fsys *FS) readDir(name string) (r []fs.DirEntry, err error) {
+	pfx := name + "/"
+	if name == "/" {
+		pfx = name
+	}
+
+	ff, err := fsys.db.Files()
+	if err != nil {
+		return
+	}
+
+	s, err := ff.Slice([]interface{}{pfx}, nil)
+	if err != nil {
+		return
+	}
+
+	files := map[string]bool{}
+	dirs := map[string]bool{}
+	if err = s.Do(func(subscripts, value []interface{}) (bool, error) {
+		k, _ := subscripts[0].(string)
+		if !strings.HasPrefix(k, pfx) {
+			return false, nil
+		}
+
+		rest := k[len(pfx):]
+		switch i := strings.IndexByte(rest, '/'); {
+		case i < 0:
+			files[rest] = true
+		case i > 0:
+			dirs[rest[:i]] = true
+		}
+		return true, nil
+	}); err != nil {
+		return
+	}
+
+	for nm := range dirs {
+		if !files[nm] {
+			r = append(r, fs.FileInfoToDirEntry(&FileInfo{name: nm, mode: fs.ModeDir | 0555}))
+		}
+	}
+	for nm := range files {
+		if nm == "" {
+			continue
+		}
+
+		f, err := fsys.db.File(pfx + nm)
+		if err != nil {
+			return nil, err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		r = append(r, fs.FileInfoToDirEntry(fi))
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name() < r[j].Name() })
+	return
+}
+
+// Stat implements fs.StatFS.
+func (fsys *FS) Stat(name string) (fi fs.FileInfo, err error) {
+	dbName, err := fsys.dbName("stat", name)
+	if err != nil {
+		return
+	}
+
+	r, err := fsys.stat(dbName)
+	switch {
+	case err != nil:
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	case r == nil:
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return r, nil
+}
+
+type fsFile struct {
+	closed  bool
+	dbName  string
+	entries []fs.DirEntry // Not yet returned by ReadDir.
+	fi      *FileInfo
+	fsys    *FS
+	h       *FileHandle // Nil for directories.
+	listed  bool
+}
+
+func (f *fsFile) check(op string) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.dbName, Err: fs.ErrClosed}
+	}
+
+	if f.fi.IsDir() && op != "readdir" && op != "close" && op != "stat" {
+		return &fs.PathError{Op: op, Path: f.dbName, Err: fs.ErrInvalid}
+	}
+
+	return nil
+}
+
+// Close implements fs.File.
+func (f *fsFile) Close() error {
+	if err := f.check("close"); err != nil {
+		return err
+	}
+
+	f.closed = true
+	if f.h != nil {
+		return f.h.Close()
+	}
+
+	return nil
+}
+
+// Stat implements fs.File.
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+
+	if f.fi.IsDir() {
+		return f.fi, nil
+	}
+
+	fi, err := f.h.File().Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+// Read implements fs.File.
+func (f *fsFile) Read(b []byte) (n int, err error) {
+	if err = f.check("read"); err != nil {
+		return
+	}
+
+	return f.h.Read(b)
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *fsFile) ReadAt(b []byte, off int64) (n int, err error) {
+	if err = f.check("read"); err != nil {
+		return
+	}
+
+	return f.h.ReadAt(b, off)
+}
+
+// Seek implements io.Seeker.
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+
+	return f.h.Seek(offset, whence)
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *fsFile) ReadDir(count int) (r []fs.DirEntry, err error) {
+	if err = f.check("readdir"); err != nil {
+		return
+	}
+
+	if !f.fi.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.dbName, Err: fs.ErrInvalid}
+	}
+
+	if !f.listed {
+		if f.entries, err = f.fsys.readDir(f.dbName); err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.dbName, Err: err}
+		}
+
+		f.listed = true
+	}
+
+	n := len(f.entries)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+
+		if count < n {
+			n = count
+		}
+	}
+	r = f.entries[:n:n]
+	f.entries = f.entries[n:]
+	if r == nil {
+		r = []fs.DirEntry{}
+	}
+	return
+}
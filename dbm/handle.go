@@ -0,0 +1,211 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Streaming File access.
+
+package dbm
+
+import (
+	"io"
+
+	"github.com/cznic/exp/lldb"
+)
+
+var (
+	_ io.ReadWriteSeeker = &FileHandle{} // Ensure FileHandle is an io.ReadWriteSeeker.
+	_ io.ReaderAt        = &FileHandle{} // Ensure FileHandle is an io.ReaderAt.
+	_ io.Closer          = &FileHandle{} // Ensure FileHandle is an io.Closer.
+)
+
+// FileHandle is an open File with a file pointer. It implements io.Reader,
+// io.Writer, io.Seeker, io.ReaderAt and io.Closer.
+//
+// Sequential writes are buffered and written to the File in chunks ending at
+// page boundaries, ie. in full page updates, except for the first and last
+// chunk of a run. The buffer is flushed by Flush, Close, by any read, by a
+// Seek relative to the end of the File and by a Write not continuing the
+// buffered run. Data buffered, but not yet flushed, are not visible through
+// other handles or through the File itself. The modification time of the File
+// is updated once per run, when the run is flushed.
+//
+// A FileHandle is not safe for concurrent use by multiple goroutines.
+type FileHandle struct {
+	buf    []byte // Buffered writes.
+	closed bool
+	dirty  bool // The run was written without touching the File.
+	f      File
+	fp     int64 // File pointer.
+	off    int64 // Offset of buf.
+}
+
+// Open returns a new FileHandle of f with the file pointer set to zero.
+func (f *File) Open() *FileHandle {
+	return &FileHandle{f: *f}
+}
+
+func (h *FileHandle) check(op string) error {
+	if h.closed {
+		return &lldb.ErrPERM{Src: "dbm.FileHandle." + op + ": handle closed"}
+	}
+
+	return nil
+}
+
+// File returns the File of h.
+func (h *FileHandle) File() *File {
+	return &h.f
+}
+
+// Flush writes any buffered data to the File.
+func (h *FileHandle) Flush() (err error) {
+	if err = h.check("Flush"); err != nil {
+		return
+	}
+
+	return h.flush()
+}
+
+// flush ends the buffered run.
+func (h *FileHandle) flush() (err error) {
+	if err = h.write(); err != nil || !h.dirty {
+		return
+	}
+
+	h.dirty = false
+	return h.f.touch()
+}
+
+// write writes the buffered chunk of the run.
+func (h *FileHandle) write() (err error) {
+	if len(h.buf) == 0 {
+		return
+	}
+
+	_, err = h.f.writeAt(h.buf, h.off, false)
+	h.buf = h.buf[:0]
+	h.dirty = true
+	return
+}
+
+// Close implements io.Closer. Close flushes any buffered data.
+func (h *FileHandle) Close() (err error) {
+	if err = h.check("Close"); err != nil {
+		return
+	}
+
+	h.closed = true
+	err = h.flush()
+	h.buf = nil
+	return
+}
+
+// Read implements io.Reader.
+func (h *FileHandle) Read(b []byte) (n int, err error) {
+	if err = h.check("Read"); err != nil {
+		return
+	}
+
+	if err = h.flush(); err != nil {
+		return
+	}
+
+	n, err = h.f.ReadAt(b, h.fp)
+	h.fp += int64(n)
+	if n != 0 && err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// ReadAt implements io.ReaderAt. ReadAt doesn't use or change the file
+// pointer.
+func (h *FileHandle) ReadAt(b []byte, off int64) (n int, err error) {
+	if err = h.check("ReadAt"); err != nil {
+		return
+	}
+
+	if off < 0 {
+		return 0, &lldb.ErrINVAL{Src: "dbm.FileHandle.ReadAt off", Val: off}
+	}
+
+	if err = h.flush(); err != nil {
+		return
+	}
+
+	return h.f.ReadAt(b, off)
+}
+
+// Seek implements io.Seeker.
+func (h *FileHandle) Seek(offset int64, whence int) (int64, error) {
+	if err := h.check("Seek"); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekStart:
+		// nop
+	case io.SeekCurrent:
+		offset += h.fp
+	case io.SeekEnd:
+		if err := h.flush(); err != nil {
+			return 0, err
+		}
+
+		sz, err := h.f.Size()
+		if err != nil {
+			return 0, err
+		}
+
+		offset += sz
+	default:
+		return 0, &lldb.ErrINVAL{Src: "dbm.FileHandle.Seek whence", Val: whence}
+	}
+
+	if offset < 0 {
+		return 0, &lldb.ErrINVAL{Src: "dbm.FileHandle.Seek offset", Val: offset}
+	}
+
+	h.fp = offset
+	return offset, nil
+}
+
+// Write implements io.Writer.
+func (h *FileHandle) Write(b []byte) (n int, err error) {
+	if err = h.check("Write"); err != nil {
+		return
+	}
+
+	if len(h.buf) != 0 && h.fp != h.off+int64(len(h.buf)) {
+		if err = h.flush(); err != nil {
+			return
+		}
+	}
+
+	if len(h.buf) == 0 {
+		h.off = h.fp
+		if h.buf == nil {
+			h.buf = make([]byte, 0, pgSize)
+		}
+	}
+
+	for len(b) != 0 {
+		end := h.off + int64(len(h.buf))
+		nc := pgSize - int(end&pgMask)
+		if nc > len(b) {
+			nc = len(b)
+		}
+		h.buf = append(h.buf, b[:nc]...)
+		b = b[nc:]
+		n += nc
+		h.fp += int64(nc)
+		if (end+int64(nc))&pgMask == 0 {
+			if err = h.write(); err != nil {
+				return
+			}
+
+			h.off = h.fp
+		}
+	}
+	return
+}
@@ -12,11 +12,12 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"time"
+	"strings"
 )
 
 // HttpDir returns an object implementing http.FileSystem using the DB file
-// system restricted to a specific directory tree.
+// system restricted to a specific directory tree. See FS for how the DB file
+// names form the directory tree.
 //
 // 'root' must be an absolute path beginning with '/'.
 func (db *DB) HttpDir(root string) http.FileSystem {
@@ -28,13 +29,12 @@ func (db *DB) HttpDir(root string) http.FileSystem {
 		return &httpFileSystem{err: fmt.Errorf("HttpDir: invalid root %q", dir)}
 	}
 
-	return &httpFileSystem{db: db, root: dir}
+	return &httpFileSystem{fs: &FS{db, dir}}
 }
 
 type httpFileSystem struct {
-	db   *DB
-	err  error
-	root string
+	err error
+	fs  *FS
 }
 
 // Implements http.FileSystem
@@ -43,79 +43,33 @@ func (fs *httpFileSystem) Open(name string) (r http.File, err error) {
 		return
 	}
 
-	var f File
-	if f, err = fs.db.File(filepath.Join(fs.root, path.Clean("/"+name))); err != nil {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		name = "."
+	}
+
+	f, err := fs.fs.Open(name)
+	if err != nil {
 		return
 	}
 
-	return &httpFile{f: f}, nil
+	return &httpFile{f.(*fsFile)}, nil
 }
 
 type httpFile struct {
-	closed bool
-	f      File
-	fp     int64
-}
-
-// Implements http.File
-func (f *httpFile) Close() error {
-	f.closed = true
-	return nil
-}
-
-// Implements http.File
-func (f *httpFile) Stat() (os.FileInfo, error) {
-	return f, nil
-}
-
-// Implements http.File
-func (f *httpFile) Readdir(count int) ([]os.FileInfo, error) {
-	panic("TODO")
-}
-
-// Implements http.File
-func (f *httpFile) Read(b []byte) (n int, err error) {
-	n, err = f.f.ReadAt(b, f.fp)
-	f.fp += int64(n)
-	return
+	*fsFile
 }
 
 // Implements http.File
-func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
-	panic("TODO")
-}
-
-// Implements os.FileInfo
-func (f *httpFile) Name() string {
-	return f.f.Name()
-}
-
-// Implements os.FileInfo
-func (f *httpFile) Size() int64 {
-	sz, err := f.f.Size()
-	if err != nil {
-		return 0
+func (f *httpFile) Readdir(count int) (r []os.FileInfo, err error) {
+	entries, err := f.ReadDir(count)
+	for _, v := range entries {
+		fi, err := v.Info()
+		if err != nil {
+			return r, err
+		}
+
+		r = append(r, fi)
 	}
-
-	return sz
-}
-
-// Implements os.FileInfo
-func (f *httpFile) Mode() os.FileMode {
-	panic("TODO")
-}
-
-// Implements os.FileInfo
-func (f *httpFile) ModTime() time.Time {
-	return time.Now()
-}
-
-// Implements os.FileInfo
-func (f *httpFile) IsDir() bool {
-	return false
-}
-
-// Implements os.FileInfo
-func (f *httpFile) Sys() interface{} {
-	panic("TODO")
+	return
 }
@@ -0,0 +1,454 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Secondary indexes of Arrays.
+
+package dbm
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/cznic/exp/lldb"
+)
+
+// Index kinds.
+const (
+	// Index item N of the values. A scalar value is item 0.
+	IndexValue = iota
+
+	// Index subscript N.
+	IndexSubscript
+)
+
+const xname = "indexes" // Index definitions
+
+type indexDef struct {
+	name string
+	kind int
+	n    int
+	xa   string // Name of the system array holding the index.
+}
+
+func indexArrayName(array, index string) string {
+	return "index\x00" + array + "\x00" + index
+}
+
+// key returns the key of the index entry for a record with subscripts and
+// value items va or nil if the record is not indexed. ok is false for a non
+// existing record.
+func (x *indexDef) key(subscripts, va []interface{}, ok bool) (k []interface{}) {
+	if !ok {
+		return
+	}
+
+	var v interface{}
+	switch x.kind {
+	case IndexValue:
+		if x.n >= len(va) {
+			return
+		}
+
+		v = va[x.n]
+	case IndexSubscript:
+		if x.n >= len(subscripts) {
+			return
+		}
+
+		v = subscripts[x.n]
+	default:
+		panic("internal error")
+	}
+
+	return append([]interface{}{v}, subscripts...)
+}
+
+// items decodes the Array value b. ok is false if b is nil, ie. for a non
+// existing record. db.bkl locked is assumed.
+func (db *DB) items(b []byte) (va []interface{}, ok bool, err error) {
+	if b == nil {
+		return
+	}
+
+	va, err = db.decodeValue(b)
+	return va, err == nil, err
+}
+
+// indexesOf returns the index definitions of array. db.bkl locked is assumed.
+func (db *DB) indexesOf(array string) (r []indexDef, err error) {
+	if r, ok := db.indexes[array]; ok {
+		return r, nil
+	}
+
+	defs, err := db.sysArray(false, xname)
+	if defs.tree == nil || err != nil {
+		return
+	}
+
+	prefix, err := lldb.EncodeScalars(array)
+	if err != nil {
+		return
+	}
+
+	en, _, err := defs.tree.Seek(prefix)
+	if err != nil {
+		return nil, noEof(err)
+	}
+
+	for {
+		bk, bv, err := en.Next()
+		if err != nil {
+			if err = noEof(err); err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
+		k, err := lldb.DecodeScalars(bk)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(k) != 2 || k[0] != array {
+			break
+		}
+
+		v, err := lldb.DecodeScalars(bv)
+		if err != nil {
+			return nil, err
+		}
+
+		name, ok := k[1].(string)
+		kind, ok2 := v[0].(int64)
+		n, ok3 := v[len(v)-1].(int64)
+		if len(v) != 2 || !ok || !ok2 || !ok3 {
+			return nil, &lldb.ErrINVAL{Src: "dbm: corrupted index definition", Val: fmt.Sprintf("%v: %v", k, v)}
+		}
+
+		r = append(r, indexDef{name, int(kind), int(n), indexArrayName(array, name)})
+	}
+
+	if db.indexes == nil {
+		db.indexes = map[string][]indexDef{}
+	}
+	db.indexes[array] = r
+	return
+}
+
+// updateIndexes updates the indexes of a for the record at key, which
+// changes its raw value from old to new. A nil value means a non existing
+// record. db.bkl locked is assumed.
+func (a *Array) updateIndexes(key, old, new []byte) (err error) {
+	xx, err := a.db.indexesOf(a.name)
+	if len(xx) == 0 || err != nil {
+		return
+	}
+
+	subscripts, err := lldb.DecodeScalars(append(append([]byte(nil), a.prefix...), key...))
+	if err != nil {
+		return
+	}
+
+	ov, oexists, err := a.db.items(old)
+	if err != nil {
+		return
+	}
+
+	nv, nexists, err := a.db.items(new)
+	if err != nil {
+		return
+	}
+
+	for i := range xx {
+		x := &xx[i]
+		ok := x.key(subscripts, ov, oexists)
+		nk := x.key(subscripts, nv, nexists)
+		if ok != nil && nk != nil {
+			bok, err := lldb.EncodeScalars(ok...)
+			if err != nil {
+				return err
+			}
+
+			bnk, err := lldb.EncodeScalars(nk...)
+			if err != nil {
+				return err
+			}
+
+			if bytes.Equal(bok, bnk) {
+				continue
+			}
+		}
+
+		xa, err := a.indexArray(x)
+		if err != nil {
+			return err
+		}
+
+		if ok != nil {
+			if err = xa.delete(ok...); err != nil {
+				return err
+			}
+		}
+
+		if nk != nil {
+			if err = xa.set(nil, nk...); err != nil {
+				return err
+			}
+		}
+	}
+	return
+}
+
+// indexArray returns the system array holding the index x of a, creating it if
+// it doesn't exist. The subscripts of the index entries collate like the
+// subscripts of a. db.bkl locked is assumed.
+func (a *Array) indexArray(x *indexDef) (xa Array, err error) {
+	db := a.db
+	c := a.coll
+	if c == nil || c == defaultCollation {
+		return db.sysArray(true, x.xa)
+	}
+
+	if xa, err = db.sysArray(false, x.xa); xa.tree != nil || err != nil {
+		return
+	}
+
+	root, err := db.root()
+	if err != nil {
+		return
+	}
+
+	c = indexCollation(c)
+	_, h, err := lldb.CreateBTree(db.alloc, c.bytes)
+	if err != nil {
+		return
+	}
+
+	if err = root.set([]interface{}{h, c.name}, systemPrefix, x.xa); err != nil {
+		return
+	}
+
+	delete(db.scache, x.xa)
+	return db.sysArray(false, x.xa)
+}
+
+// hasIndexes reports whether a maintains any indexes. db.bkl locked is
+// assumed.
+func (a *Array) hasIndexes() (bool, error) {
+	if a.namespace != arraysPrefix || a.tree == nil {
+		return false, nil
+	}
+
+	xx, err := a.db.indexesOf(a.name)
+	return len(xx) != 0, err
+}
+
+// CreateIndex declares an index named index on array. The index is built
+// from the existing content of array and from then on it's updated by every
+// Set, Inc, Delete and Clear of array within the same structural transaction.
+//
+// For kind IndexValue, the index maps item n of the values to the subscripts
+// of the records having that value. Records with values having fewer than
+// n+1 items are not indexed. For kind IndexSubscript, the index maps
+// subscript n to the subscripts of the records. Records having fewer than n+1
+// subscripts are not indexed.
+//
+// Use Lookup to search an index.
+func (db *DB) CreateIndex(array, index string, kind, n int) (err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	switch {
+	case kind != IndexValue && kind != IndexSubscript:
+		return &lldb.ErrINVAL{Src: "dbm.DB.CreateIndex: invalid kind", Val: kind}
+	case n < 0:
+		return &lldb.ErrINVAL{Src: "dbm.DB.CreateIndex: invalid n", Val: n}
+	}
+
+	xx, err := db.indexesOf(array)
+	if err != nil {
+		return
+	}
+
+	for _, x := range xx {
+		if x.name == index {
+			return &lldb.ErrINVAL{Src: "dbm.DB.CreateIndex: index already exists", Val: index}
+		}
+	}
+
+	defs, err := db.sysArray(true, xname)
+	if err != nil {
+		return
+	}
+
+	if err = defs.set([]interface{}{kind, n}, array, index); err != nil {
+		return
+	}
+
+	delete(db.indexes, array)
+	x := &indexDef{index, kind, n, indexArrayName(array, index)}
+	a, err := db.array_(false, array)
+	if a.tree == nil || err != nil {
+		return
+	}
+
+	xa, err := a.indexArray(x)
+	if err != nil {
+		return
+	}
+
+	en, err := a.tree.SeekFirst()
+	if err != nil {
+		return noEof(err)
+	}
+
+	for {
+		bk, bv, err := en.Next()
+		if err != nil {
+			return noEof(err)
+		}
+
+		subscripts, err := lldb.DecodeScalars(bk)
+		if err != nil {
+			return err
+		}
+
+		va, ok, err := db.items(bv)
+		if err != nil {
+			return err
+		}
+
+		k := x.key(subscripts, va, ok)
+		if k == nil {
+			continue
+		}
+
+		if err = xa.set(nil, k...); err != nil {
+			return err
+		}
+	}
+}
+
+// DropIndex removes index of array.
+func (db *DB) DropIndex(array, index string) (err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	xx, err := db.indexesOf(array)
+	if err != nil {
+		return
+	}
+
+	for _, x := range xx {
+		if x.name == index {
+			return db.dropIndex(array, x)
+		}
+	}
+
+	return &lldb.ErrINVAL{Src: "dbm.DB.DropIndex: no such index", Val: index}
+}
+
+// db.bkl locked is assumed.
+func (db *DB) dropIndex(array string, x indexDef) (err error) {
+	defs, err := db.sysArray(false, xname)
+	if err != nil {
+		return
+	}
+
+	if defs.tree != nil {
+		if err = defs.delete(array, x.name); err != nil {
+			return
+		}
+	}
+
+	delete(db.indexes, array)
+	if err = db.removeArray(systemPrefix, x.xa); err != nil {
+		return
+	}
+
+	delete(db.scache, x.xa)
+	return
+}
+
+// Lookup returns the subscripts of all records of array having value as the
+// indexed item of index, in the collating order of the subscripts.
+func (db *DB) Lookup(array, index string, value interface{}) (subscripts [][]interface{}, err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	xx, err := db.indexesOf(array)
+	if err != nil {
+		return
+	}
+
+	var x *indexDef
+	for i := range xx {
+		if xx[i].name == index {
+			x = &xx[i]
+			break
+		}
+	}
+	if x == nil {
+		return nil, &lldb.ErrINVAL{Src: "dbm.DB.Lookup: no such index", Val: index}
+	}
+
+	xa, err := db.sysArray(false, x.xa)
+	if xa.tree == nil || err != nil {
+		return
+	}
+
+	prefix, err := lldb.EncodeScalars(value)
+	if err != nil {
+		return
+	}
+
+	en, _, err := xa.tree.Seek(prefix)
+	if err != nil {
+		return nil, noEof(err)
+	}
+
+	v := []interface{}{value}
+	for {
+		bk, _, err := en.Next()
+		if err != nil {
+			return subscripts, noEof(err)
+		}
+
+		k, err := lldb.DecodeScalars(bk)
+		if err != nil {
+			return nil, err
+		}
+
+		if c, err := lldb.Collate(k[:1], v, nil); c != 0 || err != nil {
+			return subscripts, err
+		}
+
+		subscripts = append(subscripts, k[1:])
+	}
+}
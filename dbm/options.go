@@ -88,11 +88,71 @@ type Options struct {
 	// (particularly for mechanical, rotational HDs) are not recommended
 	// and they may not be always honored.
 	GracePeriod time.Duration
-	wal         *os.File
-	lock        *os.File
+
+	// Batch the commits of concurrent updates. Applicable iff ACID ==
+	// ACIDFull and GracePeriod is zero. Operations entering the DB while
+	// a commit is in progress are collected into the next batch, which is
+	// committed, as a single 2PC/WAL transaction, by its last operation
+	// as soon as no other goroutine is waiting to enter the DB, or after
+	// 64 operations at most. Every DB operation updating the DB returns
+	// only after the batch it belongs to is durable and it reports the
+	// commit error, if any. Read only operations don't wait for the
+	// commit. The throughput grows with the number of concurrent writers
+	// without any fixed delay.
+	GroupCommit bool
+
+	// Read the DB file through a memory mapping instead of issuing a
+	// read system call per block, see lldb.MmapFiler. Recommended for
+	// read heavy workloads, like scanning large Slices. Not applicable to
+	// memory DBs.
+	Mmap bool
+
+	// If not empty, the DB file content is encrypted and authenticated
+	// using AES-GCM with this key, see lldb.EncryptingFiler. The key must
+	// be 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+	// The WAL packets of an ACIDFull DB are encrypted using the same key.
+	// A DB created with a key must always be opened with the same key.
+	// Not applicable to memory DBs.
+	//
+	// A page rolled back to an older content is detected using the page
+	// versions kept in the DB file. The whole DB file, or a group of
+	// pages together with its versions, rolled back is not, see
+	// lldb.EncryptingFiler.
+	EncryptionKey []byte
+
+	// Store a CRC-32C checksum of every 4 kB page of the DB file and
+	// verify it on every read, see lldb.ChecksumFiler and DB.Scrub. A DB
+	// created with checksums must always be opened with checksums. The
+	// pages of an encrypted DB are authenticated already, with
+	// EncryptionKey set no checksums are stored and Checksums only enables
+	// DB.Scrub. Not applicable to memory DBs.
+	Checksums bool
+
+	// If not nil, every transaction committed by the DB is written to
+	// Ship as soon as it is durable in the WAL, see lldb.ACIDFiler0.Ship.
+	// A standby DB applies the shipped transactions, see OpenStandby.
+	// Applicable iff ACID == ACIDFull. The writes are made in another
+	// goroutine, so a stalled Ship doesn't block the DB. If a write fails
+	// or too many transactions are waiting to be written, the shipping
+	// stops and DB.ShipError returns the error, the commits are not
+	// affected by the failure. DB.Close waits until the queued
+	// transactions are written.
+	Ship io.Writer
+
+	scrub   scrubber
+	wal     *os.File
+	lock    *os.File
+	standby bool // Open a standby DB, see OpenStandby
+}
+
+// scrubber verifies the pages of a DB file, see DB.Scrub.
+type scrubber interface {
+	Scrub(n int) (done bool, err error)
 }
 
-func (o *Options) check(dbname string, new, lock bool) (err error) {
+// check validates o and opens the lock file, if lock is set, and the WAL
+// file, unless the WAL is the non nil wal.
+func (o *Options) check(dbname string, new, lock bool, wal lldb.Filer) (err error) {
 	var lname string
 	if lock {
 		lname = o.lockName(dbname)
@@ -109,6 +169,14 @@ func (o *Options) check(dbname string, new, lock bool) (err error) {
 		return fmt.Errorf("Unsupported Options.ACID: %d", o.ACID)
 	case ACIDNone, ACIDTransactions:
 	case ACIDFull:
+		if o.GroupCommit && o.GracePeriod != 0 {
+			return fmt.Errorf("Options.GroupCommit requires a zero Options.GracePeriod")
+		}
+
+		if wal != nil {
+			break
+		}
+
 		o.WAL = o.walName(dbname, o.WAL)
 		if lname == o.WAL {
 			panic("internal error")
@@ -132,7 +200,11 @@ func (o *Options) check(dbname string, new, lock bool) (err error) {
 				return
 			}
 		case false:
-			if o.wal, err = os.OpenFile(o.WAL, os.O_RDWR, 0666); err != nil {
+			flag := os.O_RDWR
+			if o.standby {
+				flag |= os.O_CREATE
+			}
+			if o.wal, err = os.OpenFile(o.WAL, flag, 0666); err != nil {
 				if os.IsNotExist(err) {
 					err = fmt.Errorf("cannot open DB %q: WAL file %q doesn't exist", dbname, o.WAL)
 				}
@@ -144,6 +216,38 @@ func (o *Options) check(dbname string, new, lock bool) (err error) {
 	return
 }
 
+func (o *Options) fileFiler(f *os.File) (r lldb.Filer, err error) {
+	switch {
+	case o.Mmap:
+		r = lldb.NewMmapFiler(f)
+	default:
+		r = lldb.NewSimpleFileFiler(f)
+	}
+	return o.pageFiler(r)
+}
+
+// pageFiler returns f wrapped as required by o.Checksums and o.EncryptionKey.
+func (o *Options) pageFiler(f lldb.Filer) (r lldb.Filer, err error) {
+	switch {
+	case len(o.EncryptionKey) != 0:
+		var e *lldb.EncryptingFiler
+		if e, err = lldb.NewEncryptingFiler(f, o.EncryptionKey); err != nil {
+			return
+		}
+
+		if o.Checksums {
+			o.scrub = e
+		}
+		r = e
+	case o.Checksums:
+		c := lldb.NewChecksumFiler(f)
+		o.scrub, r = c, c
+	default:
+		r = f
+	}
+	return
+}
+
 func (o *Options) lockName(dbname string) (r string) {
 	base := filepath.Base(filepath.Clean(dbname)) + "lockfile"
 	h := sha1.New()
@@ -162,7 +266,9 @@ func (o *Options) walName(dbname, wal string) (r string) {
 	return filepath.Join(filepath.Dir(dbname), fmt.Sprintf(".%x", h.Sum(nil)))
 }
 
-func (o *Options) acidFiler(db *DB, f lldb.Filer) (r lldb.Filer, err error) {
+// acidFiler returns f wrapped as required by o.ACID. The WAL, if any, is wal
+// or the WAL file if wal is nil.
+func (o *Options) acidFiler(db *DB, f, wal lldb.Filer) (r lldb.Filer, err error) {
 	switch o.ACID {
 	default:
 		panic("internal error")
@@ -183,15 +289,32 @@ func (o *Options) acidFiler(db *DB, f lldb.Filer) (r lldb.Filer, err error) {
 		db.xact = true
 		r = rf
 	case ACIDFull:
-		if r, err = lldb.NewACIDFiler(f, o.wal); err != nil {
+		if wal == nil {
+			wal = lldb.NewSimpleFileFiler(o.wal)
+		}
+		if o.standby {
+			if db.standby, err = lldb.NewWALApplier(f, wal, o.EncryptionKey); err != nil {
+				return
+			}
+
+			return standbyFiler{f}, nil
+		}
+
+		var a *lldb.ACIDFiler0
+		if a, err = lldb.NewACIDFilerWAL(f, wal, o.EncryptionKey); err != nil {
 			return
 		}
 
+		a.Ship(o.Ship)
+		r = a
 		db.acidState = stIdle
 		db.gracePeriod = o.GracePeriod
 		db.xact = true
 		if o.GracePeriod == 0 {
 			db.acidState = stDisabled
+			if o.GroupCommit {
+				db.acidState = stGroupIdle
+			}
 			break
 		}
 
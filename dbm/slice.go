@@ -7,6 +7,9 @@
 package dbm
 
 import (
+	"bytes"
+	"fmt"
+
 	"github.com/cznic/exp/lldb"
 )
 
@@ -15,6 +18,11 @@ type Slice struct {
 	a        *Array
 	prefix   []interface{}
 	from, to []interface{}
+	tx       *Tx    // Non nil for Slices obtained from Tx.Slice.
+	array    string // Array name, valid iff tx != nil.
+	indexed  bool   // Slice obtained from Array.SliceOffset.
+	offset   int64  // Valid iff indexed.
+	limit    int64  // Valid iff indexed.
 }
 
 // Do calls f for every subscripts-value pair in s in ascending collation order
@@ -32,6 +40,10 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 		noVal bool
 	)
 
+	if s.tx != nil {
+		return s.tx.do(s, f)
+	}
+
 	if err = db.enter(); err != nil {
 		return
 	}
@@ -54,6 +66,69 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 	}
 
 	switch {
+	case s.indexed:
+		var lo int64
+		if len(s.prefix) != 0 {
+			if lo, _, err = s.a.bounds(); err != nil {
+				return
+			}
+		}
+
+		enum, err := tree.SeekIndex(lo + s.offset)
+		if err != nil {
+			return noEof(err)
+		}
+
+		for i := s.limit; i != 0; i-- {
+			bk, bv, err := enum.Next()
+			if err != nil {
+				return noEof(err)
+			}
+
+			k, err := lldb.DecodeScalars(bk)
+			if err != nil {
+				return noEof(err)
+			}
+
+			if n := len(s.prefix); n != 0 {
+				if len(k) < len(s.prefix) {
+					return nil
+				}
+
+				c, err := s.a.cmp(k[:n], s.prefix)
+				if err != nil {
+					return err
+				}
+
+				if c > 0 {
+					return nil
+				}
+			}
+
+			v, err := db.decodeValue(bv)
+			if err != nil {
+				return err
+			}
+
+			doLeave = false
+			if db.leave(&err) != nil {
+				return err
+			}
+
+			if noVal && v != nil {
+				v = []interface{}{0}
+			}
+			if more, err := f(k[len(s.prefix):], v); !more || err != nil {
+				return noEof(err)
+			}
+
+			if err = db.enter(); err != nil {
+				return err
+			}
+
+			doLeave = true
+		}
+		return nil
 	case s.from == nil && s.to == nil:
 		bprefix, err := lldb.EncodeScalars(s.prefix...)
 		if err != nil {
@@ -81,7 +156,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 					return nil
 				}
 
-				c, err := lldb.Collate(k[:n], s.prefix, nil)
+				c, err := s.a.cmp(k[:n], s.prefix)
 				if err != nil {
 					return err
 				}
@@ -91,7 +166,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				}
 			}
 
-			v, err := lldb.DecodeScalars(bv)
+			v, err := db.decodeValue(bv)
 			if err != nil {
 				return err
 			}
@@ -137,7 +212,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return err
 			}
 
-			c, err := lldb.Collate(k, to, nil)
+			c, err := s.a.cmp(k, to)
 			if err != nil {
 				return err
 			}
@@ -146,7 +221,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return err
 			}
 
-			v, err := lldb.DecodeScalars(bv)
+			v, err := db.decodeValue(bv)
 			if err != nil {
 				return noEof(err)
 			}
@@ -196,7 +271,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 					return nil
 				}
 
-				c, err := lldb.Collate(k[:n], s.prefix, nil)
+				c, err := s.a.cmp(k[:n], s.prefix)
 				if err != nil {
 					return err
 				}
@@ -206,7 +281,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				}
 			}
 
-			v, err := lldb.DecodeScalars(bv)
+			v, err := db.decodeValue(bv)
 			if err != nil {
 				return err
 			}
@@ -252,7 +327,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return noEof(err)
 			}
 
-			c, err := lldb.Collate(k, to, nil)
+			c, err := s.a.cmp(k, to)
 			if err != nil {
 				return err
 			}
@@ -261,7 +336,7 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 				return err
 			}
 
-			v, err := lldb.DecodeScalars(bv)
+			v, err := db.decodeValue(bv)
 			if err != nil {
 				return err
 			}
@@ -288,3 +363,166 @@ func (s *Slice) Do(f func(subscripts, value []interface{}) (bool, error)) (err e
 		panic("slice.go: internal error")
 	}
 }
+
+// Delete deletes all subscripts/value pairs in s. The pairs are removed from
+// the Array at once, dropping whole pages of it instead of deleting the pairs
+// one by one.
+func (s *Slice) Delete() (err error) {
+	if s.tx != nil {
+		return s.tx.deleteSlice(s)
+	}
+
+	db := s.a.db
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	if t := s.a.tree; t != nil && !t.IsMem() && t.Handle() == 1 {
+		return &lldb.ErrPERM{Src: "dbm.Slice.Delete"}
+	}
+
+	if ok, err := s.a.validate(false); !ok {
+		return err
+	}
+
+	return s.delete()
+}
+
+// delete implements Delete. The closed range of keys to delete is computed
+// from the bounds of s. The pairs in the range are enumerated only if the
+// indexes of the Array must be updated or spilled values freed. db.bkl locked
+// is assumed.
+func (s *Slice) delete() (err error) {
+	a := s.a
+	first, last, exact, ok, err := s.keys()
+	if !ok || err != nil {
+		return
+	}
+
+	x, err := a.hasIndexes()
+	if err != nil {
+		return
+	}
+
+	sp := a.namespace == arraysPrefix
+	if sp {
+		if sp, err = a.db.hasSpills(); err != nil {
+			return
+		}
+	}
+
+	var spills [][]byte
+	if x || sp {
+		en, _, err := a.tree.Seek(first)
+		if err != nil {
+			return noEof(err)
+		}
+
+		for {
+			bk, bv, err := en.Next()
+			if err != nil {
+				if err = noEof(err); err != nil {
+					return err
+				}
+
+				break
+			}
+
+			if !exact && last != nil && a.coll.bytes(bk, last) > 0 {
+				break
+			}
+
+			if x {
+				if err = a.updateIndexes(bk[len(a.prefix):], bv, nil); err != nil {
+					return err
+				}
+			}
+
+			if isSpill(bv) {
+				spills = append(spills, append([]byte(nil), bv...))
+			}
+
+			if exact && bytes.Equal(bk, last) {
+				break
+			}
+		}
+	}
+
+	if err = a.tree.DeleteRange(first, last); err != nil {
+		return
+	}
+
+	for _, v := range spills {
+		if err = a.db.freeSpill(v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// keys returns the closed range [first, last] of the keys of s. A nil last
+// means the range is not bounded above. If exact is true then last is a key
+// of the Array. If ok is false then s is empty. db.bkl locked is assumed.
+func (s *Slice) keys() (first, last []byte, exact, ok bool, err error) {
+	a := s.a
+	prefix := s.prefix
+	if !s.indexed {
+		if first, err = lldb.EncodeScalars(append(append([]interface{}(nil), prefix...), s.from...)...); err != nil {
+			return
+		}
+
+		switch {
+		case s.to != nil:
+			last, err = lldb.EncodeScalars(append(append([]interface{}(nil), prefix...), s.to...)...)
+			return first, last, false, err == nil, err
+		case len(prefix) == 0:
+			return first, nil, false, true, nil
+		}
+
+		_, hi, err := a.bounds()
+		if err != nil || hi == 0 {
+			return nil, nil, false, false, err
+		}
+
+		if last, err = a.keyAt(hi - 1); err != nil || last == nil {
+			return nil, nil, false, false, err
+		}
+
+		return first, last, true, a.coll.bytes(first, last) <= 0, nil
+	}
+
+	var lo int64
+	hi := int64(-1) // Not bounded
+	if len(prefix) != 0 {
+		if lo, hi, err = a.bounds(); err != nil {
+			return
+		}
+	}
+
+	lo += s.offset
+	if n := lo + s.limit; s.limit >= 0 && (hi < 0 || n < hi) {
+		hi = n
+	}
+	if hi >= 0 && lo >= hi {
+		return
+	}
+
+	if first, err = a.keyAt(lo); err != nil || first == nil {
+		return nil, nil, false, false, err
+	}
+
+	if hi >= 0 {
+		if last, err = a.keyAt(hi - 1); err != nil {
+			return nil, nil, false, false, err
+		}
+	}
+
+	return first, last, last != nil, true, nil
+}
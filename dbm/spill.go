@@ -0,0 +1,258 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Transparent spilling of oversized Array values to internal Files.
+
+package dbm
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/cznic/exp/lldb"
+)
+
+const (
+	maxValue = 1 << 16  // Encoded Array values longer than this are spilled.
+	spname   = "spills" // Spill Files sequence number
+
+	// A spill reference is spillTag, 8, ID as a big endian uint64. The
+	// tag is lldb's gbBytes1, which EncodeScalars never produces for a
+	// []byte shorter than 18 bytes, so no encoded value is a spill
+	// reference.
+	spillTag    = 0x27
+	spillRefLen = 10
+)
+
+// Tags of encBig items.
+const (
+	bigEncoded = iota // Item encoded by lldb.EncodeScalars.
+	bigBytes          // Raw []byte item.
+	bigString         // Raw string item.
+)
+
+func isSpill(b []byte) bool {
+	return len(b) == spillRefLen && b[0] == spillTag && b[1] == 8
+}
+
+func spillName(b []byte) string {
+	return fmt.Sprintf("spill\x00%d", binary.BigEndian.Uint64(b[2:]))
+}
+
+func valItems(value interface{}) []interface{} {
+	if x, ok := value.([]interface{}); ok {
+		return x
+	}
+
+	return []interface{}{value}
+}
+
+// encBig encodes value like encVal does, but without limiting the size of the
+// items.
+func encBig(value interface{}) (r []byte, err error) {
+	var n [binary.MaxVarintLen64]byte
+	for _, v := range valItems(value) {
+		var b []byte
+		tag := byte(bigEncoded)
+		switch x := v.(type) {
+		case []byte:
+			b, tag = x, bigBytes
+		case string:
+			b, tag = []byte(x), bigString
+		default:
+			if b, err = lldb.EncodeScalars(x); err != nil {
+				return nil, err
+			}
+		}
+
+		r = append(r, tag)
+		r = append(r, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+		r = append(r, b...)
+	}
+	return
+}
+
+func decBig(b []byte) (va []interface{}, err error) {
+	for len(b) != 0 {
+		tag := b[0]
+		n, nn := binary.Uvarint(b[1:])
+		if nn <= 0 || uint64(len(b)-1-nn) < n {
+			return nil, &lldb.ErrINVAL{Src: "dbm: corrupted spilled value item length", Val: n}
+		}
+
+		item := b[1+nn : 1+nn+int(n)]
+		b = b[1+nn+int(n):]
+		switch tag {
+		case bigEncoded:
+			v, err := lldb.DecodeScalars(item)
+			if err != nil {
+				return nil, err
+			}
+
+			va = append(va, v...)
+		case bigBytes:
+			va = append(va, append([]byte(nil), item...))
+		case bigString:
+			va = append(va, string(item))
+		default:
+			return nil, &lldb.ErrINVAL{Src: "dbm: corrupted spilled value item tag", Val: tag}
+		}
+	}
+	return
+}
+
+// decBigVal decodes an encBig encoded value. A single item value is returned
+// as is, not as a []interface{}.
+func decBigVal(b []byte) (value interface{}, err error) {
+	va, err := decBig(b)
+	if err != nil {
+		return
+	}
+
+	value = va
+	if len(va) == 1 {
+		value = va[0]
+	}
+	return
+}
+
+// encValue encodes value for storing in an Array. Values which cannot be
+// stored in a BTree are written to a new internal File and the returned
+// encoding is a reference to that File. db.bkl locked is assumed.
+func (db *DB) encValue(value interface{}) (r []byte, err error) {
+	if r, err = encVal(value); err == nil && len(r) <= maxValue {
+		return
+	}
+
+	b, err := encBig(value)
+	if err != nil {
+		return
+	}
+
+	seq, err := db.sysArray(true, spname)
+	if err != nil {
+		return
+	}
+
+	id, err := seq.inc(1, "id")
+	if err != nil {
+		return
+	}
+
+	r = make([]byte, spillRefLen)
+	r[0], r[1] = spillTag, 8
+	binary.BigEndian.PutUint64(r[2:], uint64(id))
+	f, err := db.sysArray(true, spillName(r))
+	if err != nil {
+		return
+	}
+
+	size := int64(len(b))
+	for pg := int64(0); len(b) != 0; pg++ {
+		n := len(b)
+		if n > pgSize {
+			n = pgSize
+		}
+		if err = f.set(b[:n], pg); err != nil {
+			return
+		}
+
+		b = b[n:]
+	}
+	return r, f.set(size, fSize)
+}
+
+// decodeValue decodes an Array value, reassembling spilled values. db.bkl
+// locked is assumed.
+func (db *DB) decodeValue(b []byte) (va []interface{}, err error) {
+	if !isSpill(b) {
+		return lldb.DecodeScalars(b)
+	}
+
+	name := spillName(b)
+	f, err := db.sysArray(false, name)
+	if err != nil {
+		return
+	}
+
+	if f.tree == nil {
+		return nil, &lldb.ErrINVAL{Src: "dbm: missing spilled value", Val: name}
+	}
+
+	v, err := f.get(fSize)
+	if err != nil {
+		return
+	}
+
+	size, _ := v.(int64)
+	buf := make([]byte, 0, size)
+	for pg := int64(0); int64(len(buf)) < size; pg++ {
+		if v, err = f.get(pg); err != nil {
+			return
+		}
+
+		b, ok := v.([]byte)
+		if !ok || len(b) == 0 {
+			return nil, &lldb.ErrINVAL{Src: "dbm: corrupted spilled value", Val: name}
+		}
+
+		buf = append(buf, b...)
+	}
+	return decBig(buf)
+}
+
+// hasSpills reports whether any value of the DB was ever spilled. db.bkl
+// locked is assumed.
+func (db *DB) hasSpills() (bool, error) {
+	seq, err := db.sysArray(false, spname)
+	return seq.tree != nil, err
+}
+
+// freeSpill removes the internal File referenced by b, if any. db.bkl locked
+// is assumed.
+func (db *DB) freeSpill(b []byte) (err error) {
+	if !isSpill(b) {
+		return
+	}
+
+	name := spillName(b)
+	if err = db.removeArray(systemPrefix, name); err != nil {
+		return
+	}
+
+	delete(db.scache, name)
+	return
+}
+
+// freeSpills removes the internal Files referenced by values of t. db.bkl
+// locked is assumed.
+func (db *DB) freeSpills(t *lldb.BTree) (err error) {
+	en, err := t.SeekFirst()
+	if err != nil {
+		return noEof(err)
+	}
+
+	var refs [][]byte
+	for {
+		_, v, err := en.Next()
+		if err != nil {
+			if err = noEof(err); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if isSpill(v) {
+			refs = append(refs, v)
+		}
+	}
+
+	for _, v := range refs {
+		if err = db.freeSpill(v); err != nil {
+			return
+		}
+	}
+	return
+}
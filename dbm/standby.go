@@ -0,0 +1,130 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Standby DBs
+
+package dbm
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/cznic/exp/lldb"
+)
+
+// standbyFiler is the read only Filer of a standby DB. The shipped
+// transactions are applied to the wrapped Filer.
+type standbyFiler struct {
+	lldb.Filer
+}
+
+func (f standbyFiler) PunchHole(off, size int64) error {
+	return &lldb.ErrPERM{Src: f.Name() + ": PunchHole on a standby DB"}
+}
+
+func (f standbyFiler) Truncate(size int64) error {
+	return &lldb.ErrPERM{Src: f.Name() + ": Truncate on a standby DB"}
+}
+
+func (f standbyFiler) WriteAt(b []byte, off int64) (int, error) {
+	return 0, &lldb.ErrPERM{Src: f.Name() + ": WriteAt on a standby DB"}
+}
+
+// OpenStandby opens the named DB file as a read only standby of a primary DB
+// shipping its committed transactions, see Options.Ship. The transactions are
+// applied by db.Apply. The standby DB file must start as a copy of the primary
+// DB file made while the primary DB was closed.
+//
+// opts.ACID must be ACIDFull. The standby DB applies every shipped
+// transaction through its own WAL, see Options.WAL, so it recovers from
+// crashes like any ACIDFull DB. The WAL file is created if it doesn't exist.
+// opts.GracePeriod, opts.GroupCommit and opts.Ship are ignored,
+// opts.EncryptionKey and opts.Checksums must be the same as of the primary DB.
+//
+// A standby DB can be closed and opened by Open, ie. it can take over the
+// role of the primary DB.
+func OpenStandby(name string, opts *Options) (db *DB, err error) {
+	if opts.ACID != ACIDFull {
+		return nil, fmt.Errorf("OpenStandby requires Options.ACID == ACIDFull")
+	}
+
+	o := *opts
+	o.GracePeriod = 0
+	o.GroupCommit = false
+	o.Ship = nil
+	o.standby = true
+	return Open(name, &o)
+}
+
+// Apply applies the transactions shipped by the primary DB of the standby db,
+// read from r, until r is exhausted. Every transaction is applied atomically
+// and durably. A transaction not following the last applied one, ie. a gap in
+// the shipped transactions, is rejected, see lldb.WALApplier. db can be read
+// concurrently with Apply, the reads see only whole transactions. Apply must
+// not be invoked concurrently with itself.
+//
+// Arrays, Files and Slices obtained before a transaction was applied cannot be
+// used afterwards, their methods return an error. They must be obtained again.
+func (db *DB) Apply(r io.Reader) (err error) {
+	if db.standby == nil {
+		return &lldb.ErrPERM{Src: "dbm.DB.Apply: not a standby DB"}
+	}
+
+	for {
+		if err = db.standby.Receive(r); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+
+		if err = db.apply(); err != nil {
+			return
+		}
+	}
+}
+
+func (db *DB) apply() (err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	if err = db.standby.Apply(); err != nil {
+		return
+	}
+
+	// The DB file changed under the allocator and the caches.
+	db.gen++
+	db._root = nil
+	db.acache = nil
+	db.fcache = nil
+	db.scache = nil
+	db.indexes = nil
+	if db.alloc, err = lldb.NewAllocator(lldb.NewInnerFiler(db.filer, 16), &lldb.Options{}); err != nil {
+		return
+	}
+
+	db.alloc.Compress = compress
+	return
+}
+
+// ShipError returns the error which stopped the shipping of the committed
+// transactions to Options.Ship, or nil if the shipping didn't fail.
+func (db *DB) ShipError() error {
+	db.bkl.Lock()
+	defer db.bkl.Unlock()
+
+	if a, ok := db.filer.(*lldb.ACIDFiler0); ok {
+		return a.ShipError()
+	}
+
+	return nil
+}
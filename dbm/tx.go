@@ -0,0 +1,667 @@
+// Copyright 2014 The dbm Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbm
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cznic/exp/lldb"
+)
+
+// Tx log record tags.
+const (
+	txSet = iota
+	txDelete
+	txInc
+)
+
+// Tx is an explicit transaction obtained from DB.Begin. Updates made through
+// a Tx are private to it until Commit applies them to the DB in a single
+// structural transaction. Rollback discards them without affecting any other
+// Tx or the DB.BeginUpdate/EndUpdate nesting of other goroutines.
+//
+// Reads made through a Tx see its own pending updates overlaid over the
+// current state of the DB. No isolation from concurrent commits by others is
+// provided.
+//
+// A Tx is safe for concurrent use by multiple goroutines. After Commit or
+// Rollback the Tx cannot be used anymore.
+type Tx struct {
+	db   *DB
+	done bool
+	logs map[string]*txLog // Pending updates by array name.
+	mu   sync.Mutex
+}
+
+// txLog holds the pending updates of an array keyed by subscripts and ordered
+// by the collation of the array.
+type txLog struct {
+	coll *collation
+	tree *lldb.BTree
+}
+
+// Begin starts a new explicit transaction.
+func (db *DB) Begin() (tx *Tx, err error) {
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		db.leave(&err)
+	}()
+
+	select {
+	case _ = <-db.closed:
+		return nil, &lldb.ErrPERM{Src: "dbm.DB.Begin: closed DB"}
+	default:
+	}
+
+	return &Tx{db: db, logs: map[string]*txLog{}}, nil
+}
+
+func (tx *Tx) check(src string) error {
+	if tx.done {
+		return &lldb.ErrPERM{Src: src + ": transaction already finished"}
+	}
+
+	return nil
+}
+
+// log returns the log of array, creating it if necessary. tx.mu locked is
+// assumed.
+func (tx *Tx) log(array string) (l *txLog, err error) {
+	if l = tx.logs[array]; l != nil {
+		return
+	}
+
+	a, err := tx.db.Array(array)
+	if err != nil {
+		return
+	}
+
+	l = &txLog{a.coll, lldb.NewBTree(a.coll.bytes)}
+	tx.logs[array] = l
+	return
+}
+
+// tx.mu locked is assumed. ok reports whether a log record for key exists.
+func (tx *Tx) lookup(array string, key []byte) (op byte, b []byte, ok bool, err error) {
+	l := tx.logs[array]
+	if l == nil {
+		return
+	}
+
+	v, err := l.tree.Get(nil, key)
+	if v == nil || err != nil {
+		return
+	}
+
+	return v[0], v[1:], true, nil
+}
+
+// tx.mu locked is assumed.
+func (tx *Tx) put(array string, key, rec []byte) (err error) {
+	l, err := tx.log(array)
+	if err != nil {
+		return
+	}
+
+	return l.tree.Set(key, rec)
+}
+
+func txDelta(b []byte) (d int64, err error) {
+	va, err := lldb.DecodeScalars(b)
+	if err != nil {
+		return
+	}
+
+	if len(va) != 1 {
+		return 0, &lldb.ErrINVAL{Src: "dbm.Tx: corrupted inc record", Val: va}
+	}
+
+	d, _ = va[0].(int64)
+	return
+}
+
+// Set sets the value at subscripts in array within tx.
+func (tx *Tx) Set(value interface{}, array string, subscripts ...interface{}) (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	if err = tx.check("dbm.Tx.Set"); err != nil {
+		return
+	}
+
+	val, err := encBig(value)
+	if err != nil {
+		return
+	}
+
+	key, err := lldb.EncodeScalars(subscripts...)
+	if err != nil {
+		return
+	}
+
+	return tx.put(array, key, append([]byte{txSet}, val...))
+}
+
+// Get returns the value at subscripts in array as seen by tx, or nil if no
+// such value exists.
+func (tx *Tx) Get(array string, subscripts ...interface{}) (value interface{}, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	if err = tx.check("dbm.Tx.Get"); err != nil {
+		return
+	}
+
+	key, err := lldb.EncodeScalars(subscripts...)
+	if err != nil {
+		return
+	}
+
+	op, b, ok, err := tx.lookup(array, key)
+	if err != nil {
+		return
+	}
+
+	if !ok {
+		return tx.db.Get(array, subscripts...)
+	}
+
+	switch op {
+	case txSet:
+		return decBigVal(b)
+	case txDelete:
+		return nil, nil
+	case txInc:
+		d, err := txDelta(b)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := tx.db.Get(array, subscripts...)
+		if err != nil {
+			return nil, err
+		}
+
+		n, _ := v.(int64)
+		return n + d, nil
+	default:
+		panic("internal error")
+	}
+}
+
+// Delete deletes the value at subscripts in array within tx.
+func (tx *Tx) Delete(array string, subscripts ...interface{}) (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	if err = tx.check("dbm.Tx.Delete"); err != nil {
+		return
+	}
+
+	key, err := lldb.EncodeScalars(subscripts...)
+	if err != nil {
+		return
+	}
+
+	return tx.put(array, key, []byte{txDelete})
+}
+
+// Inc increments the value at subscripts of array by delta within tx and
+// returns the new value as seen by tx. If the value doesn't exists before
+// calling Inc or if the value is not an integer then the value is considered
+// to be zero. Unless tx has set or deleted the value before, the increment is
+// applied atomically on Commit, ie. it composes with concurrent increments
+// made by others.
+func (tx *Tx) Inc(delta int64, array string, subscripts ...interface{}) (val int64, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	if err = tx.check("dbm.Tx.Inc"); err != nil {
+		return
+	}
+
+	key, err := lldb.EncodeScalars(subscripts...)
+	if err != nil {
+		return
+	}
+
+	op, b, ok, err := tx.lookup(array, key)
+	if err != nil {
+		return
+	}
+
+	var rec []byte
+	switch {
+	case !ok || op == txInc:
+		var d int64
+		if ok {
+			if d, err = txDelta(b); err != nil {
+				return
+			}
+		}
+
+		v, err := tx.db.Get(array, subscripts...)
+		if err != nil {
+			return 0, err
+		}
+
+		n, _ := v.(int64)
+		d += delta
+		val = n + d
+		if rec, err = lldb.EncodeScalars(d); err != nil {
+			return 0, err
+		}
+
+		rec = append([]byte{txInc}, rec...)
+	case op == txDelete:
+		val = delta
+		if rec, err = encBig(val); err != nil {
+			return
+		}
+
+		rec = append([]byte{txSet}, rec...)
+	case op == txSet:
+		v, err := decBigVal(b)
+		if err != nil {
+			return 0, err
+		}
+
+		n, _ := v.(int64)
+		val = n + delta
+		if rec, err = encBig(val); err != nil {
+			return 0, err
+		}
+
+		rec = append([]byte{txSet}, rec...)
+	default:
+		panic("internal error")
+	}
+
+	return val, tx.put(array, key, rec)
+}
+
+// Slice returns a new Slice of array, with a subscripts range of [from, to],
+// as seen by tx. If from is nil it works as 'from lowest existing key'.  If
+// to is nil it works as 'to highest existing key'.
+func (tx *Tx) Slice(array string, subscripts, from, to []interface{}) (s *Slice, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err = tx.check("dbm.Tx.Slice"); err != nil {
+		return
+	}
+
+	a, err := tx.db.Array(array, subscripts...)
+	if err != nil {
+		return
+	}
+
+	prefix, err := lldb.DecodeScalars(a.prefix)
+	if err != nil {
+		return
+	}
+
+	return &Slice{
+		a:      &a,
+		prefix: prefix,
+		from:   from,
+		to:     to,
+		tx:     tx,
+		array:  array,
+	}, nil
+}
+
+// deleteSlice implements Slice.Delete for Slices obtained from a Tx by
+// deleting, within tx, every pair s enumerates.
+func (tx *Tx) deleteSlice(s *Slice) (err error) {
+	var keys [][]interface{}
+	if err = s.Do(func(subscripts, _ []interface{}) (bool, error) {
+		keys = append(keys, subscripts)
+		return true, nil
+	}); err != nil {
+		return
+	}
+
+	for _, k := range keys {
+		if err = tx.Delete(s.array, append(append([]interface{}(nil), s.prefix...), k...)...); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// seek returns the log of array, or nil if there's none, and its enumerator
+// positioned at key.
+func (tx *Tx) seek(array string, key []byte) (l *txLog, en *lldb.BTreeEnumerator, err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	if err = tx.check("dbm.Tx.Slice.Do"); err != nil {
+		return
+	}
+
+	if l = tx.logs[array]; l == nil {
+		return
+	}
+
+	en, _, err = l.tree.Seek(key)
+	return
+}
+
+// do implements Slice.Do for Slices obtained from a Tx by merging the pending
+// updates of tx into the enumeration of the DB.
+func (tx *Tx) do(s *Slice, f func(subscripts, value []interface{}) (bool, error)) (err error) {
+	s0 := *s
+	s0.tx = nil
+	pfx := s.prefix
+	n := len(pfx)
+	var hi []interface{}
+	if s.to != nil {
+		hi = append(append([]interface{}(nil), pfx...), s.to...)
+	}
+
+	lo, err := lldb.EncodeScalars(append(append([]interface{}(nil), pfx...), s.from...)...)
+	if err != nil {
+		return
+	}
+
+	l, en, err := tx.seek(s.array, lo)
+	if err != nil {
+		return noEof(err)
+	}
+
+	if l == nil {
+		return s0.Do(f)
+	}
+
+	var (
+		k    []interface{} // Current log record subscripts, nil on exhaustion.
+		op   byte
+		b    []byte
+		stop bool
+	)
+
+	next := func() (err error) {
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+
+		k = nil
+		bk, bv, err := en.Next()
+		if err != nil {
+			return noEof(err)
+		}
+
+		key, err := lldb.DecodeScalars(bk)
+		if err != nil {
+			return
+		}
+
+		if len(key) < n {
+			return
+		}
+
+		c, err := l.coll.cmp(key[:n], pfx)
+		if c != 0 || err != nil {
+			return
+		}
+
+		if hi != nil {
+			if c, err = l.coll.cmp(key, hi); c > 0 || err != nil {
+				return
+			}
+		}
+
+		k, op, b = key[n:], bv[0], bv[1:]
+		return
+	}
+
+	call := func(subscripts, value []interface{}) (more bool, err error) {
+		if more, err = f(subscripts, value); !more || err != nil {
+			stop = true
+		}
+		return
+	}
+
+	// emit passes the current log record to f. dbv is the value of the
+	// same subscripts in the DB, if any.
+	emit := func(dbv []interface{}) (more bool, err error) {
+		switch op {
+		case txSet:
+			v, err := decBig(b)
+			if err != nil {
+				return false, err
+			}
+
+			return call(k, v)
+		case txDelete:
+			return true, nil
+		case txInc:
+			d, err := txDelta(b)
+			if err != nil {
+				return false, err
+			}
+
+			var v int64
+			if len(dbv) == 1 {
+				v, _ = dbv[0].(int64)
+			}
+			return call(k, []interface{}{v + d})
+		default:
+			panic("internal error")
+		}
+	}
+
+	if err = next(); err != nil {
+		return
+	}
+
+	if err = s0.Do(func(subscripts, value []interface{}) (more bool, err error) {
+		for k != nil {
+			c, err := l.coll.cmp(k, subscripts)
+			if err != nil {
+				return false, err
+			}
+
+			switch {
+			case c < 0:
+				if more, err = emit(nil); !more || err != nil {
+					return more, err
+				}
+
+				if err = next(); err != nil {
+					return false, err
+				}
+			case c == 0:
+				if more, err = emit(value); !more || err != nil {
+					return more, err
+				}
+
+				return true, next()
+			default:
+				return call(subscripts, value)
+			}
+		}
+		return call(subscripts, value)
+	}); err != nil || stop {
+		return
+	}
+
+	for k != nil {
+		more, err := emit(nil)
+		if !more || err != nil {
+			return noEof(err)
+		}
+
+		if err = next(); err != nil {
+			return err
+		}
+	}
+	return
+}
+
+// Commit applies all updates of tx to the DB in a single structural
+// transaction and ends tx. If the DB has Options.ACID set to ACIDNone, a
+// failure while applying the updates may leave some of them applied.
+func (tx *Tx) Commit() (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err = tx.check("dbm.Tx.Commit"); err != nil {
+		return
+	}
+
+	db := tx.db
+	if err = db.enter(); err != nil {
+		return
+	}
+
+	if err = db.filer.BeginUpdate(); err != nil {
+		db.leave(&err)
+		return
+	}
+
+	tx.done = true // Nothing was applied before, tx can still be retried.
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+		switch {
+		case err != nil:
+			db.filer.Rollback() // return the original, input error
+			db.acache = nil     // Trees created by tx may be gone now.
+			db.indexes = nil
+		default:
+			err = db.filer.EndUpdate()
+		}
+		db.leave(&err)
+	}()
+
+	return tx.apply()
+}
+
+// db.bkl and tx.mu locked are assumed.
+func (tx *Tx) apply() (err error) {
+	var names []string
+	for array := range tx.logs {
+		names = append(names, array)
+	}
+	sort.Strings(names)
+	for _, array := range names {
+		if err = tx.applyLog(array, tx.logs[array]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (tx *Tx) applyLog(array string, l *txLog) (err error) {
+	db := tx.db
+	en, err := l.tree.SeekFirst()
+	if err != nil {
+		return noEof(err)
+	}
+
+	for {
+		bk, bv, err := en.Next()
+		if err != nil {
+			return noEof(err)
+		}
+
+		subscripts, err := lldb.DecodeScalars(bk)
+		if err != nil {
+			return err
+		}
+
+		op := bv[0]
+		a, err := db.array_(op != txDelete, array)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case txSet:
+			v, err := decBigVal(bv[1:])
+			if err != nil {
+				return err
+			}
+
+			if err = a.set(v, subscripts...); err != nil {
+				return err
+			}
+		case txDelete:
+			if a.tree == nil {
+				break
+			}
+
+			if err = a.delete(subscripts...); err != nil {
+				return err
+			}
+		case txInc:
+			d, err := txDelta(bv[1:])
+			if err != nil {
+				return err
+			}
+
+			if _, err = a.inc(d, subscripts...); err != nil {
+				return err
+			}
+		default:
+			panic("internal error")
+		}
+	}
+}
+
+// Rollback discards all updates of tx and ends it.
+func (tx *Tx) Rollback() (err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if err = tx.check("dbm.Tx.Rollback"); err != nil {
+		return
+	}
+
+	tx.done = true
+	tx.logs = nil
+	return
+}
@@ -10,7 +10,11 @@ import (
 	"github.com/cznic/exp/lldb"
 )
 
-func open00(name string, in *DB) (db *DB, err error) {
+// open00 opens a DB of the file format version 0x00 or 0x01. Version 0x01
+// DBs may use counted BTrees, collation names in the root directory, spilled
+// values and BTree overflow chains, which version 0x00 readers don't know. A
+// version 0x00 DB is marked as version 0x01 before it can be updated.
+func open00(name string, in *DB, ver byte) (db *DB, err error) {
 	db = in
 	if db.alloc, err = lldb.NewAllocator(lldb.NewInnerFiler(db.filer, 16), &lldb.Options{}); err != nil {
 		return nil, &os.PathError{Op: "dbm.Open", Path: name, Err: err}
@@ -18,6 +22,30 @@ func open00(name string, in *DB) (db *DB, err error) {
 
 	db.alloc.Compress = compress
 	db.emptySize = 128
+	if db.standby != nil { // Read only, boot is the primary DB business.
+		return db, nil
+	}
+
+	if ver == 0x00 {
+		if err = db.upgrade00(); err != nil {
+			return nil, &os.PathError{Op: "dbm.Open", Path: name, Err: err}
+		}
+	}
 
 	return db, db.boot()
 }
+
+// upgrade00 sets the file format version of a version 0x00 DB to 0x01.
+func (db *DB) upgrade00() (err error) {
+	f := db.filer
+	if err = f.BeginUpdate(); err != nil {
+		return
+	}
+
+	if _, err = f.WriteAt([]byte{0x01}, 4); err != nil {
+		f.Rollback()
+		return
+	}
+
+	return f.EndUpdate()
+}
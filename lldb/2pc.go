@@ -8,10 +8,14 @@ package lldb
 
 import (
 	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/cznic/fileutil"
 	"github.com/cznic/mathutil"
@@ -26,24 +30,117 @@ type acidWrite struct {
 
 type acidWriter0 ACIDFiler0
 
+// epoch starts a new WAL epoch, if not yet started.
+func (a *acidWriter0) epoch() (err error) {
+	f := (*ACIDFiler0)(a)
+	if f.bwal != nil {
+		return
+	}
+
+	f.data = f.data[:0]
+	f.shipBuf = f.shipBuf[:0]
+	f.bwal = bufio.NewWriter((*walAppender0)(f))
+	f.tx++
+	comment := ""
+	if f.txFirst {
+		comment, f.txFirst = walFirst, false
+	}
+	return a.writePacket([]interface{}{wpt00Header, walTypeACIDFiler1, comment})
+}
+
 func (a *acidWriter0) WriteAt(b []byte, off int64) (n int, err error) {
 	f := (*ACIDFiler0)(a)
-	if f.bwal == nil { // new epoch
-		f.data = f.data[:0]
-		f.bwal = bufio.NewWriter(f.wal)
-		if err = a.writePacket([]interface{}{wpt00Header, walTypeACIDFiler0, ""}); err != nil {
+	if err = a.epoch(); err != nil {
+		return
+	}
+
+	if f.pageSize == 0 {
+		if err = a.writePacket([]interface{}{wpt00WriteData, b, off}); err != nil {
 			return
 		}
 	}
 
-	if err = a.writePacket([]interface{}{wpt00WriteData, b, off}); err != nil {
+	f.data = append(f.data, acidWrite{b, off})
+	return len(b), nil
+}
+
+// pages replaces the data of the transaction by the whole pages of db they
+// touch, adds the pages rewritten by the Truncate of db to sz and writes them
+// to the WAL. The recovery can then overwrite the pages torn by a crash
+// without reading them, see pager.
+func (a *acidWriter0) pages(db Filer, sz int64) (err error) {
+	f := (*ACIDFiler0)(a)
+	osz, err := db.Size()
+	if err != nil {
 		return
 	}
 
-	f.data = append(f.data, acidWrite{b, off})
-	return len(b), nil
+	ps := f.pageSize
+	n := (sz + ps - 1) / ps
+	m := map[int64][]byte{}
+	page := func(pg int64) (p []byte, err error) {
+		if p = m[pg]; p != nil {
+			return
+		}
+
+		p = make([]byte, ps)
+		if off := pg * ps; off < osz {
+			q := p[:mathutil.MinInt64(ps, osz-off)]
+			if rn, err := db.ReadAt(q, off); rn != len(q) {
+				return nil, err
+			}
+		}
+		m[pg] = p
+		return
+	}
+
+	for _, v := range f.data {
+		for b, off := v.b, v.off; len(b) != 0 && off < n*ps; {
+			pg := off / ps
+			p, err := page(pg)
+			if err != nil {
+				return err
+			}
+
+			c := copy(p[off-pg*ps:], b)
+			b = b[c:]
+			off += int64(c)
+		}
+	}
+
+	if sz != osz && n != 0 {
+		// The old last page and the new ones are written when growing,
+		// the new last page when shrinking.
+		first := n - 1
+		if osz < sz {
+			first = osz / ps
+		}
+		for pg := first; pg < n; pg++ {
+			if _, err = page(pg); err != nil {
+				return
+			}
+		}
+	}
+
+	pgs := make([]int64, 0, len(m))
+	for pg := range m {
+		pgs = append(pgs, pg)
+	}
+	sort.Slice(pgs, func(i, j int) bool { return pgs[i] < pgs[j] })
+	f.data = f.data[:0]
+	for _, pg := range pgs {
+		b, off := m[pg], pg*ps
+		if err = a.writePacket([]interface{}{wpt00WriteData, b, off}); err != nil {
+			return
+		}
+
+		f.data = append(f.data, acidWrite{b, off})
+	}
+	return
 }
 
+// writePacket writes items as a WAL type 1 packet. The WAL type 0 is only
+// recovered, never written.
 func (a *acidWriter0) writePacket(items []interface{}) (err error) {
 	f := (*ACIDFiler0)(a)
 	b, err := EncodeScalars(items...)
@@ -51,19 +148,41 @@ func (a *acidWriter0) writePacket(items []interface{}) (err error) {
 		return
 	}
 
-	var b4 [4]byte
-	binary.BigEndian.PutUint32(b4[:], uint32(len(b)))
-	if _, err = f.bwal.Write(b4[:]); err != nil {
-		return
+	off := f.walPos + int64(f.bwal.Buffered())
+	if f.aead != nil {
+		if b, err = a.seal(b, packetAD(f.tx, off)); err != nil {
+			return
+		}
 	}
 
-	if _, err = f.bwal.Write(b); err != nil {
-		return
+	if len(b) > wal1MaxPacket {
+		return &ErrINVAL{f.wal.Name() + ": WAL packet too long", len(b)}
 	}
 
-	if m := (4 + len(b)) % 16; m != 0 {
-		var pad [15]byte
-		_, err = f.bwal.Write(pad[:16-m])
+	p := make([]byte, (wal1Header+len(b)+15)&^15)
+	binary.BigEndian.PutUint32(p, uint32(len(b)))
+	binary.BigEndian.PutUint64(p[8:], f.tx)
+	copy(p[wal1Header:], b)
+	binary.BigEndian.PutUint32(p[4:], wal1CRC(p, off))
+	_, err = f.bwal.Write(p)
+	return
+}
+
+// wal1CRC returns the checksum of the WAL type 1 packet p at off.
+func wal1CRC(p []byte, off int64) uint32 {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(off))
+	crc := crc32.Update(crc32.Checksum(b[:], crcTable), crcTable, p[:4])
+	return crc32.Update(crc, crcTable, p[8:])
+}
+
+type walAppender0 ACIDFiler0
+
+func (a *walAppender0) Write(b []byte) (n int, err error) {
+	n, err = a.wal.WriteAt(b, a.walPos)
+	a.walPos += int64(n)
+	if a.ship != nil {
+		a.shipBuf = append(a.shipBuf, b[:n]...)
 	}
 	return
 }
@@ -77,6 +196,18 @@ const (
 
 const (
 	walTypeACIDFiler0 = iota
+	walTypeACIDFiler1
+)
+
+// WAL type 1 header packet comments, see WALApplier
+const (
+	walFirst   = "first"   // The transaction number starts a new sequence
+	walApplied = "applied" // The WAL holds only the header packet of the last applied transaction
+)
+
+const (
+	wal1Header    = 16      // WAL type 1 packet header size
+	wal1MaxPacket = 1 << 20 // WAL type 1 packet payload size limit, a data packet holds a page at most
 )
 
 // ACIDFiler0 is a very simple, synchronous implementation of 2PC. It uses a
@@ -86,22 +217,32 @@ const (
 //
 // ACIDFiler0 is a Filer.
 //
-// NOTE: Durable synchronous 2PC involves three fsyncs in this implementation
-// (WAL, DB, zero truncated WAL).  Where possible, it's recommended to collect
-// transactions for, say one second before performing the two phase commit as
-// the typical performance for rotational hard disks is about few tens of
-// fsyncs per second atmost. For an example of such collective transaction
+// NOTE: Durable synchronous 2PC involves four fsyncs in this implementation
+// (WAL, WAL checkpoint, DB, zero truncated WAL).  Where possible, it's
+// recommended to collect transactions for, say one second before performing
+// the two phase commit as the typical performance for rotational hard disks is
+// about few tens of fsyncs per second atmost. For an example of such collective transaction
 // approach please see the colecting FSM STT in Dbm's documentation[1].
 //
 //  [1]: http://godoc.org/github.com/cznic/exp/dbm
 type ACIDFiler0 struct {
 	*RollbackFiler
-	wal               *os.File
+	aead              cipher.AEAD // WAL packets are not encrypted if nil
+	seq               uint64      // packet number within the WAL type 0 being recovered
+	tx                uint64      // transaction number, WAL type 1
+	txFirst           bool        // tx starts a new sequence of transaction numbers
+	walOff            int64       // offset of the next packet to recover
+	walPos            int64       // WAL write offset
+	wal               Filer
+	pageSize          int64 // WAL data are whole pages of db if not zero, see pager
 	bwal              *bufio.Writer
 	data              []acidWrite
-	testHook          bool  // keeps WAL untruncated (once)
-	peakWal           int64 // tracks WAL maximum used size
-	peakBitFilerPages int   // track maximum transaction memory
+	testHook          bool     // keeps WAL untruncated (once)
+	peakWal           int64    // tracks WAL maximum used size
+	peakBitFilerPages int      // track maximum transaction memory
+	ship              *shipper // Writes committed transactions if not nil
+	shipBuf           []byte   // WAL of the transaction to ship
+	shipErr           error    // The error which stopped the shipping
 }
 
 // NewACIDFiler0 returns a  newly created ACIDFiler0 with WAL in wal.
@@ -114,15 +255,65 @@ type ACIDFiler0 struct {
 // transaction exists it's committed to db. If the recovery process finishes
 // successfully, the WAL is truncated to zero size and fsync'ed prior to return
 // from NewACIDFiler0.
+//
+// The WAL packets are checksummed. An incomplete transaction in the WAL is
+// discarded, a corrupted committed one is reported as an ErrILSEQ of type
+// ErrInvalidWAL with the offset of the bad packet.
 func NewACIDFiler(db Filer, wal *os.File) (r *ACIDFiler0, err error) {
-	fi, err := wal.Stat()
+	return newACIDFiler(db, NewSimpleFileFiler(wal), nil)
+}
+
+// NewEncryptedACIDFiler is like NewACIDFiler but the WAL packets are encrypted
+// and authenticated using AES-GCM with key, which must be 16, 24 or 32 bytes
+// long. The packet position is authenticated as well, so a WAL with packets
+// modified or reordered is rejected by the recovery with an ErrILSEQ of type
+// ErrDecrypt or ErrInvalidWAL. Packets removed from the WAL cannot be told
+// apart from an incomplete transaction, which the recovery discards.
+//
+// The data written to db are not encrypted by the ACIDFiler0, wrap db in an
+// EncryptingFiler using the same or another key for that.
+func NewEncryptedACIDFiler(db Filer, wal *os.File, key []byte) (r *ACIDFiler0, err error) {
+	aead, err := newAEAD(key)
 	if err != nil {
 		return
 	}
 
-	r = &ACIDFiler0{wal: wal}
+	return newACIDFiler(db, NewSimpleFileFiler(wal), aead)
+}
+
+// NewACIDFilerWAL is like NewACIDFiler but the WAL is kept in the Filer wal,
+// which must not be shared with any other user. BeginUpdate, EndUpdate and
+// Rollback of wal are never called. If key is not empty, the WAL packets are
+// encrypted as by NewEncryptedACIDFiler.
+func NewACIDFilerWAL(db, wal Filer, key []byte) (r *ACIDFiler0, err error) {
+	var aead cipher.AEAD
+	if len(key) != 0 {
+		if aead, err = newAEAD(key); err != nil {
+			return
+		}
+	}
+
+	return newACIDFiler(db, wal, aead)
+}
+
+func newACIDFiler(db, wal Filer, aead cipher.AEAD) (r *ACIDFiler0, err error) {
+	sz, err := wal.Size()
+	if err != nil {
+		return
+	}
 
-	if fi.Size() != 0 {
+	r = &ACIDFiler0{aead: aead, wal: wal}
+	if p, ok := db.(pager); ok {
+		r.pageSize = p.pageSize()
+	}
+	var b [8]byte
+	if _, err = io.ReadFull(rand.Reader, b[:]); err != nil {
+		return
+	}
+
+	r.tx, r.txFirst = binary.BigEndian.Uint64(b[:]), true
+
+	if sz != 0 {
 		if err = r.recoverDb(db); err != nil {
 			return
 		}
@@ -133,7 +324,27 @@ func NewACIDFiler(db Filer, wal *os.File) (r *ACIDFiler0, err error) {
 	if r.RollbackFiler, err = NewRollbackFiler(
 		db,
 		func(sz int64) (err error) {
-			// Checkpoint
+			// Checkpoint, a Truncate alone starts no epoch.
+			if err = acidWriter.epoch(); err != nil {
+				return
+			}
+
+			if r.pageSize != 0 {
+				if err = acidWriter.pages(db, sz); err != nil {
+					return
+				}
+			}
+
+			// The checkpoint packet must not reach the disk
+			// before the rest of the transaction.
+			if err = r.bwal.Flush(); err != nil {
+				return
+			}
+
+			if err = r.wal.Sync(); err != nil {
+				return
+			}
+
 			if err = acidWriter.writePacket([]interface{}{wpt00Checkpoint, sz}); err != nil {
 				return
 			}
@@ -148,16 +359,20 @@ func NewACIDFiler(db Filer, wal *os.File) (r *ACIDFiler0, err error) {
 				return
 			}
 
-			wfi, err := r.wal.Stat()
+			wsz, err := r.wal.Size()
 			switch err != nil {
 			case true:
 				// unexpected, but ignored
 			case false:
-				r.peakWal = mathutil.MaxInt64(wfi.Size(), r.peakWal)
+				r.peakWal = mathutil.MaxInt64(wsz, r.peakWal)
 			}
 
 			// Phase 1 commit complete
 
+			if r.ship != nil {
+				r.shipTx()
+			}
+
 			for _, v := range r.data {
 				if _, err := db.WriteAt(v.b, v.off); err != nil {
 					return err
@@ -179,9 +394,7 @@ func NewACIDFiler(db Filer, wal *os.File) (r *ACIDFiler0, err error) {
 					return
 				}
 
-				if _, err = r.wal.Seek(0, 0); err != nil {
-					return
-				}
+				r.walPos = 0
 			}
 
 			r.testHook = false
@@ -201,7 +414,52 @@ func (a ACIDFiler0) PeakWALSize() int64 {
 	return a.peakWal
 }
 
-func (a *ACIDFiler0) readPacket(f *bufio.Reader) (items []interface{}, err error) {
+// seal returns the encrypted packet payload b. The nonce is stored in front
+// of the sealed payload, ad is the additional data.
+func (a *acidWriter0) seal(b, ad []byte) (r []byte, err error) {
+	ns := a.aead.NonceSize()
+	r = make([]byte, ns, ns+len(b)+a.aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, r); err != nil {
+		return
+	}
+
+	return a.aead.Seal(r, r[:ns], b, ad), nil
+}
+
+// open returns the decrypted payload b of the packet at off, see seal.
+func (a *ACIDFiler0) open(b, ad []byte, off int64) (r []byte, err error) {
+	ns := a.aead.NonceSize()
+	if len(b) < ns+a.aead.Overhead() {
+		return nil, &ErrILSEQ{Type: ErrDecrypt, Off: off, Name: a.wal.Name(), More: "short packet"}
+	}
+
+	if r, err = a.aead.Open(nil, b[:ns], b[ns:], ad); err != nil {
+		return nil, &ErrILSEQ{Type: ErrDecrypt, Off: off, Name: a.wal.Name(), More: err}
+	}
+
+	return
+}
+
+// seqAD returns the additional data of the next WAL type 0 packet, its
+// sequence number.
+func (a *ACIDFiler0) seqAD() []byte {
+	var ad [8]byte
+	binary.BigEndian.PutUint64(ad[:], a.seq)
+	a.seq++
+	return ad[:]
+}
+
+// packetAD returns the additional data of the WAL type 1 packet of
+// transaction tx at off.
+func packetAD(tx uint64, off int64) []byte {
+	var ad [16]byte
+	binary.BigEndian.PutUint64(ad[:], tx)
+	binary.BigEndian.PutUint64(ad[8:], uint64(off))
+	return ad[:]
+}
+
+// readPacket reads the next WAL type 0 packet from f, sz is the WAL size.
+func (a *ACIDFiler0) readPacket(f *bufio.Reader, sz int64) (items []interface{}, err error) {
 	var b4 [4]byte
 	n, err := io.ReadAtLeast(f, b4[:], 4)
 	if n != 4 {
@@ -211,114 +469,328 @@ func (a *ACIDFiler0) readPacket(f *bufio.Reader) (items []interface{}, err error
 	ln := int(binary.BigEndian.Uint32(b4[:]))
 	m := (4 + ln) % 16
 	padd := (16 - m) % 16
+	if int64(4+ln+padd) > sz-a.walOff {
+		return nil, io.ErrUnexpectedEOF
+	}
+
 	b := make([]byte, ln+padd)
 	if n, err = io.ReadAtLeast(f, b, len(b)); n != len(b) {
 		return
 	}
 
-	return DecodeScalars(b[:ln])
+	off := a.walOff
+	a.walOff += int64(4 + len(b))
+	b = b[:ln]
+	if a.aead != nil {
+		if b, err = a.open(b, a.seqAD(), off); err != nil {
+			return
+		}
+	}
+
+	return DecodeScalars(b)
+}
+
+// packet1 returns the payload, decrypted if necessary, and the transaction
+// number of the WAL type 1 packet at off and the offset of the next packet.
+// ok is false if there's no complete packet with a valid checksum at off.
+func (a *ACIDFiler0) packet1(off, sz int64) (b []byte, tx uint64, next int64, ok bool, err error) {
+	var h [wal1Header]byte
+	if sz-off < wal1Header {
+		return
+	}
+
+	if _, err = a.wal.ReadAt(h[:], off); err != nil {
+		if !fileutil.IsEOF(err) {
+			return
+		}
+
+		err = nil
+	}
+
+	n := int64(binary.BigEndian.Uint32(h[:]))
+	if next = off + (wal1Header+n+15)&^15; next > sz {
+		return
+	}
+
+	p := make([]byte, next-off)
+	if _, err = a.wal.ReadAt(p, off); err != nil {
+		if !fileutil.IsEOF(err) {
+			return
+		}
+
+		err = nil
+	}
+
+	b, tx, ok, err = a.parse1(p, off)
+	return
+}
+
+// parse1 returns the payload, decrypted if necessary, and the transaction
+// number of the complete WAL type 1 packet p at off. ok is false if the
+// checksum of p is invalid.
+func (a *ACIDFiler0) parse1(p []byte, off int64) (b []byte, tx uint64, ok bool, err error) {
+	if binary.BigEndian.Uint32(p[4:]) != wal1CRC(p, off) {
+		return
+	}
+
+	tx = binary.BigEndian.Uint64(p[8:])
+	b, ok = p[wal1Header:wal1Header+binary.BigEndian.Uint32(p)], true
+	if a.aead != nil {
+		b, err = a.open(b, packetAD(tx, off), off)
+	}
+	return
+}
+
+// checkpoint1 reports whether a valid WAL type 1 checkpoint packet of
+// transaction tx, or of any transaction if any is true, exists at or after
+// off.
+func (a *ACIDFiler0) checkpoint1(off, sz int64, tx uint64, any bool) (bool, error) {
+	for ; off < sz; off += 16 {
+		b, ptx, _, ok, err := a.packet1(off, sz)
+		if err != nil {
+			return false, err
+		}
+
+		if !ok || !any && ptx != tx {
+			continue
+		}
+
+		if items, err := DecodeScalars(b); err == nil && len(items) != 0 && items[0] == int64(wpt00Checkpoint) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (a *ACIDFiler0) recoverDb(db Filer) (err error) {
-	fi, err := a.wal.Stat()
+	sz, err := a.wal.Size()
 	if err != nil {
 		return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: err}
 	}
 
-	if sz := fi.Size(); sz%16 != 0 {
+	if sz%16 != 0 {
 		return &ErrILSEQ{Type: ErrFileSize, Name: a.wal.Name(), Arg: sz}
 	}
 
-	f := bufio.NewReader(a.wal)
-	items, err := a.readPacket(f)
+	defer func() {
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			// The WAL ends before the checkpoint, db was not updated
+			// by the last, incomplete transaction. Discard it.
+			if err = a.wal.Truncate(0); err == nil {
+				err = a.wal.Sync()
+			}
+		}
+	}()
+
+	a.seq, a.walOff = 0, 0
+	b, tx, next, ok, err := a.packet1(0, sz)
 	if err != nil {
 		return
 	}
 
-	if len(items) != 3 || items[0] != int64(wpt00Header) || items[1] != int64(walTypeACIDFiler0) {
-		return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("invalid packet items %#v", items)}
+	if ok {
+		return a.recover1(db, b, tx, next, sz)
 	}
 
-	tr := NewBTree(nil)
+	f := bufio.NewReader(io.NewSectionReader(a.wal, 0, sz))
+	if items, err := a.readPacket(f, sz); err == nil && len(items) == 3 && items[0] == int64(wpt00Header) && items[1] == int64(walTypeACIDFiler0) {
+		return a.recover0(db, f, sz)
+	}
+
+	// No valid header packet. A committed transaction has one, unless the
+	// WAL got corrupted.
+	if ok, err = a.checkpoint1(0, sz, 0, true); err != nil {
+		return
+	}
+
+	if ok {
+		return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: "corrupted header packet of a committed transaction"}
+	}
 
+	return io.ErrUnexpectedEOF
+}
+
+// recover0 recovers db from a WAL type 0, its header packet was already read
+// from f.
+func (a *ACIDFiler0) recover0(db Filer, f *bufio.Reader, sz int64) (err error) {
+	tr := NewBTree(nil)
 	for {
-		items, err = a.readPacket(f)
+		off := a.walOff
+		items, err := a.readPacket(f, sz)
 		if err != nil {
-			return
+			return err
 		}
 
 		if len(items) < 2 {
-			return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("too few packet items %#v", items)}
+			return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("too few packet items %#v", items)}
 		}
 
 		switch items[0] {
 		case int64(wpt00WriteData):
-			if len(items) != 3 {
-				return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("invalid data packet items %#v", items)}
-			}
-
-			b, off := items[1].([]byte), items[2].(int64)
-			var key [8]byte
-			binary.BigEndian.PutUint64(key[:], uint64(off))
-			if err = tr.Set(key[:], b); err != nil {
-				return
+			if err = a.walData(tr, items, off); err != nil {
+				return err
 			}
 		case int64(wpt00Checkpoint):
 			var b1 [1]byte
 			if n, err := f.Read(b1[:]); n != 0 || err == nil {
-				return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("checkpoint n %d, err %v", n, err)}
-			}
-
-			if len(items) != 2 {
-				return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("checkpoint packet invalid items %#v", items)}
+				return &ErrILSEQ{Type: ErrInvalidWAL, Off: a.walOff, Name: a.wal.Name(), More: fmt.Sprintf("checkpoint n %d, err %v", n, err)}
 			}
 
-			sz := items[1].(int64)
-			enum, err := tr.seekFirst()
+			sz, err := a.walCheckpoint(items, off)
 			if err != nil {
 				return err
 			}
 
-			for {
-				k, v, err := enum.current()
-				if err != nil {
-					if fileutil.IsEOF(err) {
-						break
-					}
+			return a.replay(db, tr, sz)
+		default:
+			return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("packet tag %v", items[0])}
+		}
+	}
+}
 
-					return err
-				}
+// recover1 recovers db from a WAL type 1 of transaction tx with header packet
+// payload b. The next packet is at off.
+//
+// A packet, which is torn, has an invalid checksum or belongs to another
+// transaction ends an incomplete transaction, unless a valid checkpoint
+// packet of tx follows. The checkpoint packet is written only after the rest
+// of the transaction is synced, so then the WAL is corrupted.
+func (a *ACIDFiler0) recover1(db Filer, b []byte, tx uint64, off, sz int64) (err error) {
+	items, err := DecodeScalars(b)
+	if err != nil || len(items) != 3 || items[0] != int64(wpt00Header) || items[1] != int64(walTypeACIDFiler1) {
+		return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("invalid header packet items %#v", items)}
+	}
 
-				if _, err = db.WriteAt(v, int64(binary.BigEndian.Uint64(k))); err != nil {
-					return err
-				}
+	// The numbers continue the recovered transaction, the number of an
+	// incomplete one is reused.
+	a.tx, a.txFirst = tx, items[2] == walFirst
+	if items[2] != walApplied {
+		a.tx--
+	}
+	tr := NewBTree(nil)
+	for {
+		b, ptx, next, ok, err := a.packet1(off, sz)
+		if err != nil {
+			return err
+		}
 
-				if err = enum.next(); err != nil {
-					if fileutil.IsEOF(err) {
-						break
-					}
+		if !ok || ptx != tx {
+			if ok, err = a.checkpoint1(off+16, sz, tx, false); err != nil {
+				return err
+			}
 
-					return err
-				}
+			if ok {
+				return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: "corrupted packet of a committed transaction"}
 			}
 
-			if err = db.Truncate(sz); err != nil {
+			return io.ErrUnexpectedEOF
+		}
+
+		if items, err = DecodeScalars(b); err != nil || len(items) < 2 {
+			return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("invalid packet items %#v, err %v", items, err)}
+		}
+
+		switch items[0] {
+		case int64(wpt00WriteData):
+			if err = a.walData(tr, items, off); err != nil {
 				return err
 			}
+		case int64(wpt00Checkpoint):
+			if next != sz {
+				return &ErrILSEQ{Type: ErrInvalidWAL, Off: next, Name: a.wal.Name(), More: "data after the checkpoint packet"}
+			}
 
-			if err = db.Sync(); err != nil {
+			sz, err := a.walCheckpoint(items, off)
+			if err != nil {
 				return err
 			}
 
-			// Recovery complete
+			a.tx, a.txFirst = tx, false
+			return a.replay(db, tr, sz)
+		default:
+			return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("packet tag %v", items[0])}
+		}
+		off = next
+	}
+}
 
-			if err = a.wal.Truncate(0); err != nil {
-				return err
+// walData collects the data of the WAL data packet items at off in tr.
+func (a *ACIDFiler0) walData(tr *BTree, items []interface{}, off int64) (err error) {
+	if len(items) == 3 {
+		b, ok := items[1].([]byte)
+		doff, ok2 := items[2].(int64)
+		if ok && ok2 {
+			var key [8]byte
+			binary.BigEndian.PutUint64(key[:], uint64(doff))
+			return tr.Set(key[:], b)
+		}
+	}
+
+	return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("invalid data packet items %#v", items)}
+}
+
+// walCheckpoint returns the database size of the WAL checkpoint packet items
+// at off.
+func (a *ACIDFiler0) walCheckpoint(items []interface{}, off int64) (sz int64, err error) {
+	if len(items) == 2 {
+		var ok bool
+		if sz, ok = items[1].(int64); ok {
+			return
+		}
+	}
+
+	return 0, &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("checkpoint packet invalid items %#v", items)}
+}
+
+// replay writes the data collected in tr to db, truncates it to sz and
+// discards the WAL.
+func (a *ACIDFiler0) replay(db Filer, tr *BTree, sz int64) (err error) {
+	enum, err := tr.seekFirst()
+	switch {
+	case fileutil.IsEOF(err):
+		// A Truncate only transaction.
+		enum = nil
+	case err != nil:
+		return err
+	}
+
+	for enum != nil {
+		k, v, err := enum.current()
+		if err != nil {
+			if fileutil.IsEOF(err) {
+				break
 			}
 
-			return a.wal.Sync()
-		default:
-			return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("packet tag %v", items[0])}
+			return err
+		}
+
+		if _, err = db.WriteAt(v, int64(binary.BigEndian.Uint64(k))); err != nil {
+			return err
+		}
+
+		if err = enum.next(); err != nil {
+			if fileutil.IsEOF(err) {
+				break
+			}
+
+			return err
 		}
 	}
+
+	if err = db.Truncate(sz); err != nil {
+		return err
+	}
+
+	if err = db.Sync(); err != nil {
+		return err
+	}
+
+	// Recovery complete
+
+	if err = a.wal.Truncate(0); err != nil {
+		return err
+	}
+
+	return a.wal.Sync()
 }
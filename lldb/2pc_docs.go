@@ -19,10 +19,18 @@ Packets, including the 4 byte 'size' prefix, MUST BE padded to size == 0 (mod
 Encoded scalars first item is a packet type number (packet tag). The meaning of
 any other item(s) of the payload depends on the packet tag.
 
+Encrypted WAL packet payload (NewEncryptedACIDFiler), parts in slice notation
+	[0:12],  12 bytes:       nonce []byte    // random
+	[12:N],  N-12 bytes:     sealed []byte   // AES-GCM sealed gb encoded scalars
+
+The additional data of the AES-GCM seal is the packet sequence number as an
+uint64 in network byte order. The first packet of a WAL file has sequence
+number zero.
+
 Packet definitions
 
 	{wpt00Header int, typ int, s string}
-		typ:	Must be zero (ACIDFiler0 file).
+		typ:	Zero (ACIDFiler0 file) or one (ACIDFiler1 file).
 		s:	Any comment string, empty string is okay.
 
 		This packet must be present only once - as the first packet of
@@ -37,6 +45,66 @@ Packet definitions
 		This packet must be present only once - as the last packet of
 		a WAL file.
 
+A WAL file ending before its checkpoint packet, including a truncated packet,
+holds an incomplete transaction. The database was not yet updated by it, so the
+recovery discards such WAL.
+
+Anatomy of an ACIDFiler1 WAL file
+
+The ACIDFiler0 file format above describes the ACIDFiler1 file as well, except
+the packet framing. The packets, including the header packet, are
+
+WAL type 1 packet, parts in slice notation
+	[0:4],     4 bytes:      N uint32        // network byte order
+	[4:8],     4 bytes:      crc uint32      // network byte order
+	[8:16],    8 bytes:      tx uint64       // network byte order
+	[16:16+N], N bytes:      payload []byte  // gb encoded scalars
+
+Packets, including the 16 byte header, MUST BE padded to size == 0 (mod 16).
+The values of the padding bytes MUST BE zero.
+
+crc is the CRC-32 (Castagnoli) of the packet offset as an uint64 in network
+byte order, followed by the packet bytes except crc, including the padding.
+
+tx is the transaction number, the same in all packets of a WAL file. The next
+transaction uses the next number. An ACIDFiler0 starts at a random one, the
+comment of its first header packet is then "first", unless it recovered a WAL
+of type 1. The numbers then continue after the recovered transaction or, if
+the transaction was incomplete, its number is reused.
+
+Encrypted payload is the same as in the ACIDFiler0 file, but the additional
+data of the AES-GCM seal is tx followed by the packet offset as an uint64, both
+in network byte order.
+
+The checkpoint packet is written only after all the previous packets of the
+transaction are synced to disk. The recovery hence takes a packet, which is
+truncated, has an invalid crc or a different tx, for the end of an incomplete
+transaction, which it discards, unless a valid checkpoint packet of tx follows
+it. Then the committed transaction is corrupted and the recovery fails with an
+ErrILSEQ of type ErrInvalidWAL, its Off field is the offset of the bad packet.
+Without a valid header packet of either file type, the WAL is taken for an
+incomplete transaction, unless it contains any valid checkpoint packet of type
+1.
+
+New WAL files are always ACIDFiler1 files.
+
+Shipped transactions
+
+ACIDFiler0.Ship writes a stream of the committed transactions, each one is the
+content of its ACIDFiler1 WAL file, from the header packet through the
+checkpoint packet. The packet offsets, which the crc and the encryption
+additional data depend on, are the offsets within the WAL file, ie. the first
+packet of every transaction is at offset zero.
+
+The standby WAL of a WALApplier keeps only the header packet of the last
+applied transaction, its comment is "applied". A shipped transaction must use
+the next number, unless its header comment is "first".
+
+Inspecting WAL files
+
+WALReader reads the packets of a WAL file and checks the rules above. The
+lldbwal command, see github.com/cznic/exp/cmd/lldbwal, lists them.
+
 */
 
 package lldb
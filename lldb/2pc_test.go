@@ -283,3 +283,344 @@ func TestACIDFiler0(t *testing.T) {
 		return
 	}
 }
+
+func TestEncryptedACIDFiler(t *testing.T) {
+	wal, err := ioutil.TempFile("", "test-encryptedacidfiler-wal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		wal.Close()
+		os.Remove(wal.Name())
+	}()
+
+	acidFiler, err := NewEncryptedACIDFiler(NewMemFiler(), wal, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = acidFiler.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := bytes.Repeat([]byte("secret data "), 1000)
+	if _, err = acidFiler.WriteAt(b, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	acidFiler.testHook = true // keep WAL
+	if err = acidFiler.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := ioutil.ReadFile(wal.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(image, []byte("secret")) {
+		t.Fatal("plaintext found in the WAL")
+	}
+
+	replay := func(image []byte, key []byte) (db *MemFiler, err error) {
+		if err = wal.Truncate(0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = wal.WriteAt(image, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = wal.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		db = NewMemFiler()
+		switch {
+		case key == nil:
+			_, err = NewACIDFiler(db, wal)
+		default:
+			_, err = NewEncryptedACIDFiler(db, wal, key)
+		}
+		return
+	}
+
+	// Wrong key, corrupted WAL, plain WAL reader.
+	bad := append([]byte(nil), image...)
+	bad[8] ^= 1 // Header packet nonce.
+	for i, v := range []struct {
+		image []byte
+		key   []byte
+	}{
+		{image, []byte("fedcba9876543210")},
+		{bad, testKey},
+		{image, nil},
+	} {
+		if _, err := replay(v.image, v.key); err == nil {
+			t.Fatal(i, "unexpected success")
+		} else {
+			t.Log(i, err)
+		}
+	}
+
+	// A truncated WAL is an incomplete transaction.
+	db, err := replay(image[:len(image)-16*((len(image)/16)/2)], testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sz, err := db.Size(); sz != 0 {
+		t.Fatal(sz, err)
+	}
+
+	if db, err = replay(image, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, len(b))
+	if n, err := db.ReadAt(g, 100); n != len(b) || !bytes.Equal(g, b) {
+		t.Fatal(n, err)
+	}
+
+	if fi, err := wal.Stat(); err != nil || fi.Size() != 0 {
+		t.Fatal(fi.Size(), err)
+	}
+}
+
+func TestACIDFilerWALType1(t *testing.T) {
+	for _, key := range [][]byte{nil, testKey} {
+		testACIDFilerWALType1(t, key)
+	}
+}
+
+func testACIDFilerWALType1(t *testing.T, key []byte) {
+	writes := []struct {
+		b   []byte
+		off int64
+	}{
+		{bytes.Repeat([]byte{1}, 1000), 0},
+		{bytes.Repeat([]byte{2}, 5000), 2000},
+		{bytes.Repeat([]byte{3}, 10), 100},
+	}
+	image := func(walType int) []byte {
+		wal := NewMemFiler()
+		a, err := NewACIDFilerWAL(NewMemFiler(), wal, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = a.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, v := range writes {
+			if _, err = a.WriteAt(v.b, v.off); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		a.testHook = true // keep WAL
+		if err = a.EndUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, wal.size)
+		if n, _ := wal.ReadAt(b, 0); n != len(b) {
+			t.Fatal(n)
+		}
+
+		if walType == walTypeACIDFiler0 {
+			return walImage0(t, b, key)
+		}
+
+		return b
+	}
+	replay := func(image []byte) (db *MemFiler, err error) {
+		wal := NewMemFiler()
+		if _, err = wal.WriteAt(image, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		db = NewMemFiler()
+		if _, err = NewACIDFilerWAL(db, wal, key); err != nil {
+			return
+		}
+
+		if wal.size != 0 {
+			t.Fatal(wal.size)
+		}
+
+		return
+	}
+	discarded := func(i int, image []byte) {
+		db, err := replay(image)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+
+		if db.size != 0 {
+			t.Fatal(i, db.size)
+		}
+	}
+
+	e := NewMemFiler()
+	for _, v := range writes {
+		e.WriteAt(v.b, v.off)
+	}
+	ref := make([]byte, e.size)
+	e.ReadAt(ref, 0)
+
+	for _, walType := range []int{walTypeACIDFiler0, walTypeACIDFiler1} {
+		db, err := replay(image(walType))
+		if err != nil {
+			t.Fatal(walType, err)
+		}
+
+		g := make([]byte, db.size)
+		db.ReadAt(g, 0)
+		if !bytes.Equal(g, ref) {
+			t.Fatal(walType, "recovered content differs")
+		}
+	}
+
+	img := image(walTypeACIDFiler1)
+	var packets []int64
+	for off := int64(0); off < int64(len(img)); {
+		packets = append(packets, off)
+		off += (wal1Header + int64(binary.BigEndian.Uint32(img[off:])) + 15) &^ 15
+	}
+	if len(packets) < 4 {
+		t.Fatal(len(packets))
+	}
+
+	// A truncated WAL is an incomplete transaction.
+	for n := 0; n < len(img); n += 16 {
+		discarded(n, img[:n])
+	}
+
+	// So is a WAL with an invalid checkpoint packet, a torn packet or a
+	// packet of another transaction.
+	last := packets[len(packets)-1]
+	bad := append([]byte(nil), img...)
+	bad[last+wal1Header] ^= 1
+	discarded(-1, bad)
+
+	bad = append([]byte(nil), img[:last]...)
+	for i := packets[2]; i < packets[3]; i++ {
+		bad[i] = 0
+	}
+	discarded(-2, bad)
+
+	bad = append(img[:packets[2]:packets[2]], image(walTypeACIDFiler1)[packets[2]:]...)
+	discarded(-3, bad)
+
+	// A corrupted packet of a committed transaction is reported.
+	for _, off := range packets[:len(packets)-1] {
+		bad := append([]byte(nil), img...)
+		bad[off+wal1Header] ^= 1
+		_, err := replay(bad)
+		if e, ok := err.(*ErrILSEQ); !ok || e.Type != ErrInvalidWAL || e.Off != off {
+			t.Fatalf("%#x: %v", off, err)
+		}
+	}
+}
+
+func TestACIDFilerCrash(t *testing.T) {
+	testACIDFilerCrash(t, func(f Filer) (Filer, error) { return f, nil })
+	testACIDFilerCrash(t, func(f Filer) (Filer, error) { return NewEncryptingFiler(f, testKey) })
+	testACIDFilerCrash(t, func(f Filer) (Filer, error) { return NewChecksumFiler(f), nil })
+}
+
+func testACIDFilerCrash(t *testing.T, wrap func(Filer) (Filer, error)) {
+	dbf := NewCrashFiler()
+	walf := dbf.Sibling()
+	db, err := wrap(dbf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewACIDFilerWAL(db, walf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// states[i] is the content after ends[i] operations of the CrashFiler
+	// log. The transactions write within and across pages, grow and
+	// shrink the content.
+	rng := rand.New(rand.NewSource(42))
+	ends := []int{dbf.Ops()}
+	states := [][]byte{nil}
+	m := NewMemFiler()
+	for i := 0; i < 12; i++ {
+		if err = a.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		for j := 0; j < 3; j++ {
+			b := make([]byte, rng.Intn(3*slotPageSize))
+			for k := range b {
+				b[k] = byte(rng.Int())
+			}
+			off := rng.Int63n(5 * slotPageSize)
+			for _, f := range []Filer{a, m} {
+				if _, err = f.WriteAt(b, off); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if i%3 == 2 {
+			sz := rng.Int63n(4 * slotPageSize)
+			for _, f := range []Filer{a, m} {
+				if err = f.Truncate(sz); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if err = a.EndUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		ends = append(ends, dbf.Ops())
+		states = append(states, filerBytes(m))
+	}
+
+	check := func(k int, persist func(op, sector int) bool) {
+		dimg, err := dbf.Crash(k, persist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wimg, err := walf.Crash(k, persist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := wrap(dimg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = NewACIDFilerWAL(db, wimg, nil); err != nil {
+			t.Fatalf("crash point %d: %v", k, err)
+		}
+
+		j := 0
+		for j+1 < len(ends) && ends[j+1] <= k {
+			j++
+		}
+		g := filerBytes(db)
+		if !bytes.Equal(g, states[j]) && (j+1 == len(states) || !bytes.Equal(g, states[j+1])) {
+			t.Fatalf("crash point %d: unexpected content", k)
+		}
+	}
+
+	all := func(op, sector int) bool { return true }
+	for k := ends[0]; k <= dbf.Ops(); k++ {
+		torn := func(op, sector int) bool { return op < k-1 || sector%2 == 0 }
+		check(k, nil)
+		check(k, all)
+		check(k, torn)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/cznic/bufs"
 	"github.com/cznic/fileutil"
 	"github.com/cznic/sortutil"
+	"github.com/cznic/zappy"
 )
 
 const (
@@ -23,8 +24,13 @@ const (
 	kKV               = 19          // Size of the key/value field in btreeDataPage
 	kSz               = kKV - 1 - 7 // Content prefix size
 	kH                = kKV - 7     // Content field offset for handle
+	kChain            = 0xfe        // Content field tag of an overflow chain
+	kChainData        = maxRq - 7   // Content bytes per overflow chain block
 	tagBTreeDataPage  = 1
 	tagBTreeIndexPage = 0
+
+	tagBTreeCountedIndexPage = 2 // Index page with subtree counts
+	btreeCounted             = 1 // Root block flag of a counted tree
 )
 
 // BTree is a B+tree[1][2], i.e. a variant which speeds up
@@ -39,6 +45,12 @@ const (
 // io.EOF is returned only by bTreeEnumerator methods to indicate "no more K-V
 // pair".
 //
+// A counted BTree, see NewCountedBTree and CreateCountedBTree, maintains the
+// number of KV pairs in every subtree. Len, Rank, IndexRank and SeekIndex are
+// then O(log n) instead of O(n). The price is an additional lookup and updates
+// of the index pages on the path to the data page for every insertion or
+// deletion of a KV pair.
+//
 //  [1]: http://en.wikipedia.org/wiki/B+tree
 //  [2]: http://zgking.com:8080/home/donghui/publications/books/dshandbook_BTree.pdf
 //  [3]: http://people.cs.aau.dk/~simas/aalg06/UbiquitBtree.pdf
@@ -47,17 +59,32 @@ type BTree struct {
 	root    btree
 	collate func(a, b []byte) int
 	serial  uint64
+	counted bool
 }
 
 // NewBTree returns a new, memory-only BTree.
 func NewBTree(collate func(a, b []byte) int) *BTree {
+	return newMemBTree(collate, false)
+}
+
+// NewCountedBTree returns a new, memory-only, counted BTree.
+func NewCountedBTree(collate func(a, b []byte) int) *BTree {
+	return newMemBTree(collate, true)
+}
+
+func newMemBTree(collate func(a, b []byte) int, counted bool) *BTree {
 	store := newMemBTreeStore()
-	root, err := newBTree(store)
+	root, err := newBTree2(store, counted)
 	if err != nil { // should not happen
 		panic(err.Error())
 	}
 
-	return &BTree{store, root, collate, 0}
+	return &BTree{store, root, collate, 0, counted}
+}
+
+// IsCounted reports whether t is a counted BTree.
+func (t *BTree) IsCounted() bool {
+	return t.counted
 }
 
 // IsMem reports if t is a memory only BTree.
@@ -89,6 +116,25 @@ func (t *BTree) Delete(key []byte) (err error) {
 	return
 }
 
+// DeleteRange deletes all keys in the closed interval [from, to] and their
+// associated values from the tree. A nil from or to means the interval is not
+// bounded on that side. Data pages wholly inside the interval are dropped
+// without reading their keys one by one and only the pages at the ends of the
+// interval are rebalanced.
+func (t *BTree) DeleteRange(from, to []byte) (err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.serial++
+	c := t.collate
+	if c == nil {
+		c = bytes.Compare
+	}
+	return t.root.deleteRange(t.store, c, from, to)
+}
+
 // DeleteAny deletes one key and its associated value from the tree. If the
 // tree is empty on return then empty is true.
 func (t *BTree) DeleteAny() (empty bool, err error) {
@@ -288,6 +334,132 @@ func (t *BTree) Last() (key, value []byte, err error) {
 	return
 }
 
+// Len returns the number of KV pairs in t. Len is O(1) for counted trees and
+// O(n) otherwise.
+//
+// Len is safe for concurrent access by multiple goroutines iff no other
+// goroutine mutates the tree.
+func (t *BTree) Len() (n int64, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	if !t.counted {
+		enum, err := t.seekFirst()
+		for ; err == nil; err = enum.next() {
+			n++
+		}
+		if !fileutil.IsEOF(err) {
+			return 0, err
+		}
+
+		return n, nil
+	}
+
+	return t.root.len(t.store)
+}
+
+// Rank returns the number of KV pairs with keys collating before key. If key
+// is in t then hit is true. Rank is O(log n) for counted trees and O(n)
+// otherwise.
+//
+// Rank is safe for concurrent access by multiple goroutines iff no other
+// goroutine mutates the tree.
+func (t *BTree) Rank(key []byte) (rank int64, hit bool, err error) {
+	return t.IndexRank(key, t.collate)
+}
+
+// IndexRank is like Rank, but it uses a custom collate function c for
+// comparing key with the keys of t, like IndexSeek does.
+//
+// IndexRank is safe for concurrent access by multiple goroutines iff no other
+// goroutine mutates the tree.
+func (t *BTree) IndexRank(key []byte, c func(a, b []byte) int) (rank int64, hit bool, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	if c == nil {
+		c = bytes.Compare
+	}
+
+	if !t.counted {
+		enum, err := t.seekFirst()
+		for ; err == nil; err = enum.next() {
+			k, _, err := enum.current()
+			if err != nil {
+				return 0, false, err
+			}
+
+			if y := c(key, k); y <= 0 {
+				return rank, y == 0, nil
+			}
+
+			rank++
+		}
+		if !fileutil.IsEOF(err) {
+			return 0, false, err
+		}
+
+		return rank, false, nil
+	}
+
+	return t.root.rank(t.store, c, key)
+}
+
+// SeekIndex returns an Enumerator positioned on the KV pair at index i, ie.
+// the KV pair having exactly i other KV pairs with keys collating before its
+// key. If there is no such KV pair, err == io.EOF is returned. SeekIndex is
+// O(log n) for counted trees and O(n) otherwise.
+//
+// SeekIndex is safe for concurrent access by multiple goroutines iff no other
+// goroutine mutates the tree.
+func (t *BTree) SeekIndex(i int64) (enum *BTreeEnumerator, err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	if i < 0 {
+		return nil, &ErrINVAL{Src: "BTree.SeekIndex", Val: i}
+	}
+
+	var enum0 *bTreeEnumerator
+	switch {
+	case t.counted:
+		r := &bTreeEnumerator{t: t, collate: t.collate, serial: t.serial}
+		if r.p, r.index, err = t.root.seekIndex(t.store, i); err != nil {
+			return
+		}
+
+		enum0 = r
+	default:
+		if enum0, err = t.seekFirst(); err != nil {
+			return
+		}
+
+		for ; i != 0; i-- {
+			if err = enum0.next(); err != nil {
+				return
+			}
+		}
+	}
+
+	var key []byte
+	if key, _, err = enum0.current(); err != nil {
+		return
+	}
+
+	enum = &BTreeEnumerator{
+		enum:     enum0,
+		firstHit: true,
+		key:      append([]byte(nil), key...),
+	}
+	return
+}
+
 // Put combines Get and Set in a more efficient way where the tree is walked
 // only once.  The upd(ater) receives the current (key, old-value), if that
 // exists or (key, nil) otherwise.  It can then return a (new-value, true, nil)
@@ -470,6 +642,31 @@ func (t *BTree) seekLast() (enum *bTreeEnumerator, err error) {
 	return &bTreeEnumerator{t: t, collate: t.collate, p: p, index: p.len() - 1, serial: t.serial}, nil
 }
 
+// BulkLoad fills the empty tree t with the KV pairs produced by src, which
+// returns io.EOF after the last pair. The keys must be produced in strictly
+// ascending collation order. BulkLoad writes fully packed data pages and
+// builds the index pages bottom-up, which is much faster than setting the KV
+// pairs one by one. The data pages are kept in memory, compressed, until src
+// is exhausted and then written back to back with their final links, so
+// none of them is relocated in an Allocator.
+//
+// If t is not empty, ErrPERM is returned. If the keys are not in strictly
+// ascending collation order, ErrINVAL is returned. On any error t is left
+// empty.
+func (t *BTree) BulkLoad(src func() (key, value []byte, err error)) (err error) {
+	if t == nil {
+		err = errors.New("BTree method invoked on nil receiver")
+		return
+	}
+
+	t.serial++
+	c := t.collate
+	if c == nil {
+		c = bytes.Compare
+	}
+	return t.root.bulkLoad(t.store, c, src)
+}
+
 // Set sets the value associated with key. Any previous value, if existed, is
 // overwritten by the new one.
 func (t *BTree) Set(key, value []byte) (err error) {
@@ -718,8 +915,17 @@ retry:
 // CreateBTree creates a new BTree in store. It returns the tree, its (freshly
 // assigned) handle (for OpenBTree or RemoveBTree) or an error, if any.
 func CreateBTree(store *Allocator, collate func(a, b []byte) int) (bt *BTree, handle int64, err error) {
-	r := &BTree{store: store, collate: collate}
-	if r.root, err = newBTree(store); err != nil {
+	return createBTree(store, collate, false)
+}
+
+// CreateCountedBTree is like CreateBTree, but the new tree is a counted BTree.
+func CreateCountedBTree(store *Allocator, collate func(a, b []byte) int) (bt *BTree, handle int64, err error) {
+	return createBTree(store, collate, true)
+}
+
+func createBTree(store *Allocator, collate func(a, b []byte) int, counted bool) (bt *BTree, handle int64, err error) {
+	r := &BTree{store: store, collate: collate, counted: counted}
+	if r.root, err = newBTree2(store, counted); err != nil {
 		return
 	}
 
@@ -733,13 +939,18 @@ func CreateBTree(store *Allocator, collate func(a, b []byte) int) (bt *BTree, ha
 // (handled by some upper layer "dispatcher").
 func OpenBTree(store *Allocator, collate func(a, b []byte) int, handle int64) (bt *BTree, err error) {
 	r := &BTree{store: store, root: btree(handle), collate: collate}
-	b := bufs.GCache.Get(7)
+	b := bufs.GCache.Get(8)
 	defer bufs.GCache.Put(b)
 	if b, err = store.Get(b, handle); err != nil {
 		return
 	}
 
-	if len(b) != 7 {
+	switch {
+	case len(b) == 7:
+		// ok
+	case len(b) == 8 && b[7] == btreeCounted:
+		r.counted = true
+	default:
 		return nil, &ErrILSEQ{Off: h2off(handle), More: "btree.go:671"}
 	}
 
@@ -879,56 +1090,126 @@ Offsets into the raw []byte:
 Child[X]    == 1+14*X
 DataPage[X] == 8+14*X
 
+Counted index page
+
+	  0
+	+---+
+	| 2 |
+	+---+
+
+2 indicates an index page of a counted tree
+
+1...count*21-1
+"array" of items, 21 bytes each. Count of items in kIndex-1..2*kIndex+2
+
+	Count = (len(raw) - 15) / 21
+
+	  0..6     7..13    14..20
+	+-------+---------+----------+
+	| Child | NChild  | DataPage |
+	+-------+---------+----------+
+
+	Child    == handle of a child index page
+	NChild   == number of KV pairs in the subtree of Child
+	DataPage == handle of a data page
+
+Offsets into the raw []byte:
+Child[X]    == 1+21*X
+NChild[X]   == 8+21*X
+DataPage[X] == 15+21*X
+
 */
 type btreeIndexPage []byte
 
-func newBTreeIndexPage(leftmostChild int64) (p btreeIndexPage) {
-	p = bufs.GCache.Get(1 + (kIndex+1)*2*7)[:8]
-	p[0] = tagBTreeIndexPage
+func newBTreeIndexPage(leftmostChild int64, counted bool) (p btreeIndexPage) {
+	if !counted {
+		p = bufs.GCache.Get(1 + (kIndex+1)*2*7)[:8]
+		p[0] = tagBTreeIndexPage
+		h2b(p[1:], leftmostChild)
+		return
+	}
+
+	p = bufs.GCache.Get(1 + (kIndex+1)*3*7)[:15]
+	p[0] = tagBTreeCountedIndexPage
 	h2b(p[1:], leftmostChild)
+	h2b(p[8:], 0)
 	return
 }
 
+func (p btreeIndexPage) counted() bool {
+	return p[0] == tagBTreeCountedIndexPage
+}
+
+// slot returns the size of the Child, NChild part of an item.
+func (p btreeIndexPage) slot() int {
+	if p.counted() {
+		return 14
+	}
+
+	return 7
+}
+
 func (p btreeIndexPage) len() int {
-	return (len(p) - 8) / 14
+	s := p.slot()
+	return (len(p) - 1 - s) / (s + 7)
 }
 
 func (p btreeIndexPage) child(index int) int64 {
-	return b2h(p[1+14*index:])
+	return b2h(p[1+(p.slot()+7)*index:])
 }
 
 func (p btreeIndexPage) setChild(index int, dp int64) {
-	h2b(p[1+14*index:], dp)
+	h2b(p[1+(p.slot()+7)*index:], dp)
+}
+
+func (p btreeIndexPage) count(index int) int64 {
+	return b2h(p[8+21*index:])
+}
+
+func (p btreeIndexPage) setCount(index int, n int64) {
+	h2b(p[8+21*index:], n)
+}
+
+// sum returns the number of KV pairs in the subtree of a counted index page.
+func (p btreeIndexPage) sum() (n int64) {
+	for i := 0; i <= p.len(); i++ {
+		n += p.count(i)
+	}
+	return
 }
 
 func (p btreeIndexPage) dataPage(index int) int64 {
-	return b2h(p[8+14*index:])
+	s := p.slot()
+	return b2h(p[1+s+(s+7)*index:])
 }
 
 func (p btreeIndexPage) setDataPage(index int, dp int64) {
-	h2b(p[8+14*index:], dp)
+	s := p.slot()
+	h2b(p[1+s+(s+7)*index:], dp)
 }
 
 func (q btreeIndexPage) insert(index int) btreeIndexPage {
+	s := q.slot()
+	it := s + 7
 	switch len0 := q.len(); {
 	case index < len0:
 		has := len(q)
-		need := has + 14
+		need := has + it
 		switch {
 		case cap(q) >= need:
 			q = q[:need]
 		default:
-			q = append(q, zeros[:14]...)
+			q = append(q, zeros[:it]...)
 		}
-		copy(q[8+14*(index+1):8+14*(index+1)+2*(len0-index)*7], q[8+14*index:])
+		copy(q[1+s+it*(index+1):], q[1+s+it*index:1+s+it*len0])
 	case index == len0:
 		has := len(q)
-		need := has + 14
+		need := has + it
 		switch {
 		case cap(q) >= need:
 			q = q[:need]
 		default:
-			q = append(q, zeros[:14]...)
+			q = append(q, zeros[:it]...)
 		}
 	}
 	return q
@@ -938,9 +1219,21 @@ func (p btreeIndexPage) insert3(index int, dataPage, child int64) btreeIndexPage
 	p = p.insert(index)
 	p.setDataPage(index, dataPage)
 	p.setChild(index+1, child)
+	if p.counted() {
+		p.setCount(index+1, 0)
+	}
 	return p
 }
 
+// childIndex returns the index of the child of p whose subtree holds key.
+func (p btreeIndexPage) childIndex(a btreeStore, c func(a, b []byte) int, key []byte) (int, error) {
+	i, eq, err := btreePage(p).find(a, c, key)
+	if eq {
+		i++
+	}
+	return i, err
+}
+
 func (p btreeIndexPage) cmp(a btreeStore, c func(a, b []byte) int, keyA []byte, keyBIndex int) (int, error) {
 	b := bufs.GCache.Get(maxBuf)
 	defer bufs.GCache.Put(b)
@@ -953,16 +1246,22 @@ func (p btreeIndexPage) cmp(a btreeStore, c func(a, b []byte) int, keyA []byte,
 }
 
 func (q btreeIndexPage) setLen(n int) btreeIndexPage {
+	s := q.slot()
 	q = q[:cap(q)]
-	need := 8 + 14*n
+	need := 1 + s + (s+7)*n
 	if need < len(q) {
 		return q[:need]
 	}
 	return append(q, make([]byte, need-len(q))...)
 }
 
-func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64, parentIndex int, index *int) (btreeIndexPage, error) {
-	right := newBTreeIndexPage(0)
+// For counted trees, delta is the change of the number of KV pairs in the
+// subtree of the child at the returned index, not yet reflected in the counts
+// of p. The count of p in parent already includes it.
+func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64, parentIndex int, index *int, delta int64) (btreeIndexPage, error) {
+	counted := p.counted()
+	it := p.slot() + 7
+	right := newBTreeIndexPage(0, counted)
 	canRecycle := true
 	defer func() {
 		if canRecycle {
@@ -970,7 +1269,7 @@ func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64,
 		}
 	}()
 	right = right.setLen(kIndex)
-	copy(right[1:1+(2*kIndex+1)*7], p[1+14*(kIndex+1):])
+	copy(right[1:], p[1+it*(kIndex+1):])
 	p = p.setLen(kIndex)
 	if err := a.Realloc(*ph, p); err != nil {
 		return nil, err
@@ -981,6 +1280,15 @@ func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64,
 		return nil, err
 	}
 
+	var ln, rn int64
+	if counted {
+		ln, rn = p.sum(), right.sum()
+		if *index > kIndex {
+			rn += delta
+		} else {
+			ln += delta
+		}
+	}
 	if parentIndex >= 0 {
 		var pp btreeIndexPage = bufs.GCache.Get(maxBuf)
 		defer bufs.GCache.Put(pp)
@@ -988,20 +1296,28 @@ func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64,
 			return nil, err
 		}
 		pp = pp.insert3(parentIndex, p.dataPage(kIndex), rh)
+		if counted {
+			pp.setCount(parentIndex, ln)
+			pp.setCount(parentIndex+1, rn)
+		}
 		if err = a.Realloc(parent, pp); err != nil {
 			return nil, err
 		}
 
 	} else {
-		nr := newBTreeIndexPage(*ph)
+		nr := newBTreeIndexPage(*ph, counted)
 		defer bufs.GCache.Put(nr)
 		nr = nr.insert3(0, p.dataPage(kIndex), rh)
+		if counted {
+			nr.setCount(0, ln)
+			nr.setCount(1, rn)
+		}
 		nrh, err := a.Alloc(nr)
 		if err != nil {
 			return nil, err
 		}
 
-		if err = a.Realloc(int64(root), h2b(make([]byte, 7), nrh)); err != nil {
+		if err = a.Realloc(int64(root), btreeRoot(nrh, counted)); err != nil {
 			return nil, err
 		}
 	}
@@ -1018,19 +1334,22 @@ func (p btreeIndexPage) split(a btreeStore, root btree, ph *int64, parent int64,
 func (p btreeIndexPage) extract(index int) btreeIndexPage {
 	n := p.len() - 1
 	if index < n {
-		sz := (n-index)*14 + 7
-		copy(p[1+14*index:1+14*index+sz], p[1+14*(index+1):])
+		it := p.slot() + 7
+		copy(p[1+it*index:], p[1+it*(index+1):])
 	}
 	return p.setLen(n)
 }
 
-// must persist all changes made
-func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *int64, parentIndex int, index *int) (btreeIndexPage, error) {
+// must persist all changes made. For delta see split.
+func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *int64, parentIndex int, index *int, delta int64) (btreeIndexPage, error) {
 	lh, rh, err := checkSiblings(a, parent, parentIndex)
 	if err != nil {
 		return nil, err
 	}
 
+	counted := p.counted()
+	s := p.slot()
+	it := s + 7
 	var left btreeIndexPage = bufs.GCache.Get(maxBuf)
 	defer bufs.GCache.Put(left)
 
@@ -1048,13 +1367,19 @@ func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *i
 
 			pc := p.len()
 			p = p.setLen(pc + 1)
-			di, si, sz := 1+1*14, 1+0*14, (2*pc+1)*7
-			copy(p[di:di+sz], p[si:])
+			copy(p[1+it:], p[1:1+s+it*pc])
 			p.setChild(0, btreeIndexPage(left).child(lc))
+			if counted {
+				p.setCount(0, btreeIndexPage(left).count(lc))
+			}
 			p.setDataPage(0, btreeIndexPage(pp).dataPage(parentIndex-1))
 			*index++
 			btreeIndexPage(pp).setDataPage(parentIndex-1, btreeIndexPage(left).dataPage(lc-1))
 			left = left.setLen(lc - 1)
+			if counted {
+				btreeIndexPage(pp).setCount(parentIndex-1, left.sum())
+				btreeIndexPage(pp).setCount(parentIndex, p.sum()+delta)
+			}
 			if err = a.Realloc(parent, pp); err != nil {
 				return nil, err
 			}
@@ -1086,10 +1411,16 @@ func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *i
 			p.setDataPage(pc, btreeIndexPage(pp).dataPage(parentIndex))
 			pc++
 			p.setChild(pc, btreeIndexPage(right).child(0))
+			if counted {
+				p.setCount(pc, btreeIndexPage(right).count(0))
+			}
 			btreeIndexPage(pp).setDataPage(parentIndex, btreeIndexPage(right).dataPage(0))
-			di, si, sz := 1+0*14, 1+1*14, (2*rc+1)*7
-			copy(right[di:di+sz], right[si:])
+			copy(right[1:], right[1+it:])
 			right = btreeIndexPage(right).setLen(rc - 1)
+			if counted {
+				btreeIndexPage(pp).setCount(parentIndex, p.sum()+delta)
+				btreeIndexPage(pp).setCount(parentIndex+1, btreeIndexPage(right).sum())
+			}
 			if err = a.Realloc(parent, pp); err != nil {
 				return nil, err
 			}
@@ -1104,7 +1435,7 @@ func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *i
 
 	if lh != 0 {
 		*index += left.len() + 1
-		if left, err = left.concat(a, root, iroot, parent, lh, *ph, parentIndex-1); err != nil {
+		if left, err = left.concat(a, root, iroot, parent, lh, *ph, parentIndex-1, delta); err != nil {
 			return p, err
 		}
 
@@ -1112,11 +1443,11 @@ func (p btreeIndexPage) underflow(a btreeStore, root, iroot, parent int64, ph *i
 		return p, nil
 	}
 
-	return p.concat(a, root, iroot, parent, *ph, rh, parentIndex)
+	return p.concat(a, root, iroot, parent, *ph, rh, parentIndex, delta)
 }
 
-// must persist all changes made
-func (p btreeIndexPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, parentIndex int) (btreeIndexPage, error) {
+// must persist all changes made. For delta see split.
+func (p btreeIndexPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, parentIndex int, delta int64) (btreeIndexPage, error) {
 	pp := bufs.GCache.Get(maxBuf)
 	defer bufs.GCache.Put(pp)
 	pp, err := a.Get(pp, parent)
@@ -1130,12 +1461,14 @@ func (p btreeIndexPage) concat(a btreeStore, root, iroot, parent, ph, rh int64,
 		return nil, err
 	}
 
+	counted := p.counted()
+	s := p.slot()
+	it := s + 7
 	pc := p.len()
 	rc := btreeIndexPage(right).len()
 	p = p.setLen(pc + rc + 1)
 	p.setDataPage(pc, btreeIndexPage(pp).dataPage(parentIndex))
-	di, si, sz := 1+14*(pc+1), 1+0*14, (2*rc+1)*7
-	copy(p[di:di+sz], right[si:])
+	copy(p[1+it*(pc+1):], right[1:1+s+it*rc])
 	if err := a.Realloc(ph, p); err != nil {
 		return nil, err
 	}
@@ -1146,10 +1479,12 @@ func (p btreeIndexPage) concat(a btreeStore, root, iroot, parent, ph, rh int64,
 
 	if pc := btreeIndexPage(pp).len(); pc > 1 {
 		if parentIndex < pc-1 {
-			di, si, sz := 8+parentIndex*14, 8+(parentIndex+1)*14, 2*(pc-1-parentIndex)*7
-			copy(pp[di:si+sz], pp[si:])
+			copy(pp[1+s+it*parentIndex:], pp[1+s+it*(parentIndex+1):])
 		}
 		pp = btreeIndexPage(pp).setLen(pc - 1)
+		if counted {
+			btreeIndexPage(pp).setCount(parentIndex, p.sum()+delta)
+		}
 		return p, a.Realloc(parent, pp)
 	}
 
@@ -1157,9 +1492,7 @@ func (p btreeIndexPage) concat(a btreeStore, root, iroot, parent, ph, rh int64,
 		return nil, err
 	}
 
-	b7 := bufs.GCache.Get(7)
-	defer bufs.GCache.Put(b7)
-	return p, a.Realloc(root, h2b(b7[:7], ph))
+	return p, a.Realloc(root, btreeRoot(ph, counted))
 }
 
 /*
@@ -1217,6 +1550,27 @@ Length >= kKV
 	Data == Key or Value content, first kKV-7 bytes
 	H    == Handle to THE REST of the content, w/o the first bytes in Data.
 
+Length >= kKV, rest of the content longer than maxRq
+
+	   0     1...kkV-8   kKV-7...kkV-1
+	+------+-----------+--------------+
+	| 0xFE |   Data    |      H       |
+	+------+-----------+--------------+
+
+	Data == Key or Value content, first kKV-7 bytes
+	H    == Handle of the first block of an overflow chain holding THE REST
+	        of the content.
+
+Overflow chain block
+
+	  0..6    7...
+	+------+--------+
+	| Next |  Data  |
+	+------+--------+
+
+	Next == Handle of the next block of the chain or zero in the last one
+	Data == Next up to kChainData bytes of the content
+
 Offsets into the raw []byte:
 Key[X]   == 15+2*kKV*X
 Value[X] == 15+kKV+2*kKV*X
@@ -1309,6 +1663,10 @@ func (p btreeDataPage) content(a btreeStore, off int) (b []byte, err error) {
 	}
 
 	// content has a handle
+	if p[off] == kChain {
+		return getChain(a, b, h)
+	}
+
 	b2, err := a.Get(nil, h) //TODO buffers: Later, not a public API
 	if err != nil {
 		return nil, err
@@ -1317,8 +1675,31 @@ func (p btreeDataPage) content(a btreeStore, off int) (b []byte, err error) {
 	return append(b, b2...), nil
 }
 
+// freeContent frees the handle or the overflow chain of the content at off, if
+// any.
+func (p btreeDataPage) freeContent(a btreeStore, off int) (err error) {
+	_, h := p.contentField(off)
+	switch {
+	case h == 0:
+		return
+	case p[off] == kChain:
+		return freeChain(a, h)
+	default:
+		return a.Free(h)
+	}
+}
+
 func (p btreeDataPage) setContent(a btreeStore, off int, b []byte) (err error) {
 	p = p[off:]
+	if p[0] == kChain { // existing content is an overflow chain
+		if err = freeChain(a, b2h(p[kH:])); err != nil {
+			return
+		}
+
+		p[0] = 0
+	}
+
+	chain := len(b)-kSz > maxRq
 	switch {
 	case p[0] >= kKV: // existing content has a handle
 		switch n := len(b); {
@@ -1328,6 +1709,12 @@ func (p btreeDataPage) setContent(a btreeStore, off int, b []byte) (err error) {
 				return
 			}
 			copy(p[1:], b)
+		case chain:
+			if err = a.Free(b2h(p[kH:])); err != nil {
+				return
+			}
+
+			return p.setChain(a, b)
 		default:
 			// reuse handle
 			copy(p[1:1+kSz], b)
@@ -1338,6 +1725,8 @@ func (p btreeDataPage) setContent(a btreeStore, off int, b []byte) (err error) {
 		case n < kKV:
 			p[0] = byte(n)
 			copy(p[1:], b)
+		case chain:
+			return p.setChain(a, b)
 		default:
 			p[0] = 0xff
 			copy(p[1:1+kSz], b)
@@ -1352,6 +1741,77 @@ func (p btreeDataPage) setContent(a btreeStore, off int, b []byte) (err error) {
 	return
 }
 
+// setChain sets the content field p to b, storing all but the first kSz bytes
+// of b in a new overflow chain.
+func (p btreeDataPage) setChain(a btreeStore, b []byte) (err error) {
+	h, err := allocChain(a, b[kSz:])
+	if err != nil {
+		return
+	}
+
+	p[0] = kChain
+	copy(p[1:1+kSz], b)
+	h2b(p[kH:], h)
+	return
+}
+
+// allocChain stores b in a new overflow chain and returns the handle of its
+// first block.
+func allocChain(a btreeStore, b []byte) (h int64, err error) {
+	for n := len(b); n > 0; {
+		lo := (n - 1) / kChainData * kChainData
+		blk := make([]byte, 7+n-lo) // memBTreeStore keeps the slice
+		h2b(blk, h)
+		copy(blk[7:], b[lo:n])
+		if h, err = a.Alloc(blk); err != nil {
+			return
+		}
+
+		n = lo
+	}
+	return
+}
+
+// getChain returns b with the content of the overflow chain at h appended.
+func getChain(a btreeStore, b []byte, h int64) (r []byte, err error) {
+	for h != 0 {
+		var blk []byte
+		if blk, err = a.Get(nil, h); err != nil { //TODO buffers
+			return
+		}
+
+		if len(blk) < 7 {
+			return nil, &ErrILSEQ{Type: ErrOther, Off: h2off(h), More: "invalid BTree overflow chain block"}
+		}
+
+		b = append(b, blk[7:]...)
+		h = b2h(blk)
+	}
+	return b, nil
+}
+
+// freeChain frees all blocks of the overflow chain at h.
+func freeChain(a btreeStore, h int64) (err error) {
+	for h != 0 {
+		var blk []byte
+		if blk, err = a.Get(nil, h); err != nil {
+			return
+		}
+
+		if len(blk) < 7 {
+			return &ErrILSEQ{Type: ErrOther, Off: h2off(h), More: "invalid BTree overflow chain block"}
+		}
+
+		next := b2h(blk)
+		if err = a.Free(h); err != nil {
+			return
+		}
+
+		h = next
+	}
+	return
+}
+
 func (p btreeDataPage) keyField(index int) (b []byte, h int64) {
 	return p.contentField(15 + 2*kKV*index)
 }
@@ -1431,7 +1891,7 @@ func (p btreeDataPage) insertItem(a btreeStore, index int, key, value []byte) (b
 	return p, p.setValue(a, index, value)
 }
 
-func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex, index int, key, value []byte) (btreeDataPage, error) {
+func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex, index int, key, value []byte, counted bool) (btreeDataPage, error) {
 	right, rh, err := newBTreeDataPageAlloc(a)
 	// fails defer bufs.GCache.Put(right)
 	if err != nil {
@@ -1459,6 +1919,12 @@ func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex,
 	right.copy(p, 0, kData, kData)
 	p = p.setLen(kData)
 
+	ln, rn := int64(kData), int64(kData)
+	if index > kData {
+		rn++
+	} else {
+		ln++
+	}
 	if parentIndex >= 0 {
 		var pp btreeIndexPage = bufs.GCache.Get(maxBuf)
 		defer bufs.GCache.Put(pp)
@@ -1467,20 +1933,28 @@ func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex,
 		}
 
 		pp = pp.insert3(parentIndex, rh, rh)
+		if counted {
+			pp.setCount(parentIndex, ln)
+			pp.setCount(parentIndex+1, rn)
+		}
 		if err = a.Realloc(parent, pp); err != nil {
 			return nil, err
 		}
 
 	} else {
-		nr := newBTreeIndexPage(ph)
+		nr := newBTreeIndexPage(ph, counted)
 		defer bufs.GCache.Put(nr)
 		nr = nr.insert3(0, rh, rh)
+		if counted {
+			nr.setCount(0, ln)
+			nr.setCount(1, rn)
+		}
 		nrh, err := a.Alloc(nr)
 		if err != nil {
 			return nil, err
 		}
 
-		if err = a.Realloc(root, h2b(make([]byte, 7), nrh)); err != nil {
+		if err = a.Realloc(root, btreeRoot(nrh, counted)); err != nil {
 			return nil, err
 		}
 
@@ -1501,7 +1975,7 @@ func (p btreeDataPage) split(a btreeStore, root, ph, parent int64, parentIndex,
 	return p, a.Realloc(rh, right)
 }
 
-func (p btreeDataPage) overflow(a btreeStore, root, ph, parent int64, parentIndex, index int, key, value []byte) (btreeDataPage, error) {
+func (p btreeDataPage) overflow(a btreeStore, root, ph, parent int64, parentIndex, index int, key, value []byte, counted bool) (btreeDataPage, error) {
 	leftH, rightH, err := checkSiblings(a, parent, parentIndex)
 	if err != nil {
 		return nil, err
@@ -1525,6 +1999,12 @@ func (p btreeDataPage) overflow(a btreeStore, root, ph, parent int64, parentInde
 				return nil, err
 			}
 
+			if counted {
+				if err = setCounts(a, parent, parentIndex-1, left.len(), p.len()); err != nil {
+					return nil, err
+				}
+			}
+
 			return p, a.Realloc(ph, p)
 		}
 	}
@@ -1547,17 +2027,29 @@ func (p btreeDataPage) overflow(a btreeStore, root, ph, parent int64, parentInde
 					return nil, err
 				}
 
+				if counted {
+					if err = setCounts(a, parent, parentIndex, p.len(), right.len()); err != nil {
+						return nil, err
+					}
+				}
+
 				return p, a.Realloc(ph, p)
 			} else {
 				if right, err = right.insertItem(a, 0, key, value); err != nil {
 					return nil, err
 				}
 
+				if counted {
+					if err = setCounts(a, parent, parentIndex, p.len(), right.len()); err != nil {
+						return nil, err
+					}
+				}
+
 				return p, a.Realloc(rightH, right)
 			}
 		}
 	}
-	return p.split(a, root, ph, parent, parentIndex, index, key, value)
+	return p.split(a, root, ph, parent, parentIndex, index, key, value, counted)
 }
 
 func (p btreeDataPage) swap(a btreeStore, di int, value []byte, canOverwrite bool) (oldValue []byte, err error) {
@@ -1577,7 +2069,7 @@ func (p btreeDataPage) swap(a btreeStore, di int, value []byte, canOverwrite boo
 type btreePage []byte
 
 func (p btreePage) isIndex() bool {
-	return p[0] == tagBTreeIndexPage
+	return p[0] != tagBTreeDataPage
 }
 
 func (p btreePage) len() int {
@@ -1626,16 +2118,12 @@ func (p btreeDataPage) extract(a btreeStore, index int) (btreeDataPage, []byte,
 		return nil, nil, err
 	}
 
-	if _, h := p.keyField(index); h != 0 {
-		if err = a.Free(h); err != nil {
-			return nil, nil, err
-		}
+	if err = p.freeContent(a, 15+2*kKV*index); err != nil {
+		return nil, nil, err
 	}
 
-	if _, h := p.valueField(index); h != 0 {
-		if err = a.Free(h); err != nil {
-			return nil, nil, err
-		}
+	if err = p.freeContent(a, 15+kKV+2*kKV*index); err != nil {
+		return nil, nil, err
 	}
 
 	n := p.len() - 1
@@ -1645,26 +2133,58 @@ func (p btreeDataPage) extract(a btreeStore, index int) (btreeDataPage, []byte,
 	return p.setLen(n), value, nil
 }
 
-func checkSiblings(a btreeStore, parent int64, parentIndex int) (left, right int64, err error) {
-	if parentIndex >= 0 {
-		var p btreeIndexPage = bufs.GCache.Get(maxBuf)
-		defer bufs.GCache.Put(p)
-		if p, err = a.Get(p, parent); err != nil {
-			return
+// extractRange removes the items [i, j) of p, freeing their content.
+func (p btreeDataPage) extractRange(a btreeStore, i, j int) (btreeDataPage, error) {
+	for k := i; k < j; k++ {
+		if err := p.freeContent(a, 15+2*kKV*k); err != nil {
+			return nil, err
 		}
 
-		if parentIndex > 0 {
-			left = p.child(parentIndex - 1)
-		}
-		if parentIndex < p.len() {
-			right = p.child(parentIndex + 1)
+		if err := p.freeContent(a, 15+kKV+2*kKV*k); err != nil {
+			return nil, err
+		}
+	}
+
+	n := p.len()
+	p.copy(p, i, j, n-j)
+	return p.setLen(n - (j - i)), nil
+}
+
+// setCounts sets the subtree counts of the children of the counted index page
+// parent, starting at index, to n.
+func setCounts(a btreeStore, parent int64, index int, n ...int) (err error) {
+	var pp btreeIndexPage = bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(pp)
+	if pp, err = a.Get(pp, parent); err != nil {
+		return
+	}
+
+	for i, v := range n {
+		pp.setCount(index+i, int64(v))
+	}
+	return a.Realloc(parent, pp)
+}
+
+func checkSiblings(a btreeStore, parent int64, parentIndex int) (left, right int64, err error) {
+	if parentIndex >= 0 {
+		var p btreeIndexPage = bufs.GCache.Get(maxBuf)
+		defer bufs.GCache.Put(p)
+		if p, err = a.Get(p, parent); err != nil {
+			return
+		}
+
+		if parentIndex > 0 {
+			left = p.child(parentIndex - 1)
+		}
+		if parentIndex < p.len() {
+			right = p.child(parentIndex + 1)
 		}
 	}
 	return
 }
 
 // underflow must persist all changes made.
-func (p btreeDataPage) underflow(a btreeStore, root, iroot, parent, ph int64, parentIndex int) (err error) {
+func (p btreeDataPage) underflow(a btreeStore, root, iroot, parent, ph int64, parentIndex int, counted bool) (err error) {
 	lh, rh, err := checkSiblings(a, parent, parentIndex)
 	if err != nil {
 		return err
@@ -1683,6 +2203,12 @@ func (p btreeDataPage) underflow(a btreeStore, root, iroot, parent, ph int64, pa
 				return err
 			}
 
+			if counted {
+				if err = setCounts(a, parent, parentIndex-1, btreeDataPage(left).len(), p.len()); err != nil {
+					return err
+				}
+			}
+
 			return a.Realloc(ph, p)
 		}
 	}
@@ -1700,6 +2226,12 @@ func (p btreeDataPage) underflow(a btreeStore, root, iroot, parent, ph int64, pa
 				return err
 			}
 
+			if counted {
+				if err = setCounts(a, parent, parentIndex, p.len(), btreeDataPage(right).len()); err != nil {
+					return err
+				}
+			}
+
 			return a.Realloc(ph, p)
 		}
 	}
@@ -1715,14 +2247,14 @@ func (p btreeDataPage) underflow(a btreeStore, root, iroot, parent, ph int64, pa
 			return err
 		}
 
-		return btreeDataPage(left).concat(a, root, iroot, parent, lh, ph, parentIndex-1)
+		return btreeDataPage(left).concat(a, root, iroot, parent, lh, ph, parentIndex-1, counted)
 	}
 
-	return p.concat(a, root, iroot, parent, ph, rh, parentIndex)
+	return p.concat(a, root, iroot, parent, ph, rh, parentIndex, counted)
 }
 
 // concat must persist all changes made.
-func (p btreeDataPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, parentIndex int) (err error) {
+func (p btreeDataPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, parentIndex int, counted bool) (err error) {
 	right := bufs.GCache.Get(maxBuf)
 	defer bufs.GCache.Put(right)
 	if right, err = a.Get(right, rh); err != nil {
@@ -1757,6 +2289,9 @@ func (p btreeDataPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, p
 	if btreeIndexPage(pp).len() > 1 {
 		pp = btreeIndexPage(pp).extract(parentIndex)
 		btreeIndexPage(pp).setChild(parentIndex, ph)
+		if counted {
+			btreeIndexPage(pp).setCount(parentIndex, int64(p.len()))
+		}
 		if err = a.Realloc(parent, pp); err != nil {
 			return err
 		}
@@ -1772,18 +2307,40 @@ func (p btreeDataPage) concat(a btreeStore, root, iroot, parent, ph, rh int64, p
 		return err
 	}
 
-	var b7 [7]byte
-	return a.Realloc(root, h2b(b7[:], ph))
+	return a.Realloc(root, btreeRoot(ph, counted))
 }
 
 // external "root" is stable and contains the real root.
+//
+// The root block is the 7 byte handle of the real root, zero for an empty
+// tree. The root block of a counted tree has an additional byte btreeCounted.
 type btree int64
 
 func newBTree(a btreeStore) (btree, error) {
-	r, err := a.Alloc(zeros[:7])
+	return newBTree2(a, false)
+}
+
+func newBTree2(a btreeStore, counted bool) (btree, error) {
+	r, err := a.Alloc(btreeRoot(0, counted))
 	return btree(r), err
 }
 
+// btreeRoot returns the content of a root block referring to iroot.
+func btreeRoot(iroot int64, counted bool) []byte {
+	b := make([]byte, 7, 8)
+	h2b(b, iroot)
+	if counted {
+		b = append(b, btreeCounted)
+	}
+	return b
+}
+
+// isCounted reports whether the root block r is the root block of a counted
+// tree.
+func isCounted(r []byte) bool {
+	return len(r) == 8 && r[7] == btreeCounted
+}
+
 func (root btree) String(a btreeStore) string {
 	r := bufs.GCache.Get(16)
 	defer bufs.GCache.Put(r)
@@ -1870,6 +2427,7 @@ func (root btree) put2(dst []byte, a btreeStore, c func(a, b []byte) int, key []
 	}
 
 	iroot := b2h(r)
+	counted := isCounted(r)
 	var h int64
 	if iroot == 0 {
 		p := newBTreeDataPage()
@@ -1887,10 +2445,30 @@ func (root btree) put2(dst []byte, a btreeStore, c func(a, b []byte) int, key []
 			return nil, true, err
 		}
 
-		err = a.Realloc(int64(root), h2b(r, h)[:7])
+		err = a.Realloc(int64(root), btreeRoot(h, counted))
 		return
 	}
 
+	// In a counted tree the counts on the path to the data page are updated
+	// on the way down, so it must be known in advance whether a new KV pair
+	// gets inserted.
+	var delta int64
+	if counted {
+		if old, err = root.get(a, nil, c, key); err != nil {
+			return
+		}
+
+		if old == nil {
+			if value, written, err = upd(key, nil); err != nil || !written {
+				return
+			}
+
+			delta = 1
+			upd = func(key, old []byte) ([]byte, bool, error) { return value, true, nil }
+		}
+		old = nil
+	}
+
 	parentIndex := -1
 	var parent int64
 	ph := iroot
@@ -1950,10 +2528,14 @@ func (root btree) put2(dst []byte, a btreeStore, c func(a, b []byte) int, key []
 			return
 		case btreePage(p).isIndex():
 			if btreePage(p).len() > 2*kIndex {
-				if p, err = btreeIndexPage(p).split(a, root, &ph, parent, parentIndex, &index); err != nil {
+				if p, err = btreeIndexPage(p).split(a, root, &ph, parent, parentIndex, &index, delta); err != nil {
 					return
 				}
 			}
+			if err = root.addCount(a, p, ph, index, delta); err != nil {
+				return
+			}
+
 			parentIndex = index
 			parent = ph
 			ph = btreeIndexPage(p).child(index)
@@ -1972,7 +2554,7 @@ func (root btree) put2(dst []byte, a btreeStore, c func(a, b []byte) int, key []
 			}
 
 			// page is full
-			p, err = btreeDataPage(p).overflow(a, int64(root), ph, parent, parentIndex, index, key, value)
+			p, err = btreeDataPage(p).overflow(a, int64(root), ph, parent, parentIndex, index, key, value, counted)
 			return
 		}
 	}
@@ -2037,6 +2619,18 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 		return
 	}
 
+	counted := isCounted(r)
+	var delta int64
+	if counted {
+		// See put2.
+		if value, err = root.get(a, nil, c, key); err != nil || value == nil {
+			return
+		}
+
+		delta = -1
+		value = nil
+	}
+
 	ph := iroot
 	parentIndex := -1
 	var parent int64
@@ -2057,27 +2651,33 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 
 		if ok {
 			if btreePage(p).isIndex() {
-				dph := btreeIndexPage(p).dataPage(index)
-				dp, err := a.Get(dst, dph)
-				if err != nil {
-					return nil, err
-				}
-
-				if btreeDataPage(dp).len() > kData {
-					if dp, value, err = btreeDataPage(dp).extract(a, 0); err != nil {
+				if !counted { // Counts on the path to dph must be updated.
+					dph := btreeIndexPage(p).dataPage(index)
+					dp, err := a.Get(dst, dph)
+					if err != nil {
 						return nil, err
 					}
 
-					return value, a.Realloc(dph, dp)
+					if btreeDataPage(dp).len() > kData {
+						if dp, value, err = btreeDataPage(dp).extract(a, 0); err != nil {
+							return nil, err
+						}
+
+						return value, a.Realloc(dph, dp)
+					}
 				}
 
 				if btreeIndexPage(p).len() < kIndex && ph != iroot {
 					var err error
-					if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index); err != nil {
+					if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index, delta); err != nil {
 						return nil, err
 					}
 				}
 				parentIndex = index + 1
+				if err = root.addCount(a, p, ph, parentIndex, delta); err != nil {
+					return nil, err
+				}
+
 				parent = ph
 				ph = btreeIndexPage(p).child(parentIndex)
 				continue
@@ -2090,7 +2690,7 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 			}
 
 			if ph != iroot {
-				err = btreeDataPage(p).underflow(a, int64(root), iroot, parent, ph, parentIndex)
+				err = btreeDataPage(p).underflow(a, int64(root), iroot, parent, ph, parentIndex, counted)
 				return
 			}
 
@@ -2099,7 +2699,7 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 					return
 				}
 
-				err = a.Realloc(int64(root), zeros[:7])
+				err = a.Realloc(int64(root), btreeRoot(0, counted))
 				return
 			}
 			err = a.Realloc(ph, p)
@@ -2111,16 +2711,31 @@ func (root btree) extract(a btreeStore, dst []byte, c func(a, b []byte) int, key
 		}
 
 		if btreePage(p).len() < kIndex && ph != iroot {
-			if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index); err != nil {
+			if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index, delta); err != nil {
 				return nil, err
 			}
 		}
 		parentIndex = index
+		if err = root.addCount(a, p, ph, parentIndex, delta); err != nil {
+			return nil, err
+		}
+
 		parent = ph
 		ph = btreeIndexPage(p).child(index)
 	}
 }
 
+// addCount adds delta to the subtree count of the child at index of the index
+// page p at ph.
+func (root btree) addCount(a btreeStore, p []byte, ph int64, index int, delta int64) error {
+	if delta == 0 {
+		return nil
+	}
+
+	btreeIndexPage(p).setCount(index, btreeIndexPage(p).count(index)+delta)
+	return a.Realloc(ph, p)
+}
+
 func (root btree) deleteAny(a btreeStore) (bool, error) {
 	r := bufs.GCache.Get(7)
 	defer bufs.GCache.Put(r)
@@ -2134,6 +2749,12 @@ func (root btree) deleteAny(a btreeStore) (bool, error) {
 		return true, nil
 	}
 
+	counted := isCounted(r)
+	var delta int64
+	if counted {
+		delta = -1
+	}
+
 	ph := iroot
 	parentIndex := -1
 	var parent int64
@@ -2147,27 +2768,33 @@ func (root btree) deleteAny(a btreeStore) (bool, error) {
 
 		index := btreePage(p).len() / 2
 		if btreePage(p).isIndex() {
-			dph := btreeIndexPage(p).dataPage(index)
-			dp := bufs.GCache.Get(maxBuf)
-			defer bufs.GCache.Put(dp)
-			if dp, err = a.Get(dp, dph); err != nil {
-				return false, err
-			}
-
-			if btreeDataPage(dp).len() > kData {
-				if dp, _, err = btreeDataPage(dp).extract(a, 0); err != nil {
+			if !counted { // See extract.
+				dph := btreeIndexPage(p).dataPage(index)
+				dp := bufs.GCache.Get(maxBuf)
+				defer bufs.GCache.Put(dp)
+				if dp, err = a.Get(dp, dph); err != nil {
 					return false, err
 				}
 
-				return false, a.Realloc(dph, dp)
+				if btreeDataPage(dp).len() > kData {
+					if dp, _, err = btreeDataPage(dp).extract(a, 0); err != nil {
+						return false, err
+					}
+
+					return false, a.Realloc(dph, dp)
+				}
 			}
 
 			if btreeIndexPage(p).len() < kIndex && ph != iroot {
-				if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index); err != nil {
+				if p, err = btreeIndexPage(p).underflow(a, int64(root), iroot, parent, &ph, parentIndex, &index, delta); err != nil {
 					return false, err
 				}
 			}
 			parentIndex = index + 1
+			if err = root.addCount(a, p, ph, parentIndex, delta); err != nil {
+				return false, err
+			}
+
 			parent = ph
 			ph = btreeIndexPage(p).child(parentIndex)
 			continue
@@ -2180,7 +2807,7 @@ func (root btree) deleteAny(a btreeStore) (bool, error) {
 		}
 
 		if ph != iroot {
-			err = btreeDataPage(p).underflow(a, int64(root), iroot, parent, ph, parentIndex)
+			err = btreeDataPage(p).underflow(a, int64(root), iroot, parent, ph, parentIndex, counted)
 			return false, err
 		}
 
@@ -2189,7 +2816,7 @@ func (root btree) deleteAny(a btreeStore) (bool, error) {
 				return true, err
 			}
 
-			return true, a.Realloc(int64(root), zeros[:7])
+			return true, a.Realloc(int64(root), btreeRoot(0, counted))
 		}
 
 		return false, a.Realloc(ph, p)
@@ -2270,6 +2897,812 @@ func (root btree) seek(a btreeStore, c func(a, b []byte) int, key []byte) (p btr
 	return
 }
 
+func (root btree) len(a btreeStore) (n int64, err error) {
+	r := bufs.GCache.Get(8)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	iroot := b2h(r)
+	if iroot == 0 {
+		return
+	}
+
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	if p, err = a.Get(p, iroot); err != nil {
+		return
+	}
+
+	if btreePage(p).isIndex() {
+		return btreeIndexPage(p).sum(), nil
+	}
+
+	return int64(btreeDataPage(p).len()), nil
+}
+
+// rank is Rank of a counted tree.
+func (root btree) rank(a btreeStore, c func(a, b []byte) int, key []byte) (rank int64, hit bool, err error) {
+	r := bufs.GCache.Get(8)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	p := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(p)
+	for ph := b2h(r); ph != 0; {
+		if p, err = a.Get(p, ph); err != nil {
+			return
+		}
+
+		var index int
+		if index, hit, err = btreePage(p).find(a, c, key); err != nil {
+			return
+		}
+
+		if !btreePage(p).isIndex() {
+			return rank + int64(index), hit, nil
+		}
+
+		if hit {
+			index++
+		}
+		for i := 0; i < index; i++ {
+			rank += btreeIndexPage(p).count(i)
+		}
+		if hit {
+			return
+		}
+
+		ph = btreeIndexPage(p).child(index)
+	}
+	return
+}
+
+// seekIndex is SeekIndex of a counted tree.
+func (root btree) seekIndex(a btreeStore, i int64) (p btreeDataPage, index int, err error) {
+	r := bufs.GCache.Get(8)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	ph := b2h(r)
+	for ph != 0 {
+		if p, err = a.Get(p, ph); err != nil {
+			return
+		}
+
+		if !btreePage(p).isIndex() {
+			break
+		}
+
+		ip := btreeIndexPage(p)
+		ph = 0
+		for j := 0; j <= ip.len(); j++ {
+			if n := ip.count(j); i >= n {
+				i -= n
+				continue
+			}
+
+			ph = ip.child(j)
+			break
+		}
+	}
+	if ph == 0 || i >= int64(p.len()) {
+		return nil, 0, io.EOF
+	}
+
+	return p, int(i), nil
+}
+
+// btreeBulkItem describes a page of a tree level, see buildIndex.
+type btreeBulkItem struct {
+	h  int64 // Page handle.
+	dp int64 // Handle of the leftmost data page of the subtree.
+	n  int64 // Number of KV pairs in the subtree.
+}
+
+// btreeIndexItems returns the children of the index page p, the leftmost data
+// page of its subtree is first.
+func btreeIndexItems(p btreeIndexPage, first int64) (items []btreeBulkItem) {
+	counted := p.counted()
+	for i := 0; i <= p.len(); i++ {
+		v := btreeBulkItem{h: p.child(i), dp: first}
+		if i != 0 {
+			v.dp = p.dataPage(i - 1)
+		}
+		if counted {
+			v.n = p.count(i)
+		}
+		items = append(items, v)
+	}
+	return
+}
+
+// newBTreeIndexPageItems returns a new index page with the children items.
+func newBTreeIndexPageItems(items []btreeBulkItem, counted bool) btreeIndexPage {
+	ip := newBTreeIndexPage(items[0].h, counted)
+	if counted {
+		ip.setCount(0, items[0].n)
+	}
+	for x, v := range items[1:] {
+		ip = ip.insert3(x, v.dp, v.h)
+		if counted {
+			ip.setCount(x+1, v.n)
+		}
+	}
+	return ip
+}
+
+// btreeItemsSum returns the number of KV pairs in the subtrees of items.
+func btreeItemsSum(items []btreeBulkItem) (n int64) {
+	for _, v := range items {
+		n += v.n
+	}
+	return
+}
+
+func (root btree) bulkLoad(a btreeStore, c func(a, b []byte) int, src func() (key, value []byte, err error)) (err error) {
+	r := bufs.GCache.Get(8)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	if b2h(r) != 0 {
+		return &ErrPERM{Src: "BTree.BulkLoad: tree not empty"}
+	}
+
+	counted := isCounted(r)
+	var leaves []btreeBulkItem
+	var pages [][]byte // Data pages not written yet, zappy encoded.
+	p := newBTreeDataPage()
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		// Leave the tree empty, ignoring any further errors.
+		for _, v := range leaves {
+			root.clear2(a, v.h)
+		}
+		clear := func(p btreeDataPage) {
+			for i := 0; i < p.len(); i++ {
+				p.setKey(a, i, nil)
+				p.setValue(a, i, nil)
+			}
+		}
+		for _, v := range pages[len(leaves):] {
+			if q, err := zappy.Decode(nil, v); err == nil {
+				clear(q)
+			}
+		}
+		clear(p)
+	}()
+
+	push := func(p btreeDataPage) (err error) {
+		b, err := zappy.Encode(nil, p)
+		if err != nil {
+			return
+		}
+
+		pages = append(pages, b)
+		return
+	}
+
+	var last []byte
+	for n := 0; ; n++ {
+		key, value, err := src()
+		if err != nil {
+			if fileutil.IsEOF(err) {
+				break
+			}
+
+			return err
+		}
+
+		if n != 0 && c(last, key) >= 0 {
+			return &ErrINVAL{Src: "BTree.BulkLoad: keys not in ascending collation order", Val: key}
+		}
+
+		last = append(last[:0], key...)
+		if p.len() == 2*kData {
+			if err = push(p); err != nil {
+				return err
+			}
+
+			p = newBTreeDataPage()
+		}
+
+		if p, err = p.insertItem(a, p.len(), key, value); err != nil {
+			return err
+		}
+	}
+
+	if n := p.len(); n != 0 {
+		if x := len(pages) - 1; n < kData && x >= 0 {
+			q, err := zappy.Decode(nil, pages[x])
+			if err != nil {
+				return err
+			}
+
+			prev := btreeDataPage(q)
+			m := (prev.len()+n)/2 - n
+			prev, p = prev.moveRight(p, m)
+			if q, err = zappy.Encode(nil, prev); err != nil {
+				p, _ = p.moveLeft(prev, m)
+				return err
+			}
+
+			pages[x] = q
+		}
+		if err = push(p); err != nil {
+			return
+		}
+
+		p = p[:15]
+	}
+
+	if leaves, err = root.writeLeaves(a, pages); err != nil {
+		return
+	}
+
+	if len(leaves) == 0 {
+		return
+	}
+
+	h, err := root.buildIndex(a, leaves, counted)
+	if err != nil {
+		return
+	}
+
+	return a.Realloc(int64(root), btreeRoot(h, counted))
+}
+
+// writeLeaves writes the zappy encoded data pages, linked in their order, and
+// returns the leaves of the tree. An Allocator gets the pages back to back at
+// the end of the file, every page written once and only after its size with
+// the final next link is known, so no page is ever relocated. On error the
+// leaves returned are the pages written so far.
+func (root btree) writeLeaves(a btreeStore, pages [][]byte) (leaves []btreeBulkItem, err error) {
+	al, ok := a.(*Allocator)
+	if !ok {
+		var prev btreeDataPage
+		var prevH int64
+		for _, v := range pages {
+			var p btreeDataPage
+			if p, err = zappy.Decode(nil, v); err != nil {
+				return
+			}
+
+			p.setPrev(prevH)
+			h, err := a.Alloc(p)
+			if err != nil {
+				return leaves, err
+			}
+
+			if prevH != 0 {
+				prev.setNext(h)
+				if err = a.Realloc(prevH, prev); err != nil {
+					a.Free(h)
+					return leaves, err
+				}
+			}
+
+			leaves = append(leaves, btreeBulkItem{h, h, int64(p.len())})
+			prev, prevH = p, h
+		}
+		return
+	}
+
+	sz, err := al.f.Size()
+	if err != nil {
+		return
+	}
+
+	buf := bufs.GCache.Get(maxBuf)
+	defer bufs.GCache.Put(buf)
+	zbuf := bufs.GCache.Get(zappy.MaxEncodedLen(maxBuf))
+	defer bufs.GCache.Put(zbuf)
+	var prevH int64
+	for h, i := off2h(sz), 0; i < len(pages); i++ {
+		var p btreeDataPage
+		if p, err = zappy.Decode(buf, pages[i]); err != nil {
+			return
+		}
+
+		// The next page starts where this one ends, but where it ends
+		// depends on the next link when the page gets compressed. Grow
+		// the link until the page fits before it.
+		var next int64
+		if i != len(pages)-1 {
+			next = h + 1
+		}
+		p.setPrev(prevH)
+		var w []byte
+		var atoms int
+		var cc byte
+		for {
+			p.setNext(next)
+			if w, atoms, cc, err = al.makeUsedBlock(zbuf, p); err != nil {
+				return
+			}
+
+			end := h + int64(atoms)
+			if next == 0 || end <= next {
+				break
+			}
+
+			next = end
+		}
+		if err = al.writeUsedBlock(h, cc, w); err != nil {
+			return
+		}
+
+		al.cadd(p, h)
+		leaves = append(leaves, btreeBulkItem{h, h, int64(p.len())})
+		if end := h + int64(atoms); next > end { // Atoms left over by a shorter encoding.
+			if err = al.link(end, next-end); err != nil {
+				return
+			}
+		}
+
+		prevH, h = h, next
+	}
+	return
+}
+
+// buildIndex writes the index pages over the data pages in level, level by
+// level and distributing the children evenly, and returns the handle of the
+// new root page. On error the index pages written so far are freed.
+func (root btree) buildIndex(a btreeStore, level []btreeBulkItem, counted bool) (h int64, err error) {
+	var upper []int64
+	defer func() {
+		if err != nil {
+			for _, h := range upper {
+				a.Free(h)
+			}
+		}
+	}()
+
+	for len(level) > 1 {
+		var next []btreeBulkItem
+		g := (len(level) + 2*kIndex) / (2*kIndex + 1)
+		for i, j := 0, 0; i < g; i++ {
+			k := len(level) * (i + 1) / g
+			items := level[j:k]
+			if h, err = a.Alloc(newBTreeIndexPageItems(items, counted)); err != nil {
+				return
+			}
+
+			upper = append(upper, h)
+			next = append(next, btreeBulkItem{h, items[0].dp, btreeItemsSum(items)})
+			j = k
+		}
+		level = next
+	}
+	return level[0].h, nil
+}
+
+// rangeKeys returns the keys in [from, to], but at most max of them. more
+// reports whether the interval contains more keys.
+func (root btree) rangeKeys(a btreeStore, c func(a, b []byte) int, from, to []byte, max int) (keys [][]byte, more bool, err error) {
+	var p btreeDataPage
+	var i int
+	switch {
+	case from == nil:
+		_, p, err = root.first(a)
+	default:
+		p, i, _, err = root.seek(a, c, from)
+	}
+	for p != nil && err == nil {
+		for ; i < p.len(); i++ {
+			k, err := p.key(a, i)
+			if err != nil {
+				return nil, false, err
+			}
+
+			if to != nil && c(k, to) > 0 {
+				return keys, false, nil
+			}
+
+			if len(keys) == max {
+				return keys, true, nil
+			}
+
+			keys = append(keys, k)
+		}
+
+		h := p.next()
+		if h == 0 {
+			break
+		}
+
+		p, err = a.Get(p, h)
+		i = 0
+	}
+	return
+}
+
+func (root btree) deleteRange(a btreeStore, c func(a, b []byte) int, from, to []byte) (err error) {
+	r := bufs.GCache.Get(8)
+	defer bufs.GCache.Put(r)
+	if r, err = a.Get(r, int64(root)); err != nil {
+		return
+	}
+
+	iroot := b2h(r)
+	if iroot == 0 || from != nil && to != nil && c(from, to) > 0 {
+		return
+	}
+
+	// Few keys are cheaper to delete one by one.
+	keys, more, err := root.rangeKeys(a, c, from, to, kData)
+	if err != nil {
+		return
+	}
+
+	if !more {
+		for _, k := range keys {
+			if _, err = root.extract(a, nil, c, k); err != nil {
+				return
+			}
+		}
+		return
+	}
+
+	return root.deleteRange2(a, c, iroot, isCounted(r), from, to)
+}
+
+// deleteRange2 deletes the KV pairs in [from, to] from the tree rooted at
+// iroot. Only the pages on the paths to from and to and their siblings are
+// read and written, besides the freed pages in between.
+func (root btree) deleteRange2(a btreeStore, c func(a, b []byte) int, iroot int64, counted bool, from, to []byte) (err error) {
+	first, _, err := root.first(a)
+	if err != nil {
+		return
+	}
+
+	if first, _, err = root.deleteRange3(a, c, counted, iroot, first, from, to); err != nil {
+		return
+	}
+
+	if first == 0 {
+		return a.Realloc(int64(root), btreeRoot(0, counted))
+	}
+
+	// Drop the index pages with a single child from the top.
+	h := iroot
+	for {
+		p, err := a.Get(nil, h)
+		if err != nil {
+			return err
+		}
+
+		if !btreePage(p).isIndex() || btreeIndexPage(p).len() != 0 {
+			break
+		}
+
+		if err = a.Free(h); err != nil {
+			return err
+		}
+
+		h = btreeIndexPage(p).child(0)
+	}
+	if h == iroot {
+		return
+	}
+
+	return a.Realloc(int64(root), btreeRoot(h, counted))
+}
+
+// deleteRange3 deletes the KV pairs in [from, to] from the subtree of the page
+// at ph, its leftmost data page is first. It returns the leftmost data page of
+// the subtree afterwards, zero if the subtree became empty and was freed, and,
+// in a counted tree, the number of its KV pairs. The pages of the subtree
+// except the page at ph are left at least half full.
+func (root btree) deleteRange3(a btreeStore, c func(a, b []byte) int, counted bool, ph, first int64, from, to []byte) (_ int64, n int64, err error) {
+	p, err := a.Get(nil, ph)
+	if err != nil {
+		return
+	}
+
+	if !btreePage(p).isIndex() {
+		return deleteRangeData(a, c, ph, p, from, to)
+	}
+
+	ip := btreeIndexPage(p)
+	items := btreeIndexItems(ip, first)
+	i, j := 0, len(items)-1
+	if from != nil {
+		if i, err = ip.childIndex(a, c, from); err != nil {
+			return
+		}
+	}
+	if to != nil {
+		if j, err = ip.childIndex(a, c, to); err != nil {
+			return
+		}
+	}
+
+	// Free the subtrees in between, linking the data pages around them.
+	if j-i > 1 {
+		var dp []byte
+		if dp, err = a.Get(nil, items[i+1].dp); err != nil {
+			return
+		}
+
+		if err = linkDataPages(a, btreeDataPage(dp).prev(), items[j].dp); err != nil {
+			return
+		}
+
+		for _, v := range items[i+1 : j] {
+			if err = root.clear2(a, v.h); err != nil {
+				return
+			}
+		}
+
+		items = append(items[:i+1], items[j:]...)
+		j = i + 1
+	}
+
+	hi := to
+	if i != j {
+		hi = nil
+	}
+	v := &items[i]
+	if v.dp, v.n, err = root.deleteRange3(a, c, counted, v.h, v.dp, from, hi); err != nil {
+		return
+	}
+
+	if i != j {
+		v = &items[j]
+		if v.dp, v.n, err = root.deleteRange3(a, c, counted, v.h, v.dp, nil, to); err != nil {
+			return
+		}
+	}
+
+	// Drop the emptied children.
+	var touched []int
+	w := 0
+	for k, v := range items {
+		if k == i || k == j {
+			if v.dp == 0 {
+				continue
+			}
+
+			touched = append(touched, w)
+		}
+		items[w] = v
+		w++
+	}
+	items = items[:w]
+	if len(items) == 0 {
+		return 0, 0, a.Free(ph)
+	}
+
+	// Rebalance the remaining children at the ends of the interval.
+	for len(touched) != 0 && len(items) > 1 {
+		k := touched[0]
+		hs := []int64{items[k].h}
+		if len(touched) == 2 {
+			hs = append(hs, items[k+1].h)
+		}
+		var u bool
+		if u, err = btreeUnderfull(a, hs...); err != nil {
+			return
+		}
+
+		if !u {
+			break
+		}
+
+		if len(touched) == 1 && k != 0 {
+			k--
+		}
+		m := len(items)
+		if items, err = root.balance(a, counted, items, k); err != nil {
+			return
+		}
+
+		if len(touched) == 1 || len(items) == m {
+			break
+		}
+
+		touched = touched[:1] // Concatenated, may be still underfull.
+	}
+
+	if err = a.Realloc(ph, newBTreeIndexPageItems(items, counted)); err != nil {
+		return
+	}
+
+	return items[0].dp, btreeItemsSum(items), nil
+}
+
+// deleteRangeData deletes the KV pairs in [from, to] from the data page p at
+// ph. An emptied data page is unlinked and freed.
+func deleteRangeData(a btreeStore, c func(a, b []byte) int, ph int64, p btreeDataPage, from, to []byte) (first, n int64, err error) {
+	i, j := 0, p.len()
+	if from != nil {
+		if i, _, err = btreePage(p).find(a, c, from); err != nil {
+			return
+		}
+	}
+	if to != nil {
+		var eq bool
+		if j, eq, err = btreePage(p).find(a, c, to); err != nil {
+			return
+		}
+
+		if eq {
+			j++
+		}
+	}
+	if i >= j {
+		return ph, int64(p.len()), nil
+	}
+
+	if p, err = p.extractRange(a, i, j); err != nil {
+		return
+	}
+
+	if p.len() == 0 {
+		if err = linkDataPages(a, p.prev(), p.next()); err != nil {
+			return
+		}
+
+		return 0, 0, a.Free(ph)
+	}
+
+	return ph, int64(p.len()), a.Realloc(ph, p)
+}
+
+// balance concatenates the sibling pages items[k] and items[k+1], if their
+// items fit in one page, or distributes their items evenly. It returns the
+// updated items.
+func (root btree) balance(a btreeStore, counted bool, items []btreeBulkItem, k int) (_ []btreeBulkItem, err error) {
+	x, y := &items[k], &items[k+1]
+	xp, err := a.Get(nil, x.h)
+	if err != nil {
+		return
+	}
+
+	yp, err := a.Get(nil, y.h)
+	if err != nil {
+		return
+	}
+
+	if !btreePage(xp).isIndex() {
+		l, r := btreeDataPage(xp), btreeDataPage(yp)
+		nl, nr := l.len(), r.len()
+		if nl+nr <= 2*kData {
+			r, l = r.moveLeft(l, nr)
+			nxh := r.next()
+			if nxh != 0 {
+				var nx []byte
+				if nx, err = a.Get(nil, nxh); err != nil {
+					return
+				}
+
+				btreeDataPage(nx).setPrev(x.h)
+				if err = a.Realloc(nxh, nx); err != nil {
+					return
+				}
+			}
+			l.setNext(nxh)
+			x.n = int64(l.len())
+			if err = a.Realloc(x.h, l); err != nil {
+				return
+			}
+
+			if err = a.Free(y.h); err != nil {
+				return
+			}
+
+			return append(items[:k+1], items[k+2:]...), nil
+		}
+
+		switch m := (nl + nr) / 2; {
+		case nl < m:
+			r, l = r.moveLeft(l, m-nl)
+		case nl > m:
+			l, r = l.moveRight(r, nl-m)
+		}
+		x.n, y.n = int64(l.len()), int64(r.len())
+		if err = a.Realloc(x.h, l); err != nil {
+			return
+		}
+
+		return items, a.Realloc(y.h, r)
+	}
+
+	xs := btreeIndexItems(xp, x.dp)
+	j := len(xs)
+	v := append(xs, btreeIndexItems(yp, y.dp)...)
+
+	// The children meeting in the middle may be underfull, see
+	// deleteRange3.
+	u, err := btreeUnderfull(a, v[j-1].h, v[j].h)
+	if err != nil {
+		return
+	}
+
+	if u {
+		if v, err = root.balance(a, counted, v, j-1); err != nil {
+			return
+		}
+	}
+
+	if len(v) <= 2*kIndex+1 {
+		x.n = btreeItemsSum(v)
+		if err = a.Realloc(x.h, newBTreeIndexPageItems(v, counted)); err != nil {
+			return
+		}
+
+		if err = a.Free(y.h); err != nil {
+			return
+		}
+
+		return append(items[:k+1], items[k+2:]...), nil
+	}
+
+	m := len(v) / 2
+	x.n, y.n, y.dp = btreeItemsSum(v[:m]), btreeItemsSum(v[m:]), v[m].dp
+	if err = a.Realloc(x.h, newBTreeIndexPageItems(v[:m], counted)); err != nil {
+		return
+	}
+
+	return items, a.Realloc(y.h, newBTreeIndexPageItems(v[m:], counted))
+}
+
+// btreeUnderfull reports whether any of the pages at hs is less than half
+// full.
+func btreeUnderfull(a btreeStore, hs ...int64) (bool, error) {
+	for _, h := range hs {
+		p, err := a.Get(nil, h)
+		if err != nil {
+			return false, err
+		}
+
+		min := kData
+		if btreePage(p).isIndex() {
+			min = kIndex
+		}
+		if btreePage(p).len() < min {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// linkDataPages makes the data pages at lh and rh, any of them may be zero,
+// adjacent in the list of data pages.
+func linkDataPages(a btreeStore, lh, rh int64) (err error) {
+	var p []byte
+	if lh != 0 {
+		if p, err = a.Get(nil, lh); err != nil {
+			return
+		}
+
+		btreeDataPage(p).setNext(rh)
+		if err = a.Realloc(lh, p); err != nil {
+			return
+		}
+	}
+	if rh != 0 {
+		if p, err = a.Get(nil, rh); err != nil {
+			return
+		}
+
+		btreeDataPage(p).setPrev(lh)
+		err = a.Realloc(rh, p)
+	}
+	return
+}
+
 func (root btree) clear(a btreeStore) (err error) {
 	r := bufs.GCache.Get(7)
 	defer bufs.GCache.Put(r)
@@ -2286,8 +3719,7 @@ func (root btree) clear(a btreeStore) (err error) {
 		return
 	}
 
-	var b [7]byte
-	return a.Realloc(int64(root), b[:])
+	return a.Realloc(int64(root), btreeRoot(0, isCounted(r)))
 }
 
 func (root btree) clear2(a btreeStore, ph int64) (err error) {
@@ -23,6 +23,7 @@ import (
 
 	"github.com/cznic/fileutil"
 	"github.com/cznic/mathutil"
+	"github.com/cznic/sortutil"
 )
 
 var (
@@ -1975,3 +1976,975 @@ func TestGetEmpty(t *testing.T) {
 		}
 	}
 }
+
+func TestBTreeOverflow(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	content := func(n int) []byte {
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(rng.Int())
+		}
+		return b
+	}
+
+	sizes := []int{0, kKV - 1, kKV, kSz + maxRq, kSz + maxRq + 1, kSz + 2*kChainData + 1, 3*maxRq + 17, 1 << 20}
+	test := func(tree *BTree) {
+		keys := make([][]byte, len(sizes))
+		values := make([][]byte, len(sizes))
+		for i, n := range sizes {
+			keys[i] = append(content(n), byte(i))
+			values[i] = content(sizes[len(sizes)-1-i])
+			if err := tree.Set(keys[i], values[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i, k := range keys {
+			v, err := tree.Get(nil, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := v, values[i]; !bytes.Equal(g, e) {
+				t.Fatal(i, len(g), len(e))
+			}
+		}
+
+		// Replace values, growing and shrinking across the storage kinds.
+		for i, k := range keys {
+			nv := content(sizes[i])
+			old, written, err := tree.Put(nil, k, func(key, old []byte) ([]byte, bool, error) {
+				return nv, true, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !written || !bytes.Equal(old, values[i]) {
+				t.Fatal(i, written, len(old), len(values[i]))
+			}
+
+			values[i] = nv
+		}
+
+		for i, k := range keys {
+			v, err := tree.Extract(nil, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := v, values[i]; !bytes.Equal(g, e) {
+				t.Fatal(i, len(g), len(e))
+			}
+
+			if i%2 == 0 {
+				if err = tree.Set(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		for i, k := range keys {
+			v, err := tree.Get(nil, k)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i%2 != 0 {
+				if v != nil {
+					t.Fatal(i, len(v))
+				}
+				continue
+			}
+
+			if g, e := v, values[i]; !bytes.Equal(g, e) {
+				t.Fatal(i, len(g), len(e))
+			}
+
+			if err = tree.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tree := NewBTree(nil)
+	test(tree)
+	if g, e := len(tree.store.(*memBTreeStore).m), 1; g != e {
+		t.Fatal(g, e)
+	}
+
+	f := NewMemFiler()
+	store, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, handle, err := CreateBTree(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test(tree)
+	if err = RemoveBTree(store, handle); err != nil {
+		t.Fatal(err)
+	}
+
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := sz-sz0, int64(0); g != e {
+		t.Fatal(g, e)
+	}
+}
+
+// btreeCount verifies the subtree counts of a counted tree and returns the
+// number of KV pairs in the subtree at ph.
+func btreeCount(a btreeStore, ph int64) (n int64, err error) {
+	p, err := a.Get(nil, ph)
+	if err != nil {
+		return
+	}
+
+	if !btreePage(p).isIndex() {
+		return int64(btreeDataPage(p).len()), nil
+	}
+
+	ip := btreeIndexPage(p)
+	if !ip.counted() {
+		return 0, fmt.Errorf("index page %#x not counted", ph)
+	}
+
+	for i := 0; i <= ip.len(); i++ {
+		c, err := btreeCount(a, ip.child(i))
+		if err != nil {
+			return 0, err
+		}
+
+		if g, e := ip.count(i), c; g != e {
+			return 0, fmt.Errorf("index page %#x, child %d: count %d, expected %d", ph, i, g, e)
+		}
+
+		n += c
+	}
+	return
+}
+
+func testBTreeCounted(t *testing.T, tree *BTree, ins, del []int64, drain bool) {
+	if !tree.IsCounted() {
+		t.Fatal("tree not counted")
+	}
+
+	m := map[int64]bool{}
+	check := func(full bool) {
+		var keys []int64
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Sort(sortutil.Int64Slice(keys))
+
+		n, err := tree.Len()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := n, int64(len(keys)); g != e {
+			t.Fatal(g, e)
+		}
+
+		if full {
+			b, err := tree.store.Get(nil, int64(tree.root))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h := b2h(b); h != 0 {
+				if n, err = btreeCount(tree.store, h); err != nil {
+					t.Fatal(err)
+				}
+
+				if g, e := n, int64(len(keys)); g != e {
+					t.Fatal(g, e)
+				}
+			}
+		}
+
+		step := len(keys)/1000 + 1
+		if !full {
+			step = len(keys)/100 + 1
+		}
+		for i := 0; i < len(keys); i += step {
+			k := keys[i]
+			rank, hit, err := tree.Rank(enc8(k))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := rank, int64(i); !hit || g != e {
+				t.Fatal(hit, g, e)
+			}
+
+			if rank, hit, err = tree.Rank(enc8(k + 1)); err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := rank, int64(i+1); hit != m[k+1] || g != e {
+				t.Fatal(hit, g, e)
+			}
+
+			en, err := tree.SeekIndex(int64(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for j := i; j < len(keys) && j < i+3; j++ {
+				key, value, err := en.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if g, e := key, enc8(keys[j]); !bytes.Equal(g, e) {
+					t.Fatal(j, g, e)
+				}
+
+				if g, e := value, enc8(-keys[j]); !bytes.Equal(g, e) {
+					t.Fatal(j, g, e)
+				}
+			}
+		}
+
+		if _, err := tree.SeekIndex(int64(len(keys))); !fileutil.IsEOF(err) {
+			t.Fatal(err)
+		}
+	}
+
+	for i, k := range ins {
+		var err error
+		switch i % 3 {
+		case 0:
+			err = tree.Set(enc8(k), enc8(-k))
+		case 1:
+			_, _, err = tree.Put(nil, enc8(k), func(key, old []byte) ([]byte, bool, error) {
+				return enc8(-k), true, nil
+			})
+		case 2:
+			// Not written, must not count.
+			if _, _, err = tree.Put(nil, enc8(k), func(key, old []byte) ([]byte, bool, error) {
+				return nil, false, nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			err = tree.Set(enc8(k), enc8(-k))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m[k] = true
+		if i%(len(ins)/8+1) == 0 {
+			check(false)
+		}
+	}
+	check(true)
+
+	// Overwriting must not count.
+	for _, k := range ins[:len(ins)/10] {
+		if err := tree.Set(enc8(k), enc8(-k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(false)
+
+	for i, k := range del {
+		var err error
+		switch i % 2 {
+		case 0:
+			err = tree.Delete(enc8(k))
+		case 1:
+			_, err = tree.Extract(nil, enc8(k))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delete(m, k)
+		if i%(len(del)/8+1) == 0 {
+			check(false)
+		}
+	}
+	check(true)
+	if !drain {
+		return
+	}
+
+	for n := int64(len(m)); n != 0; {
+		empty, err := tree.DeleteAny()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n--
+		if g, e := empty, n == 0; g != e {
+			t.Fatal(g, e)
+		}
+
+		g, err := tree.Len()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e := n; g != e {
+			t.Fatal(g, e)
+		}
+
+		if n%1000 == 0 && n != 0 {
+			b, err := tree.store.Get(nil, int64(tree.root))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = btreeCount(tree.store, b2h(b)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestBTreeCounted(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	n := 5000
+	ins := rng.Perm(2 * n)[:n]
+	keys := make([]int64, len(ins))
+	for i, v := range ins {
+		keys[i] = int64(v)
+	}
+	del := append([]int64(nil), keys[:n/2]...)
+	for i := range del {
+		j := rng.Intn(i + 1)
+		del[i], del[j] = del[j], del[i]
+	}
+	del = append(del, int64(2*n)) // Not in the tree.
+
+	testBTreeCounted(t, NewCountedBTree(nil), keys, del, true)
+
+	f := NewMemFiler()
+	store, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, handle, err := CreateCountedBTree(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBTreeCounted(t, tree, keys, del, true)
+	if tree, err = OpenBTree(store, nil, handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if !tree.IsCounted() {
+		t.Fatal("reopened tree not counted")
+	}
+
+	if testing.Short() {
+		return
+	}
+
+	// Enough KV pairs for the root index page to split and for index pages
+	// to underflow later.
+	n = 2 * kData * (2*kIndex + 2)
+	keys = make([]int64, n)
+	for i := range keys {
+		keys[i] = int64(i)
+	}
+	testBTreeCounted(t, NewCountedBTree(nil), keys, keys[:n/8], false)
+}
+
+func TestBTreeNotCounted(t *testing.T) {
+	tree := NewBTree(nil)
+	for i := int64(0); i < 1000; i += 2 {
+		if err := tree.Set(enc8(i), enc8(-i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := tree.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := n, int64(500); g != e {
+		t.Fatal(g, e)
+	}
+
+	rank, hit, err := tree.Rank(enc8(501))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := rank, int64(251); hit || g != e {
+		t.Fatal(hit, g, e)
+	}
+
+	en, err := tree.SeekIndex(250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k, _, err := en.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := k, enc8(500); !bytes.Equal(g, e) {
+		t.Fatal(g, e)
+	}
+
+	if _, err = tree.SeekIndex(500); !fileutil.IsEOF(err) {
+		t.Fatal(err)
+	}
+}
+
+func testBTreeBulkLoad(t *testing.T, tree *BTree, n int) {
+	value := func(i int) []byte {
+		v := enc8(int64(-i))
+		if i%97 == 0 {
+			v = append(v, make([]byte, kKV)...)
+		}
+		return v
+	}
+
+	i := 0
+	if err := tree.BulkLoad(func() (k, v []byte, err error) {
+		if i == n {
+			return nil, nil, io.EOF
+		}
+
+		k, v = enc8(int64(2*i)), value(i)
+		i++
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyPageLinks(tree.store, tree.root, n); err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.IsCounted() {
+		b, err := tree.store.Get(nil, int64(tree.root))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h := b2h(b); h != 0 {
+			c, err := btreeCount(tree.store, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := c, int64(n); g != e {
+				t.Fatal(g, e)
+			}
+		}
+	}
+
+	step := n/1000 + 1
+	for i := 0; i < n; i += step {
+		v, err := tree.Get(nil, enc8(int64(2*i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := v, value(i); !bytes.Equal(g, e) {
+			t.Fatal(i, len(g), len(e))
+		}
+
+		if v, err = tree.Get(nil, enc8(int64(2*i+1))); err != nil || v != nil {
+			t.Fatal(i, v, err)
+		}
+	}
+
+	if n != 0 {
+		if _, ok := tree.BulkLoad(func() (k, v []byte, err error) { return nil, nil, io.EOF }).(*ErrPERM); !ok {
+			t.Fatal("expected ErrPERM")
+		}
+	}
+
+	// The tree must remain fully functional.
+	m := n
+	for i := 0; i < n; i += step {
+		if err := tree.Set(enc8(int64(2*i+1)), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		m++
+	}
+	for i := 0; i < n; i += 2 * step {
+		if err := tree.Delete(enc8(int64(2 * i))); err != nil {
+			t.Fatal(err)
+		}
+
+		m--
+	}
+
+	if err := verifyPageLinks(tree.store, tree.root, m); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := tree.Len()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := c, int64(m); g != e {
+		t.Fatal(g, e)
+	}
+}
+
+func TestBTreeBulkLoad(t *testing.T) {
+	sizes := []int{0, 1, kData, 2 * kData, 2*kData + 1, 3*kData - 1, 2*kData*(2*kIndex+1) + 1}
+	if testing.Short() {
+		sizes = sizes[:len(sizes)-1]
+	}
+	for _, n := range sizes {
+		testBTreeBulkLoad(t, NewBTree(nil), n)
+		testBTreeBulkLoad(t, NewCountedBTree(nil), n)
+	}
+
+	f := NewMemFiler()
+	store, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, handle, err := CreateCountedBTree(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys not in ascending order.
+	n := 5 * kData
+	i := 0
+	if _, ok := tree.BulkLoad(func() (k, v []byte, err error) {
+		i++
+		if i == n {
+			i = 0
+		}
+		return enc8(int64(i)), make([]byte, kKV+1), nil
+	}).(*ErrINVAL); !ok {
+		t.Fatal("expected ErrINVAL")
+	}
+
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := sz, sz0; g != e {
+		t.Fatal(g, e)
+	}
+
+	testBTreeBulkLoad(t, tree, n)
+	if err = RemoveBTree(store, handle); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compressed data pages must not get relocated.
+	if store, err = NewAllocator(NewMemFiler(), &Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.Compress = true
+	if tree, _, err = CreateBTree(store, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	n = 50 * kData
+	i = 0
+	if err = tree.BulkLoad(func() (k, v []byte, err error) {
+		if i == n {
+			return nil, nil, io.EOF
+		}
+
+		k, v = enc8(int64(i)), make([]byte, i%(3*kKV))
+		for j := range v {
+			v[j] = byte(i * j)
+		}
+		i++
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifyPageLinks(store, tree.root, n); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats AllocStats
+	if err = store.Verify(NewMemFiler(), nil, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := stats.Relocations, int64(0); g != e {
+		t.Fatal(g, e)
+	}
+}
+
+// btreeShape verifies the subtree at ph, its leftmost data page is first, is
+// depth levels deep, its separators refer to the leftmost data pages of the
+// subtrees and its pages, except a root page, are at least half full as
+// defined by the underflow handling.
+func btreeShape(a btreeStore, ph, first int64, depth int, isRoot bool) (err error) {
+	p, err := a.Get(nil, ph)
+	if err != nil {
+		return
+	}
+
+	if !btreePage(p).isIndex() {
+		switch {
+		case depth != 0:
+			return fmt.Errorf("data page %#x at depth %d", ph, depth)
+		case ph != first:
+			return fmt.Errorf("data page %#x, expected leftmost %#x", ph, first)
+		case !isRoot && btreeDataPage(p).len() < kData-1:
+			return fmt.Errorf("data page %#x underfull: %d", ph, btreeDataPage(p).len())
+		}
+		return
+	}
+
+	ip := btreeIndexPage(p)
+	if depth == 0 || !isRoot && ip.len() < kIndex-1 || isRoot && ip.len() == 0 {
+		return fmt.Errorf("index page %#x at depth %d: len %d", ph, depth, ip.len())
+	}
+
+	for i := 0; i <= ip.len(); i++ {
+		dp := first
+		if i != 0 {
+			dp = ip.dataPage(i - 1)
+		}
+		if err = btreeShape(a, ip.child(i), dp, depth-1, false); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// verifyBTreeShape verifies the page structure of tree, see btreeShape.
+func verifyBTreeShape(a btreeStore, tree btree) (err error) {
+	r, err := a.Get(nil, int64(tree))
+	if err != nil {
+		return
+	}
+
+	h := b2h(r)
+	if h == 0 {
+		return
+	}
+
+	first, _, err := tree.first(a)
+	if err != nil {
+		return
+	}
+
+	depth := 0
+	for ph := h; ph != first; depth++ {
+		p, err := a.Get(nil, ph)
+		if err != nil {
+			return err
+		}
+
+		ph = btreeIndexPage(p).child(0)
+	}
+	return btreeShape(a, h, first, depth, true)
+}
+
+func testBTreeDeleteRange(t *testing.T, tree *BTree, n int, from, to []byte) {
+	value := func(i int) []byte {
+		v := enc8(int64(-i))
+		if i%97 == 0 {
+			v = append(v, make([]byte, kKV)...)
+		}
+		return v
+	}
+
+	i := 0
+	if err := tree.BulkLoad(func() (k, v []byte, err error) {
+		if i == n {
+			return nil, nil, io.EOF
+		}
+
+		k, v = enc8(int64(2*i)), value(i)
+		i++
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.DeleteRange(from, to); err != nil {
+		t.Fatal(err)
+	}
+
+	var e []int
+	for i := 0; i < n; i++ {
+		k := enc8(int64(2 * i))
+		if (from == nil || bytes.Compare(k, from) >= 0) && (to == nil || bytes.Compare(k, to) <= 0) {
+			continue
+		}
+
+		e = append(e, i)
+	}
+
+	if err := verifyPageLinks(tree.store, tree.root, len(e)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyBTreeShape(tree.store, tree.root); err != nil {
+		t.Fatal(err)
+	}
+
+	if tree.IsCounted() {
+		b, err := tree.store.Get(nil, int64(tree.root))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if h := b2h(b); h != 0 {
+			c, err := btreeCount(tree.store, h)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if g, e := c, int64(len(e)); g != e {
+				t.Fatal(g, e)
+			}
+		}
+	}
+
+	en, err := tree.SeekFirst()
+	if err != nil && !fileutil.IsEOF(err) {
+		t.Fatal(err)
+	}
+
+	for _, i := range e {
+		k, v, err := en.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := k, enc8(int64(2*i)); !bytes.Equal(g, e) {
+			t.Fatal(g, e)
+		}
+
+		if g, e := v, value(i); !bytes.Equal(g, e) {
+			t.Fatal(i, len(g), len(e))
+		}
+	}
+
+	if en != nil {
+		if _, _, err = en.Next(); !fileutil.IsEOF(err) {
+			t.Fatal(err)
+		}
+	}
+
+	// The tree must remain fully functional.
+	m := map[int]bool{}
+	for _, i := range e {
+		m[i] = true
+	}
+	c := len(e)
+	for i := 0; i < n; i += 97 {
+		if err := tree.Set(enc8(int64(2*i+1)), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tree.Delete(enc8(int64(2 * i))); err != nil {
+			t.Fatal(err)
+		}
+
+		c++
+		if m[i] {
+			c--
+		}
+	}
+
+	if err = verifyPageLinks(tree.store, tree.root, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = verifyBTreeShape(tree.store, tree.root); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tree.Clear(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBTreeDeleteRange(t *testing.T) {
+	n := 20 * 2 * kData
+	k := func(i int) []byte { return enc8(int64(i)) }
+	ranges := [][2][]byte{
+		{nil, nil},
+		{nil, k(-1)},
+		{k(4 * n), nil},
+		{k(10), k(9)},
+		{k(100), k(200)},
+		{k(101), k(1100)},
+		{nil, k(3 * kData)},
+		{nil, k(2*n - 2)},
+		{k(2*n - 3*kData), nil},
+		{k(2), nil},
+		{k(3 * kData), k(2*n - 3*kData)},
+		{k(4*kData + 1), k(8*kData - 1)},
+		{k(2*kData - 2), k(4*kData + 2)},
+		{k(5000), k(5000 + 2*kData)},
+	}
+	for _, r := range ranges {
+		testBTreeDeleteRange(t, NewBTree(nil), n, r[0], r[1])
+		testBTreeDeleteRange(t, NewCountedBTree(nil), n, r[0], r[1])
+	}
+	testBTreeDeleteRange(t, NewBTree(nil), 3*kData, k(100), k(2*kData))
+
+	f := NewMemFiler()
+	store, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, handle, err := CreateCountedBTree(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range ranges {
+		testBTreeDeleteRange(t, tree, n, r[0], r[1])
+		sz, err := f.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, e := sz, sz0; g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	if err = RemoveBTree(store, handle); err != nil {
+		t.Fatal(err)
+	}
+
+	if testing.Short() {
+		return
+	}
+
+	n = 2*kData*(2*kIndex+1) + 1
+	testBTreeDeleteRange(t, NewCountedBTree(nil), n, k(1000), k(2*n-1000))
+	testBTreeDeleteRange(t, NewBTree(nil), n, k(n-2*kData), k(n+2*kData))
+}
+
+// countingBTreeStore counts the page accesses.
+type countingBTreeStore struct {
+	btreeStore
+	n int
+}
+
+func (s *countingBTreeStore) Alloc(b []byte) (int64, error) {
+	s.n++
+	return s.btreeStore.Alloc(b)
+}
+
+func (s *countingBTreeStore) Free(h int64) error {
+	s.n++
+	return s.btreeStore.Free(h)
+}
+
+func (s *countingBTreeStore) Get(dst []byte, h int64) ([]byte, error) {
+	s.n++
+	return s.btreeStore.Get(dst, h)
+}
+
+func (s *countingBTreeStore) Realloc(h int64, b []byte) error {
+	s.n++
+	return s.btreeStore.Realloc(h, b)
+}
+
+func TestBTreeDeleteRangeLocal(t *testing.T) {
+	// Two levels of index pages.
+	n := 2*kData*(2*kIndex+1)*3 + 1
+	k := func(i int) []byte { return enc8(int64(i)) }
+	for _, counted := range []bool{false, true} {
+		tree := newMemBTree(nil, counted)
+		i := 0
+		if err := tree.BulkLoad(func() (k, v []byte, err error) {
+			if i == n {
+				return nil, nil, io.EOF
+			}
+
+			k, v = enc8(int64(i)), enc8(int64(-i))
+			i++
+			return
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		s := &countingBTreeStore{btreeStore: tree.store}
+		tree.store = s
+		for _, r := range [][2]int{
+			{n/2 - kData, n/2 + 3*kData},
+			{0, 3 * kData},
+			{n - 5*kData, n - 1},
+			{n / 3, n/2 - 2*kData},
+		} {
+			s.n = 0
+			if err := tree.DeleteRange(k(r[0]), k(r[1])); err != nil {
+				t.Fatal(err)
+			}
+
+			// Pages freed in between count as well.
+			if g, e := s.n, 200+4*(r[1]-r[0])/kData; g > e {
+				t.Fatal(counted, r, g, e)
+			}
+
+			n -= r[1] - r[0] + 1
+			if err := verifyPageLinks(s, tree.root, n); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := verifyBTreeShape(s, tree.root); err != nil {
+				t.Fatal(counted, r, err)
+			}
+
+			if !counted {
+				continue
+			}
+
+			b, err := s.Get(nil, int64(tree.root))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c, err := btreeCount(s, b2h(b)); err != nil || c != int64(n) {
+				t.Fatal(c, n, err)
+			}
+		}
+		n = 2*kData*(2*kIndex+1)*3 + 1
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Checksummed Filer content.
+
+package lldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	crcHdrSize  = 16
+	crcSlotSize = crcHdrSize + slotPageSize
+)
+
+var (
+	_ Filer = &ChecksumFiler{} // Ensure ChecksumFiler is a Filer.
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// ChecksumFiler is a Filer detecting silent corruption of the content of
+// another Filer. The content is split into pages of 4096 bytes, each stored
+// in the wrapped Filer in a slot of 4112 bytes:
+//
+//	+------+------+-------+------------+
+//	| 0..3 | 4..7 | 8..15 | 16..4111   |
+//	+------+------+-------+------------+
+//	| CRC  |  N   | zero  | page bytes |
+//	+------+------+-------+------------+
+//
+// N is the number of bytes of the page within the Filer size, it's 4096 for
+// all pages but the last one. CRC is the CRC-32C (Castagnoli) of the page
+// index as an uint64, N and the whole page, the bytes beyond N being zero.
+// CRC and N are stored in network byte order. Every read of a page verifies
+// its checksum, a mismatch makes ReadAt fail with an ErrILSEQ of type
+// ErrChecksum. Scrub verifies all the pages incrementally.
+//
+// A crash of an ACIDFiler0 wrapping a ChecksumFiler is recovered like that of
+// an EncryptingFiler.
+//
+// BeginUpdate, EndUpdate and Rollback are passed to the wrapped Filer.
+// PunchHole is a nop.
+type ChecksumFiler struct {
+	slotFiler
+}
+
+// NewChecksumFiler returns a new ChecksumFiler wrapping f.
+func NewChecksumFiler(f Filer) *ChecksumFiler {
+	r := &ChecksumFiler{}
+	r.slotFiler = slotFiler{codec: r, f: f, size: -1, slotSize: crcSlotSize}
+	return r
+}
+
+// crcPage returns the checksum of the page pg having n valid bytes.
+func crcPage(p []byte, pg int64, n int) uint32 {
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[:], uint64(pg))
+	binary.BigEndian.PutUint32(b[8:], uint32(n))
+	return crc32.Update(crc32.Checksum(b[:], crcTable), crcTable, p)
+}
+
+// invalid implements slotCodec.
+func (f *ChecksumFiler) invalid(pg int64, more interface{}) error {
+	return &ErrILSEQ{Type: ErrChecksum, Off: pg * crcSlotSize, Arg: pg << slotPageBits, Name: f.Name(), More: more}
+}
+
+// open implements slotCodec.
+func (f *ChecksumFiler) open(p, s []byte, pg int64) (n int, err error) {
+	n = int(binary.BigEndian.Uint32(s[4:]))
+	if n == 0 || n > slotPageSize {
+		return 0, f.invalid(pg, "invalid page header")
+	}
+
+	if g, e := binary.BigEndian.Uint32(s), crcPage(s[crcHdrSize:], pg, n); g != e {
+		return 0, f.invalid(pg, fmt.Sprintf("stored %#08x, computed %#08x", g, e))
+	}
+
+	copy(p, s[crcHdrSize:])
+	return
+}
+
+// last implements slotCodec.
+func (f *ChecksumFiler) last(pg int64) error { return nil }
+
+// seal implements slotCodec.
+func (f *ChecksumFiler) seal(s, p []byte, pg int64, n int) error {
+	binary.BigEndian.PutUint32(s, crcPage(p, pg, n))
+	binary.BigEndian.PutUint32(s[4:], uint32(n))
+	for i := 8; i < crcHdrSize; i++ {
+		s[i] = 0
+	}
+	copy(s[crcHdrSize:], p)
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestChecksumFiler(t *testing.T) {
+	const sz = 5*slotPageSize + 100
+
+	inner := NewMemFiler()
+	f := NewChecksumFiler(inner)
+	b := make([]byte, sz)
+	for i := range b {
+		b[i] = byte(rand.Int())
+	}
+	if n, err := f.WriteAt(b, 0); n != sz {
+		t.Fatal(n, err)
+	}
+
+	if g, err := inner.Size(); g != 6*crcSlotSize {
+		t.Fatal(g, err)
+	}
+
+	if done, err := f.Scrub(100); !done || err != nil {
+		t.Fatal(done, err)
+	}
+
+	// Flip a bit of the page 3.
+	var c [1]byte
+	off := int64(3*crcSlotSize + crcHdrSize + 1234)
+	if _, err := inner.ReadAt(c[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	c[0] ^= 4
+	if _, err := inner.WriteAt(c[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, sz)
+	if n, err := f.ReadAt(g[:3*slotPageSize], 0); n != 3*slotPageSize || !bytes.Equal(g[:n], b[:n]) {
+		t.Fatal(n, err)
+	}
+
+	_, err := f.ReadAt(g, 0)
+	e, ok := err.(*ErrILSEQ)
+	if !ok || e.Type != ErrChecksum || e.Off != 3*crcSlotSize || e.Arg != 3*slotPageSize {
+		t.Fatal(err)
+	}
+
+	t.Log(err)
+
+	// Scrub reports the corrupted page and continues after it.
+	var done bool
+	if done, err = f.Scrub(2); done || err != nil {
+		t.Fatal(done, err)
+	}
+
+	if done, err = f.Scrub(2); done || err == nil {
+		t.Fatal(done, err)
+	}
+
+	if e, ok := err.(*ErrILSEQ); !ok || e.Type != ErrChecksum || e.Arg != 3*slotPageSize {
+		t.Fatal(err)
+	}
+
+	if done, err = f.Scrub(2); !done || err != nil {
+		t.Fatal(done, err)
+	}
+
+	// Rewriting the page fixes it.
+	if _, err = f.WriteAt(b[3*slotPageSize:4*slotPageSize], 3*slotPageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if done, err = f.Scrub(100); !done || err != nil {
+		t.Fatal(done, err)
+	}
+
+	// A partial slot at the end, left by a crash, is ignored and
+	// overwritten by the next write of its page.
+	if err = inner.Truncate(6*crcSlotSize - 10); err != nil {
+		t.Fatal(err)
+	}
+
+	f = NewChecksumFiler(inner)
+	if g, err := f.Size(); g != 5*slotPageSize {
+		t.Fatal(g, err)
+	}
+
+	if _, err = f.WriteAt(b[5*slotPageSize:], 5*slotPageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, err := inner.Size(); g != 6*crcSlotSize {
+		t.Fatal(g, err)
+	}
+
+	if n, err := NewChecksumFiler(inner).ReadAt(g, 0); n != sz || !bytes.Equal(g, b) {
+		t.Fatal(n, err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Online compaction of Allocator files.
+
+package lldb
+
+import (
+	"github.com/cznic/bufs"
+)
+
+// Compaction phases.
+const (
+	compactScan = iota // Collecting the targets of relocated blocks.
+	compactMove        // Moving the content of used blocks.
+)
+
+// compactor is the state of an incremental compaction. Allocator methods
+// keep h pointing to a block start while the file is mutated in between
+// Compact calls.
+type compactor struct {
+	h       int64          // The next block to examine. Zero at the start of a pass.
+	phase   int            // compactScan or compactMove.
+	targets map[int64]bool // Handles of blocks referred to by relocated blocks.
+	moved   bool           // Some block was moved in the current pass.
+}
+
+// joined updates the compaction cursor after the block at h became a part of
+// the block at into.
+func (a *Allocator) joined(h, into int64) {
+	if c := a.compact; c != nil && c.h == h {
+		c.h = into
+	}
+}
+
+// truncate truncates the file at the block h, updating the compaction cursor.
+func (a *Allocator) truncate(h int64) error {
+	if c := a.compact; c != nil && c.h > h {
+		c.h = h
+	}
+	return a.f.Truncate(h2off(h))
+}
+
+// Compact performs a bounded step of an online compaction of the file,
+// examining at most n blocks. The content of used blocks is moved to free
+// blocks closer to the file start. The handles of the moved blocks stay valid,
+// the first atom of such block becomes a relocated used block (tag 0xFD)
+// referring to the new location of the content. The space left behind is
+// joined with any adjacent free blocks and free space at the end of the file
+// is truncated.
+//
+// Compaction is incremental, every call continues where the previous one
+// stopped, even if the file was mutated in between. done is true once a whole
+// pass over the file moved no block; the next call starts a new compaction.
+//
+// The first atom of a block cannot be moved without invalidating its handle,
+// so the file cannot shrink below the highest handle in use.
+func (a *Allocator) Compact(n int) (done bool, err error) {
+	c := a.compact
+	if c == nil {
+		c = &compactor{targets: map[int64]bool{}}
+		a.compact = c
+	}
+
+	for ; n > 0; n-- {
+		sz, err := a.f.Size()
+		if err != nil {
+			return false, err
+		}
+
+		if c.h == 0 {
+			c.h = 1
+		}
+		if h2off(c.h) >= sz {
+			c.h = 0
+			switch {
+			case c.phase == compactScan:
+				c.phase = compactMove
+			case !c.moved:
+				a.compact = nil
+				return true, nil
+			}
+			c.moved = false
+			continue
+		}
+
+		tag, atoms, _, next, err := a.nfo(c.h)
+		if err != nil {
+			return false, err
+		}
+
+		switch tag {
+		case tagFreeShort, tagFreeLong:
+			c.h += atoms
+		case tagUsedRelocated:
+			c.targets[next] = true
+			if c.phase == compactMove {
+				if err = a.compactTarget(c.h, next); err != nil {
+					return false, err
+				}
+			}
+			c.h++
+		default:
+			moved := false
+			if c.phase == compactMove && atoms > 1 && !c.targets[c.h] {
+				if moved, err = a.compactUsed(c.h, atoms); err != nil {
+					return false, err
+				}
+			}
+			switch {
+			case moved:
+				c.h++ // The freed remainder may have been joined with its right neighbor.
+			default:
+				c.h += atoms
+			}
+		}
+	}
+	return false, nil
+}
+
+// lower returns the handle of the smallest readily available free block of at
+// least atoms, located before the block h, or zero if there's none. Only the
+// heads of the free lists are considered.
+func (a *Allocator) lower(h, atoms int64) int64 {
+	for _, slot := range a.flt {
+		if slot.head == 0 || slot.head >= h {
+			continue
+		}
+
+		if slot.minSize < atoms {
+			if _, s, _, _, err := a.nfo(slot.head); err != nil || s < atoms {
+				continue
+			}
+		}
+
+		return slot.head
+	}
+	return 0
+}
+
+// move copies the used block of atoms at h to the free block at dst, which
+// must be the head of its free list.
+func (a *Allocator) move(dst, h, atoms int64) (err error) {
+	_, s, p, n, err := a.nfo(dst)
+	if err != nil {
+		return
+	}
+
+	if err = a.unlink(dst, s, p, n); err != nil {
+		return
+	}
+
+	if s > atoms {
+		if err = a.link(dst+atoms, s-atoms); err != nil {
+			return
+		}
+	}
+
+	b := bufs.GCache.Get(int(16 * atoms))
+	defer bufs.GCache.Put(b)
+	if err = a.read(b, h2off(h)); err != nil {
+		return
+	}
+
+	return a.writeAt(b, h2off(dst))
+}
+
+// compactUsed moves the content of the used block of atoms at h closer to the
+// file start, leaving a relocated block at h.
+func (a *Allocator) compactUsed(h, atoms int64) (moved bool, err error) {
+	dst := a.lower(h, atoms)
+	if dst == 0 {
+		return
+	}
+
+	if err = a.move(dst, h, atoms); err != nil {
+		return
+	}
+
+	rb := bufs.GCache.Cget(16)
+	defer bufs.GCache.Put(rb)
+	rb[0] = tagUsedRelocated
+	h2b(rb[1:], dst)
+	if err = a.writeAt(rb, h2off(h)); err != nil {
+		return
+	}
+
+	c := a.compact
+	c.targets[dst] = true
+	c.moved = true
+	return true, a.free2(h+1, atoms-1)
+}
+
+// compactTarget moves the content referred to by the relocated block at h
+// from the block t closer to the file start.
+func (a *Allocator) compactTarget(h, t int64) (err error) {
+	_, atoms, _, _, err := a.nfo(t)
+	if err != nil {
+		return
+	}
+
+	dst := a.lower(t, atoms)
+	if dst == 0 {
+		return
+	}
+
+	if err = a.move(dst, t, atoms); err != nil {
+		return
+	}
+
+	b := bufs.GCache.Get(7)
+	defer bufs.GCache.Put(b)
+	if err = a.writeAt(h2b(b, dst), h2off(h)+1); err != nil {
+		return
+	}
+
+	c := a.compact
+	delete(c.targets, t)
+	c.targets[dst] = true
+	c.moved = true
+	return a.free2(t, atoms)
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestAllocatorCompact(t *testing.T) {
+	N := 4 * *testN
+	rng := rand.New(rand.NewSource(42))
+	f := NewMemFiler()
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := map[int64][]byte{}
+	data := func() []byte {
+		b := make([]byte, rng.Intn(2*maxShort))
+		for i := range b {
+			b[i] = byte(rng.Int())
+		}
+		return b
+	}
+
+	verify := func() {
+		for h, v := range ref {
+			g, err := a.Get(nil, h)
+			if err != nil {
+				t.Fatal(h, err)
+			}
+
+			if !bytes.Equal(g, v) {
+				t.Fatalf("h %#x: got %d bytes, exp %d bytes", h, len(g), len(v))
+			}
+		}
+
+		if err := a.Verify(NewMemFiler(), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		b := data()
+		h, err := a.Alloc(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ref[h] = b
+	}
+
+	// Free most of the blocks, keeping the last one.
+	var last int64
+	for h := range ref {
+		if h > last {
+			last = h
+		}
+	}
+	for h := range ref {
+		if h == last || rng.Intn(4) == 0 {
+			continue
+		}
+
+		if err := a.Free(h); err != nil {
+			t.Fatal(err)
+		}
+
+		delete(ref, h)
+	}
+	verify()
+
+	sz0, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interleave compaction steps with mutations.
+	for i := 0; ; i++ {
+		done, err := a.Compact(1 + rng.Intn(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if done {
+			break
+		}
+
+		if i%4 == 0 {
+			for h := range ref {
+				switch rng.Intn(3) {
+				case 0:
+					if err := a.Free(h); err != nil {
+						t.Fatal(err)
+					}
+
+					delete(ref, h)
+				case 1:
+					b := data()
+					if err := a.Realloc(h, b); err != nil {
+						t.Fatal(err)
+					}
+
+					ref[h] = b
+				default:
+					b := data()
+					h, err := a.Alloc(b)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					ref[h] = b
+				}
+				break
+			}
+			verify()
+		}
+	}
+
+	// A compaction without interleaved mutations.
+	for {
+		done, err := a.Compact(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if done {
+			break
+		}
+	}
+	verify()
+
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sz >= sz0 {
+		t.Fatalf("file size %d, before compaction %d", sz, sz0)
+	}
+
+	t.Logf("file size %d, before compaction %d", sz, sz0)
+}
@@ -0,0 +1,173 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A Filer simulating crashes.
+
+package lldb
+
+import (
+	"github.com/cznic/mathutil"
+)
+
+// CrashSectorSize is the granularity at which CrashFiler.Crash tears writes.
+const CrashSectorSize = 512
+
+var _ Filer = &CrashFiler{} // Ensure CrashFiler is a Filer.
+
+const (
+	crashWrite = iota
+	crashTruncate
+	crashSync
+)
+
+type crashOp struct {
+	f    *CrashFiler
+	kind int
+	b    []byte
+	off  int64 // WriteAt offset or Truncate size
+}
+
+type crashLog struct {
+	ops []crashOp
+}
+
+// CrashFiler is a memory backed Filer recording every WriteAt, Truncate and
+// Sync in a log, which can be shared by more CrashFilers, see Sibling. Crash
+// reconstructs the content a CrashFiler would have on a disk after a power
+// loss following any prefix of the log. Use it for testing the crash
+// consistency of code using Filers, for example by replaying the recovery of
+// an ACIDFiler0 with the database and WAL content of every crash point.
+//
+// PunchHole is a nop.
+type CrashFiler struct {
+	f   *MemFiler
+	log *crashLog
+}
+
+// NewCrashFiler returns a new, empty CrashFiler with an empty log.
+func NewCrashFiler() *CrashFiler {
+	return &CrashFiler{f: NewMemFiler(), log: &crashLog{}}
+}
+
+// Sibling returns a new, empty CrashFiler appending to the log of f, so the
+// crash points of both Filers are totally ordered.
+func (f *CrashFiler) Sibling() *CrashFiler {
+	return &CrashFiler{f: NewMemFiler(), log: f.log}
+}
+
+// Ops returns the number of operations in the log of f, ie. the number of
+// crash points.
+func (f *CrashFiler) Ops() int { return len(f.log.ops) }
+
+// BeginUpdate implements Filer.
+func (f *CrashFiler) BeginUpdate() error { return f.f.BeginUpdate() }
+
+// Close implements Filer.
+func (f *CrashFiler) Close() error { return f.f.Close() }
+
+// EndUpdate implements Filer.
+func (f *CrashFiler) EndUpdate() error { return f.f.EndUpdate() }
+
+// Name implements Filer.
+func (f *CrashFiler) Name() string { return f.f.Name() }
+
+// PunchHole implements Filer.
+func (f *CrashFiler) PunchHole(off, size int64) (err error) {
+	if off < 0 {
+		return &ErrINVAL{f.Name() + ": PunchHole off", off}
+	}
+
+	if size < 0 || off+size > f.f.size {
+		return &ErrINVAL{f.Name() + ": PunchHole size", size}
+	}
+
+	return
+}
+
+// ReadAt implements Filer.
+func (f *CrashFiler) ReadAt(b []byte, off int64) (n int, err error) { return f.f.ReadAt(b, off) }
+
+// Rollback implements Filer.
+func (f *CrashFiler) Rollback() error { return f.f.Rollback() }
+
+// Size implements Filer.
+func (f *CrashFiler) Size() (int64, error) { return f.f.Size() }
+
+// Sync implements Filer.
+func (f *CrashFiler) Sync() error {
+	f.log.ops = append(f.log.ops, crashOp{f: f, kind: crashSync})
+	return f.f.Sync()
+}
+
+// Truncate implements Filer.
+func (f *CrashFiler) Truncate(size int64) (err error) {
+	if err = f.f.Truncate(size); err != nil {
+		return
+	}
+
+	f.log.ops = append(f.log.ops, crashOp{f: f, kind: crashTruncate, off: size})
+	return
+}
+
+// WriteAt implements Filer.
+func (f *CrashFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	if n, err = f.f.WriteAt(b, off); err != nil {
+		return
+	}
+
+	f.log.ops = append(f.log.ops, crashOp{f: f, kind: crashWrite, b: append([]byte(nil), b...), off: off})
+	return
+}
+
+// Crash returns the content of f after a crash following the first n
+// operations of its log. Operations of f followed by a Sync of f within the
+// first n operations are durable. The other writes and truncations of f may
+// or may not have reached the disk: persist reports whether the sector
+// (counted from zero within the write, sectors are CrashSectorSize aligned in
+// the file) of the operation op (an index into the log) did. The only sector
+// of a Truncate is zero. A nil persist drops all the operations not yet
+// durable.
+//
+// Passing the same n and persist to Crash of Filers sharing a log gives a
+// consistent state of all of them.
+func (f *CrashFiler) Crash(n int, persist func(op, sector int) bool) (r *MemFiler, err error) {
+	ops := f.log.ops[:n]
+	synced := -1
+	for i := len(ops) - 1; i >= 0; i-- {
+		if v := ops[i]; v.f == f && v.kind == crashSync {
+			synced = i
+			break
+		}
+	}
+
+	r = NewMemFiler()
+	for i, v := range ops {
+		if v.f != f {
+			continue
+		}
+
+		durable := i < synced
+		switch v.kind {
+		case crashWrite:
+			for sector, b, off := 0, v.b, v.off; len(b) != 0; sector++ {
+				m := int(mathutil.MinInt64(int64(len(b)), CrashSectorSize-off%CrashSectorSize))
+				if durable || persist != nil && persist(i, sector) {
+					if _, err = r.WriteAt(b[:m], off); err != nil {
+						return nil, err
+					}
+				}
+
+				b = b[m:]
+				off += int64(m)
+			}
+		case crashTruncate:
+			if durable || persist != nil && persist(i, 0) {
+				if err = r.Truncate(v.off); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCrashFiler(t *testing.T) {
+	f := NewCrashFiler()
+	g := f.Sibling()
+	a := bytes.Repeat([]byte{'a'}, 3*CrashSectorSize)
+	b := bytes.Repeat([]byte{'b'}, 2*CrashSectorSize)
+	for i, v := range []func() error{
+		func() error { _, err := f.WriteAt(a, 0); return err },                 // 0
+		func() error { _, err := g.WriteAt(b, 0); return err },                 // 1
+		func() error { return f.Sync() },                                       // 2
+		func() error { _, err := f.WriteAt(b, CrashSectorSize/2); return err }, // 3, 3 sectors
+		func() error { return f.Truncate(CrashSectorSize) },                    // 4
+		func() error { return g.Sync() },                                       // 5
+	} {
+		if err := v(); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	if g, e := f.Ops(), 6; g != e {
+		t.Fatal(g, e)
+	}
+
+	content := func(f *CrashFiler, n int, persist func(op, sector int) bool) []byte {
+		m, err := f.Crash(n, persist)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sz, err := m.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := make([]byte, sz)
+		if n, err := m.ReadAt(r, 0); n != len(r) {
+			t.Fatal(n, err)
+		}
+
+		return r
+	}
+
+	const half = CrashSectorSize / 2
+	cat := func(s ...[]byte) []byte { return bytes.Join(s, nil) }
+	all := func(op, sector int) bool { return true }
+	for i, v := range []struct {
+		f       *CrashFiler
+		n       int
+		persist func(op, sector int) bool
+		exp     []byte
+	}{
+		{f, 0, all, nil},
+		{f, 1, nil, nil},
+		{f, 1, all, a},
+		{f, 2, nil, nil},
+		{f, 3, nil, a},
+		{g, 3, nil, nil},
+		{g, 3, all, b},
+		{g, 6, nil, b},
+		{f, 6, nil, a},
+		{f, 6, all, cat(a[:half], b[:half])},
+		{f, 4, all, cat(a[:half], b, a[:half])},
+		// Only the second sector of the write of b reaches the disk.
+		{f, 4, func(op, sector int) bool { return sector == 1 }, cat(a[:2*half], b[:2*half], a[:2*half])},
+	} {
+		if g := content(v.f, v.n, v.persist); !bytes.Equal(g, v.exp) {
+			t.Fatalf("%d: got %d bytes, exp %d bytes", i, len(g), len(v.exp))
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Authenticated encryption of Filer content.
+
+package lldb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/cznic/bufs"
+)
+
+const (
+	encHdrSize    = 4
+	encSlotSize   = encHdrSize + slotPageSize + 16 // N, sealed page, GCM tag.
+	encTableSize  = 12 + slotPageSize + 16         // Nonce, sealed table, GCM tag.
+	encTablePages = (slotPageSize - 8) / 12        // Pages of a version table.
+)
+
+var _ Filer = &EncryptingFiler{} // Ensure EncryptingFiler is a Filer.
+
+// EncryptingFiler is a Filer encrypting and authenticating the content of
+// another Filer using AES-GCM. The content is split into pages of 4096 bytes,
+// each stored in the wrapped Filer in a slot of 4116 bytes:
+//
+//	+------+----------------------------+
+//	| 0..3 | 4..4115                    |
+//	+------+----------------------------+
+//	|  N   | encrypted page and GCM tag |
+//	+------+----------------------------+
+//
+// N is the number of bytes of the page within the Filer size, it's 4096 for
+// all pages but the last one, stored in network byte order. The page index and
+// N are authenticated as additional data.
+//
+// The GCM nonce of a page is its version, kept out of band in a version table.
+// The slots come in groups of 340, each preceded by two copies of the version
+// table of its pages, 4124 bytes each:
+//
+//	+-------+-----------------------------+
+//	| 0..11 | 12..4123                    |
+//	+-------+-----------------------------+
+//	| nonce | encrypted table and GCM tag |
+//	+-------+-----------------------------+
+//
+// The table is a sequence number, an uint64 in network byte order, followed by
+// the nonces of the 340 pages, zero for the pages not written. The index of
+// the group and of the copy are authenticated as additional data. A page is
+// decrypted only with the nonce in the table, so a page modified, moved to
+// another offset, shortened or replaced by an older copy of itself in the
+// wrapped Filer makes ReadAt fail with an ErrILSEQ of type ErrDecrypt. So does
+// Size when pages in the table are missing at the end of the wrapped Filer.
+// Scrub verifies all the pages incrementally.
+//
+// A new nonce is used on every write of a page or of a table. It's made of 8
+// bytes chosen randomly when the EncryptingFiler is created, or when the
+// counter wraps, followed by a 4 byte write counter, so that reusing a key for
+// many files, truncating and regrowing a file or reverting a page to an older
+// content never repeats a nonce.
+//
+// The tables are updated in memory and written by Sync and Close, each to the
+// copy not holding the valid table with the higher sequence number, so a crash
+// while writing a table leaves the other copy valid. The pages written after
+// the last Sync are unreadable after a crash, until the WAL of an ACIDFiler0
+// wrapping the EncryptingFiler rewrites them. The WAL holds whole pages, so
+// the recovery overwrites the torn pages without reading them. A partial slot
+// at the end of the wrapped Filer, left by a crash, is ignored.
+//
+// A group replaced together with its tables by an older copy of the group, and
+// whole groups removed from the end of the wrapped Filer, pass the
+// authentication. Detecting that requires a version kept outside of the
+// wrapped Filer.
+//
+// BeginUpdate and EndUpdate are passed to the wrapped Filer, so is Rollback,
+// which discards the tables read. PunchHole is a nop.
+type EncryptingFiler struct {
+	slotFiler
+	aead   cipher.AEAD
+	mu     sync.Mutex // tables from concurrent ReadAts
+	nonce  [12]byte
+	tables map[int64]*encTable // by group
+}
+
+// encTable is the version table of a group of pages.
+type encTable struct {
+	b     []byte // Sequence number and the page nonces.
+	copy  int64  // Copy holding b, -1 if none.
+	dirty bool
+}
+
+// NewEncryptingFiler returns a new EncryptingFiler wrapping f. The key must be
+// 16, 24 or 32 bytes long to select AES-128, AES-192 or AES-256.
+func NewEncryptingFiler(f Filer, key []byte) (r *EncryptingFiler, err error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return
+	}
+
+	r = &EncryptingFiler{aead: aead, tables: map[int64]*encTable{}}
+	r.slotFiler = slotFiler{codec: r, f: f, group: encTablePages, meta: 2 * encTableSize, size: -1, slotSize: encSlotSize}
+	if err = r.reseed(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Close implements Filer.
+func (f *EncryptingFiler) Close() (err error) {
+	if err = f.writeTables(); err != nil {
+		f.f.Close()
+		return
+	}
+
+	return f.f.Close()
+}
+
+// Rollback implements Filer.
+func (f *EncryptingFiler) Rollback() error {
+	f.mu.Lock()
+	f.tables = map[int64]*encTable{}
+	f.mu.Unlock()
+	return f.slotFiler.Rollback()
+}
+
+// Sync implements Filer.
+func (f *EncryptingFiler) Sync() (err error) {
+	if err = f.writeTables(); err != nil {
+		return
+	}
+
+	return f.f.Sync()
+}
+
+// Truncate implements Filer.
+func (f *EncryptingFiler) Truncate(size int64) (err error) {
+	if err = f.slotFiler.Truncate(size); err != nil {
+		return
+	}
+
+	// Forget the versions of the pages removed.
+	pages := (size + slotPageMask) >> slotPageBits
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for g := range f.tables {
+		if g*encTablePages >= pages {
+			delete(f.tables, g)
+		}
+	}
+	if pages%encTablePages == 0 {
+		return
+	}
+
+	t, err := f.table(pages / encTablePages)
+	if err != nil {
+		return
+	}
+
+	for i := 8 + 12*int(pages%encTablePages); i < len(t.b); i++ {
+		if t.b[i] != 0 {
+			t.b[i], t.dirty = 0, true
+		}
+	}
+	return
+}
+
+// reseed sets a new random nonce prefix and zeroes the write counter.
+func (f *EncryptingFiler) reseed() (err error) {
+	f.nonce = [12]byte{}
+	_, err = io.ReadFull(rand.Reader, f.nonce[:8])
+	return
+}
+
+// nextNonce returns the nonce of the next page or table write.
+func (f *EncryptingFiler) nextNonce() (nonce []byte, err error) {
+	c := binary.BigEndian.Uint32(f.nonce[8:]) + 1
+	if c == 0 {
+		if err = f.reseed(); err != nil {
+			return
+		}
+
+		c = 1
+	}
+	binary.BigEndian.PutUint32(f.nonce[8:], c)
+	return f.nonce[:], nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(c)
+}
+
+// encAD sets the GCM additional data of the page pg having n valid bytes.
+func encAD(ad []byte, pg int64, n int) {
+	binary.BigEndian.PutUint64(ad, uint64(pg))
+	binary.BigEndian.PutUint32(ad[8:], uint32(n))
+}
+
+// encTableAD sets the GCM additional data of the copy c of the table of the
+// group g.
+func encTableAD(ad []byte, g, c int64) {
+	binary.BigEndian.PutUint64(ad, uint64(g))
+	ad[8] = byte(c)
+}
+
+// tableOff returns the offset of the copy c of the table of the group g in the
+// wrapped Filer.
+func (f *EncryptingFiler) tableOff(g, c int64) int64 {
+	return g*f.groupSize() + c*encTableSize
+}
+
+// table returns the version table of the group g, reading it on first use. A
+// copy failing the authentication, not written yet or torn by a crash, is
+// ignored. The caller must hold f.mu.
+func (f *EncryptingFiler) table(g int64) (t *encTable, err error) {
+	if t = f.tables[g]; t != nil {
+		return
+	}
+
+	s := bufs.GCache.Get(encTableSize)
+	defer bufs.GCache.Put(s)
+	p := bufs.GCache.Get(slotPageSize)
+	defer bufs.GCache.Put(p)
+	t = &encTable{b: make([]byte, slotPageSize), copy: -1}
+	for c := int64(0); c < 2; c++ {
+		if n, err := f.f.ReadAt(s, f.tableOff(g, c)); n != len(s) {
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+
+			continue
+		}
+
+		var ad [9]byte
+		encTableAD(ad[:], g, c)
+		if _, err := f.aead.Open(p[:0], s[:12], s[12:], ad[:]); err != nil {
+			continue
+		}
+
+		if t.copy < 0 || binary.BigEndian.Uint64(p) > binary.BigEndian.Uint64(t.b) {
+			copy(t.b, p)
+			t.copy = c
+		}
+	}
+	f.tables[g] = t
+	return t, nil
+}
+
+// isZeroed reports whether b contains only zeros.
+func isZeroed(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// version returns the nonce of the page pg, zero if the page was not written.
+func (f *EncryptingFiler) version(pg int64) (nonce [12]byte, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(pg / encTablePages)
+	if err != nil {
+		return
+	}
+
+	copy(nonce[:], t.b[8+12*(pg%encTablePages):])
+	return
+}
+
+// setVersion sets the nonce of the page pg.
+func (f *EncryptingFiler) setVersion(pg int64, nonce []byte) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(pg / encTablePages)
+	if err != nil {
+		return
+	}
+
+	copy(t.b[8+12*(pg%encTablePages):], nonce)
+	t.dirty = true
+	return
+}
+
+// writeTables writes the tables updated since the last call, each to the copy
+// not holding it.
+func (f *EncryptingFiler) writeTables() (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := bufs.GCache.Get(encTableSize)
+	defer bufs.GCache.Put(s)
+	for g, t := range f.tables {
+		if !t.dirty {
+			continue
+		}
+
+		c := 1 - t.copy
+		if t.copy < 0 {
+			c = 0
+		}
+		binary.BigEndian.PutUint64(t.b, binary.BigEndian.Uint64(t.b)+1)
+		nonce, err := f.nextNonce()
+		if err != nil {
+			return err
+		}
+
+		copy(s, nonce)
+		var ad [9]byte
+		encTableAD(ad[:], g, c)
+		f.aead.Seal(s[12:12], nonce, t.b, ad[:])
+		if _, err = f.f.WriteAt(s, f.tableOff(g, c)); err != nil {
+			return err
+		}
+
+		t.copy, t.dirty = c, false
+	}
+	return
+}
+
+// invalid implements slotCodec.
+func (f *EncryptingFiler) invalid(pg int64, more interface{}) error {
+	return &ErrILSEQ{Type: ErrDecrypt, Off: f.off(pg), Name: f.Name(), More: more}
+}
+
+// last implements slotCodec.
+func (f *EncryptingFiler) last(pg int64) (err error) {
+	next := pg + 1
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, err := f.table(next / encTablePages)
+	if err != nil {
+		return
+	}
+
+	if !isZeroed(t.b[8+12*(next%encTablePages):]) {
+		return f.invalid(next, "missing page")
+	}
+
+	return
+}
+
+// open implements slotCodec.
+func (f *EncryptingFiler) open(p, s []byte, pg int64) (n int, err error) {
+	n = int(binary.BigEndian.Uint32(s))
+	if n == 0 || n > slotPageSize {
+		return 0, f.invalid(pg, "invalid page header")
+	}
+
+	nonce, err := f.version(pg)
+	if err != nil {
+		return
+	}
+
+	if nonce == [12]byte{} {
+		return 0, f.invalid(pg, "page not in the version table")
+	}
+
+	var ad [12]byte
+	encAD(ad[:], pg, n)
+	if _, err = f.aead.Open(p[:0], nonce[:], s[encHdrSize:], ad[:]); err != nil {
+		return 0, f.invalid(pg, err)
+	}
+
+	return
+}
+
+// seal implements slotCodec.
+func (f *EncryptingFiler) seal(s, p []byte, pg int64, n int) (err error) {
+	nonce, err := f.nextNonce()
+	if err != nil {
+		return
+	}
+
+	if err = f.setVersion(pg, nonce); err != nil {
+		return
+	}
+
+	binary.BigEndian.PutUint32(s, uint32(n))
+	var ad [12]byte
+	encAD(ad[:], pg, n)
+	f.aead.Seal(s[encHdrSize:encHdrSize], nonce, p, ad[:])
+	return
+}
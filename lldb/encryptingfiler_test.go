@@ -0,0 +1,450 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func encryptingFilerFill(t *testing.T, sz int) (f *EncryptingFiler, inner *MemFiler, b []byte) {
+	inner = NewMemFiler()
+	f, err := NewEncryptingFiler(inner, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = make([]byte, sz)
+	for i := range b {
+		b[i] = byte(rand.Int())
+	}
+	if n, err := f.WriteAt(b, 0); n != sz {
+		t.Fatal(n, err)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func isErrDecrypt(err error) bool {
+	e, ok := err.(*ErrILSEQ)
+	return ok && e.Type == ErrDecrypt
+}
+
+func TestEncryptingFilerTamper(t *testing.T) {
+	const sz = 3*slotPageSize + 100
+
+	f, inner, b := encryptingFilerFill(t, sz)
+	if g, err := inner.Size(); g != 2*encTableSize+4*encSlotSize {
+		t.Fatal(g, err)
+	}
+
+	g := make([]byte, sz)
+	if n, err := f.ReadAt(g, 0); n != sz || !bytes.Equal(g, b) {
+		t.Fatal(n, err)
+	}
+
+	// Modify a byte of the sealed page 1.
+	var c [1]byte
+	off := f.off(1) + encHdrSize + 42
+	if _, err := inner.ReadAt(c[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	c[0] ^= 1
+	if _, err := inner.WriteAt(c[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.ReadAt(g[:10], 10); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := f.ReadAt(g[:10], slotPageSize+10)
+	if !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+	t.Log(err)
+
+	// Move page 0 to the place of page 2.
+	s := make([]byte, encSlotSize)
+	if n, err := inner.ReadAt(s, f.off(0)); n != len(s) {
+		t.Fatal(n, err)
+	}
+
+	if _, err := inner.WriteAt(s, f.off(2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.ReadAt(g[:10], 2*slotPageSize); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+
+	// Wrong key.
+	if f, err = NewEncryptingFiler(inner, []byte("fedcba9876543210")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.ReadAt(g[:10], 0); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+
+	if _, err := NewEncryptingFiler(inner, testKey[:15]); err == nil {
+		t.Fatal("unexpected success")
+	}
+}
+
+func TestEncryptingFilerNonce(t *testing.T) {
+	const sz = 2 * slotPageSize
+
+	f, inner, b := encryptingFilerFill(t, sz)
+	s0 := make([]byte, 2*encTableSize+2*encSlotSize)
+	if n, err := inner.ReadAt(s0, 0); n != len(s0) {
+		t.Fatal(n, err)
+	}
+
+	if bytes.Contains(s0, b[100:132]) {
+		t.Fatal("plaintext found in the wrapped Filer")
+	}
+
+	var v0 [2][12]byte
+	for i := range v0 {
+		var err error
+		if v0[i], err = f.version(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Write the same content again, truncate and regrow.
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, err := inner.Size(); g != 0 {
+		t.Fatal(g, err)
+	}
+
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s := make([]byte, len(s0))
+	if n, err := inner.ReadAt(s, 0); n != len(s) {
+		t.Fatal(n, err)
+	}
+
+	for i := range v0 {
+		v, err := f.version(int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		off := f.off(int64(i))
+		x, y := s0[off:off+encSlotSize], s[off:off+encSlotSize]
+		if v == v0[i] || bytes.Equal(x[encHdrSize:], y[encHdrSize:]) {
+			t.Fatal(i, "nonce reused")
+		}
+	}
+
+	// A new EncryptingFiler on the same key doesn't repeat the nonces.
+	f2, err := NewEncryptingFiler(NewMemFiler(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f2.WriteAt(b[:slotPageSize], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := f2.version(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(v[:8], v0[0][:8]) {
+		t.Fatal("nonce reused")
+	}
+}
+
+func TestEncryptingFilerTruncate(t *testing.T) {
+	const sz = 2*slotPageSize + 100
+
+	f, inner, b := encryptingFilerFill(t, sz)
+	for _, v := range []int64{sz - 50, slotPageSize + 1, slotPageSize, 10} {
+		if err := f.Truncate(v); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		f2, err := NewEncryptingFiler(inner, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, err := f2.Size(); g != v {
+			t.Fatal(g, err, v)
+		}
+
+		g := make([]byte, v)
+		if n, err := f2.ReadAt(g, 0); n != int(v) || !bytes.Equal(g, b[:v]) {
+			t.Fatal(n, err, v)
+		}
+	}
+
+	// Regrowing reads back zeros.
+	if err := f.Truncate(sz); err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, sz)
+	if n, err := f.ReadAt(g, 0); n != sz {
+		t.Fatal(n, err)
+	}
+
+	if !bytes.Equal(g[:10], b[:10]) || !bytes.Equal(g[10:], make([]byte, sz-10)) {
+		t.Fatal("unexpected content")
+	}
+}
+
+func TestEncryptingFilerOverwrite(t *testing.T) {
+	const sz = 3*slotPageSize + 100
+
+	f, inner, b := encryptingFilerFill(t, sz)
+
+	// Corrupt the page 1, a whole page write replaces it without reading
+	// it, a partial one fails.
+	var c [1]byte
+	off := f.off(1) + encHdrSize + 42
+	if _, err := inner.ReadAt(c[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	c[0] ^= 1
+	if _, err := inner.WriteAt(c[:], off); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.WriteAt(b[:10], slotPageSize+10); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+
+	for i := range b[slotPageSize : 2*slotPageSize] {
+		b[slotPageSize+i] = byte(rand.Int())
+	}
+	if _, err := f.WriteAt(b[slotPageSize:2*slotPageSize], slotPageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := NewEncryptingFiler(inner, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, sz)
+	if n, err := f2.ReadAt(g, 0); n != sz || !bytes.Equal(g, b) {
+		t.Fatal(n, err)
+	}
+}
+
+func TestEncryptingFilerConcurrentRead(t *testing.T) {
+	const sz = 3*slotPageSize + 100
+
+	_, inner, b := encryptingFilerFill(t, sz)
+	f, err := NewEncryptingFiler(inner, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The size is not known yet, the readers compute it concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g := make([]byte, sz)
+			if n, err := f.ReadAt(g, 0); n != sz || !bytes.Equal(g, b) {
+				t.Error(n, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEncryptingFilerRollback(t *testing.T) {
+	const sz = 3*slotPageSize + 100
+
+	f, inner, b := encryptingFilerFill(t, sz)
+
+	// Replace the page 1 by its older copy.
+	s := make([]byte, encSlotSize)
+	if n, err := inner.ReadAt(s, f.off(1)); n != len(s) {
+		t.Fatal(n, err)
+	}
+
+	if _, err := f.WriteAt(b[:slotPageSize], slotPageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := inner.WriteAt(s, f.off(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, sz)
+	if _, err := f.ReadAt(g[:10], slotPageSize+10); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+
+	f2, err := NewEncryptingFiler(inner, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f2.ReadAt(g[:10], slotPageSize+10); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+
+	if n, err := f2.ReadAt(g[:slotPageSize], 0); n != slotPageSize || !bytes.Equal(g[:slotPageSize], b[:slotPageSize]) {
+		t.Fatal(n, err)
+	}
+
+	// Remove the last page.
+	if err := inner.Truncate(f.off(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if f2, err = NewEncryptingFiler(inner, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f2.Size(); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptingFilerTornTable(t *testing.T) {
+	const sz = 2 * slotPageSize
+
+	f, inner, b := encryptingFilerFill(t, sz)
+	if _, err := f.WriteAt(b[:10], 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the newer table, the older one is used. It has the older
+	// version of the page 0.
+	if _, err := inner.WriteAt(make([]byte, 100), f.tableOff(0, 1)+1000); err != nil {
+		t.Fatal(err)
+	}
+
+	f2, err := NewEncryptingFiler(inner, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, sz)
+	if _, err := f2.ReadAt(g[:10], 0); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+
+	if n, err := f2.ReadAt(g[slotPageSize:], slotPageSize); n != slotPageSize || !bytes.Equal(g[slotPageSize:], b[slotPageSize:]) {
+		t.Fatal(n, err)
+	}
+
+	// Rewriting the page 0 makes it readable again, the next table goes
+	// to the torn copy.
+	if _, err := f2.WriteAt(b[:slotPageSize], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f2.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f2, err = NewEncryptingFiler(inner, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := f2.ReadAt(g, 0); n != sz || !bytes.Equal(g, b) {
+		t.Fatal(n, err)
+	}
+
+	// Both copies torn.
+	for c := int64(0); c < 2; c++ {
+		if _, err := inner.WriteAt(make([]byte, 100), f.tableOff(0, c)+1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f2, err = NewEncryptingFiler(inner, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f2.ReadAt(g, 0); !isErrDecrypt(err) {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptingFilerGroups(t *testing.T) {
+	const sz = (encTablePages+2)*slotPageSize + 10
+
+	f, inner, b := encryptingFilerFill(t, sz)
+	if g, err := inner.Size(); g != 4*encTableSize+(encTablePages+3)*encSlotSize {
+		t.Fatal(g, err)
+	}
+
+	check := func(sz int64) {
+		f2, err := NewEncryptingFiler(inner, testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g, err := f2.Size(); g != sz {
+			t.Fatal(g, err, sz)
+		}
+
+		g := make([]byte, sz)
+		if n, err := f2.ReadAt(g, 0); n != int(sz) || !bytes.Equal(g, b[:sz]) {
+			t.Fatal(n, err, sz)
+		}
+	}
+
+	check(sz)
+	for _, v := range []int64{encTablePages*slotPageSize + 1, encTablePages * slotPageSize, 10} {
+		if err := f.Truncate(v); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		check(v)
+	}
+}
@@ -56,7 +56,9 @@ const (
 	ErrOther ErrType = iota
 
 	ErrAdjacentFree          // Adjacent free blocks (.Off and .Arg)
+	ErrChecksum              // Page of .Name at .Off, content offset .Arg, has an invalid checksum, .More: more
 	ErrDecompress            // Used compressed block: corrupted compression
+	ErrDecrypt               // Encrypted page or WAL packet at .Off of .Name failed to authenticate, .More: more
 	ErrExpFreeTag            // Expected a free block tag, got .Arg
 	ErrExpUsedTag            // Expected a used block tag, got .Arg
 	ErrFLT                   // Free block is invalid or referenced multiple times
@@ -67,7 +69,7 @@ const (
 	ErrFreeTailBlock         // Last block is free
 	ErrHead                  // Head of a free block list has non zero Prev (.Arg)
 	ErrInvalidRelocTarget    // Reloc doesn't target (.Arg) a short or long used block
-	ErrInvalidWAL            // Corrupted write ahead log. .Name: file name, .More: more
+	ErrInvalidWAL            // Corrupted write ahead log. .Name: file name, .Off: packet offset, .More: more
 	ErrLongFreeBlkTooLong    // Long free block spans beyond EOF, size .Arg
 	ErrLongFreeBlkTooShort   // Long free block must have at least 2 atoms, got only .Arg
 	ErrLongFreeNextBeyondEOF // Long free block .Next (.Arg) spans beyond EOF
@@ -101,8 +103,12 @@ func (e *ErrILSEQ) Error() string {
 	switch e.Type {
 	case ErrAdjacentFree:
 		return fmt.Sprintf("Adjacent free blocks at offset %#x and %#x", e.Off, e.Arg)
+	case ErrChecksum:
+		return fmt.Sprintf("Page at offset %#x of %q (content offset %#x): Checksum mismatch: %v", e.Off, e.Name, e.Arg, e.More)
 	case ErrDecompress:
 		return fmt.Sprintf("Compressed block at offset %#x: Corrupted compressed content", e.Off)
+	case ErrDecrypt:
+		return fmt.Sprintf("Encrypted data at offset %#x of %q: Authentication failed: %v", e.Off, e.Name, e.More)
 	case ErrExpFreeTag:
 		return fmt.Sprintf("Block at offset %#x: Expected a free block tag, got %#2x", e.Off, e.Arg)
 	case ErrExpUsedTag:
@@ -124,7 +130,7 @@ func (e *ErrILSEQ) Error() string {
 	case ErrInvalidRelocTarget:
 		return fmt.Sprintf("Used reloc block at offset %#x: Target (%#x) is not a short or long used block", e.Off, e.Arg)
 	case ErrInvalidWAL:
-		return fmt.Sprintf("Corrupted write ahead log file: %q %v", e.Name, e.More)
+		return fmt.Sprintf("Corrupted write ahead log file: %q, offset %#x: %v", e.Name, e.Off, e.More)
 	case ErrLongFreeBlkTooLong:
 		return fmt.Sprintf("Long free block at offset %#x: Size (%#x) beyond EOF", e.Off, e.Arg)
 	case ErrLongFreeBlkTooShort:
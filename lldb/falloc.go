@@ -269,8 +269,10 @@ S is the size of this unused block in atoms. P and N are the previous and next
 free block handles in the doubly linked list to which this free block belongs.
 Leak contains any data the block had before deallocating this block.  See also
 the subtitle 'Content wiping' above. S, P and N are stored in network byte
-order. Large free blocks may trigger a consideration of file hole punching of
-the Leak field - for some value of 'large'.
+order. When a block is freed, all the whole 4kB file pages of its Leak field
+are deallocated using Filer.PunchHole, provided the Filer deallocates file
+space, like a SimpleFileFiler on Linux does. A RollbackFiler, and hence an
+ACIDFiler0, doesn't.
 
 Note: Allocator methods vs CRUD[1]:
 
@@ -294,6 +296,9 @@ type Allocator struct {
 	expHit   int64
 	expMiss  int64
 	cacheSz  int
+	compact  *compactor // Non nil while a compaction is in progress.
+	punchOff int64      // Offset of f in the file, see holePuncher.
+	canPunch bool       // f.PunchHole deallocates file space.
 	hit      uint16
 	miss     uint16
 	mu       sync.Mutex
@@ -312,15 +317,24 @@ func NewAllocator(f Filer, opts *Options) (a *Allocator, err error) {
 	}
 
 	a.cinit()
-	switch x := f.(type) {
+	if p, ok := f.(holePuncher); ok {
+		a.punchOff, a.canPunch = p.punchOffset()
+	}
+	rf := f
+	if x, ok := f.(*InnerFiler); ok {
+		rf = x.outer
+	}
+	switch x := rf.(type) {
 	case *RollbackFiler:
 		x.afterRollback = func() error {
 			a.cinit()
+			a.compact = nil
 			return a.flt.load(a.f, 0)
 		}
 	case *ACIDFiler0:
 		x.RollbackFiler.afterRollback = func() error {
 			a.cinit()
+			a.compact = nil
 			return a.flt.load(a.f, 0)
 		}
 	}
@@ -545,11 +559,17 @@ func (a *Allocator) free2(h, atoms int64) (err error) {
 		ratoms = 0
 	}
 
+	if !isTail {
+		if err = a.punch(h, atoms); err != nil {
+			return
+		}
+	}
+
 	switch {
 	case latoms == 0 && ratoms == 0:
 		// -> isolated <-
 		if isTail { // cut tail
-			return a.f.Truncate(h2off(h))
+			return a.truncate(h)
 		}
 
 		return a.link(h, atoms)
@@ -559,6 +579,7 @@ func (a *Allocator) free2(h, atoms int64) (err error) {
 			return
 		}
 
+		a.joined(h+atoms, h)
 		return a.link(h, atoms+ratoms)
 	case latoms != 0 && ratoms == 0:
 		// <- left join
@@ -566,8 +587,9 @@ func (a *Allocator) free2(h, atoms int64) (err error) {
 			return
 		}
 
+		a.joined(h, h-latoms)
 		if isTail {
-			return a.f.Truncate(h2off(h - latoms))
+			return a.truncate(h - latoms)
 		}
 
 		return a.link(h-latoms, latoms+atoms)
@@ -589,9 +611,28 @@ func (a *Allocator) free2(h, atoms int64) (err error) {
 		return
 	}
 
+	a.joined(h, lh)
+	a.joined(rh, lh)
 	return a.link(h-latoms, latoms+atoms+ratoms)
 }
 
+// punch deallocates the whole file pages of the Leak field of the freed block
+// h, if the Filer deallocates file space at all. The Leak of any free block it
+// may be joined with is left as is, it was punched when that block was freed.
+func (a *Allocator) punch(h, atoms int64) error {
+	if !a.canPunch {
+		return nil
+	}
+
+	off := (a.punchOff+h2off(h)+22+punchMask)&^punchMask - a.punchOff
+	end := (a.punchOff+h2off(h+atoms)-8)&^punchMask - a.punchOff
+	if off >= end {
+		return nil
+	}
+
+	return a.f.PunchHole(off, end-off)
+}
+
 // Add a free block h to the appropriate free list
 func (a *Allocator) link(h, atoms int64) (err error) {
 	if err = a.makeFree(h, atoms, 0, a.flt.head(atoms)); err != nil {
@@ -865,7 +906,7 @@ retry:
 		}
 
 		if h2off(fh)+16*fa == sz {
-			return a.f.Truncate(h2off(fh))
+			return a.truncate(fh)
 		}
 
 		return a.free2(fh, fa)
@@ -885,6 +926,7 @@ retry:
 	switch {
 	case off+atoms*16 == sz:
 		// relocating tail block - shortcut
+		a.joined(handle+atoms, handle)
 		return a.writeUsedBlock(handle, cc, b)
 	default:
 		if off+atoms*16 < sz {
@@ -903,6 +945,7 @@ retry:
 						return
 					}
 
+					a.joined(rh, handle)
 					atoms += ratoms
 					goto retry
 
@@ -922,6 +965,10 @@ retry:
 		return err
 	}
 
+	if c := a.compact; c != nil {
+		c.targets[newH] = true
+	}
+
 	rb := bufs.GCache.Cget(16)
 	defer bufs.GCache.Put(rb)
 	rb[0] = tagUsedRelocated
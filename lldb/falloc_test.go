@@ -1831,3 +1831,135 @@ func TestFltHead(t *testing.T) {
 	}
 
 }
+
+func TestAllocatorPunchHole(t *testing.T) {
+	if !canPunch {
+		t.Skip("no hole punching")
+	}
+
+	f := newFileFiler()
+	defer f.Close()
+
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, maxRq)
+	for i := range b {
+		b[i] = byte(rand.Intn(255) + 1)
+	}
+	h, err := a.Alloc(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.Alloc([]byte{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Free(h); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.Verify(NewMemFiler(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	g := make([]byte, maxRq)
+	if n, err := f.ReadAt(g, h2off(h)); n != len(g) {
+		t.Fatal(n, err)
+	}
+
+	zeros := 0
+	for _, v := range g {
+		if v == 0 {
+			zeros++
+		}
+	}
+	if e := maxRq - 2*punchSize; zeros < e {
+		t.Fatal(zeros, e)
+	}
+}
+
+// punchFiler records the PunchHole calls.
+type punchFiler struct {
+	Filer
+	punched [][2]int64
+}
+
+func (f *punchFiler) PunchHole(off, size int64) error {
+	f.punched = append(f.punched, [2]int64{off, size})
+	return f.Filer.PunchHole(off, size)
+}
+
+// punchingFiler is a punchFiler deallocating file space.
+type punchingFiler struct {
+	punchFiler
+}
+
+func (f *punchingFiler) punchOffset() (int64, bool) { return 0, true }
+
+func testAllocatorPunch(t *testing.T, f Filer) {
+	a, err := NewAllocator(f, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		h, err := a.Alloc(make([]byte, maxRq-i*punchSize/3))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = a.Alloc([]byte{42}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = a.Free(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAllocatorPunchAlign(t *testing.T) {
+	f := &punchingFiler{punchFiler{Filer: NewMemFiler()}}
+	testAllocatorPunch(t, NewInnerFiler(f, 16))
+	if len(f.punched) == 0 {
+		t.Fatal("no holes punched")
+	}
+
+	// Whole file pages, not shifted by the InnerFiler offset.
+	for _, v := range f.punched {
+		if off, size := v[0], v[1]; off&punchMask != 0 || size&punchMask != 0 || size == 0 {
+			t.Fatalf("%#x %#x", off, size)
+		}
+	}
+
+	// No holes in a Filer not deallocating file space.
+	g := &punchFiler{Filer: NewMemFiler()}
+	testAllocatorPunch(t, NewInnerFiler(g, 16))
+	if len(g.punched) != 0 {
+		t.Fatal(len(g.punched))
+	}
+
+	// Nor in a RollbackFiler, its PunchHole writes zero pages.
+	h := &punchingFiler{punchFiler{Filer: NewMemFiler()}}
+	r, err := NewRollbackFiler(h, func(sz int64) error { return h.Truncate(sz) }, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	testAllocatorPunch(t, NewInnerFiler(r, 16))
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h.punched) != 0 {
+		t.Fatal(len(h.punched))
+	}
+}
@@ -150,7 +150,22 @@ func (f *InnerFiler) EndUpdate() error { return f.outer.EndUpdate() }
 func (f *InnerFiler) Name() string { return f.outer.Name() }
 
 // PunchHole implements Filer. `off`, `size` must be >= 0.
-func (f *InnerFiler) PunchHole(off, size int64) error { return f.outer.PunchHole(f.off+off, size) }
+func (f *InnerFiler) PunchHole(off, size int64) error {
+	if off < 0 {
+		return &ErrINVAL{f.outer.Name() + ":PunchHole invalid off", off}
+	}
+
+	return f.outer.PunchHole(f.off+off, size)
+}
+
+func (f *InnerFiler) punchOffset() (off int64, ok bool) {
+	if p, ok := f.outer.(holePuncher); ok {
+		off, ok = p.punchOffset()
+		return f.off + off, ok
+	}
+
+	return
+}
 
 // ReadAt implements Filer. `off` must be >= 0.
 func (f *InnerFiler) ReadAt(b []byte, off int64) (n int, err error) {
@@ -179,8 +194,14 @@ func (f *InnerFiler) Sync() (err error) {
 	return f.outer.Sync()
 }
 
-// Truncate implements Filer.
-func (f *InnerFiler) Truncate(size int64) error { return f.outer.Truncate(size + f.off) }
+// Truncate implements Filer. `size` must be >= 0.
+func (f *InnerFiler) Truncate(size int64) error {
+	if size < 0 {
+		return &ErrINVAL{f.outer.Name() + ":Truncate invalid size", size}
+	}
+
+	return f.outer.Truncate(size + f.off)
+}
 
 // WriteAt implements Filer. `off` must be >= 0.
 func (f *InnerFiler) WriteAt(b []byte, off int64) (n int, err error) {
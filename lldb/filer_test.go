@@ -37,6 +37,14 @@ func (t *testFileFiler) Close() (err error) {
 	return
 }
 
+func (t *testFileFiler) punchOffset() (off int64, ok bool) {
+	if p, ok := t.Filer.(holePuncher); ok {
+		return p.punchOffset()
+	}
+
+	return
+}
+
 var (
 	newFileFiler = func() Filer {
 		file, err := ioutil.TempFile("", "lldb-test-file")
@@ -56,10 +64,36 @@ var (
 		return &testFileFiler{NewOSFiler(file)}
 	}
 
+	newMmapFiler = func() Filer {
+		file, err := ioutil.TempFile("", "lldb-test-mmapfile")
+		if err != nil {
+			panic(err)
+		}
+
+		return &testFileFiler{NewMmapFiler(file)}
+	}
+
 	newMemFiler = func() Filer {
 		return NewMemFiler()
 	}
 
+	newCrashFiler = func() Filer {
+		return NewCrashFiler()
+	}
+
+	newChecksumFiler = func() Filer {
+		return NewChecksumFiler(NewMemFiler())
+	}
+
+	newEncryptingFiler = func() Filer {
+		f, err := NewEncryptingFiler(NewMemFiler(), testKey)
+		if err != nil {
+			panic(err)
+		}
+
+		return f
+	}
+
 	nwBitFiler = func() Filer {
 		f, err := newBitFiler(NewMemFiler())
 		if err != nil {
@@ -90,7 +124,11 @@ var (
 func TestFilerNesting(t *testing.T) {
 	testFilerNesting(t, newFileFiler)
 	testFilerNesting(t, newOSFileFiler)
+	testFilerNesting(t, newMmapFiler)
 	testFilerNesting(t, newMemFiler)
+	testFilerNesting(t, newEncryptingFiler)
+	testFilerNesting(t, newChecksumFiler)
+	testFilerNesting(t, newCrashFiler)
 	testFilerNesting(t, newRollbackFiler)
 }
 
@@ -140,7 +178,11 @@ func testFilerNesting(t *testing.T, nf newFunc) {
 func TestFilerTruncate(t *testing.T) {
 	testFilerTruncate(t, newFileFiler)
 	testFilerTruncate(t, newOSFileFiler)
+	testFilerTruncate(t, newMmapFiler)
 	testFilerTruncate(t, newMemFiler)
+	testFilerTruncate(t, newEncryptingFiler)
+	testFilerTruncate(t, newChecksumFiler)
+	testFilerTruncate(t, newCrashFiler)
 	testFilerTruncate(t, nwBitFiler)
 	testFilerTruncate(t, newRollbackFiler)
 }
@@ -230,7 +272,11 @@ func testFilerTruncate(t *testing.T, nf newFunc) {
 func TestFilerReadAtWriteAt(t *testing.T) {
 	testFilerReadAtWriteAt(t, newFileFiler)
 	testFilerReadAtWriteAt(t, newOSFileFiler)
+	testFilerReadAtWriteAt(t, newMmapFiler)
 	testFilerReadAtWriteAt(t, newMemFiler)
+	testFilerReadAtWriteAt(t, newEncryptingFiler)
+	testFilerReadAtWriteAt(t, newChecksumFiler)
+	testFilerReadAtWriteAt(t, newCrashFiler)
 	testFilerReadAtWriteAt(t, nwBitFiler)
 	testFilerReadAtWriteAt(t, newRollbackFiler)
 }
@@ -392,7 +438,11 @@ func testFilerReadAtWriteAt(t *testing.T, nf newFunc) {
 func TestInnerFiler(t *testing.T) {
 	testInnerFiler(t, newFileFiler)
 	testInnerFiler(t, newOSFileFiler)
+	testInnerFiler(t, newMmapFiler)
 	testInnerFiler(t, newMemFiler)
+	testInnerFiler(t, newEncryptingFiler)
+	testInnerFiler(t, newChecksumFiler)
+	testInnerFiler(t, newCrashFiler)
 	testInnerFiler(t, nwBitFiler)
 	testInnerFiler(t, newRollbackFiler)
 }
@@ -609,7 +659,11 @@ func testInnerFiler(t *testing.T, nf newFunc) {
 func TestFileReadAtHole(t *testing.T) {
 	testFileReadAtHole(t, newFileFiler)
 	testFileReadAtHole(t, newOSFileFiler)
+	testFileReadAtHole(t, newMmapFiler)
 	testFileReadAtHole(t, newMemFiler)
+	testFileReadAtHole(t, newEncryptingFiler)
+	testFileReadAtHole(t, newChecksumFiler)
+	testFileReadAtHole(t, newCrashFiler)
 	testFileReadAtHole(t, nwBitFiler)
 	testFileReadAtHole(t, newRollbackFiler)
 }
@@ -658,6 +712,99 @@ func testFileReadAtHole(t *testing.T, nf newFunc) {
 	}
 }
 
+func TestFilerPunchHole(t *testing.T) {
+	testFilerPunchHole(t, newFileFiler)
+	testFilerPunchHole(t, newOSFileFiler)
+	testFilerPunchHole(t, newMmapFiler)
+	testFilerPunchHole(t, newMemFiler)
+	testFilerPunchHole(t, newEncryptingFiler)
+	testFilerPunchHole(t, newChecksumFiler)
+	testFilerPunchHole(t, newCrashFiler)
+	testFilerPunchHole(t, nwBitFiler)
+	testFilerPunchHole(t, newRollbackFiler)
+}
+
+func testFilerPunchHole(t *testing.T, nf newFunc) {
+	const (
+		sz  = 1 << 17
+		off = 5000
+		n   = 70000
+	)
+
+	f := nf()
+	t.Log(f.Name())
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if _, ok := f.(*RollbackFiler); ok {
+		if err := f.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		defer func() {
+			if err := f.EndUpdate(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	b := make([]byte, sz)
+	for i := range b {
+		b[i] = byte(rand.Intn(255) + 1)
+	}
+	if _, err := f.WriteAt(b, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.PunchHole(off, n); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, err := f.Size(); err != nil || g != sz {
+		t.Fatal(g, err)
+	}
+
+	g := make([]byte, sz)
+	if n, err := f.ReadAt(g, 0); n != sz {
+		t.Fatal(n, err)
+	}
+
+	zeros := 0
+	for i, v := range g {
+		switch {
+		case v == b[i]:
+			// nop
+		case v == 0 && i >= off && i < off+n:
+			zeros++
+		default:
+			t.Fatalf("%#x: got %#02x, exp %#02x", i, v, b[i])
+		}
+	}
+	t.Log(zeros)
+
+	switch f.(type) {
+	case *ChecksumFiler, *CrashFiler, *EncryptingFiler:
+		if zeros != 0 {
+			t.Fatal(zeros)
+		}
+	case *MemFiler, *bitFiler, *RollbackFiler:
+		if zeros < n-2*pgSize {
+			t.Fatal(zeros)
+		}
+	default:
+		if zeros != n {
+			t.Fatal(zeros)
+		}
+
+		if err := f.PunchHole(sz-10, 11); err == nil {
+			t.Fatal("unexpected success")
+		}
+	}
+}
+
 func BenchmarkMemFilerWrSeq(b *testing.B) {
 	b.StopTimer()
 	buf := make([]byte, filerTestChunkSize)
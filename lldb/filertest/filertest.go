@@ -0,0 +1,412 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package filertest provides a conformance test suite for implementations of
+// lldb.Filer.
+//
+// A typical use in a _test.go file of a package implementing a Filer
+//
+//	func TestMyFiler(t *testing.T) {
+//		filertest.Run(t, func() lldb.Filer { return NewMyFiler() }, nil)
+//	}
+//
+// The suite checks
+//
+//   - BeginUpdate, EndUpdate and Rollback nesting rules
+//   - ReadAt and WriteAt round trips, including reading holes
+//   - io.EOF reporting of ReadAt at and beyond the Filer size
+//   - Truncate and Size semantics
+//   - PunchHole argument validation and preservation of the content
+//     outside of the hole
+//   - Rollback discarding updates, if Options.Rollback is set
+//
+// All updates are made between BeginUpdate and EndUpdate, so Filers like
+// lldb.RollbackFiler or lldb.ACIDFiler0 can be tested as well.
+package filertest
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/cznic/exp/lldb"
+)
+
+// Options amend the behavior of Run. A nil *Options is the same as
+// &Options{}.
+type Options struct {
+	// Rollback reports the Filer's Rollback discards the updates made
+	// since the matching BeginUpdate, like lldb.RollbackFiler does.
+	// Otherwise only the Rollback nesting rules are checked.
+	Rollback bool
+}
+
+// Run runs the conformance suite against Filers returned by nf, each test as
+// a subtest of t. nf must return a new, empty Filer every time it's called.
+// Every Filer is closed by the suite, so nf can arrange for removing any
+// resources it acquired on Close.
+func Run(t *testing.T, nf func() lldb.Filer, opts *Options) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	for _, v := range []struct {
+		name string
+		test func(*testing.T, func() lldb.Filer, *Options)
+	}{
+		{"Nesting", testNesting},
+		{"ReadAtWriteAt", testReadAtWriteAt},
+		{"EOF", testEOF},
+		{"Truncate", testTruncate},
+		{"PunchHole", testPunchHole},
+		{"Rollback", testRollback},
+	} {
+		test := v.test
+		t.Run(v.name, func(t *testing.T) { test(t, nf, opts) })
+	}
+}
+
+// update calls fn between f.BeginUpdate and f.EndUpdate.
+func update(t *testing.T, f lldb.Filer, fn func()) {
+	if err := f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	fn()
+	if err := f.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func size(t *testing.T, f lldb.Filer) int64 {
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sz
+}
+
+func write(t *testing.T, f lldb.Filer, b []byte, off int64) {
+	if n, err := f.WriteAt(b, off); n != len(b) || err != nil {
+		t.Fatalf("WriteAt(%d bytes, %#x): %d, %v", len(b), off, n, err)
+	}
+}
+
+// read returns n bytes read from f at off, which must be within the Filer
+// size.
+func read(t *testing.T, f lldb.Filer, n int, off int64) []byte {
+	b := make([]byte, n)
+	if n, err := f.ReadAt(b, off); n != len(b) || err != nil && err != io.EOF {
+		t.Fatalf("ReadAt(%d bytes, %#x): %d, %v", len(b), off, n, err)
+	}
+
+	return b
+}
+
+func random(rng *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rng.Intn(255) + 1)
+	}
+	return b
+}
+
+func closeFiler(t *testing.T, f lldb.Filer) {
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func testNesting(t *testing.T, nf func() lldb.Filer, opts *Options) {
+	// {Create, Close} works.
+	f := nf()
+	if g := size(t, f); g != 0 {
+		t.Fatalf("size of a new Filer: %d", g)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unbalanced EndUpdate and Rollback fail.
+	f = nf()
+	if err := f.EndUpdate(); err == nil {
+		t.Error("unbalanced EndUpdate: unexpected success")
+	}
+
+	if err := f.Rollback(); err == nil {
+		t.Error("unbalanced Rollback: unexpected success")
+	}
+
+	closeFiler(t, f)
+
+	// {Create, BeginUpdate, Close} fails. Whether the Filer is closed
+	// anyway is implementation defined, lldb.RollbackFiler does that, so
+	// the errors of releasing it are ignored.
+	f = nf()
+	if err := f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err == nil {
+		t.Error("Close inside an update: unexpected success")
+	}
+
+	f.EndUpdate()
+	f.Close()
+
+	// Nested updates finished by any mix of EndUpdate and Rollback.
+	f = nf()
+	for _, v := range []string{"EE", "ER", "RE", "RR"} {
+		for i := 0; i < 2; i++ {
+			if err := f.BeginUpdate(); err != nil {
+				t.Fatal(v, err)
+			}
+		}
+
+		for _, c := range v {
+			var err error
+			switch c {
+			case 'E':
+				err = f.EndUpdate()
+			case 'R':
+				err = f.Rollback()
+			}
+			if err != nil {
+				t.Fatal(v, err)
+			}
+		}
+	}
+
+	if err := f.EndUpdate(); err == nil {
+		t.Error("unbalanced EndUpdate: unexpected success")
+	}
+
+	closeFiler(t, f)
+}
+
+func testReadAtWriteAt(t *testing.T, nf func() lldb.Filer, opts *Options) {
+	const N = 1 << 17
+
+	f := nf()
+	defer closeFiler(t, f)
+
+	rng := rand.New(rand.NewSource(42))
+	ref := make([]byte, N)
+	var sz int64
+	update(t, f, func() {
+		for i := 0; i < 200; i++ {
+			off := rng.Intn(N)
+			n := rng.Intn(N/16) + 1
+			if off+n > N {
+				n = N - off
+			}
+			b := random(rng, n)
+			write(t, f, b, int64(off))
+			copy(ref[off:], b)
+			if end := int64(off + n); end > sz {
+				sz = end
+			}
+			if g := size(t, f); g != sz {
+				t.Fatalf("size: got %d, exp %d", g, sz)
+			}
+		}
+	})
+
+	for i := 0; i < 200; i++ {
+		off := rng.Int63n(sz)
+		n := rng.Intn(N/16) + 1
+		if off+int64(n) > sz {
+			n = int(sz - off)
+		}
+		if g, e := read(t, f, n, off), ref[off:off+int64(n)]; !bytes.Equal(g, e) {
+			t.Fatalf("ReadAt(%d bytes, %#x): content differs", n, off)
+		}
+	}
+
+	if g, e := read(t, f, int(sz), 0), ref[:sz]; !bytes.Equal(g, e) {
+		t.Fatal("content differs")
+	}
+
+	// Negative offsets are rejected.
+	if _, err := f.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Error("ReadAt at -1: unexpected success")
+	}
+
+	update(t, f, func() {
+		if _, err := f.WriteAt(make([]byte, 1), -1); err == nil {
+			t.Error("WriteAt at -1: unexpected success")
+		}
+	})
+
+	// Writing beyond the size leaves a hole of zeros.
+	update(t, f, func() { write(t, f, []byte{1, 2, 3}, N+5000) })
+	if g, e := size(t, f), int64(N+5003); g != e {
+		t.Fatalf("size: got %d, exp %d", g, e)
+	}
+
+	if g, e := read(t, f, int(N+5003-sz), sz), append(make([]byte, N+5000-sz), 1, 2, 3); !bytes.Equal(g, e) {
+		t.Fatal("hole content differs")
+	}
+}
+
+func testEOF(t *testing.T, nf func() lldb.Filer, opts *Options) {
+	f := nf()
+	defer closeFiler(t, f)
+
+	b := make([]byte, 10)
+	if n, err := f.ReadAt(b, 0); n != 0 || err != io.EOF {
+		t.Fatalf("ReadAt of an empty Filer: %d, %v", n, err)
+	}
+
+	data := random(rand.New(rand.NewSource(42)), 1000)
+	update(t, f, func() { write(t, f, data, 0) })
+
+	// At the end of the content err may be io.EOF or nil.
+	if n, err := f.ReadAt(b, 990); n != 10 || err != nil && err != io.EOF || !bytes.Equal(b, data[990:]) {
+		t.Fatalf("ReadAt up to the size: %d, %v", n, err)
+	}
+
+	for _, off := range []int64{995, 1000, 1001, 5000} {
+		e := int(1000 - off)
+		if e < 0 {
+			e = 0
+		}
+		n, err := f.ReadAt(b, off)
+		if n != e || err != io.EOF {
+			t.Fatalf("ReadAt(%d bytes, %d): got %d, %v, exp %d, %v", len(b), off, n, err, e, io.EOF)
+		}
+
+		if n != 0 && !bytes.Equal(b[:n], data[off:off+int64(n)]) {
+			t.Fatalf("ReadAt(%d bytes, %d): content differs", len(b), off)
+		}
+	}
+}
+
+func testTruncate(t *testing.T, nf func() lldb.Filer, opts *Options) {
+	f := nf()
+	defer closeFiler(t, f)
+
+	data := random(rand.New(rand.NewSource(42)), 20000)
+	update(t, f, func() { write(t, f, data, 0) })
+	for _, v := range []int64{20000, 19999, 12345, 4096, 4095, 1, 0} {
+		update(t, f, func() {
+			if err := f.Truncate(v); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if g := size(t, f); g != v {
+			t.Fatalf("size after Truncate(%d): %d", v, g)
+		}
+
+		if v != 0 && !bytes.Equal(read(t, f, int(v), 0), data[:v]) {
+			t.Fatalf("content after Truncate(%d) differs", v)
+		}
+	}
+
+	// Growing reads back zeros, also where content was truncated before.
+	update(t, f, func() {
+		write(t, f, data[:100], 0)
+		if err := f.Truncate(50); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.Truncate(10000); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if g := size(t, f); g != 10000 {
+		t.Fatalf("size after growing Truncate: %d", g)
+	}
+
+	if g, e := read(t, f, 10000, 0), append(data[:50:50], make([]byte, 9950)...); !bytes.Equal(g, e) {
+		t.Fatal("content after growing Truncate differs")
+	}
+
+	update(t, f, func() {
+		if err := f.Truncate(-1); err == nil {
+			t.Error("Truncate(-1): unexpected success")
+		}
+	})
+}
+
+func testPunchHole(t *testing.T, nf func() lldb.Filer, opts *Options) {
+	const (
+		sz  = 1 << 17
+		off = 5000
+		n   = 70000
+	)
+
+	f := nf()
+	defer closeFiler(t, f)
+
+	data := random(rand.New(rand.NewSource(42)), sz)
+	update(t, f, func() {
+		write(t, f, data, 0)
+		for _, v := range []struct{ off, size int64 }{
+			{-1, 10},
+			{0, -1},
+			{sz - 10, 11},
+		} {
+			if err := f.PunchHole(v.off, v.size); err == nil {
+				t.Errorf("PunchHole(%d, %d): unexpected success", v.off, v.size)
+			}
+		}
+
+		if err := f.PunchHole(off, n); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := f.PunchHole(sz, 0); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if g := size(t, f); g != sz {
+		t.Fatalf("size after PunchHole: %d", g)
+	}
+
+	// The content of the hole is unspecified.
+	g := read(t, f, sz, 0)
+	if !bytes.Equal(g[:off], data[:off]) || !bytes.Equal(g[off+n:], data[off+n:]) {
+		t.Fatal("content outside of the hole differs")
+	}
+}
+
+func testRollback(t *testing.T, nf func() lldb.Filer, opts *Options) {
+	if !opts.Rollback {
+		t.Skip("Options.Rollback not set")
+	}
+
+	f := nf()
+	defer closeFiler(t, f)
+
+	data := random(rand.New(rand.NewSource(42)), 10000)
+	update(t, f, func() { write(t, f, data, 0) })
+
+	if err := f.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	write(t, f, make([]byte, 20000), 5000)
+	if err := f.Truncate(30000); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nested update, rolled back by the outer Rollback.
+	update(t, f, func() { write(t, f, []byte{1, 2, 3}, 100) })
+	if err := f.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := size(t, f); g != 10000 {
+		t.Fatalf("size after Rollback: %d", g)
+	}
+
+	if !bytes.Equal(read(t, f, 10000, 0), data) {
+		t.Fatal("content after Rollback differs")
+	}
+}
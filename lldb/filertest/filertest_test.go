@@ -0,0 +1,83 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filertest
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cznic/exp/lldb"
+)
+
+// fileFiler removes its files on Close, even if closing the Filer failed.
+type fileFiler struct {
+	lldb.Filer
+	wal *os.File
+}
+
+func (f *fileFiler) Close() (err error) {
+	err = f.Filer.Close()
+	os.Remove(f.Name())
+	if f.wal != nil {
+		f.wal.Close()
+		os.Remove(f.wal.Name())
+	}
+	return
+}
+
+func tempFile(t *testing.T) *os.File {
+	f, err := ioutil.TempFile("", "filertest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestLLDBFilers(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	for _, v := range []struct {
+		name string
+		nf   func() lldb.Filer
+		opts *Options
+	}{
+		{"MemFiler", func() lldb.Filer { return lldb.NewMemFiler() }, nil},
+		{"SimpleFileFiler", func() lldb.Filer { return &fileFiler{Filer: lldb.NewSimpleFileFiler(tempFile(t))} }, nil},
+		{"OSFiler", func() lldb.Filer { return &fileFiler{Filer: lldb.NewOSFiler(tempFile(t))} }, nil},
+		{"MmapFiler", func() lldb.Filer { return &fileFiler{Filer: lldb.NewMmapFiler(tempFile(t))} }, nil},
+		{"InnerFiler", func() lldb.Filer { return lldb.NewInnerFiler(lldb.NewMemFiler(), 16) }, nil},
+		{"CrashFiler", func() lldb.Filer { return lldb.NewCrashFiler() }, nil},
+		{"ChecksumFiler", func() lldb.Filer { return lldb.NewChecksumFiler(lldb.NewMemFiler()) }, nil},
+		{"EncryptingFiler", func() lldb.Filer {
+			f, err := lldb.NewEncryptingFiler(lldb.NewMemFiler(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return f
+		}, nil},
+		{"RollbackFiler", func() lldb.Filer {
+			f := lldb.NewMemFiler()
+			r, err := lldb.NewRollbackFiler(f, f.Truncate, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return r
+		}, &Options{Rollback: true}},
+		{"ACIDFiler0", func() lldb.Filer {
+			wal := tempFile(t)
+			f, err := lldb.NewACIDFiler(lldb.NewSimpleFileFiler(tempFile(t)), wal)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return &fileFiler{Filer: f, wal: wal}
+		}, &Options{Rollback: true}},
+	} {
+		t.Run(v.name, func(t *testing.T) { Run(t, v.nf, v.opts) })
+	}
+}
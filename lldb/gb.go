@@ -334,7 +334,7 @@ func DecodeScalars(b []byte) (scalars []interface{}, err error) {
 			b = b[1:]
 		case gbFloat1, gbFloat2, gbFloat3, gbFloat4, gbFloat5, gbFloat6, gbFloat7, gbFloat8:
 			n := 1 + int(tag) - gbFloat0
-			if len(b) < n-1 {
+			if len(b) < n {
 				goto corrupted
 			}
 
@@ -342,7 +342,7 @@ func DecodeScalars(b []byte) (scalars []interface{}, err error) {
 			b = b[n:]
 		case gbComplex0, gbComplex1, gbComplex2, gbComplex3, gbComplex4, gbComplex5, gbComplex6, gbComplex7, gbComplex8:
 			n := 1 + int(tag) - gbComplex0
-			if len(b) < n-1 {
+			if len(b) < n {
 				goto corrupted
 			}
 
@@ -359,7 +359,7 @@ func DecodeScalars(b []byte) (scalars []interface{}, err error) {
 			}
 
 			n = 1 + int(tag) - gbComplex0
-			if len(b) < n-1 {
+			if len(b) < n {
 				goto corrupted
 			}
 
@@ -362,3 +362,25 @@ func TestEncodingBug(t *testing.T) {
 		bits |= 1 << 63
 	}
 }
+
+func TestDecodeScalarsTruncated(t *testing.T) {
+	for _, v := range []interface{}{
+		math.Pi,
+		-1.5,
+		complex(math.Pi, -math.E),
+		complex(1, 0.25),
+		[]byte(s256),
+		s256[:42],
+	} {
+		b, err := EncodeScalars(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 1; i < len(b); i++ {
+			if _, err := DecodeScalars(b[:i]); err == nil {
+				t.Fatalf("%v: |% x|: unexpected success", v, b[:i])
+			}
+		}
+	}
+}
@@ -37,9 +37,10 @@
 // BTrees
 //
 // In addition to the VMM like services, lldb provides volatile and
-// non-volatile BTrees. Keys and values of a BTree are limited in size to 64kB
-// each (a bit more actually). Support for larger keys/values, if desired, can
-// be built atop a BTree to certain limits.
+// non-volatile BTrees. Keys and values of a BTree can be of any size. Short
+// keys and values are stored inline in the tree pages, longer ones in a
+// separate block and those exceeding the maximum block size in a chain of
+// overflow blocks.
 //
 // Handles vs pointers
 //
@@ -167,10 +167,16 @@ func (f *MemFiler) PunchHole(off, size int64) (err error) {
 	return
 }
 
+func (f *MemFiler) punchOffset() (int64, bool) { return 0, true }
+
 var zeroPage [pgSize]byte
 
 // ReadAt implements Filer.
 func (f *MemFiler) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ": ReadAt off", off}
+	}
+
 	avail := f.size - off
 	pgI := off >> pgBits
 	pgO := int(off & pgMask)
@@ -221,8 +227,16 @@ func (f *MemFiler) ReadFrom(r io.Reader) (n int64, err error) {
 	return
 }
 
-// Rollback implements Filer.
-func (f *MemFiler) Rollback() (err error) { return }
+// Rollback implements Filer. Rollback only decrements the nesting counter, the
+// updates are not discarded.
+func (f *MemFiler) Rollback() (err error) {
+	if f.nest == 0 {
+		return &ErrPERM{(f.Name() + ": Rollback")}
+	}
+
+	f.nest--
+	return
+}
 
 // Size implements Filer.
 func (f *MemFiler) Size() (int64, error) {
@@ -245,6 +259,15 @@ func (f *MemFiler) Truncate(size int64) (err error) {
 		return
 	}
 
+	if size < f.size {
+		// Zero the truncated tail of the last page, should it
+		// ever get regrown.
+		if pg := f.m[size>>pgBits]; pg != nil {
+			o := int(size & pgMask)
+			copy(pg[o:], zeroPage[o:])
+		}
+	}
+
 	first := size >> pgBits
 	if size&pgMask != 0 {
 		first++
@@ -263,6 +286,10 @@ func (f *MemFiler) Truncate(size int64) (err error) {
 
 // WriteAt implements Filer.
 func (f *MemFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ": WriteAt off", off}
+	}
+
 	pgI := off >> pgBits
 	pgO := int(off & pgMask)
 	n = len(b)
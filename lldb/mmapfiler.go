@@ -0,0 +1,259 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// An os.File backed Filer reading through a memory mapping.
+
+package lldb
+
+import (
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/cznic/mathutil"
+)
+
+const mmapChunk = 1 << 24 // Mapping size granularity.
+
+var _ Filer = &MmapFiler{} // Ensure MmapFiler is a Filer.
+
+// MmapFiler is an os.File backed Filer like SimpleFileFiler, but ReadAt copies
+// the data from a read only memory mapping of the file instead of issuing a
+// read system call. Writes go through the file's WriteAt. The mapping is
+// established lazily and it's replaced when the file grows beyond it or when
+// the file shrinks.
+//
+// ReadAt, Size and PunchHole may be invoked concurrently, also while another
+// goroutine's ReadAt replaces the mapping.
+//
+// On platforms not supporting memory mapping, or if mapping fails, MmapFiler
+// falls back to reading the file like SimpleFileFiler does.
+//
+// Like SimpleFileFiler, MmapFiler does not implement BeginUpdate,
+// EndUpdate and Rollback in any way which would protect the structural
+// integrity of data and it's intended to be wrapped in eg. a RollbackFiler or
+// ACIDFiler0.
+type MmapFiler struct {
+	file  *os.File
+	mu    sync.RWMutex // Protects m, nomap and size.
+	m     []byte       // The mapping, nil if not established.
+	nest  int
+	nomap bool  // Mapping failed, use file.ReadAt.
+	size  int64 // not set if < 0
+}
+
+// NewMmapFiler returns a new MmapFiler.
+func NewMmapFiler(f *os.File) *MmapFiler {
+	return &MmapFiler{file: f, size: -1}
+}
+
+// BeginUpdate implements Filer.
+func (f *MmapFiler) BeginUpdate() error {
+	f.nest++
+	return nil
+}
+
+// Close implements Filer.
+func (f *MmapFiler) Close() (err error) {
+	if f.nest != 0 {
+		return &ErrPERM{(f.Name() + ":Close")}
+	}
+
+	f.mu.Lock()
+	err = f.unmap()
+	f.mu.Unlock()
+	if err2 := f.file.Close(); err2 != nil && err == nil {
+		err = err2
+	}
+	return
+}
+
+// EndUpdate implements Filer.
+func (f *MmapFiler) EndUpdate() (err error) {
+	if f.nest == 0 {
+		return &ErrPERM{(f.Name() + ":EndUpdate")}
+	}
+
+	f.nest--
+	return
+}
+
+// Name implements Filer.
+func (f *MmapFiler) Name() string {
+	return f.file.Name()
+}
+
+func (f *MmapFiler) punchOffset() (int64, bool) { return 0, canPunch }
+
+// PunchHole implements Filer. It works like SimpleFileFiler.PunchHole.
+func (f *MmapFiler) PunchHole(off, size int64) (err error) {
+	if off < 0 {
+		return &ErrINVAL{f.Name() + ": PunchHole off", off}
+	}
+
+	fsize, err := f.Size()
+	if err != nil {
+		return
+	}
+
+	if size < 0 || off+size > fsize {
+		return &ErrINVAL{f.Name() + ": PunchHole size", size}
+	}
+
+	if size == 0 {
+		return
+	}
+
+	return punchHole(f.file, off, size)
+}
+
+// ReadAt implements Filer.
+func (f *MmapFiler) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ": ReadAt off", off}
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for f.size < 0 || !f.nomap && f.size > int64(len(f.m)) {
+		f.mu.RUnlock()
+		f.mu.Lock()
+		sz, err := f.stat()
+		if err == nil {
+			err = f.mmap(sz)
+		}
+		f.mu.Unlock()
+		f.mu.RLock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sz := f.size
+	if off >= sz {
+		return 0, io.EOF
+	}
+
+	if f.nomap {
+		return f.file.ReadAt(b, off)
+	}
+
+	if n = copy(b, f.m[off:sz]); n < len(b) {
+		err = io.EOF
+	}
+	return
+}
+
+// Rollback implements Filer. Rollback only decrements the nesting counter, the
+// updates are not discarded.
+func (f *MmapFiler) Rollback() (err error) {
+	if f.nest == 0 {
+		return &ErrPERM{(f.Name() + ": Rollback")}
+	}
+
+	f.nest--
+	return
+}
+
+// Size implements Filer.
+func (f *MmapFiler) Size() (int64, error) {
+	f.mu.RLock()
+	sz := f.size
+	f.mu.RUnlock()
+	if sz >= 0 {
+		return sz, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stat()
+}
+
+// stat returns the file size, f.mu must be locked.
+func (f *MmapFiler) stat() (int64, error) {
+	if f.size < 0 { // boot
+		fi, err := f.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+
+		f.size = fi.Size()
+	}
+	return f.size, nil
+}
+
+// Sync implements Filer.
+func (f *MmapFiler) Sync() error {
+	return f.file.Sync()
+}
+
+// Truncate implements Filer.
+func (f *MmapFiler) Truncate(size int64) (err error) {
+	if size < 0 {
+		return &ErrINVAL{"Truncate size", size}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sz, err := f.stat()
+	if err != nil {
+		return
+	}
+
+	// Keep the mapping unless the file shrinks, eg. a checkpoint of an
+	// ACIDFiler0 truncates the file to its current size on every commit.
+	if size < sz && size < int64(len(f.m)) {
+		if err = f.unmap(); err != nil {
+			return
+		}
+	}
+
+	f.size = size
+	return f.file.Truncate(size)
+}
+
+// WriteAt implements Filer.
+func (f *MmapFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sz, err := f.stat()
+	if err != nil {
+		return
+	}
+
+	f.size = mathutil.MaxInt64(sz, int64(len(b))+off)
+	return f.file.WriteAt(b, off)
+}
+
+// mmap makes sure the mapping covers the first sz bytes of the file, f.mu must
+// be locked.
+func (f *MmapFiler) mmap(sz int64) (err error) {
+	if f.nomap || sz <= int64(len(f.m)) {
+		return
+	}
+
+	if err = f.unmap(); err != nil {
+		return
+	}
+
+	n := (sz + mmapChunk - 1) &^ (mmapChunk - 1)
+	if n > math.MaxInt32 && int64(int(n)) != n {
+		f.nomap = true
+		return
+	}
+
+	if f.m, err = mmap(f.file, int(n)); err != nil {
+		f.m, f.nomap, err = nil, true, nil
+	}
+	return
+}
+
+func (f *MmapFiler) unmap() (err error) {
+	if f.m != nil {
+		err = munmap(f.m)
+		f.m = nil
+	}
+	return
+}
@@ -0,0 +1,162 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Test remapping on file growth and truncation.
+func TestMmapFilerRemap(t *testing.T) {
+	file, err := ioutil.TempFile("", "lldb-test-mmapfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+
+	f := NewMmapFiler(file)
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	read := func(off int64, e []byte) {
+		b := make([]byte, len(e))
+		if n, err := f.ReadAt(b, off); n != len(b) {
+			t.Fatal(off, n, err)
+		}
+
+		if !bytes.Equal(b, e) {
+			t.Fatalf("off %#x: got %x, exp %x", off, b, e)
+		}
+	}
+
+	if _, err := f.WriteAt([]byte("foo"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	read(10, []byte("foo"))
+	m := len(f.m)
+
+	// Written after mapping, within the mapping.
+	if _, err := f.WriteAt([]byte("bar"), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	read(10, []byte("bar"))
+
+	// Growing beyond the mapping.
+	off := int64(m) + 100
+	if _, err := f.WriteAt([]byte("baz"), off); err != nil {
+		t.Fatal(err)
+	}
+
+	read(off, []byte("baz"))
+	read(10, []byte("bar"))
+	if f.nomap {
+		t.Log("mmap not supported")
+		return
+	}
+
+	if g := len(f.m); g <= m {
+		t.Fatal(g, m)
+	}
+
+	// Shrinking.
+	if err := f.Truncate(12); err != nil {
+		t.Fatal(err)
+	}
+
+	read(10, []byte("ba"))
+	if n, err := f.ReadAt(make([]byte, 3), 10); n != 2 || err == nil {
+		t.Fatal(n, err)
+	}
+
+	if n, err := f.ReadAt(make([]byte, 3), 12); n != 0 || err == nil {
+		t.Fatal(n, err)
+	}
+
+	// Growing a hole.
+	if err := f.Truncate(off + 3); err != nil {
+		t.Fatal(err)
+	}
+
+	read(10, []byte("ba\x00"))
+	read(off, []byte{0, 0, 0})
+}
+
+// Test concurrent readers replacing the mapping.
+func TestMmapFilerConcurrentRead(t *testing.T) {
+	file, err := ioutil.TempFile("", "lldb-test-mmapfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+
+	f := NewMmapFiler(file)
+	defer func() {
+		if err := f.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var offs []int64
+	for i := 0; i < 4; i++ {
+		off := int64(i) * (mmapChunk + 100)
+		b := []byte{byte(i + 1)}
+		if _, err := f.WriteAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+
+		offs = append(offs, off)
+		var wg sync.WaitGroup
+		errs := make(chan error, 8*len(offs))
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k, off := range offs {
+					b := []byte{0}
+					if n, err := f.ReadAt(b, off); n != 1 || b[0] != byte(k+1) {
+						errs <- fmt.Errorf("off %#x: %v %x %v", off, n, b, err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatal(err)
+		}
+	}
+
+	if f.nomap {
+		t.Log("mmap not supported")
+		return
+	}
+
+	// Truncating to the same size keeps the mapping.
+	m := &f.m[0]
+	sz, err := f.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Truncate(sz); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.m == nil || &f.m[0] != m {
+		t.Fatal("mapping replaced")
+	}
+}
@@ -74,9 +74,37 @@ func (f *OSFiler) Name() string {
 	return f.f.Name()
 }
 
-// PunchHole implements Filer.
+// PunchHole implements Filer. If the OSFile is an *os.File, PunchHole works
+// like SimpleFileFiler.PunchHole, otherwise the range is overwritten with
+// zeros.
 func (f *OSFiler) PunchHole(off, size int64) (err error) {
-	return
+	if off < 0 {
+		return &ErrINVAL{f.Name() + ": PunchHole off", off}
+	}
+
+	fsize, err := f.Size()
+	if err != nil {
+		return
+	}
+
+	if size < 0 || off+size > fsize {
+		return &ErrINVAL{f.Name() + ": PunchHole size", size}
+	}
+
+	if size == 0 {
+		return
+	}
+
+	if file, ok := f.f.(*os.File); ok {
+		return punchHole(file, off, size)
+	}
+
+	return zeroFill(f.f, off, size)
+}
+
+func (f *OSFiler) punchOffset() (int64, bool) {
+	_, ok := f.f.(*os.File)
+	return 0, ok && canPunch
 }
 
 // ReadAt implements Filer.
@@ -84,8 +112,16 @@ func (f *OSFiler) ReadAt(b []byte, off int64) (n int, err error) {
 	return f.f.ReadAt(b, off)
 }
 
-// Rollback implements Filer.
-func (f *OSFiler) Rollback() (err error) { return }
+// Rollback implements Filer. Rollback only decrements the nesting counter, the
+// updates are not discarded.
+func (f *OSFiler) Rollback() (err error) {
+	if f.nest == 0 {
+		return &ErrPERM{(f.Name() + ": Rollback")}
+	}
+
+	f.nest--
+	return
+}
 
 // Size implements Filer.
 func (f *OSFiler) Size() (n int64, err error) {
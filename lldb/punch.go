@@ -0,0 +1,46 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Hole punching support for the file backed Filers.
+
+package lldb
+
+import (
+	"io"
+
+	"github.com/cznic/bufs"
+	"github.com/cznic/mathutil"
+)
+
+// Hole punching granularity used by the Allocator.
+const (
+	punchBits = 12
+	punchSize = 1 << punchBits
+	punchMask = punchSize - 1
+)
+
+// holePuncher is implemented by the Filers whose PunchHole may deallocate file
+// space. Other Filers, like RollbackFiler, implement PunchHole by writing
+// zeros or not at all, punching holes in them only adds writes.
+type holePuncher interface {
+	// punchOffset returns the offset of the Filer's offset zero in the
+	// file and reports whether PunchHole deallocates space of the file.
+	punchOffset() (off int64, ok bool)
+}
+
+// zeroFill overwrites size bytes of w at off with zeros.
+func zeroFill(w io.WriterAt, off, size int64) (err error) {
+	b := bufs.GCache.Cget(int(mathutil.MinInt64(size, 1<<16)))
+	defer bufs.GCache.Put(b)
+	for size > 0 {
+		n := mathutil.MinInt64(size, int64(len(b)))
+		if _, err = w.WriteAt(b[:n], off); err != nil {
+			return
+		}
+
+		off += n
+		size -= n
+	}
+	return
+}
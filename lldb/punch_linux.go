@@ -0,0 +1,32 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"os"
+	"syscall"
+)
+
+// canPunch reports whether punchHole deallocates file space.
+const canPunch = true
+
+// fallocate(2) mode flags.
+const (
+	fallocFlKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocFlPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+// punchHole deallocates size bytes of f at off. If the file system doesn't
+// support hole punching, the range is overwritten with zeros instead.
+func punchHole(f *os.File, off, size int64) error {
+	switch err := syscall.Fallocate(int(f.Fd()), fallocFlKeepSize|fallocFlPunchHole, off, size); err {
+	case nil:
+		return nil
+	case syscall.EOPNOTSUPP, syscall.ENOSYS:
+		return zeroFill(f, off, size)
+	default:
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+}
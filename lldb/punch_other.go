@@ -0,0 +1,19 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package lldb
+
+import (
+	"os"
+)
+
+// canPunch reports whether punchHole deallocates file space.
+const canPunch = false
+
+// punchHole overwrites size bytes of f at off with zeros.
+func punchHole(f *os.File, off, size int64) error {
+	return zeroFill(f, off, size)
+}
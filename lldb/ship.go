@@ -0,0 +1,306 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// WAL shipping
+
+package lldb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// shipQueue is the maximum number of committed transactions waiting to be
+// written to the Ship writer.
+const shipQueue = 1024
+
+// shipper writes the shipped transactions to w in its own goroutine.
+type shipper struct {
+	done chan struct{} // Closed when the goroutine exits.
+	err  error         // The failed write error.
+	mu   sync.Mutex    // Guards err.
+	q    chan []byte   // Transactions waiting to be written.
+	w    io.Writer
+}
+
+func newShipper(w io.Writer) *shipper {
+	s := &shipper{done: make(chan struct{}), q: make(chan []byte, shipQueue), w: w}
+	go s.run()
+	return s
+}
+
+func (s *shipper) run() {
+	defer close(s.done)
+
+	for b := range s.q {
+		if s.error() != nil {
+			continue // Discard the rest of the queue.
+		}
+
+		if _, err := s.w.Write(b); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *shipper) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Ship makes a write every committed transaction to w, as soon as the
+// transaction is durable in the WAL. What is written is the WAL file content
+// of the transaction, see the ACIDFiler1 WAL file format, so a WALApplier can
+// verify it and apply it to another copy of the database. Passing a nil w
+// stops the shipping.
+//
+// The writes are made in another goroutine, the commit only queues the
+// transaction, so a slow or stalled w doesn't block the commits. If a write
+// fails or if more than 1024 transactions are waiting to be written, the
+// shipping stops and ShipError returns the error. The commit is not affected
+// by the failure, its transaction is already durable. A w which never
+// returns is abandoned by the overflow together with its goroutine, use for
+// example a net.Conn with a write deadline.
+//
+// Ship first stops the previous shipping, if any, and waits until the
+// transactions queued for it are written. A non nil w clears the error, Ship
+// with a nil w keeps it, including the error of the final writes. Ship must
+// not be invoked concurrently with updates of a.
+func (a *ACIDFiler0) Ship(w io.Writer) {
+	if s := a.ship; s != nil {
+		a.ship = nil
+		close(s.q)
+		<-s.done
+		if a.shipErr == nil {
+			a.shipErr = s.error()
+		}
+	}
+	if w != nil {
+		a.ship, a.shipErr = newShipper(w), nil
+	}
+}
+
+// ShipError returns the error which stopped the shipping, see Ship, or nil if
+// the shipping didn't fail. ShipError must not be invoked concurrently with
+// updates of a.
+func (a *ACIDFiler0) ShipError() error {
+	if a.shipErr == nil && a.ship != nil {
+		return a.ship.error()
+	}
+
+	return a.shipErr
+}
+
+// shipTx queues the committed transaction in shipBuf for the shipping or
+// stops the shipping if it failed or its queue is full.
+func (a *ACIDFiler0) shipTx() {
+	s := a.ship
+	err := s.error()
+	if err == nil {
+		select {
+		case s.q <- a.shipBuf:
+			a.shipBuf = nil // Owned by s now.
+			return
+		default:
+			err = &ErrPERM{a.wal.Name() + ": shipping stopped, too many transactions waiting to be written"}
+		}
+	}
+
+	close(s.q) // Not waiting for s, it may be stalled.
+	a.ship, a.shipErr = nil, err
+}
+
+// WALApplier applies the transactions shipped by an ACIDFiler0, see
+// ACIDFiler0.Ship, to a standby copy of its database. Every transaction is
+// first received into a WAL of the standby and only then applied to the
+// standby database, so a standby crash loses at most the transaction being
+// received.
+//
+// The standby database must start as a copy of the database of the shipping
+// ACIDFiler0 made while there was no transaction in progress. All the
+// transactions shipped afterwards must be applied in order. The standby WAL
+// keeps the number of the last applied transaction, a shipped transaction not
+// following it is rejected. A gap is detected across restarts of the standby
+// and of the shipping ACIDFiler0, except when the shipping ACIDFiler0 is
+// reopened after a clean shutdown: its transaction numbers then start a new
+// sequence, which is accepted. The transactions committed while the shipping
+// was stopped by a failed write, see ACIDFiler0.ShipError, must be shipped
+// before that.
+//
+// WALApplier is not safe for concurrent use by multiple goroutines.
+type WALApplier struct {
+	a       *ACIDFiler0 // Only its WAL machinery is used.
+	db      Filer
+	known   bool   // last is set
+	last    uint64 // The last applied transaction
+	pending bool   // A received transaction was not yet applied
+}
+
+// NewWALApplier returns a new WALApplier applying transactions to db, using
+// wal, which must not be shared with any other user, as the standby WAL. If
+// wal is not empty, the transaction received into it before a crash, if
+// complete, is applied to db first. If key is not empty, the shipped packets
+// must be encrypted by the same key, see NewEncryptedACIDFiler.
+func NewWALApplier(db, wal Filer, key []byte) (w *WALApplier, err error) {
+	a, err := newWALFiler(wal, key)
+	if err != nil {
+		return
+	}
+
+	w = &WALApplier{a: a, db: db}
+	if err = w.Apply(); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Receive reads the next shipped transaction from r into the standby WAL and
+// syncs it. Receive returns io.EOF if r ends before the transaction starts and
+// io.ErrUnexpectedEOF if it ends within the transaction. A shipped packet
+// longer than any packet an ACIDFiler0 writes, with an invalid checksum or of
+// another transaction and a transaction not following the last applied one
+// are reported as an ErrILSEQ of type ErrInvalidWAL. A failed Receive leaves
+// no transaction in the WAL.
+//
+// The received transaction must be applied by Apply before the next one can
+// be received.
+func (w *WALApplier) Receive(r io.Reader) (err error) {
+	a := w.a
+	if w.pending {
+		return &ErrPERM{a.wal.Name() + ": Receive with a transaction not yet applied"}
+	}
+
+	var wrote bool
+	defer func() {
+		if err != nil && wrote {
+			w.mark()
+		}
+	}()
+
+	var tx uint64
+	for off := int64(0); ; {
+		var h [wal1Header]byte
+		if _, err = io.ReadFull(r, h[:]); err != nil {
+			if err == io.EOF && off != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+
+		n := int64(binary.BigEndian.Uint32(h[:]))
+		if n > wal1MaxPacket {
+			return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("shipped packet too long: %d", n)}
+		}
+
+		p := make([]byte, (wal1Header+n+15)&^15)
+		copy(p, h[:])
+		if _, err = io.ReadFull(r, p[wal1Header:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+
+		b, ptx, ok, err := a.parse1(p, off)
+		if err != nil {
+			return err
+		}
+
+		if !ok || off != 0 && ptx != tx {
+			return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: "invalid shipped packet"}
+		}
+
+		items, err := DecodeScalars(b)
+		if err != nil || len(items) == 0 || (off == 0) != (items[0] == int64(wpt00Header)) {
+			return &ErrILSEQ{Type: ErrInvalidWAL, Off: off, Name: a.wal.Name(), More: fmt.Sprintf("invalid shipped packet items %#v, err %v", items, err)}
+		}
+
+		if off == 0 && w.known && ptx != w.last+1 && (len(items) != 3 || items[2] != walFirst) {
+			return &ErrILSEQ{Type: ErrInvalidWAL, Name: a.wal.Name(), More: fmt.Sprintf("shipped transaction %d doesn't follow the last applied transaction %d", ptx, w.last)}
+		}
+
+		wrote = true
+		if _, err = a.wal.WriteAt(p, off); err != nil {
+			return err
+		}
+
+		if items[0] == int64(wpt00Checkpoint) {
+			if err = a.wal.Sync(); err != nil {
+				return err
+			}
+
+			w.pending = true
+			return nil
+		}
+
+		tx, off = ptx, off+int64(len(p))
+	}
+}
+
+// Apply applies the transaction received by Receive to the standby database,
+// syncs it and replaces the content of the standby WAL by the header packet of
+// the transaction, which keeps the transaction number. Apply is a nop if no
+// transaction was received.
+func (w *WALApplier) Apply() (err error) {
+	a := w.a
+	sz, err := a.wal.Size()
+	if err != nil || sz == 0 {
+		return
+	}
+
+	b, tx, _, ok, err := a.packet1(0, sz)
+	if err != nil {
+		return
+	}
+
+	if ok {
+		if items, err := DecodeScalars(b); err == nil && len(items) == 3 && items[2] == walApplied {
+			w.last, w.known = tx, true
+			return nil
+		}
+	}
+
+	if err = a.recoverWAL(w.db); err != nil {
+		return
+	}
+
+	if ok {
+		// The recovery continues the numbers of a valid header packet.
+		w.last, w.known = a.tx, true
+	}
+	w.pending = false
+	return w.mark()
+}
+
+// mark replaces the content of the standby WAL by the header packet of the
+// last applied transaction, if known.
+func (w *WALApplier) mark() (err error) {
+	a := w.a
+	if err = a.wal.Truncate(0); err != nil {
+		return
+	}
+
+	if w.known {
+		a.tx, a.walPos = w.last, 0
+		a.bwal = bufio.NewWriter((*walAppender0)(a))
+		defer func() { a.bwal = nil }()
+		if err = (*acidWriter0)(a).writePacket([]interface{}{wpt00Header, walTypeACIDFiler1, walApplied}); err != nil {
+			return
+		}
+
+		if err = a.bwal.Flush(); err != nil {
+			return
+		}
+	}
+
+	return a.wal.Sync()
+}
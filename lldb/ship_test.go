@@ -0,0 +1,347 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// shipTx makes n random update transactions of a.
+func shipTx(t *testing.T, a *ACIDFiler0, rng *rand.Rand, n int) {
+	for i := 0; i < n; i++ {
+		if err := a.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		b := make([]byte, rng.Intn(3000)+1)
+		rng.Read(b)
+		if _, err := a.WriteAt(b, rng.Int63n(10000)); err != nil {
+			t.Fatal(err)
+		}
+
+		if i%3 == 2 {
+			sz, err := a.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = a.Truncate(sz / 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := a.EndUpdate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// lastApplied returns the number of the last applied transaction kept in the
+// standby WAL.
+func lastApplied(t *testing.T, wal Filer, key []byte) uint64 {
+	a, err := newWALFiler(wal, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sz, err := wal.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, tx, next, ok, err := a.packet1(0, sz)
+	if err != nil || !ok || next != sz {
+		t.Fatal(sz, next, ok, err)
+	}
+
+	items, err := DecodeScalars(b)
+	if err != nil || len(items) != 3 || items[2] != walApplied {
+		t.Fatal(items, err)
+	}
+
+	return tx
+}
+
+func testShip(t *testing.T, key []byte) {
+	const n = 10
+
+	db := NewMemFiler()
+	a, err := NewACIDFilerWAL(db, NewMemFiler(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	a.Ship(&stream)
+	rng := rand.New(rand.NewSource(42))
+	shipTx(t, a, rng, n)
+	a.Ship(nil)
+
+	standby := NewMemFiler()
+	w, err := NewWALApplier(standby, NewMemFiler(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shipped := append([]byte(nil), stream.Bytes()...)
+	r := bytes.NewReader(shipped)
+	for i := 0; ; i++ {
+		if err = w.Receive(r); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+
+			if i != n {
+				t.Fatal(i, n)
+			}
+
+			break
+		}
+
+		if err = w.Apply(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmpFilerBytes(t, standby, db)
+
+	// A transaction received but not applied before a standby crash is
+	// applied by the next WALApplier.
+	stream.Reset()
+	a.Ship(&stream)
+	shipTx(t, a, rng, 1)
+	a.Ship(nil)
+	swal := NewMemFiler()
+	if w, err = NewWALApplier(standby, swal, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = w.Receive(&stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = NewWALApplier(standby, swal, key); err != nil {
+		t.Fatal(err)
+	}
+
+	cmpFilerBytes(t, standby, db)
+	if g, e := lastApplied(t, swal, key), a.tx; g != e {
+		t.Fatal(g, e)
+	}
+
+	// A truncated stream.
+	n0 := (wal1Header + int(shipped[3]) + 15) &^ 15 // The header packet is short.
+	for _, v := range []struct {
+		n   int
+		err error
+	}{
+		{0, io.EOF},
+		{8, io.ErrUnexpectedEOF},
+		{24, io.ErrUnexpectedEOF},
+		{n0, io.ErrUnexpectedEOF},
+	} {
+		if err = w.Receive(bytes.NewReader(shipped[:v.n])); err != v.err {
+			t.Fatal(v.n, err, v.err)
+		}
+
+		if g, e := lastApplied(t, swal, key), a.tx; g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	// A corrupted stream.
+	for _, off := range []int{5, 20, 40} {
+		corrupted := append([]byte(nil), shipped...)
+		corrupted[off] ^= 1
+		err := w.Receive(bytes.NewReader(corrupted))
+		if e, ok := err.(*ErrILSEQ); !ok || e.Type != ErrInvalidWAL {
+			t.Fatal(off, err)
+		}
+
+		if g, e := lastApplied(t, swal, key), a.tx; g != e {
+			t.Fatal(g, e)
+		}
+	}
+
+	// A packet length is checked before allocating the packet.
+	long := append([]byte(nil), shipped[:wal1Header]...)
+	binary.BigEndian.PutUint32(long, math.MaxUint32)
+	err = w.Receive(bytes.NewReader(long))
+	if e, ok := err.(*ErrILSEQ); !ok || e.Type != ErrInvalidWAL {
+		t.Fatal(err)
+	}
+}
+
+func TestShip(t *testing.T) {
+	testShip(t, nil)
+}
+
+func TestShipEncrypted(t *testing.T) {
+	testShip(t, []byte("0123456789abcdef"))
+}
+
+func TestShipGap(t *testing.T) {
+	db, pwal := NewMemFiler(), NewMemFiler()
+	a, err := NewACIDFilerWAL(db, pwal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stream bytes.Buffer
+	rng := rand.New(rand.NewSource(42))
+	var txs [][]byte
+	ship := func(a *ACIDFiler0) {
+		stream.Reset()
+		a.Ship(&stream)
+		shipTx(t, a, rng, 1)
+		a.Ship(nil)
+		txs = append(txs, append([]byte(nil), stream.Bytes()...))
+	}
+
+	standby, swal := NewMemFiler(), NewMemFiler()
+	w, err := NewWALApplier(standby, swal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apply := func(i int) {
+		if err := w.Receive(bytes.NewReader(txs[i])); err != nil {
+			t.Fatal(i, err)
+		}
+
+		if err := w.Apply(); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+
+	reject := func(i int) {
+		last := lastApplied(t, swal, nil)
+		err := w.Receive(bytes.NewReader(txs[i]))
+		if e, ok := err.(*ErrILSEQ); !ok || e.Type != ErrInvalidWAL {
+			t.Fatal(i, err)
+		}
+
+		if g := lastApplied(t, swal, nil); g != last {
+			t.Fatal(i, g, last)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		ship(a)
+	}
+	apply(0)
+	reject(2)
+
+	// The last applied transaction survives a standby restart.
+	if w, err = NewWALApplier(standby, swal, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	reject(2)
+	apply(1)
+	apply(2)
+	reject(2)
+
+	// A clean restart of the primary starts a new sequence.
+	if a, err = NewACIDFilerWAL(db, pwal, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ship(a)
+	apply(3)
+
+	// The recovery after a primary crash continues the sequence of the
+	// recovered transaction.
+	a.testHook = true
+	ship(a)
+	if a, err = NewACIDFilerWAL(db, pwal, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ship(a)
+	reject(5)
+	apply(4)
+	apply(5)
+	cmpFilerBytes(t, standby, db)
+}
+
+// failWriter fails every write.
+type failWriter struct {
+	writes int
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return 0, fmt.Errorf("failWriter")
+}
+
+func TestShipError(t *testing.T) {
+	db := NewMemFiler()
+	a, err := NewACIDFilerWAL(db, NewMemFiler(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var w failWriter
+	a.Ship(&w)
+	if err = a.ShipError(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit succeeds, the shipping stops.
+	rng := rand.New(rand.NewSource(42))
+	shipTx(t, a, rng, 2)
+	a.Ship(nil)
+	if w.writes != 1 || a.ShipError() == nil {
+		t.Fatal(w.writes, a.ShipError())
+	}
+
+	var stream bytes.Buffer
+	a.Ship(&stream)
+	if err = a.ShipError(); err != nil {
+		t.Fatal(err)
+	}
+
+	shipTx(t, a, rng, 1)
+	a.Ship(nil)
+	if stream.Len() == 0 || a.ShipError() != nil {
+		t.Fatal(stream.Len(), a.ShipError())
+	}
+}
+
+// stallWriter blocks every write until it's closed.
+type stallWriter chan struct{}
+
+func (w stallWriter) Write(b []byte) (int, error) {
+	<-w
+	return len(b), nil
+}
+
+func TestShipStalled(t *testing.T) {
+	a, err := NewACIDFilerWAL(NewMemFiler(), NewMemFiler(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The commits don't wait for a stalled writer, the shipping stops when
+	// the queue overflows.
+	w := make(stallWriter)
+	defer close(w)
+
+	a.Ship(w)
+	rng := rand.New(rand.NewSource(42))
+	shipTx(t, a, rng, shipQueue+2)
+	if _, ok := a.ShipError().(*ErrPERM); !ok || a.ship != nil {
+		t.Fatal(a.ShipError(), a.ship)
+	}
+
+	shipTx(t, a, rng, 1)
+}
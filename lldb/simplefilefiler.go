@@ -9,7 +9,6 @@ package lldb
 import (
 	"os"
 
-	"github.com/cznic/fileutil"
 	"github.com/cznic/mathutil"
 )
 
@@ -67,18 +66,47 @@ func (f *SimpleFileFiler) Name() string {
 	return f.file.Name()
 }
 
-// PunchHole implements Filer.
+// PunchHole implements Filer. On Linux the space is deallocated using
+// fallocate(2), elsewhere or if the file system doesn't support hole punching
+// the range is overwritten with zeros.
 func (f *SimpleFileFiler) PunchHole(off, size int64) (err error) {
-	return fileutil.PunchHole(f.file, off, size)
+	if off < 0 {
+		return &ErrINVAL{f.Name() + ": PunchHole off", off}
+	}
+
+	fsize, err := f.Size()
+	if err != nil {
+		return
+	}
+
+	if size < 0 || off+size > fsize {
+		return &ErrINVAL{f.Name() + ": PunchHole size", size}
+	}
+
+	if size == 0 {
+		return
+	}
+
+	return punchHole(f.file, off, size)
 }
 
+func (f *SimpleFileFiler) punchOffset() (int64, bool) { return 0, canPunch }
+
 // ReadAt implements Filer.
 func (f *SimpleFileFiler) ReadAt(b []byte, off int64) (n int, err error) {
 	return f.file.ReadAt(b, off)
 }
 
-// Rollback implements Filer.
-func (f *SimpleFileFiler) Rollback() (err error) { return }
+// Rollback implements Filer. Rollback only decrements the nesting counter, the
+// updates are not discarded.
+func (f *SimpleFileFiler) Rollback() (err error) {
+	if f.nest == 0 {
+		return &ErrPERM{(f.Name() + ": Rollback")}
+	}
+
+	f.nest--
+	return
+}
 
 // Size implements Filer.
 func (f *SimpleFileFiler) Size() (int64, error) {
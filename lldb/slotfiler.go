@@ -0,0 +1,433 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Paged Filer content stored in slots.
+
+package lldb
+
+import (
+	"io"
+	"sync"
+
+	"github.com/cznic/bufs"
+	"github.com/cznic/mathutil"
+)
+
+const (
+	slotPageBits = 12
+	slotPageSize = 1 << slotPageBits
+	slotPageMask = slotPageSize - 1
+)
+
+// slotCodec stores the pages of a slotFiler in slots.
+type slotCodec interface {
+	// invalid returns the error reporting a bad slot of the page pg.
+	invalid(pg int64, more interface{}) error
+
+	// open verifies the slot s of the page pg, decodes the page into p,
+	// which is slotPageSize bytes long, and returns its N.
+	open(p, s []byte, pg int64) (n int, err error)
+
+	// seal encodes the page p having N n as the slot s of the page pg.
+	seal(s, p []byte, pg int64, n int) error
+
+	// last verifies that pg, -1 if there are no pages, is the last page
+	// of the wrapped Filer.
+	last(pg int64) error
+}
+
+// slotFiler is the Filer part of EncryptingFiler and ChecksumFiler. The content
+// is split into pages of 4096 bytes, the page pg is stored in the wrapped Filer
+// as a slot of slotSize bytes, encoded by codec together with its N. N is the
+// number of bytes of the page within the Filer size, it's 4096 for all pages
+// but the last one. If group is not zero, the slots come in groups of group
+// slots, each preceded by meta bytes of the codec, otherwise the slot of the
+// page pg is at pg*slotSize.
+type slotFiler struct {
+	codec    slotCodec
+	f        Filer
+	group    int64
+	meta     int64
+	mu       sync.Mutex // Size sets size from concurrent ReadAts
+	scrub    int64      // next page to Scrub
+	size     int64      // not set if < 0
+	slotSize int64
+}
+
+// BeginUpdate implements Filer.
+func (f *slotFiler) BeginUpdate() error { return f.f.BeginUpdate() }
+
+// Close implements Filer.
+func (f *slotFiler) Close() error { return f.f.Close() }
+
+// EndUpdate implements Filer.
+func (f *slotFiler) EndUpdate() error { return f.f.EndUpdate() }
+
+// Name implements Filer.
+func (f *slotFiler) Name() string { return f.f.Name() }
+
+// PunchHole implements Filer.
+func (f *slotFiler) PunchHole(off, size int64) (err error) {
+	if off < 0 {
+		return &ErrINVAL{f.Name() + ": PunchHole off", off}
+	}
+
+	fsize, err := f.Size()
+	if err != nil {
+		return
+	}
+
+	if size < 0 || off+size > fsize {
+		return &ErrINVAL{f.Name() + ": PunchHole size", size}
+	}
+
+	return
+}
+
+// ReadAt implements Filer.
+func (f *slotFiler) ReadAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ": ReadAt off", off}
+	}
+
+	sz, err := f.Size()
+	if err != nil {
+		return
+	}
+
+	if off >= sz {
+		return 0, io.EOF
+	}
+
+	eof := false
+	if avail := sz - off; int64(len(b)) > avail {
+		b, eof = b[:avail], true
+	}
+
+	p := bufs.GCache.Get(slotPageSize)
+	defer bufs.GCache.Put(p)
+	for len(b) != 0 {
+		pg, po := off>>slotPageBits, int(off&slotPageMask)
+		if _, err = f.page(p, pg); err != nil {
+			return
+		}
+
+		m := copy(b, p[po:])
+		b = b[m:]
+		n += m
+		off += int64(m)
+	}
+	if eof {
+		err = io.EOF
+	}
+	return
+}
+
+// Rollback implements Filer.
+func (f *slotFiler) Rollback() error {
+	f.size = -1
+	return f.f.Rollback()
+}
+
+// Scrub verifies at most n pages. Scrubbing is incremental, every call
+// continues where the previous one stopped, even if the file was mutated in
+// between. done is true once the last page was verified; the next call starts
+// over at the first page. On a corrupted page Scrub returns the ErrILSEQ of
+// ReadAt, of type ErrChecksum or ErrDecrypt, and the next call continues with
+// the page after the corrupted one.
+func (f *slotFiler) Scrub(n int) (done bool, err error) {
+	sz, err := f.Size()
+	if err != nil {
+		return
+	}
+
+	p := bufs.GCache.Get(slotPageSize)
+	defer bufs.GCache.Put(p)
+	pages := (sz + slotPageMask) >> slotPageBits
+	for ; n > 0 && f.scrub < pages; n-- {
+		pg := f.scrub
+		f.scrub++
+		if _, err = f.page(p, pg); err != nil {
+			return
+		}
+	}
+
+	if f.scrub >= pages {
+		f.scrub = 0
+		done = true
+	}
+	return
+}
+
+// Size implements Filer.
+func (f *slotFiler) Size() (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size >= 0 {
+		return f.size, nil
+	}
+
+	pages, _, err := f.slots()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = f.codec.last(pages - 1); err != nil {
+		return 0, err
+	}
+
+	if pages == 0 {
+		f.size = 0
+		return 0, nil
+	}
+
+	p := bufs.GCache.Get(slotPageSize)
+	defer bufs.GCache.Put(p)
+	n, err := f.page(p, pages-1)
+	if err != nil {
+		return 0, err
+	}
+
+	f.size = (pages-1)<<slotPageBits + int64(n)
+	return f.size, nil
+}
+
+// Sync implements Filer.
+func (f *slotFiler) Sync() error { return f.f.Sync() }
+
+// Truncate implements Filer.
+func (f *slotFiler) Truncate(size int64) (err error) {
+	if size < 0 {
+		return &ErrINVAL{"Truncate size", size}
+	}
+
+	sz := f.size
+	if size == sz {
+		return
+	}
+
+	defer func() {
+		f.size = size
+		if err != nil {
+			f.size = -1
+		}
+	}()
+
+	slots, fsz, err := f.slots()
+	if err != nil {
+		return
+	}
+
+	pages := (size + slotPageMask) >> slotPageBits
+	if pages > slots {
+		if sz, err = f.Size(); err != nil {
+			return
+		}
+
+		return f.grow(sz, size)
+	}
+
+	// The content of the new last page is valid, so the sizes of the
+	// other pages don't matter, see overwrite.
+	var end int64
+	if pages != 0 {
+		end = f.off(pages-1) + f.slotSize
+	}
+	if end != fsz {
+		if err = f.f.Truncate(end); err != nil {
+			return
+		}
+	}
+
+	if pages == 0 || size&slotPageMask == 0 && size < sz {
+		return
+	}
+
+	p := bufs.GCache.Get(slotPageSize)
+	defer bufs.GCache.Put(p)
+	pn, err := f.page(p, pages-1)
+	if err != nil {
+		return
+	}
+
+	if n := int(size - (pages-1)<<slotPageBits); n != pn {
+		return f.writePage(p, pages-1, n)
+	}
+
+	return
+}
+
+// WriteAt implements Filer.
+func (f *slotFiler) WriteAt(b []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, &ErrINVAL{f.Name() + ": WriteAt off", off}
+	}
+
+	sz, err := f.Size()
+	if err != nil {
+		return f.overwrite(b, off, err)
+	}
+
+	defer func() {
+		f.size = sz
+		if err != nil {
+			f.size = -1
+		}
+	}()
+
+	if off > sz {
+		if err = f.grow(sz, off); err != nil {
+			return
+		}
+
+		sz = off
+	}
+
+	p := bufs.GCache.Get(slotPageSize)
+	defer bufs.GCache.Put(p)
+	pages := (sz + slotPageMask) >> slotPageBits
+	for len(b) != 0 {
+		pg, po := off>>slotPageBits, int(off&slotPageMask)
+		var pn int
+		switch {
+		case pg < pages && po == 0 && len(b) >= slotPageSize:
+			// The whole page is overwritten.
+		case pg < pages:
+			if pn, err = f.page(p, pg); err != nil {
+				return
+			}
+		default:
+			pages++
+		}
+
+		m := copy(p[po:], b)
+		if err = f.writePage(p, pg, mathutil.Max(pn, po+m)); err != nil {
+			return
+		}
+
+		b = b[m:]
+		n += m
+		off += int64(m)
+		sz = mathutil.MaxInt64(sz, off)
+	}
+	return
+}
+
+// overwrite writes b at off, if that's a write of whole pages within the
+// wrapped Filer or appended to it. No old page is read, so the WAL recovery of
+// an ACIDFiler0 can rewrite the pages torn by a crash. Otherwise overwrite
+// returns serr, the error of Size.
+func (f *slotFiler) overwrite(b []byte, off int64, serr error) (n int, err error) {
+	if off&slotPageMask != 0 || len(b)&slotPageMask != 0 {
+		return 0, serr
+	}
+
+	slots, _, err := f.slots()
+	if err != nil || off>>slotPageBits > slots {
+		return 0, serr
+	}
+
+	for ; len(b) != 0; b = b[slotPageSize:] {
+		if err = f.writePage(b[:slotPageSize], off>>slotPageBits, slotPageSize); err != nil {
+			return
+		}
+
+		n += slotPageSize
+		off += slotPageSize
+	}
+	return
+}
+
+// grow extends the content from size sz to size with zeros.
+func (f *slotFiler) grow(sz, size int64) (err error) {
+	p := bufs.GCache.Get(slotPageSize)
+	defer bufs.GCache.Put(p)
+	for sz < size {
+		pg, po := sz>>slotPageBits, int(sz&slotPageMask)
+		switch {
+		case po != 0:
+			if _, err = f.page(p, pg); err != nil {
+				return
+			}
+		default:
+			for i := range p {
+				p[i] = 0
+			}
+		}
+
+		m := int(mathutil.MinInt64(int64(slotPageSize-po), size-sz))
+		if err = f.writePage(p, pg, po+m); err != nil {
+			return
+		}
+
+		sz += int64(m)
+	}
+	return
+}
+
+// slots returns the number of slots in the wrapped Filer and its size sz. A
+// partial slot at the end, left by a crash while appending it, is ignored.
+func (f *slotFiler) slots() (n, sz int64, err error) {
+	if sz, err = f.f.Size(); err != nil {
+		return
+	}
+
+	if f.group == 0 {
+		return sz / f.slotSize, sz, nil
+	}
+
+	g, r := sz/f.groupSize(), sz%f.groupSize()
+	return g*f.group + mathutil.MaxInt64(r-f.meta, 0)/f.slotSize, sz, nil
+}
+
+// groupSize returns the size of a whole group of slots in the wrapped Filer,
+// including its meta bytes.
+func (f *slotFiler) groupSize() int64 { return f.meta + f.group*f.slotSize }
+
+// off returns the offset of the slot of the page pg in the wrapped Filer.
+func (f *slotFiler) off(pg int64) int64 {
+	if f.group == 0 {
+		return pg * f.slotSize
+	}
+
+	return (pg/f.group+1)*f.meta + pg*f.slotSize
+}
+
+// page reads the page pg into p, which must be slotPageSize bytes long, and
+// returns its N.
+func (f *slotFiler) page(p []byte, pg int64) (n int, err error) {
+	s := bufs.GCache.Get(int(f.slotSize))
+	defer bufs.GCache.Put(s)
+	if m, err := f.f.ReadAt(s, f.off(pg)); m != len(s) {
+		return 0, f.codec.invalid(pg, err)
+	}
+
+	return f.codec.open(p, s, pg)
+}
+
+// writePage writes the first n bytes of the page p, zeroing the rest, as the
+// page pg.
+func (f *slotFiler) writePage(p []byte, pg int64, n int) (err error) {
+	for i := range p[n:] {
+		p[n+i] = 0
+	}
+
+	s := bufs.GCache.Get(int(f.slotSize))
+	defer bufs.GCache.Put(s)
+	if err = f.codec.seal(s, p, pg, n); err != nil {
+		return
+	}
+
+	_, err = f.f.WriteAt(s, f.off(pg))
+	return
+}
+
+// pager is a Filer storing its content in pages, which are crash safe only if
+// overwritten whole. The WAL of an ACIDFiler0 over a pager holds whole pages.
+type pager interface {
+	pageSize() int64
+}
+
+func (f *slotFiler) pageSize() int64 { return slotPageSize }
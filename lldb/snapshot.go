@@ -0,0 +1,247 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Point-in-time read only views of a RollbackFiler.
+
+package lldb
+
+import (
+	"io"
+
+	"github.com/cznic/fileutil"
+	"github.com/cznic/mathutil"
+)
+
+var _ Filer = &Snapshot{} // Ensure Snapshot is a Filer.
+
+// Snapshot is a read only Filer presenting the committed content of a
+// RollbackFiler, ie. the content of the Filer it wraps, as it was at the
+// moment the Snapshot was created. The updates of transactions open at that
+// moment, and all updates made afterwards, are not visible through the
+// Snapshot, regardless of whether they are later committed or rolled back.
+//
+// A Snapshot is implemented by copy on write: Before a page of the wrapped
+// Filer is changed for the first time after the Snapshot was created, ie.
+// when the outermost transaction is committed by EndUpdate, its original
+// content is preserved in memory. Long living Snapshots of heavily updated
+// Filers can thus consume a lot of memory. An open Snapshot should be closed
+// when no more needed.
+//
+// WriteAt, Truncate and PunchHole return ErrPERM. BeginUpdate, EndUpdate and
+// Rollback only maintain a nesting counter.
+//
+// Snapshot is safe for concurrent use by multiple goroutines.
+type Snapshot struct {
+	closed bool
+	m      map[int64]*[bfSize]byte // Preserved pages.
+	nest   int
+	r      *RollbackFiler
+	size   int64
+}
+
+// Snapshot returns a new Snapshot of the committed content of r. Snapshot may
+// be invoked within an open transaction, the Snapshot doesn't include any
+// updates made so far by the transaction.
+func (r *RollbackFiler) Snapshot() (s *Snapshot, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil, &ErrPERM{r.f.Name() + ": Snapshot of a closed Filer"}
+	}
+
+	sz, err := r.f.Size()
+	if err != nil {
+		return
+	}
+
+	s = &Snapshot{m: map[int64]*[bfSize]byte{}, r: r, size: sz}
+	if r.snapshots == nil {
+		r.snapshots = map[*Snapshot]bool{}
+	}
+	r.snapshots[s] = true
+	return
+}
+
+// preserve saves the committed content of pages in [off, off+size) for all
+// open snapshots which have not yet preserved them. r.mu locked is assumed.
+func (r *RollbackFiler) preserve(off, size int64) (err error) {
+	if len(r.snapshots) == 0 || size <= 0 || off < 0 {
+		return
+	}
+
+	first, last := off>>bfBits, (off+size-1)>>bfBits
+	for s := range r.snapshots {
+		for pgI := first; pgI <= last && pgI<<bfBits < s.size; pgI++ {
+			if err = r.preservePage(s, pgI); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (r *RollbackFiler) preservePage(s *Snapshot, pgI int64) (err error) {
+	if _, ok := s.m[pgI]; ok || pgI<<bfBits >= s.size {
+		return
+	}
+
+	pg := &[bfSize]byte{}
+	if _, err = r.f.ReadAt(pg[:], pgI<<bfBits); err != nil && !fileutil.IsEOF(err) {
+		return
+	}
+
+	s.m[pgI] = pg
+	return nil
+}
+
+// preserveCommit saves the committed content of all pages which the commit of
+// the outermost transaction bf is about to change, including those beyond
+// the committed size. r.mu locked is assumed.
+func (r *RollbackFiler) preserveCommit(bf *bitFiler) (err error) {
+	if len(r.snapshots) == 0 {
+		return
+	}
+
+	psz, err := r.f.Size()
+	if err != nil {
+		return
+	}
+
+	if off := mathutil.MinInt64(bf.trunc, bf.size); off < psz {
+		if err = r.preserve(off, psz-off); err != nil {
+			return
+		}
+	}
+
+	var zeroFlags [bfSize >> 3]byte
+	for pgI, pg := range bf.m {
+		if !pg.dirty && pg.flags == zeroFlags {
+			continue
+		}
+
+		for s := range r.snapshots {
+			if err = r.preservePage(s, pgI); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// BeginUpdate implements Filer.
+func (s *Snapshot) BeginUpdate() error {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+
+	s.nest++
+	return nil
+}
+
+// Close implements Filer. Close releases the memory used by s.
+func (s *Snapshot) Close() (err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+
+	if s.closed {
+		return &ErrPERM{s.r.f.Name() + ": Snapshot already closed"}
+	}
+
+	s.closed = true
+	s.m = nil
+	delete(s.r.snapshots, s)
+	return
+}
+
+// EndUpdate implements Filer.
+func (s *Snapshot) EndUpdate() (err error) {
+	s.r.mu.Lock()
+	defer s.r.mu.Unlock()
+
+	if s.nest == 0 {
+		return &ErrPERM{(s.r.f.Name() + ":EndUpdate")}
+	}
+
+	s.nest--
+	return
+}
+
+// Name implements Filer.
+func (s *Snapshot) Name() string {
+	return s.r.Name()
+}
+
+// PunchHole implements Filer. It always returns ErrPERM.
+func (s *Snapshot) PunchHole(off, size int64) error {
+	return &ErrPERM{s.r.Name() + ": PunchHole on a Snapshot"}
+}
+
+// ReadAt implements Filer.
+func (s *Snapshot) ReadAt(b []byte, off int64) (n int, err error) {
+	r := s.r
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if s.closed {
+		return 0, &ErrPERM{r.f.Name() + ": ReadAt on a closed Snapshot"}
+	}
+
+	if off < 0 {
+		return 0, &ErrINVAL{r.f.Name() + ": ReadAt off", off}
+	}
+
+	avail := s.size - off
+	if avail <= 0 {
+		return 0, io.EOF
+	}
+
+	rem := len(b)
+	if int64(rem) >= avail {
+		rem = int(avail)
+		err = io.EOF
+	}
+	for rem != 0 {
+		pgI := off >> bfBits
+		pgO := int(off & bfMask)
+		nc := mathutil.Min(rem, bfSize-pgO)
+		switch pg := s.m[pgI]; {
+		case pg != nil:
+			copy(b[:nc], pg[pgO:])
+		default:
+			if _, e := r.f.ReadAt(b[:nc], off); e != nil && !fileutil.IsEOF(e) {
+				return n, e
+			}
+		}
+		rem -= nc
+		n += nc
+		b = b[nc:]
+		off += int64(nc)
+	}
+	return
+}
+
+// Rollback implements Filer.
+func (s *Snapshot) Rollback() (err error) {
+	return s.EndUpdate()
+}
+
+// Size implements Filer.
+func (s *Snapshot) Size() (int64, error) {
+	return s.size, nil
+}
+
+// Sync implements Filer. It's a nop.
+func (s *Snapshot) Sync() error {
+	return nil
+}
+
+// Truncate implements Filer. It always returns ErrPERM.
+func (s *Snapshot) Truncate(size int64) error {
+	return &ErrPERM{s.r.Name() + ": Truncate on a Snapshot"}
+}
+
+// WriteAt implements Filer. It always returns ErrPERM.
+func (s *Snapshot) WriteAt(b []byte, off int64) (n int, err error) {
+	return 0, &ErrPERM{s.r.Name() + ": WriteAt on a Snapshot"}
+}
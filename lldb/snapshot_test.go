@@ -0,0 +1,188 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSnapshot0(t *testing.T) {
+	f := NewMemFiler()
+	r, err := NewRollbackFiler(f, func(sz int64) error { return f.Truncate(sz) }, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.WriteAt([]byte("foo"), 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := r.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := filerBytes(r)
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.WriteAt([]byte("bar"), 1001); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := filerBytes(s); !bytes.Equal(g, e) {
+		t.Fatalf("\n% x\n% x", g[990:], e[990:])
+	}
+
+	if err = r.Truncate(10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := filerBytes(s); !bytes.Equal(g, e) {
+		t.Fatalf("\n% x\n% x", g[990:], e[990:])
+	}
+
+	if _, err = s.WriteAt([]byte{0}, 0); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatal("unexpected success")
+	}
+
+	if g, e := len(r.snapshots), 0; g != e {
+		t.Fatal(g, e)
+	}
+
+	// A Snapshot taken within an open transaction doesn't include its
+	// updates, neither before nor after they are committed.
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.WriteAt([]byte("baz"), 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	e = filerBytes(f)
+	if s, err = r.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.WriteAt([]byte("qux"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := filerBytes(s); !bytes.Equal(g, e) {
+		t.Fatalf("\n% x\n% x", g, e)
+	}
+
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g := filerBytes(s); !bytes.Equal(g, e) {
+		t.Fatalf("\n% x\n% x", g, e)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshot1(t *testing.T) {
+	const N = 5000
+
+	f := NewMemFiler()
+	r, err := NewRollbackFiler(f, func(sz int64) error { return f.Truncate(sz) }, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(42))
+	var (
+		level int
+		snaps []*Snapshot
+		exp   [][]byte
+	)
+
+	for i := 0; i < N; i++ {
+		switch x := rng.Intn(20); {
+		case x < 2:
+			if err = r.BeginUpdate(); err != nil {
+				t.Fatal(err)
+			}
+
+			level++
+		case x < 4 && level != 0:
+			if err = r.EndUpdate(); err != nil {
+				t.Fatal(err)
+			}
+
+			level--
+		case x < 5 && level != 0:
+			if err = r.Rollback(); err != nil {
+				t.Fatal(err)
+			}
+
+			level--
+		case x < 7:
+			s, err := r.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snaps = append(snaps, s)
+			exp = append(exp, filerBytes(f))
+		case x < 8 && len(snaps) != 0:
+			j := rng.Intn(len(snaps))
+			if err = snaps[j].Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			snaps = append(snaps[:j], snaps[j+1:]...)
+			exp = append(exp[:j], exp[j+1:]...)
+		case x < 9 && level != 0:
+			sz, err := r.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = r.Truncate(rng.Int63n(sz + 1)); err != nil {
+				t.Fatal(err)
+			}
+		case level != 0:
+			off, b := rng.Intn(1<<14), rndBytes(rng, rng.Intn(1<<10)+1)
+			if _, err = r.WriteAt(b, int64(off)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for j, s := range snaps {
+			if g, e := filerBytes(s), exp[j]; !bytes.Equal(g, e) {
+				t.Fatalf("step %d, snapshot %d: content mismatch (len %d, %d)", i, j, len(g), len(e))
+			}
+		}
+	}
+}
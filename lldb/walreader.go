@@ -0,0 +1,305 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// WAL inspection
+
+package lldb
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/cznic/fileutil"
+)
+
+// WAL packet tags, see WALPacket.
+const (
+	WALHeader     = wpt00Header
+	WALWriteData  = wpt00WriteData
+	WALCheckpoint = wpt00Checkpoint
+)
+
+// WALPacket is a WAL packet read by a WALReader. For the WAL file formats
+// please see the package documentation of the ACIDFiler0 and ACIDFiler1 WAL
+// files.
+type WALPacket struct {
+	Off  int64  // Offset of the packet in the WAL.
+	Size int64  // Size of the packet, including its header and padding.
+	Tx   uint64 // Transaction number, zero in an ACIDFiler0 WAL.
+	Tag  int    // Packet tag, WALHeader, WALWriteData or WALCheckpoint.
+
+	Type    int    // WALHeader: WAL file type, 0 (ACIDFiler0) or 1 (ACIDFiler1).
+	Comment string // WALHeader: The comment string.
+	Data    []byte // WALWriteData: The data written to the database.
+	DataOff int64  // WALWriteData: The database offset of Data.
+	DBSize  int64  // WALCheckpoint: The database size after the transaction.
+
+	// The padding bytes of the packet are not all zero. That violates the
+	// WAL file format, but the recovery ignores the padding.
+	BadPadding bool
+}
+
+// WALReader reads the packets of a WAL, validating the rules of the WAL file
+// format. A WAL holds at most one transaction, its header packet is the first
+// packet of the WAL, its checkpoint packet is the last one.
+type WALReader struct {
+	a          *ACIDFiler0 // Only its WAL machinery is used.
+	checkpoint bool        // The checkpoint packet was read.
+	off        int64       // Next packet offset.
+	sz         int64       // WAL size.
+	tx         uint64
+	typ        int // WAL file type, -1 if not yet known.
+}
+
+// newWALFiler returns an ACIDFiler0 usable only for the WAL machinery. If key
+// is not empty, the WAL packets are encrypted, see NewEncryptedACIDFiler.
+func newWALFiler(wal Filer, key []byte) (a *ACIDFiler0, err error) {
+	var aead cipher.AEAD
+	if len(key) != 0 {
+		if aead, err = newAEAD(key); err != nil {
+			return
+		}
+	}
+
+	return &ACIDFiler0{aead: aead, wal: wal}, nil
+}
+
+// NewWALReader returns a new WALReader of wal. If key is not empty, the WAL
+// packets are encrypted, see NewEncryptedACIDFiler. wal is not modified by
+// the WALReader.
+func NewWALReader(wal Filer, key []byte) (r *WALReader, err error) {
+	a, err := newWALFiler(wal, key)
+	if err != nil {
+		return
+	}
+
+	sz, err := wal.Size()
+	if err != nil {
+		return
+	}
+
+	return &WALReader{a: a, sz: sz, typ: -1}, nil
+}
+
+// Next returns the next packet of the WAL. At the end of the WAL, Next
+// returns io.EOF or, if the WAL ends before the checkpoint packet, ie. it
+// holds an incomplete transaction, io.ErrUnexpectedEOF. Like the recovery,
+// Next takes an ACIDFiler1 packet, which is truncated, has an invalid
+// checksum or belongs to another transaction, for the end of an incomplete
+// transaction, unless a valid checkpoint packet of the transaction follows.
+// Other packets violating the WAL file format are reported as an ErrILSEQ of
+// type ErrInvalidWAL or ErrDecrypt. Such packet cannot be skipped, the
+// following invocations of Next return the same error. Non zero padding bytes,
+// which the recovery ignores as well, only set WALPacket.BadPadding.
+func (r *WALReader) Next() (p *WALPacket, err error) {
+	if r.sz%16 != 0 {
+		return nil, &ErrILSEQ{Type: ErrFileSize, Name: r.a.wal.Name(), Arg: r.sz}
+	}
+
+	if r.off == r.sz {
+		if r.sz != 0 && !r.checkpoint {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		return nil, io.EOF
+	}
+
+	if r.checkpoint {
+		return nil, &ErrILSEQ{Type: ErrInvalidWAL, Off: r.off, Name: r.a.wal.Name(), More: "data after the checkpoint packet"}
+	}
+
+	if r.typ < 0 {
+		if r.typ, err = r.fileType(); err != nil {
+			return
+		}
+	}
+
+	var b []byte
+	p = &WALPacket{Off: r.off}
+	switch r.typ {
+	case walTypeACIDFiler0:
+		b, p.Size, p.BadPadding, err = r.packet0()
+	default:
+		b, p.Tx, p.Size, p.BadPadding, err = r.packet1()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := DecodeScalars(b)
+	if err != nil || len(items) == 0 {
+		return nil, r.invalid(fmt.Sprintf("invalid packet items %#v, err %v", items, err))
+	}
+
+	switch tag := items[0]; {
+	case tag == int64(wpt00Header) && len(items) == 3 && r.off == 0:
+		typ, ok := items[1].(int64)
+		comment, ok2 := items[2].(string)
+		if !ok || !ok2 || int(typ) != r.typ {
+			return nil, r.invalid(fmt.Sprintf("invalid header packet items %#v", items))
+		}
+
+		p.Tag, p.Type, p.Comment = WALHeader, r.typ, comment
+		r.tx = p.Tx
+	case r.off == 0:
+		return nil, r.invalid(fmt.Sprintf("header packet expected, got items %#v", items))
+	case tag == int64(wpt00WriteData) && len(items) == 3:
+		data, ok := items[1].([]byte)
+		off, ok2 := items[2].(int64)
+		if !ok || !ok2 {
+			return nil, r.invalid(fmt.Sprintf("invalid data packet items %#v", items))
+		}
+
+		p.Tag, p.Data, p.DataOff = WALWriteData, data, off
+	case tag == int64(wpt00Checkpoint) && len(items) == 2:
+		sz, ok := items[1].(int64)
+		if !ok {
+			return nil, r.invalid(fmt.Sprintf("checkpoint packet invalid items %#v", items))
+		}
+
+		p.Tag, p.DBSize = WALCheckpoint, sz
+		r.checkpoint = true
+	default:
+		return nil, r.invalid(fmt.Sprintf("invalid packet items %#v", items))
+	}
+
+	r.off += p.Size
+	return
+}
+
+func (r *WALReader) invalid(more string) error {
+	return &ErrILSEQ{Type: ErrInvalidWAL, Off: r.off, Name: r.a.wal.Name(), More: more}
+}
+
+// fileType returns the WAL file type determined by the header packet.
+func (r *WALReader) fileType() (typ int, err error) {
+	if _, _, _, ok, err := r.a.packet1(0, r.sz); ok || err != nil {
+		return walTypeACIDFiler1, err
+	}
+
+	f := bufio.NewReader(io.NewSectionReader(r.a.wal, 0, r.sz))
+	if items, err := r.a.readPacket(f, r.sz); err == nil && len(items) == 3 && items[0] == int64(wpt00Header) && items[1] == int64(walTypeACIDFiler0) {
+		r.a.seq, r.a.walOff = 0, 0
+		return walTypeACIDFiler0, nil
+	}
+
+	// Recovery discards a WAL without a valid header packet, unless it
+	// contains a checkpoint packet of an ACIDFiler1 WAL.
+	ok, err := r.a.checkpoint1(0, r.sz, 0, true)
+	if err != nil {
+		return -1, err
+	}
+
+	if ok {
+		return -1, r.invalid("corrupted header packet of a committed transaction")
+	}
+
+	return -1, io.ErrUnexpectedEOF
+}
+
+// readAt reads len(b) bytes of the WAL at off.
+func (r *WALReader) readAt(b []byte, off int64) (err error) {
+	if off+int64(len(b)) > r.sz {
+		return io.ErrUnexpectedEOF
+	}
+
+	if _, err = r.a.wal.ReadAt(b, off); err != nil && fileutil.IsEOF(err) {
+		err = nil
+	}
+	return
+}
+
+// badPadding reports whether the padding bytes of the packet p, after its
+// first n bytes, are not all zero.
+func badPadding(p []byte, n int) bool {
+	for _, v := range p[n:] {
+		if v != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// packet0 returns the payload and the size of the WAL type 0 packet at r.off
+// and reports whether its padding is bad.
+func (r *WALReader) packet0() (b []byte, size int64, bad bool, err error) {
+	var b4 [4]byte
+	if err = r.readAt(b4[:], r.off); err != nil {
+		return
+	}
+
+	n := 4 + int(binary.BigEndian.Uint32(b4[:]))
+	size = int64(n+15) &^ 15
+	if r.off+size > r.sz {
+		return nil, 0, false, io.ErrUnexpectedEOF
+	}
+
+	p := make([]byte, size)
+	if err = r.readAt(p, r.off); err != nil {
+		return
+	}
+
+	b, bad = p[4:n], badPadding(p, n)
+	if r.a.aead != nil {
+		b, err = r.a.open(b, r.a.seqAD(), r.off)
+	}
+	return
+}
+
+// packet1 returns the payload, the transaction number and the size of the
+// WAL type 1 packet at r.off and reports whether its padding is bad.
+func (r *WALReader) packet1() (b []byte, tx uint64, size int64, bad bool, err error) {
+	b, tx, next, ok, err := r.a.packet1(r.off, r.sz)
+	if err != nil {
+		return
+	}
+
+	if !ok || tx != r.tx && r.off != 0 {
+		if ok, err = r.a.checkpoint1(r.off+16, r.sz, r.tx, false); err != nil {
+			return
+		}
+
+		if ok {
+			return nil, 0, 0, false, r.invalid("corrupted packet of a committed transaction")
+		}
+
+		return nil, 0, 0, false, io.ErrUnexpectedEOF
+	}
+
+	size = next - r.off
+	p := make([]byte, size)
+	if err = r.readAt(p, r.off); err != nil {
+		return
+	}
+
+	bad = badPadding(p, wal1Header+int(binary.BigEndian.Uint32(p)))
+	return
+}
+
+// ReplayWAL applies the committed transaction in wal to db, like the recovery
+// of NewACIDFilerWAL does, syncs db and empties wal. An incomplete transaction
+// in wal is discarded. If key is not empty, the WAL packets are encrypted,
+// see NewEncryptedACIDFiler.
+func ReplayWAL(db, wal Filer, key []byte) (err error) {
+	a, err := newWALFiler(wal, key)
+	if err != nil {
+		return
+	}
+
+	return a.recoverWAL(db)
+}
+
+// recoverWAL recovers db from the WAL, if not empty.
+func (a *ACIDFiler0) recoverWAL(db Filer) (err error) {
+	sz, err := a.wal.Size()
+	if err != nil || sz == 0 {
+		return
+	}
+
+	return a.recoverDb(db)
+}
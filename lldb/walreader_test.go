@@ -0,0 +1,245 @@
+// Copyright 2014 The lldb Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// walImage returns the WAL of a transaction writing writes and truncating
+// the database to sz.
+func walImage(t *testing.T, walType int, key []byte, writes []acidWrite, sz int64) []byte {
+	wal := NewMemFiler()
+	a, err := NewACIDFilerWAL(NewMemFiler(), wal, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range writes {
+		if _, err = a.WriteAt(v.b, v.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = a.Truncate(sz); err != nil {
+		t.Fatal(err)
+	}
+
+	a.testHook = true // keep WAL
+	if err = a.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if walType == walTypeACIDFiler0 {
+		return walImage0(t, filerBytes(wal), key)
+	}
+
+	return filerBytes(wal)
+}
+
+// walImage0 returns the WAL type 1 image img rewritten as a WAL type 0, which
+// is no more written by ACIDFiler0.
+func walImage0(t *testing.T, img, key []byte) (r []byte) {
+	wal := NewMemFiler()
+	wal.WriteAt(img, 0)
+	a, err := NewACIDFilerWAL(NewMemFiler(), NewMemFiler(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.wal = wal
+	for off, sz := int64(0), int64(len(img)); off < sz; {
+		b, _, next, ok, err := a.packet1(off, sz)
+		if !ok || err != nil {
+			t.Fatal(off, ok, err)
+		}
+
+		items, err := DecodeScalars(b)
+		if err != nil {
+			t.Fatal(off, err)
+		}
+
+		if items[0] == int64(wpt00Header) {
+			items[1] = walTypeACIDFiler0
+		}
+		if b, err = EncodeScalars(items...); err != nil {
+			t.Fatal(off, err)
+		}
+
+		if key != nil {
+			if b, err = (*acidWriter0)(a).seal(b, a.seqAD()); err != nil {
+				t.Fatal(off, err)
+			}
+		}
+
+		p := make([]byte, (4+len(b)+15)&^15)
+		binary.BigEndian.PutUint32(p, uint32(len(b)))
+		copy(p[4:], b)
+		r = append(r, p...)
+		off = next
+	}
+	return
+}
+
+// readWAL returns the packets of the WAL image and the error ending them.
+func readWAL(t *testing.T, image, key []byte) (packets []*WALPacket, err error) {
+	wal := NewMemFiler()
+	wal.WriteAt(image, 0)
+	r, err := NewWALReader(wal, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		p, err := r.Next()
+		if err != nil {
+			return packets, err
+		}
+
+		packets = append(packets, p)
+	}
+}
+
+func TestWALReader(t *testing.T) {
+	for _, key := range [][]byte{nil, testKey} {
+		for _, walType := range []int{walTypeACIDFiler0, walTypeACIDFiler1} {
+			testWALReader(t, walType, key)
+		}
+	}
+}
+
+func testWALReader(t *testing.T, walType int, key []byte) {
+	writes := []acidWrite{
+		{bytes.Repeat([]byte{1}, 100), 0},
+		{bytes.Repeat([]byte{2}, 10), 1000},
+	}
+	img := walImage(t, walType, key, writes, 1010)
+	packets, err := readWAL(t, img, key)
+	if err != io.EOF {
+		t.Fatal(walType, err)
+	}
+
+	if len(packets) != 4 {
+		t.Fatal(walType, len(packets))
+	}
+
+	var data []byte
+	off := int64(0)
+	for i, p := range packets {
+		if p.Off != off || p.Size%16 != 0 || p.Tx != packets[0].Tx || walType == walTypeACIDFiler0 && p.Tx != 0 {
+			t.Fatal(walType, i, p.Off, off, p.Size, p.Tx)
+		}
+
+		off += p.Size
+		switch {
+		case i == 0:
+			if p.Tag != WALHeader || p.Type != walType {
+				t.Fatal(walType, i, p.Tag, p.Type)
+			}
+		case i == len(packets)-1:
+			if p.Tag != WALCheckpoint || p.DBSize != 1010 {
+				t.Fatal(walType, i, p.Tag, p.DBSize)
+			}
+		default:
+			if p.Tag != WALWriteData {
+				t.Fatal(walType, i, p.Tag)
+			}
+
+			data = append(data, p.Data...)
+		}
+	}
+	if off != int64(len(img)) {
+		t.Fatal(walType, off, len(img))
+	}
+
+	// RollbackFiler writes whole pages, see bfSize.
+	if g, e := len(data), 2*bfSize; g != e {
+		t.Fatal(walType, g, e)
+	}
+
+	// The last packet written is the checkpoint.
+	last := packets[len(packets)-1].Off
+	for n := int64(16); n < int64(len(img)); n += 16 {
+		if _, err := readWAL(t, img[:n], key); err != io.ErrUnexpectedEOF {
+			t.Fatal(walType, n, err)
+		}
+	}
+
+	// Data after the checkpoint packet.
+	bad := append(append([]byte(nil), img...), img[last:]...)
+	if _, err := readWAL(t, bad, key); !isInvalidWAL(err, int64(len(img))) {
+		t.Fatal(walType, err)
+	}
+
+	// Non zero padding.
+	for _, p := range packets {
+		if n := p.Size - 1; img[p.Off+n] == 0 {
+			bad := append([]byte(nil), img...)
+			bad[p.Off+n] = 1
+			bp, err := readWAL(t, bad, key)
+			switch walType {
+			case walTypeACIDFiler0:
+				// Ignored by the recovery.
+				if err != io.EOF {
+					t.Fatal(walType, p.Off, err)
+				}
+
+				for _, v := range bp {
+					if v.BadPadding != (v.Off == p.Off) {
+						t.Fatal(walType, p.Off, v.Off, v.BadPadding)
+					}
+				}
+
+				db, wal := NewMemFiler(), NewMemFiler()
+				wal.WriteAt(bad, 0)
+				if err = ReplayWAL(db, wal, key); err != nil {
+					t.Fatal(walType, p.Off, err)
+				}
+			default:
+				// A checksum error.
+				if p.Off == last {
+					if err != io.ErrUnexpectedEOF {
+						t.Fatal(walType, p.Off, err)
+					}
+					break
+				}
+
+				if !isInvalidWAL(err, p.Off) {
+					t.Fatal(walType, p.Off, err)
+				}
+			}
+		}
+	}
+
+	// ReplayWAL.
+	db, wal := NewMemFiler(), NewMemFiler()
+	wal.WriteAt(img, 0)
+	if err = ReplayWAL(db, wal, key); err != nil {
+		t.Fatal(walType, err)
+	}
+
+	if sz, _ := wal.Size(); sz != 0 {
+		t.Fatal(walType, sz)
+	}
+
+	e := NewMemFiler()
+	for _, v := range writes {
+		e.WriteAt(v.b, v.off)
+	}
+	e.Truncate(1010)
+	cmpFilerBytes(t, db, e)
+}
+
+func isInvalidWAL(err error, off int64) bool {
+	e, ok := err.(*ErrILSEQ)
+	return ok && e.Type == ErrInvalidWAL && e.Off == off
+}
@@ -96,6 +96,7 @@ type (
 		parent Filer
 		m      bitFilerMap
 		size   int64
+		trunc  int64 // Content at or above trunc is not inherited from parent.
 		sync.Mutex
 	}
 )
@@ -106,7 +107,31 @@ func newBitFiler(parent Filer) (f *bitFiler, err error) {
 		return
 	}
 
-	return &bitFiler{parent: parent, m: bitFilerMap{}, size: sz}, nil
+	return &bitFiler{parent: parent, m: bitFilerMap{}, size: sz, trunc: sz}, nil
+}
+
+// page returns the page pgI, loading it if necessary. Pages above a previous
+// truncation are not loaded from parent, they are zeroed and marked dirty
+// instead. f locked is assumed.
+func (f *bitFiler) page(pgI int64) (pg *bitPage, err error) {
+	if pg = f.m[pgI]; pg != nil {
+		return
+	}
+
+	pg = &bitPage{}
+	switch off := pgI << bfBits; {
+	case off >= f.trunc:
+		pg.flags = allDirtyFlags
+		pg.dirty = true
+	case f.parent != nil:
+		if _, err = f.parent.ReadAt(pg.data[:], off); err != nil && !fileutil.IsEOF(err) {
+			return nil, err
+		}
+
+		err = nil
+	}
+	f.m[pgI] = pg
+	return
 }
 
 func (f *bitFiler) BeginUpdate() error { panic("internal error") }
@@ -152,21 +177,12 @@ func (f *bitFiler) ReadAt(b []byte, off int64) (n int, err error) {
 	}
 	for rem != 0 && avail > 0 {
 		f.Lock()
-		pg := f.m[pgI]
-		if pg == nil {
-			pg = &bitPage{}
-			if f.parent != nil {
-				_, err = f.parent.ReadAt(pg.data[:], off&^bfMask)
-				if err != nil && !fileutil.IsEOF(err) {
-					f.Unlock()
-					return
-				}
-
-				err = nil
-			}
-			f.m[pgI] = pg
-		}
+		pg, e := f.page(pgI)
 		f.Unlock()
+		if e != nil {
+			return n, e
+		}
+
 		nc := copy(b[:mathutil.Min(rem, bfSize)], pg.data[pgO:])
 		pgI++
 		pgO = 0
@@ -187,9 +203,30 @@ func (f *bitFiler) Truncate(size int64) (err error) {
 	case size == 0:
 		f.m = bitFilerMap{}
 		f.size = 0
+		f.trunc = 0
 		return
 	}
 
+	if size < f.size {
+		// Zero the truncated tail of the last page, should it
+		// ever get regrown.
+		if o := int(size & bfMask); o != 0 {
+			pg, err := f.page(size >> bfBits)
+			if err != nil {
+				return err
+			}
+
+			for i := o; i < bfSize; i++ {
+				pg.data[i] = 0
+				pg.flags[i>>3] |= bitmask[i&7]
+			}
+			pg.dirty = true
+		}
+		if size < f.trunc {
+			f.trunc = size
+		}
+	}
+
 	first := size >> bfBits
 	if size&bfMask != 0 {
 		first++
@@ -215,21 +252,12 @@ func (f *bitFiler) WriteAt(b []byte, off int64) (n int, err error) {
 	var nc int
 	for rem != 0 {
 		f.Lock()
-		pg := f.m[pgI]
-		if pg == nil {
-			pg = &bitPage{}
-			if f.parent != nil {
-				_, err = f.parent.ReadAt(pg.data[:], off&^bfMask)
-				if err != nil && !fileutil.IsEOF(err) {
-					f.Unlock()
-					return
-				}
-
-				err = nil
-			}
-			f.m[pgI] = pg
-		}
+		pg, err := f.page(pgI)
 		f.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
 		nc = copy(pg.data[pgO:], b)
 		pgI++
 		pg.dirty = true
@@ -380,7 +408,9 @@ type RollbackFiler struct {
 	closed       bool
 	f            Filer
 	parent       Filer
-	tlevel       int // transaction nesting level, 0 == not in transaction
+	snapshots    map[*Snapshot]bool // Open snapshots.
+	tlevel       int                // transaction nesting level, 0 == not in transaction
+	updates      int64              // See Updates.
 	writerAt     io.WriterAt
 
 	// afterRollback, if not nil, is called after performing Rollback
@@ -482,6 +512,17 @@ func (r *RollbackFiler) Close() (err error) {
 	return
 }
 
+// Updates returns the number of the WriteAt, Truncate and PunchHole calls
+// which updated the content of r since r was created. Comparing the numbers
+// returned before and after an operation tells whether the operation itself
+// updated r, regardless of the other updates made by the same transaction.
+func (r *RollbackFiler) Updates() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.updates
+}
+
 // Implements Filer.
 func (r *RollbackFiler) EndUpdate() (err error) {
 	r.mu.Lock()
@@ -500,8 +541,13 @@ func (r *RollbackFiler) EndUpdate() (err error) {
 	bf := r.bitFiler
 	parent := bf.parent
 	w := r.writerAt
-	if r.tlevel != 0 {
+	switch {
+	case r.tlevel != 0:
 		w = parent
+	default:
+		if err = r.preserveCommit(bf); err != nil {
+			return
+		}
 	}
 	nwr, err := bf.dumpDirty(w)
 	if err != nil {
@@ -512,7 +558,12 @@ func (r *RollbackFiler) EndUpdate() (err error) {
 	case r.tlevel == 0:
 		r.bitFiler = nil
 		if nwr == 0 {
-			return
+			// Nothing was written, but an aligned Truncate
+			// still needs the checkpoint.
+			var psz int64
+			if psz, err = parent.Size(); err != nil || psz == sz {
+				return
+			}
 		}
 
 		return r.checkpoint(sz)
@@ -548,6 +599,9 @@ func (r *RollbackFiler) PunchHole(off, size int64) error {
 		return &ErrINVAL{r.f.Name() + ": PunchHole size", size}
 	}
 
+	if size != 0 {
+		r.updates++
+	}
 	return r.bitFiler.PunchHole(off, size)
 }
 
@@ -626,6 +680,9 @@ func (r *RollbackFiler) Truncate(size int64) error {
 		return &ErrPERM{r.f.Name() + ": Truncate outside of a transaction"}
 	}
 
+	if size != r.bitFiler.size {
+		r.updates++
+	}
 	return r.bitFiler.Truncate(size)
 }
 
@@ -638,5 +695,8 @@ func (r *RollbackFiler) WriteAt(b []byte, off int64) (n int, err error) {
 		return 0, &ErrPERM{r.f.Name() + ": WriteAt outside of a transaction"}
 	}
 
+	if len(b) != 0 {
+		r.updates++
+	}
 	return r.bitFiler.WriteAt(b, off)
 }
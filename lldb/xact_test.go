@@ -361,6 +361,66 @@ func TestRollbackFiler4(t *testing.T) {
 	}
 }
 
+func TestRollbackFilerUpdates(t *testing.T) {
+	f := NewMemFiler()
+	r, err := NewRollbackFiler(f, func(sz int64) error { return f.Truncate(sz) }, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.BeginUpdate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.WriteAt(make([]byte, 1000), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if g, e := r.Updates(), int64(1); g != e {
+		t.Fatal(g, e)
+	}
+
+	for i, update := range []func() error{
+		nil,
+		func() error { return r.Truncate(1000) },
+		func() error { _, err := r.ReadAt(make([]byte, 100), 0); return err },
+		func() error { _, err := r.WriteAt([]byte{1}, 10); return err },
+		func() error { return r.PunchHole(0, 1000) },
+		func() error { return r.Truncate(10) },
+	} {
+		// Only the updates made by the nested transaction itself are
+		// counted, not the updates inherited from the outer one nor
+		// the commit of the nested transaction.
+		if err = r.BeginUpdate(); err != nil {
+			t.Fatal(err)
+		}
+
+		n := r.Updates()
+		if update != nil {
+			if err = update(); err != nil {
+				t.Fatal(i, err)
+			}
+		}
+
+		if g, e := r.Updates() != n, i > 2; g != e {
+			t.Fatal(i, g, e)
+		}
+
+		n = r.Updates()
+		if err = r.EndUpdate(); err != nil {
+			t.Fatal(i, err)
+		}
+
+		if g := r.Updates(); g != n {
+			t.Fatal(i, g, n)
+		}
+	}
+
+	if err = r.EndUpdate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkRollbackFiler(b *testing.B) {
 	rng := rand.New(rand.NewSource(42))
 	type t struct {